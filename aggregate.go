@@ -15,6 +15,7 @@ import (
 	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/expr"
 	"github.com/getlantern/zenodb/sql"
+	"golang.org/x/net/context"
 )
 
 type Row struct {
@@ -103,6 +104,8 @@ type entry struct {
 type queryExecution struct {
 	db *DB
 	sql.Query
+	ctx                    context.Context
+	memory                 *queryMemory
 	t                      queryable
 	q                      *query
 	knownFields            []sql.Field
@@ -136,7 +139,20 @@ func (db *DB) Query(query *sql.Query) *Query {
 	return &Query{db: db, Query: *query}
 }
 
+// Run runs the query without a deadline. See RunContext.
 func (aq *Query) Run() (*QueryResult, error) {
+	return aq.RunContext(context.Background())
+}
+
+// RunContext runs the query, stopping as soon as the given context is done. If
+// the context ends before the query finishes, RunContext returns the context's
+// error.
+func (aq *Query) RunContext(ctx context.Context) (*QueryResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	memory := newQueryMemory(aq.db, cancel)
+	defer memory.release()
+
 	q := &query{
 		asOf:        aq.AsOf,
 		asOfOffset:  aq.AsOfOffset,
@@ -145,13 +161,13 @@ func (aq *Query) Run() (*QueryResult, error) {
 	}
 	numWorkers := runtime.NumCPU() / 2
 	if aq.From != "" {
-		table := aq.db.getTable(aq.From)
+		table := aq.db.getQueryable(aq.From)
 		if table == nil {
 			return nil, fmt.Errorf("Table '%v' not found", aq.From)
 		}
 		q.t = table
 	} else {
-		sq, err := aq.runSubQuery()
+		sq, err := aq.runSubQuery(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("Unable to run subquery: %v", err)
 		}
@@ -160,6 +176,8 @@ func (aq *Query) Run() (*QueryResult, error) {
 	exec := &queryExecution{
 		Query:       aq.Query,
 		db:          aq.db,
+		ctx:         ctx,
+		memory:      memory,
 		t:           q.t,
 		q:           q,
 		knownFields: q.t.fields(),
@@ -168,7 +186,12 @@ func (aq *Query) Run() (*QueryResult, error) {
 		entriesCh:   make(chan map[string]*entry, numWorkers),
 	}
 	exec.wg.Add(numWorkers)
-	return exec.run()
+	result, err := exec.run()
+	if memErr := memory.error(); memErr != nil {
+		// Report running out of memory rather than the resulting cancellation
+		return nil, memErr
+	}
+	return result, err
 }
 
 func (exec *queryExecution) run() (*QueryResult, error) {
@@ -185,11 +208,11 @@ func (exec *queryExecution) run() (*QueryResult, error) {
 
 func (exec *queryExecution) runSubQueries() error {
 	for _, sq := range exec.SubQueries {
-		t := exec.db.getTable(sq.Query.From)
+		t := exec.db.getQueryable(sq.Query.From)
 		if t == nil {
 			return fmt.Errorf("Table '%v' not found", sq.Query.From)
 		}
-		_result, err := exec.db.Query(&sq.Query).Run()
+		_result, err := exec.db.Query(&sq.Query).RunContext(exec.ctx)
 		if err != nil {
 			return fmt.Errorf("Error running subquery: %v", err)
 		}
@@ -254,6 +277,7 @@ func (exec *queryExecution) prepare() error {
 	if exec.Where != nil {
 		log.Tracef("Applying where: %v", exec.Where)
 		exec.q.filter = exec.Where
+		exec.q.dimFilters = exec.DimFilters
 	}
 
 	err := exec.q.init(exec.db)
@@ -325,6 +349,13 @@ func (exec *queryExecution) prepare() error {
 	worker := func() {
 		entries := make(map[string]*entry, 0)
 		for resp := range exec.responsesCh {
+			select {
+			case <-exec.ctx.Done():
+				// Query cancelled, just drain remaining responses
+				continue
+			default:
+			}
+
 			kb := sliceKey(resp.key)
 			en := entries[string(kb)]
 			if en == nil {
@@ -332,11 +363,14 @@ func (exec *queryExecution) prepare() error {
 					dims:   kb.AsMap(),
 					values: make([]encoding.Sequence, len(exec.Fields)),
 				}
+				entryBytes := entryOverhead + 2*len(kb) + len(en.values)*sequenceSliceWidth
 				if exec.isCrosstab {
 					// Store totals separately from values
 					en.totals = make([]encoding.Sequence, 0, len(exec.Fields))
 					for _, field := range exec.Fields {
-						en.totals = append(en.totals, encoding.NewSequence(field.Expr.EncodedWidth(), exec.outPeriods))
+						total := encoding.NewSequence(field.Expr.EncodedWidth(), exec.outPeriods)
+						en.totals = append(en.totals, total)
+						entryBytes += sequenceSliceWidth + len(total)
 					}
 				}
 
@@ -354,9 +388,13 @@ func (exec *queryExecution) prepare() error {
 				// Initialize havings
 				if exec.Having != nil {
 					en.havingTest = encoding.NewSequence(exec.Having.EncodedWidth(), exec.outPeriods)
+					entryBytes += len(en.havingTest)
 				}
 
 				entries[string(kb)] = en
+				if !exec.memory.allocate(entryBytes) {
+					continue
+				}
 			}
 
 			inPeriods := resp.seq.NumPeriods(resp.e.EncodedWidth()) - resp.startOffset
@@ -407,6 +445,7 @@ func (exec *queryExecution) prepare() error {
 							orig := en.values
 							en.values = make([]encoding.Sequence, idx+1)
 							copy(en.values, orig)
+							exec.memory.allocate((len(en.values) - len(orig)) * sequenceSliceWidth)
 						}
 						seq := en.values[idx]
 						if seq == nil {
@@ -414,6 +453,7 @@ func (exec *queryExecution) prepare() error {
 							seq = encoding.NewSequence(field.Expr.EncodedWidth(), exec.outPeriods)
 							seq.SetStart(exec.q.until)
 							en.values[idx] = seq
+							exec.memory.allocate(len(seq))
 						}
 						seq.SubMergeValueAt(out, field.Expr, subMerge, other, resp.key)
 						if exec.isCrosstab {
@@ -442,20 +482,27 @@ func (exec *queryExecution) prepare() error {
 	}
 
 	exec.q.onValues = func(key bytemap.ByteMap, field string, e expr.Expr, seq encoding.Sequence, startOffset int) {
-		exec.responsesCh <- &queryResponse{key, field, e, seq, startOffset}
+		select {
+		case exec.responsesCh <- &queryResponse{key, field, e, seq, startOffset}:
+			// okay
+		case <-exec.ctx.Done():
+			// query was cancelled, nobody cares about this value anymore
+		}
 	}
 
 	return nil
 }
 
 func (exec *queryExecution) finish() (*QueryResult, error) {
-	stats, err := exec.q.run(exec.db)
-	if err != nil {
-		return nil, err
-	}
+	stats, err := exec.q.run(exec.ctx, exec.db)
+	// Always stop the workers, even on error, so that they don't leak
 	close(exec.responsesCh)
 	exec.wg.Wait()
 	close(exec.entriesCh)
+	if err != nil {
+		return nil, err
+	}
+	stats.PeakMemory = exec.memory.peakBytes()
 	if log.IsTraceEnabled() {
 		log.Tracef("%v\nScanned Points: %v", spew.Sdump(stats), humanize.Comma(exec.scannedPoints))
 	}
@@ -0,0 +1,130 @@
+package zenodb
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/getlantern/zenodb/sql"
+)
+
+// alteration describes changes to a table's fields, resolution and retention
+// period that need to be applied by the rowStore in between flushes. If the
+// alteration can't be applied because flushing fails, err is set before done is
+// closed.
+type alteration struct {
+	opts       *TableOpts
+	fields     []sql.Field
+	resolution time.Duration
+	done       chan bool
+	err        error
+}
+
+// alter applies the given opts to this existing table. Changes to the WHERE
+// clause and InsertPolicy take effect immediately. Changes to fields,
+// resolution, retention and partition periods and memstore settings are applied
+// after flushing the current memstore, so that data already in the table is
+// persisted with the structure that it was written with. Changes to
+// InsertQueueSize only take effect once the table is reopened.
+//
+// New fields start out empty, removed fields are dropped from the file store
+// when its segments are next compacted and existing data is re-aggregated when
+// the resolution becomes coarser. Note that changing the expression of an
+// existing field is equivalent to removing the old field and adding a new one.
+//
+// Changes that can't be applied to existing data (changing FROM or GROUP BY, or
+// making the resolution finer) are rejected without altering anything. While
+// flushes are failing, changes that require a flush fail with an error (changes
+// to the WHERE clause and InsertPolicy still take effect).
+func (t *table) alter(opts *TableOpts) error {
+	if opts.View != t.View {
+		return fmt.Errorf("Changing table %v between table and view is not supported", t.Name)
+	}
+	err := opts.applyDefaults()
+	if err != nil {
+		return err
+	}
+	q, err := t.db.queryFor(opts)
+	if err != nil {
+		return err
+	}
+	q.Fields = withPointsField(q.Fields)
+	current := t.currentStructure()
+	if q.Resolution == 0 {
+		q.Resolution = current.resolution
+	}
+
+	if q.From != t.From {
+		return fmt.Errorf("Changing FROM of table %v from %v to %v is not supported", t.Name, t.From, q.From)
+	}
+	if q.GroupByAll != t.GroupByAll || groupByString(q.GroupBy) != groupByString(t.GroupBy) {
+		return fmt.Errorf("Changing GROUP BY of table %v is not supported", t.Name)
+	}
+	if q.Resolution != current.resolution {
+		if q.Resolution < current.resolution || q.Resolution%current.resolution != 0 {
+			return fmt.Errorf("Unable to change resolution of table %v from %v to %v, new resolution must be a multiple of the existing resolution", t.Name, current.resolution, q.Resolution)
+		}
+	}
+
+	t.log.Debugf("Altering where: %v", q.Where)
+	t.applyWhere(q.Where)
+	t.log.Debugf("Altering insert policy: %v", opts.InsertPolicy)
+	t.applyInsertPolicy(opts.InsertPolicy)
+
+	if t.needsAlteration(current, opts, q) {
+		t.log.Debugf("Altering fields, resolution %v and retention period %v", q.Resolution, opts.RetentionPeriod)
+		alt := &alteration{
+			opts:       opts,
+			fields:     q.Fields,
+			resolution: q.Resolution,
+			done:       make(chan bool),
+		}
+		t.rowStore.alterations <- alt
+		<-alt.done
+		return alt.err
+	}
+
+	return nil
+}
+
+func (t *table) needsAlteration(current *structure, opts *TableOpts, q *sql.Query) bool {
+	if q.Resolution != current.resolution ||
+		opts.RetentionPeriod != current.retentionPeriod ||
+		opts.PartitionPeriod != t.PartitionPeriod ||
+		opts.MaxMemStoreBytes != t.MaxMemStoreBytes ||
+		opts.MinFlushLatency != t.MinFlushLatency ||
+		opts.MaxFlushLatency != t.MaxFlushLatency ||
+		len(q.Fields) != len(current.fields) {
+		return true
+	}
+	for i, field := range q.Fields {
+		if field.String() != current.fields[i].String() {
+			return true
+		}
+	}
+	return false
+}
+
+// applyAlteration updates the table's structure. It must be called while
+// holding a write lock on the rowStore, so that snapshots always see a
+// structure matching their memstores.
+func (t *table) applyAlteration(alt *alteration) {
+	t.structure.Store(&structure{
+		fields:          alt.fields,
+		resolution:      alt.resolution,
+		retentionPeriod: alt.opts.RetentionPeriod,
+	})
+	t.TableOpts.PartitionPeriod = alt.opts.PartitionPeriod
+	t.TableOpts.MaxMemStoreBytes = alt.opts.MaxMemStoreBytes
+	t.TableOpts.MinFlushLatency = alt.opts.MinFlushLatency
+	t.TableOpts.MaxFlushLatency = alt.opts.MaxFlushLatency
+	t.TableOpts.SQL = alt.opts.SQL
+}
+
+func groupByString(groupBy []sql.GroupBy) string {
+	parts := make([]string, 0, len(groupBy))
+	for _, gb := range groupBy {
+		parts = append(parts, gb.String())
+	}
+	return strings.Join(parts, ", ")
+}
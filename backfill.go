@@ -0,0 +1,137 @@
+package zenodb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/bytetree"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/sql"
+	"golang.org/x/net/context"
+)
+
+// backfill builds a memstore for this view that's seeded with the data that's
+// already in the view's underlying table (both the file store and the
+// memstores), re-aggregated into the view's GROUP BY and resolution. The
+// returned memstore carries the WAL offset up to which the table had consumed
+// data, so that the view can pick up reading the WAL from there without
+// counting anything twice.
+//
+// Note that the view's WHERE clause can only be applied to dimensions that are
+// still present in the underlying table's keys.
+func (t *table) backfill() (*memstore, error) {
+	parentName, err := sql.TableFor(t.SQL)
+	if err != nil {
+		return nil, err
+	}
+	parent := t.db.getTable(parentName)
+	if parent == nil {
+		return nil, fmt.Errorf("Table '%v' not found", parentName)
+	}
+	st := t.currentStructure()
+	parentStructure, fs, memStores, offset := parent.rowStore.snapshot(true)
+	parentResolution := parentStructure.resolution
+	if st.resolution < parentResolution || st.resolution%parentResolution != 0 {
+		return nil, fmt.Errorf("Unable to backfill view at resolution %v from table %v at resolution %v, view's resolution must be a multiple of the table's resolution", st.resolution, parent.Name, parentResolution)
+	}
+
+	if len(offset) == 0 {
+		t.log.Debugf("Table %v has not recorded a WAL offset, not backfilling", parent.Name)
+		return nil, nil
+	}
+
+	t.log.Debugf("Backfilling from %v", parent.Name)
+	start := time.Now()
+
+	t.whereMutex.RLock()
+	where := t.Where
+	t.whereMutex.RUnlock()
+
+	parentColumns := make([]expr.Expr, 0, len(parentStructure.fields))
+	for _, field := range parentStructure.fields {
+		parentColumns = append(parentColumns, field.Expr)
+	}
+	subMergers := make([][]expr.SubMerge, 0, len(st.fields))
+	for _, field := range st.fields {
+		subMergers = append(subMergers, field.Expr.SubMergers(parentColumns))
+	}
+
+	tree := bytetree.New()
+	truncateBefore := st.truncateBefore(t.db.clock.Now())
+	rows := 0
+	onRow := func(key bytemap.ByteMap, columns []encoding.Sequence) {
+		if where != nil {
+			ok, _ := where.Eval(key).(bool)
+			if !ok {
+				return
+			}
+		}
+
+		// Find the range covered by all columns
+		var seqStart, seqEnd time.Time
+		for c, column := range columns {
+			if len(column) == 0 {
+				continue
+			}
+			columnStart := column.Start()
+			columnEnd := columnStart.Add(-1 * time.Duration(column.NumPeriods(parentColumns[c].EncodedWidth())) * parentResolution)
+			if seqStart.IsZero() || columnStart.After(seqStart) {
+				seqStart = columnStart
+			}
+			if seqEnd.IsZero() || columnEnd.Before(seqEnd) {
+				seqEnd = columnEnd
+			}
+		}
+		if seqStart.IsZero() {
+			return
+		}
+		numPeriods := int(seqStart.Sub(seqEnd) / parentResolution)
+
+		data := make([]encoding.Sequence, len(st.fields))
+		hasData := false
+		for f, field := range st.fields {
+			var seq encoding.Sequence
+			for c, column := range columns {
+				subMerge := subMergers[f][c]
+				if subMerge == nil || len(column) == 0 {
+					continue
+				}
+				if seq == nil {
+					seq = encoding.NewSequence(field.Expr.EncodedWidth(), numPeriods)
+					seq.SetStart(seqStart)
+				}
+				e := parentColumns[c]
+				periodOffset := int(seqStart.Sub(column.Start()) / parentResolution)
+				for p := 0; p < column.NumPeriods(e.EncodedWidth()); p++ {
+					other, found := column.DataAt(p, e)
+					if found {
+						seq.SubMergeValueAt(p+periodOffset, field.Expr, subMerge, other, key)
+					}
+				}
+			}
+			if seq != nil && parentResolution != st.resolution {
+				seq = seq.Rescale(field.Expr, parentResolution, st.resolution)
+			}
+			if seq != nil {
+				data[f] = seq
+				hasData = true
+			}
+		}
+
+		if hasData {
+			tree.Merge(st.fields, st.resolution, truncateBefore, t.keyFor(key), data)
+			rows++
+		}
+	}
+
+	err = fs.iterate(context.Background(), parentStructure, onRow, memStores)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to backfill from %v: %v", parent.Name, err)
+	}
+
+	t.log.Debugf("Backfilled %v rows from %v into %v keys (%v) in %v", humanize.Comma(int64(rows)), parent.Name, humanize.Comma(int64(tree.Length())), humanize.Bytes(uint64(tree.Bytes())), time.Now().Sub(start))
+	return &memstore{tree: tree, offset: offset}, nil
+}
@@ -143,7 +143,21 @@ func (bt *Tree) Copy() *Tree {
 // Update updates all of the fields at the given timestamp with the given
 // parameters.
 func (bt *Tree) Update(fields []sql.Field, resolution time.Duration, truncateBefore time.Time, key []byte, vals encoding.TSParams, metadata bytemap.ByteMap) int {
-	bytesAdded, newNode := bt.doUpdate(fields, resolution, truncateBefore, key, vals, metadata)
+	return bt.apply(key, func(n *node) int {
+		return n.doUpdate(fields, resolution, truncateBefore, vals, metadata)
+	})
+}
+
+// Merge merges the given data (one encoding.Sequence per field) into the data
+// at the given key.
+func (bt *Tree) Merge(fields []sql.Field, resolution time.Duration, truncateBefore time.Time, key []byte, data []encoding.Sequence) int {
+	return bt.apply(key, func(n *node) int {
+		return n.doMerge(fields, resolution, truncateBefore, data)
+	})
+}
+
+func (bt *Tree) apply(key []byte, fn func(n *node) int) int {
+	bytesAdded, newNode := bt.doApply(key, fn)
 	bt.bytes += bytesAdded
 	if newNode {
 		bt.length++
@@ -151,7 +165,7 @@ func (bt *Tree) Update(fields []sql.Field, resolution time.Duration, truncateBef
 	return bytesAdded
 }
 
-func (bt *Tree) doUpdate(fields []sql.Field, resolution time.Duration, truncateBefore time.Time, fullKey []byte, vals encoding.TSParams, metadata bytemap.ByteMap) (int, bool) {
+func (bt *Tree) doApply(fullKey []byte, fn func(n *node) int) (int, bool) {
 	n := bt.root
 	key := fullKey
 	// Try to update on existing edge
@@ -168,7 +182,7 @@ nodeLoop:
 			}
 			if i == keyLength && keyLength == labelLength {
 				// update existing node
-				return edge.target.doUpdate(fields, resolution, truncateBefore, fullKey, vals, metadata), false
+				return fn(edge.target), false
 			} else if i == labelLength && labelLength < keyLength {
 				// descend
 				n = edge.target
@@ -176,25 +190,29 @@ nodeLoop:
 				continue nodeLoop
 			} else if i > 0 {
 				// common substring, split on that
-				return edge.split(bt, fields, resolution, truncateBefore, i, fullKey, key, vals, metadata), true
+				return edge.split(i, fullKey, key, fn), true
 			}
 		}
 
 		// Create new edge
 		target := &node{key: fullKey}
 		n.edges = append(n.edges, &edge{key, target})
-		return target.doUpdate(fields, resolution, truncateBefore, fullKey, vals, metadata) + len(key), true
+		return fn(target) + len(key), true
 	}
 }
 
-func (n *node) doUpdate(fields []sql.Field, resolution time.Duration, truncateBefore time.Time, fullKey []byte, vals encoding.TSParams, metadata bytemap.ByteMap) int {
-	bytesAdded := 0
+func (n *node) growData(numFields int) {
 	// Grow encoding.Sequences to match number of fields in table
-	if len(n.data) < len(fields) {
-		newData := make([]encoding.Sequence, len(fields))
+	if len(n.data) < numFields {
+		newData := make([]encoding.Sequence, numFields)
 		copy(newData, n.data)
 		n.data = newData
 	}
+}
+
+func (n *node) doUpdate(fields []sql.Field, resolution time.Duration, truncateBefore time.Time, vals encoding.TSParams, metadata bytemap.ByteMap) int {
+	bytesAdded := 0
+	n.growData(len(fields))
 	for i, field := range fields {
 		current := n.data[i]
 		previousSize := cap(current)
@@ -205,6 +223,22 @@ func (n *node) doUpdate(fields []sql.Field, resolution time.Duration, truncateBe
 	return bytesAdded
 }
 
+func (n *node) doMerge(fields []sql.Field, resolution time.Duration, truncateBefore time.Time, data []encoding.Sequence) int {
+	bytesAdded := 0
+	n.growData(len(fields))
+	for i, field := range fields {
+		if i >= len(data) {
+			break
+		}
+		current := n.data[i]
+		previousSize := cap(current)
+		merged := current.Merge(data[i], field.Expr, resolution, truncateBefore)
+		n.data[i] = merged
+		bytesAdded += cap(merged) - previousSize
+	}
+	return bytesAdded
+}
+
 func (n *node) wasRemovedFor(bt *Tree, ctx int64) bool {
 	if ctx == 0 {
 		return false
@@ -229,7 +263,7 @@ func (n *node) doRemoveFor(bt *Tree, ctx int64) {
 	bt.mx.Unlock()
 }
 
-func (e *edge) split(bt *Tree, fields []sql.Field, resolution time.Duration, truncateBefore time.Time, splitOn int, fullKey []byte, key []byte, vals encoding.TSParams, metadata bytemap.ByteMap) int {
+func (e *edge) split(splitOn int, fullKey []byte, key []byte, fn func(n *node) int) int {
 	newNode := &node{edges: edges{&edge{e.label[splitOn:], e.target}}}
 	newLeaf := newNode
 	if splitOn != len(key) {
@@ -238,7 +272,7 @@ func (e *edge) split(bt *Tree, fields []sql.Field, resolution time.Duration, tru
 	}
 	e.label = e.label[:splitOn]
 	e.target = newNode
-	return len(key) - splitOn + newLeaf.doUpdate(fields, resolution, truncateBefore, fullKey, vals, metadata)
+	return len(key) - splitOn + fn(newLeaf)
 }
 
 type edges []*edge
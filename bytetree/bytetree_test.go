@@ -110,3 +110,30 @@ func checkTree(ctx int64, t *testing.T, bt *Tree, e expr.Expr) {
 	assert.EqualValues(t, 16, val)
 	assert.Nil(t, bt.Remove(ctx, []byte("unknown")))
 }
+
+func TestByteTreeMerge(t *testing.T) {
+	e := expr.SUM("a")
+
+	fields := []sql.Field{sql.NewField("myfield", e)}
+	resolution := 5 * time.Second
+	now := time.Now()
+	truncateBefore := now.Add(-5000 * resolution)
+
+	seq := func(val float64) []encoding.Sequence {
+		return []encoding.Sequence{encoding.Sequence(nil).Update(encoding.NewTSParams(now, bytemap.NewFloat(map[string]float64{"a": val})), nil, e, resolution, truncateBefore)}
+	}
+
+	bt := New()
+	bt.Update(fields, resolution, truncateBefore, []byte("test"), encoding.NewTSParams(now, bytemap.NewFloat(map[string]float64{"a": 1})), nil)
+	bt.Merge(fields, resolution, truncateBefore, []byte("test"), seq(10))
+	bt.Merge(fields, resolution, truncateBefore, []byte("team"), seq(15))
+	bt.Merge(fields, resolution, truncateBefore, []byte("toast"), seq(16))
+	assert.Equal(t, 3, bt.Length())
+
+	val, _ := bt.Remove(ctx, []byte("test"))[0].ValueAt(0, e)
+	assert.EqualValues(t, 11, val)
+	val, _ = bt.Remove(ctx, []byte("team"))[0].ValueAt(0, e)
+	assert.EqualValues(t, 15, val)
+	val, _ = bt.Remove(ctx, []byte("toast"))[0].ValueAt(0, e)
+	assert.EqualValues(t, 16, val)
+}
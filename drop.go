@@ -0,0 +1,89 @@
+package zenodb
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getlantern/zenodb/sql"
+)
+
+const (
+	// readerStopTimeout bounds how long stopping a table waits for its WAL
+	// reader to stop.
+	readerStopTimeout = 30 * time.Second
+)
+
+// DropTable drops the table or view with the given name, stopping all of its
+// processing and deleting its data. Tables that still have dependent views
+// can't be dropped, drop the views first.
+func (db *DB) DropTable(name string) error {
+	name = strings.ToLower(name)
+	db.tablesMutex.Lock()
+	t := db.tables[name]
+	if t == nil {
+		db.tablesMutex.Unlock()
+		return fmt.Errorf("Table '%v' not found", name)
+	}
+	var dependents []string
+	for _, other := range db.orderedTables {
+		if !other.View {
+			continue
+		}
+		dependsOn, err := sql.TableFor(other.SQL)
+		if err == nil && strings.ToLower(dependsOn) == name {
+			dependents = append(dependents, other.Name)
+		}
+	}
+	if len(dependents) > 0 {
+		db.tablesMutex.Unlock()
+		return fmt.Errorf("Unable to drop table %v, the following views depend on it: %v", name, strings.Join(dependents, ", "))
+	}
+	delete(db.tables, name)
+	for i, other := range db.orderedTables {
+		if other == t {
+			db.orderedTables = append(db.orderedTables[:i], db.orderedTables[i+1:]...)
+			break
+		}
+	}
+	db.tablesMutex.Unlock()
+
+	log.Debugf("Dropping table %v", name)
+	err := t.stop(false)
+	if err != nil {
+		log.Errorf("Error stopping table %v: %v", name, err)
+	}
+	// Dropped tables don't hold back inserts
+	t.updateBehind()
+	err = os.RemoveAll(t.rowStore.opts.dir)
+	if err != nil {
+		return fmt.Errorf("Unable to delete data for table %v: %v", name, err)
+	}
+	err = os.Remove(t.statsFile())
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Unable to delete stats for table %v: %v", name, err)
+	}
+	log.Debugf("Dropped table %v", name)
+	return nil
+}
+
+// stop stops reading from the WAL and stops the table's rowStore, optionally
+// flushing the current memstore first. If the WAL reader doesn't stop within
+// readerStopTimeout, the rowStore is stopped anyway. Since queueing inserts
+// gives up once the table is stopping, a reader that stops late doesn't block
+// on the stopped rowStore.
+func (t *table) stop(flush bool) error {
+	close(t.stopCh)
+	err := t.wal.Close()
+	select {
+	case <-t.stopped:
+	case <-time.After(readerStopTimeout):
+		t.log.Errorf("WAL reader didn't stop within %v, stopping anyway", readerStopTimeout)
+	}
+	t.rowStore.stop(flush)
+	if err != nil {
+		return fmt.Errorf("Unable to close WAL reader: %v", err)
+	}
+	return nil
+}
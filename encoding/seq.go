@@ -375,6 +375,65 @@ func (seq Sequence) Truncate(periodWidth int, resolution time.Duration, truncate
 	return seq[:maxLength]
 }
 
+// Slice returns a new Sequence containing only the periods of this Sequence
+// whose times fall within [from, to), or nil if there are no such periods.
+func (seq Sequence) Slice(periodWidth int, resolution time.Duration, from time.Time, to time.Time) Sequence {
+	if len(seq) == 0 {
+		return nil
+	}
+	start := seq.Start()
+	if start.Before(from) {
+		return nil
+	}
+	first := 0
+	if !start.Before(to) {
+		first = int(start.Sub(to)/resolution) + 1
+	}
+	last := seq.NumPeriods(periodWidth) - 1
+	if maxLast := int(start.Sub(from) / resolution); maxLast < last {
+		last = maxLast
+	}
+	if first > last {
+		return nil
+	}
+	out := NewSequence(periodWidth, last-first+1)
+	out.SetStart(start.Add(-1 * time.Duration(first) * resolution))
+	copy(out[Width64bits:], seq[Width64bits+first*periodWidth:Width64bits+(last+1)*periodWidth])
+	return out
+}
+
+// Rescale re-aggregates this Sequence from the resolution from to the coarser
+// resolution to by merging all periods that fall within the same coarser
+// period using the given Expr. to must be a multiple of from.
+//
+// Rescale always returns a newly allocated Sequence, or nil if this Sequence is
+// empty.
+func (seq Sequence) Rescale(e expr.Expr, from time.Duration, to time.Duration) Sequence {
+	if len(seq) == 0 {
+		return nil
+	}
+	periodWidth := e.EncodedWidth()
+	numPeriods := seq.NumPeriods(periodWidth)
+	if numPeriods == 0 {
+		return nil
+	}
+	start := seq.Start()
+	end := start.Add(-1 * time.Duration(numPeriods-1) * from)
+	newStart := RoundTime(start, to)
+	newPeriods := int(newStart.Sub(RoundTime(end, to))/to) + 1
+	out := NewSequence(periodWidth, newPeriods)
+	out.SetStart(newStart)
+	for i := 0; i < numPeriods; i++ {
+		data, found := seq.DataAt(i, e)
+		if !found {
+			continue
+		}
+		t := RoundTime(start.Add(-1*time.Duration(i)*from), to)
+		out.MergeValueAt(int(newStart.Sub(t)/to), e, data)
+	}
+	return out
+}
+
 // String provides a string representation of this Sequence assuming that it
 // holds data for the given Expr.
 func (seq Sequence) String(e expr.Expr) string {
@@ -187,3 +187,58 @@ func TestSequenceTruncate(t *testing.T) {
 func randBelow(res time.Duration) time.Duration {
 	return time.Duration(-1 * rand.Intn(int(res)))
 }
+
+func TestSequenceRescale(t *testing.T) {
+	e := SUM("a")
+	to := 2 * res
+
+	var seq Sequence
+	for i := 0; i < 5; i++ {
+		seq = seq.Update(NewTSParams(epoch.Add(-1*time.Duration(i)*res), bytemap.NewFloat(map[string]float64{"a": float64(i + 1)})), nil, e, res, truncateBefore)
+	}
+
+	rescaled := seq.Rescale(e, res, to)
+	assert.Equal(t, RoundTime(epoch, to), rescaled.Start())
+	var total float64
+	for i := 0; i < rescaled.NumPeriods(e.EncodedWidth()); i++ {
+		val, _ := rescaled.ValueAt(i, e)
+		total += val
+	}
+	assert.EqualValues(t, 15, total, "Rescaling should preserve the total")
+	for i := 0; i < 5; i++ {
+		ts := epoch.Add(-1 * time.Duration(i) * res)
+		expected := float64(0)
+		for j := 0; j < 5; j++ {
+			if RoundTime(epoch.Add(-1*time.Duration(j)*res), to).Equal(RoundTime(ts, to)) {
+				expected += float64(j + 1)
+			}
+		}
+		val, _ := rescaled.ValueAtTime(ts, e, to)
+		assert.EqualValues(t, expected, val)
+	}
+
+	assert.Nil(t, Sequence(nil).Rescale(e, res, to))
+}
+
+func TestSequenceSlice(t *testing.T) {
+	e := SUM("a")
+	width := e.EncodedWidth()
+
+	var seq Sequence
+	for i := 0; i < 5; i++ {
+		seq = seq.Update(NewTSParams(epoch.Add(-1*time.Duration(i)*res), bytemap.NewFloat(map[string]float64{"a": float64(i + 1)})), nil, e, res, truncateBefore)
+	}
+
+	sliced := seq.Slice(width, res, epoch.Add(-3*res), epoch.Add(-1*res))
+	assert.Equal(t, epoch.Add(-2*res), sliced.Start())
+	assert.Equal(t, 2, sliced.NumPeriods(width))
+	val, _ := sliced.ValueAt(0, e)
+	assert.EqualValues(t, 3, val)
+	val, _ = sliced.ValueAt(1, e)
+	assert.EqualValues(t, 4, val)
+
+	assert.Equal(t, seq, seq.Slice(width, res, epoch.Add(-10*res), epoch.Add(res)), "Slicing around entire sequence should keep everything")
+	assert.Nil(t, seq.Slice(width, res, epoch.Add(res), epoch.Add(2*res)), "Slicing after sequence should yield nil")
+	assert.Nil(t, seq.Slice(width, res, epoch.Add(-10*res), epoch.Add(-5*res)), "Slicing before sequence should yield nil")
+	assert.Nil(t, Sequence(nil).Slice(width, res, epoch, epoch.Add(res)))
+}
@@ -0,0 +1,255 @@
+package zenodb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/wal"
+)
+
+const (
+	// quarantinePrefix is prepended to the names of damaged files, which are
+	// kept around for inspection instead of being deleted.
+	quarantinePrefix = "corrupt_"
+)
+
+// FsckResult describes the state of a table directory as checked by Fsck.
+type FsckResult struct {
+	// Dir is the table directory that was checked
+	Dir string
+	// Segments is the number of segments that were checked
+	Segments int
+	// Damaged maps the names of damaged files to the problem found with them
+	Damaged map[string]error
+	// Dropped lists the undamaged segments that have to be dropped in order to
+	// restore the data in the damaged segments from the WAL
+	Dropped []string
+	// ReplayFrom is the WAL offset from which data is replayed after repairing
+	// (nil meaning from the beginning of the WAL)
+	ReplayFrom wal.Offset
+	// Repaired indicates whether the damage was repaired
+	Repaired bool
+}
+
+// OK indicates whether no damage was found.
+func (r *FsckResult) OK() bool {
+	return len(r.Damaged) == 0
+}
+
+// Fsck checks the files in the given table directory for damage. If repair is
+// true, damaged files are quarantined and the table's manifest is rewritten so
+// that the affected data is replayed from the WAL the next time the table is
+// opened. Fsck must not be run against a table that's currently open.
+func Fsck(dir string, repair bool) (*FsckResult, error) {
+	result := &FsckResult{Dir: dir, Damaged: make(map[string]error)}
+	m, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		// Check legacy file store instead
+		legacyFiles, err := legacyFileStores(dir)
+		if err != nil {
+			return nil, err
+		}
+		if len(legacyFiles) == 0 {
+			return result, nil
+		}
+		result.Segments = 1
+		verifyErr := verifySegmentFile(legacyFiles[0])
+		if verifyErr != nil {
+			result.Damaged[filepath.Base(legacyFiles[0])] = verifyErr
+			if repair {
+				// The previous file store will be used instead
+				err = quarantine(legacyFiles[0])
+				if err != nil {
+					return nil, err
+				}
+				result.Repaired = true
+			}
+		}
+		return result, nil
+	}
+
+	fs := &fileStore{opts: &rowStoreOptions{dir: dir}, segments: m.Segments, offset: m.Offset}
+	result.Segments = len(fs.segments)
+	damaged := fs.verify(true)
+	if len(damaged) == 0 {
+		return result, nil
+	}
+	for seg, verifyErr := range damaged {
+		result.Damaged[seg.Name] = verifyErr
+	}
+	recovered, dropped := fs.withoutDamaged(damaged)
+	for _, seg := range dropped {
+		if damaged[seg] == nil {
+			result.Dropped = append(result.Dropped, seg.Name)
+		}
+	}
+	result.ReplayFrom = recovered.offset
+	if repair {
+		err = recovered.quarantine(damaged)
+		if err != nil {
+			return nil, err
+		}
+		result.Repaired = true
+	}
+	return result, nil
+}
+
+// verify checks all of the fileStore's segments and returns the ones that are
+// damaged, along with the problem found with them. If thorough is false, only
+// the sizes of segments and the checksums of their row groups are checked,
+// without decompressing anything.
+func (fs *fileStore) verify(thorough bool) map[*segment]error {
+	damaged := make(map[*segment]error)
+	for _, seg := range fs.segments {
+		filename := filepath.Join(fs.opts.dir, seg.Name)
+		fi, err := os.Stat(filename)
+		if err == nil && fi.Size() != seg.Bytes {
+			err = fmt.Errorf("Expected %d bytes, found %d", seg.Bytes, fi.Size())
+		}
+		if err == nil && thorough {
+			err = verifySegmentFile(filename)
+		} else if err == nil {
+			err = verifySegmentChecksums(filename)
+		}
+		if err != nil {
+			damaged[seg] = err
+		}
+	}
+	return damaged
+}
+
+// verifySegmentFile reads all of the rows in the given segment (or legacy file
+// store), verifying checksums where available and making sure that rows are
+// sorted by key.
+func verifySegmentFile(filename string) error {
+	sr, err := openSegment(filename, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer sr.close()
+	sorted := versionFor(filename) >= FileVersion_5
+	var lastKey bytemap.ByteMap
+	for {
+		key, _, err := sr.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if sorted && lastKey != nil && bytes.Compare(key, lastKey) <= 0 {
+			return fmt.Errorf("Rows in %v are out of order", filename)
+		}
+		lastKey = key
+	}
+}
+
+// verifySegmentChecksums checks the headers and blocks of all row groups in the
+// given segment against their checksums without decompressing any blocks.
+// Legacy segments don't have checksums and aren't checked.
+func verifySegmentChecksums(filename string) error {
+	sr, err := openSegment(filename, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer sr.close()
+	if sr.groups == nil {
+		return nil
+	}
+	sr.groups.checksumsOnly = true
+	_, _, err = sr.groups.next()
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// withoutDamaged returns a fileStore without the given damaged segments, whose
+// offset is set such that their data gets replayed from the WAL. Since
+// replaying the WAL also replays the data of any later segments, those segments
+// get dropped too (which in turn may require replaying from further back). The
+// segments that were dropped are returned along with the new fileStore.
+func (fs *fileStore) withoutDamaged(damaged map[*segment]error) (*fileStore, []*segment) {
+	replayFrom := fs.offset
+	drop := make(map[*segment]bool, len(damaged))
+	for seg := range damaged {
+		drop[seg] = true
+		replayFrom = earliestOffset(replayFrom, seg.StartOffset)
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, seg := range fs.segments {
+			if !drop[seg] && (replayFrom == nil || seg.Offset.After(replayFrom)) {
+				drop[seg] = true
+				replayFrom = earliestOffset(replayFrom, seg.StartOffset)
+				changed = true
+			}
+		}
+	}
+
+	var segments, dropped []*segment
+	for _, seg := range fs.segments {
+		if drop[seg] {
+			dropped = append(dropped, seg)
+		} else {
+			segments = append(segments, seg)
+		}
+	}
+	return &fileStore{t: fs.t, opts: fs.opts, segments: segments, offset: replayFrom}, dropped
+}
+
+// quarantine moves the given damaged segments out of the way and writes this
+// fileStore's manifest.
+func (fs *fileStore) quarantine(damaged map[*segment]error) error {
+	for seg := range damaged {
+		err := quarantine(filepath.Join(fs.opts.dir, seg.Name))
+		if err != nil {
+			return err
+		}
+		err = quarantine(filepath.Join(fs.opts.dir, indexFileFor(seg.Name)))
+		if err != nil {
+			return err
+		}
+	}
+	return fs.writeManifest()
+}
+
+// quarantine renames the given file so that it's no longer used (nor cleaned
+// up).
+func quarantine(filename string) error {
+	err := os.Rename(filename, filepath.Join(filepath.Dir(filename), quarantinePrefix+filepath.Base(filename)))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to quarantine %v: %v", filename, err)
+	}
+	return nil
+}
+
+// earliestOffset returns the earlier of the given WAL offsets, treating nil as
+// the beginning of the WAL.
+func earliestOffset(a wal.Offset, b wal.Offset) wal.Offset {
+	if a == nil || b == nil {
+		return nil
+	}
+	if a.After(b) {
+		return b
+	}
+	return a
+}
+
+// recoverFrom quarantines the given damaged segments and returns a fileStore
+// from which the lost data gets replayed from the WAL.
+func (rs *rowStore) recoverFrom(damaged map[*segment]error) (*fileStore, error) {
+	for seg, err := range damaged {
+		rs.t.log.Errorf("Segment %v is damaged, quarantining: %v", seg.Name, err)
+	}
+	fs, dropped := rs.fileStore.withoutDamaged(damaged)
+	rs.t.log.Errorf("Dropping %d segments and replaying WAL from %v, data that's no longer in the WAL is lost", len(dropped), fs.offset)
+	return fs, fs.quarantine(damaged)
+}
@@ -0,0 +1,186 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/sql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFsck(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	resolution := time.Minute
+	now := time.Now().Truncate(resolution)
+	fields := []sql.Field{sql.NewField("a", expr.SUM("a"))}
+	tb := &table{
+		TableOpts: &TableOpts{RetentionPeriod: time.Hour},
+		Query:     sql.Query{Fields: fields, Resolution: resolution},
+		db:        &DB{clock: vtime.RealClock},
+		log:       golog.LoggerFor("fscktest"),
+	}
+	tb.initStructure()
+	opts := &rowStoreOptions{dir: tmpDir}
+
+	// Each segment holds the data for the next 10 positions in the WAL
+	fs := &fileStore{t: tb, opts: opts}
+	for i := 0; i < 3; i++ {
+		sw, err := newSegmentWriter(tmpDir, fields, resolution, tb.truncateBefore(), wal.NewOffset(0, int64((i+1)*10)))
+		if !assert.NoError(t, err) {
+			return
+		}
+		for j := 0; j < 100; j++ {
+			var seq encoding.Sequence
+			seq = seq.Update(encoding.NewTSParams(now, bytemap.NewFloat(map[string]float64{"a": 1})), nil, fields[0].Expr, resolution, tb.truncateBefore())
+			assert.NoError(t, sw.write(bytemap.New(map[string]interface{}{"i": i*100 + j}), []encoding.Sequence{seq}))
+		}
+		seg, err := sw.close(0)
+		if !assert.NoError(t, err) {
+			return
+		}
+		seg.StartOffset = wal.NewOffset(0, int64(i*10))
+		fs = fs.withOffset(seg.Offset).withSegments(seg)
+	}
+	if !assert.NoError(t, fs.writeManifest()) {
+		return
+	}
+
+	result, err := Fsck(tmpDir, false)
+	if assert.NoError(t, err) {
+		assert.True(t, result.OK())
+		assert.Equal(t, 3, result.Segments)
+	}
+
+	// Corrupt the middle segment
+	damagedName := fs.segments[1].Name
+	filename := filepath.Join(tmpDir, damagedName)
+	data, err := ioutil.ReadFile(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data[len(data)-10] ^= 0xFF
+	if !assert.NoError(t, ioutil.WriteFile(filename, data, 0644)) {
+		return
+	}
+
+	result, err = Fsck(tmpDir, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, result.OK())
+	assert.Contains(t, result.Damaged, damagedName)
+	assert.Equal(t, []string{fs.segments[2].Name}, result.Dropped, "Later segment should be dropped")
+	assert.Equal(t, wal.NewOffset(0, 10), result.ReplayFrom, "Should replay from start of damaged segment")
+	assert.False(t, result.Repaired)
+
+	result, err = Fsck(tmpDir, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, result.Repaired)
+	_, err = os.Stat(filepath.Join(tmpDir, quarantinePrefix+damagedName))
+	assert.NoError(t, err, "Damaged segment should have been quarantined")
+	m, err := readManifest(tmpDir)
+	if assert.NoError(t, err) {
+		if assert.Len(t, m.Segments, 1) {
+			assert.Equal(t, fs.segments[0].Name, m.Segments[0].Name)
+		}
+		assert.Equal(t, wal.NewOffset(0, 10), m.Offset)
+	}
+
+	result, err = Fsck(tmpDir, false)
+	if assert.NoError(t, err) {
+		assert.True(t, result.OK(), "Repaired table should be ok")
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	resolution := time.Minute
+	now := time.Now().Truncate(resolution)
+	fields := []sql.Field{sql.NewField("a", expr.SUM("a"))}
+	tb := &table{
+		TableOpts: &TableOpts{RetentionPeriod: time.Hour},
+		Query:     sql.Query{Fields: fields, Resolution: resolution},
+		db:        &DB{clock: vtime.RealClock},
+		log:       golog.LoggerFor("fscktest"),
+	}
+	tb.initStructure()
+	opts := &rowStoreOptions{dir: tmpDir}
+
+	sw, err := newSegmentWriter(tmpDir, fields, resolution, tb.truncateBefore(), wal.NewOffset(0, 10))
+	if !assert.NoError(t, err) {
+		return
+	}
+	for i := 0; i < 100; i++ {
+		var seq encoding.Sequence
+		seq = seq.Update(encoding.NewTSParams(now, bytemap.NewFloat(map[string]float64{"a": 1})), nil, fields[0].Expr, resolution, tb.truncateBefore())
+		assert.NoError(t, sw.write(bytemap.New(map[string]interface{}{"i": i}), []encoding.Sequence{seq}))
+	}
+	seg, err := sw.close(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fs := (&fileStore{t: tb, opts: opts}).withOffset(seg.Offset).withSegments(seg)
+
+	filename := filepath.Join(tmpDir, seg.Name)
+	sr, err := openSegment(filename, nil, 0, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	dataOffset := sr.dataOffset
+	sr.close()
+	original, err := ioutil.ReadFile(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	corrupt := func(offset int64) {
+		data := make([]byte, len(original))
+		copy(data, original)
+		data[offset] ^= 0xFF
+		assert.NoError(t, ioutil.WriteFile(filename, data, 0644))
+	}
+
+	assert.Empty(t, fs.verify(false))
+	assert.Empty(t, fs.verify(true))
+
+	// Damaged blocks are found by their checksums, without a thorough check
+	corrupt(int64(len(original)) - 10)
+	for _, thorough := range []bool{false, true} {
+		assert.Contains(t, fs.verify(thorough), seg)
+	}
+
+	// Damaged headers are always found, even though the damaged field (numrows)
+	// isn't otherwise checked
+	corrupt(dataOffset)
+	for _, thorough := range []bool{false, true} {
+		damaged := fs.verify(thorough)
+		if assert.Contains(t, damaged, seg) {
+			assert.Contains(t, damaged[seg].Error(), "header")
+		}
+	}
+
+	// Truncated segments are found by their size
+	assert.NoError(t, ioutil.WriteFile(filename, original[:len(original)-1], 0644))
+	assert.Contains(t, fs.verify(false), seg)
+}
@@ -0,0 +1,114 @@
+// Package importer bulk loads points from CSV and NDJSON files into a zenodb
+// stream.
+//
+// CSV files need a header row. One column holds the timestamp, the columns
+// listed in Mapping.Vals become values and the remaining columns (or those
+// listed in Mapping.Dims) become dimensions:
+//
+//	ts,server,load
+//	2016-10-01T12:00:00Z,a,0.5
+//
+// NDJSON files hold one object per line, either shaped like the points accepted
+// by the HTTP insert endpoint or, if Mapping.Vals is set, flat objects that are
+// mapped the same way as CSV rows.
+//
+// Rows that can't be parsed are skipped and counted.
+package importer
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/zenodb"
+)
+
+const (
+	defaultProgressInterval = 5 * time.Second
+	retryDelay              = 250 * time.Millisecond
+)
+
+var (
+	log = golog.LoggerFor("zenodb.importer")
+)
+
+// Opts configures an import.
+type Opts struct {
+	Mapping
+	// Stream is the stream into which to insert points.
+	Stream string
+	// Format is FormatCSV or FormatNDJSON.
+	Format string
+	// OnProgress, if specified, is called every ProgressInterval while
+	// importing, and once more when done.
+	OnProgress func(*Progress)
+	// ProgressInterval defaults to 5 seconds.
+	ProgressInterval time.Duration
+}
+
+// Progress reports how far along an import is.
+type Progress struct {
+	Inserted int64
+	Skipped  int64
+	Elapsed  time.Duration
+}
+
+// Import reads points from r and inserts them into the configured stream using
+// DB.InsertRaw. If a table reading from the stream is behind, Import waits and
+// retries rather than dropping points. Import stops and returns an error if the
+// input can't be read or an insert fails, reporting how much it imported up to
+// that point.
+func Import(db *zenodb.DB, r io.Reader, opts *Opts) (*Progress, error) {
+	var parse func(io.Reader, *Mapping, func(*zenodb.Point) error, func(*ParseError)) error
+	switch opts.Format {
+	case FormatCSV:
+		parse = ParseCSV
+	case FormatNDJSON:
+		parse = ParseNDJSON
+	default:
+		return nil, fmt.Errorf("Unknown format %v, use %v or %v", opts.Format, FormatCSV, FormatNDJSON)
+	}
+	progressInterval := opts.ProgressInterval
+	if progressInterval <= 0 {
+		progressInterval = defaultProgressInterval
+	}
+
+	start := time.Now()
+	nextProgress := start.Add(progressInterval)
+	progress := &Progress{}
+	reportProgress := func() {
+		progress.Elapsed = time.Now().Sub(start)
+		if opts.OnProgress != nil {
+			opts.OnProgress(progress)
+		}
+	}
+
+	err := parse(r, &opts.Mapping, func(point *zenodb.Point) error {
+		dims := bytemap.New(point.Dims)
+		vals := bytemap.NewFloat(point.Vals)
+		for {
+			err := db.InsertRaw(opts.Stream, point.Ts, dims, vals)
+			if err == zenodb.ErrTableBehind {
+				time.Sleep(retryDelay)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("Unable to insert point: %v", err)
+			}
+			break
+		}
+		progress.Inserted++
+		if time.Now().After(nextProgress) {
+			reportProgress()
+			nextProgress = time.Now().Add(progressInterval)
+		}
+		return nil
+	}, func(err *ParseError) {
+		log.Debugf("Skipping row: %v", err)
+		progress.Skipped++
+	})
+	reportProgress()
+	return progress, err
+}
@@ -0,0 +1,94 @@
+package importer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImport(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbimporttest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	schemaFile := filepath.Join(tmpDir, "schema.yaml")
+	err = ioutil.WriteFile(schemaFile, []byte(`
+import_test:
+  retentionperiod: 24h
+  sql: >
+    SELECT SUM(load) AS load
+    FROM inbound
+    GROUP BY server, period(1h)
+`), 0644)
+	if !assert.NoError(t, err, "Unable to write schema") {
+		return
+	}
+
+	db, err := zenodb.NewDB(&zenodb.DBOpts{
+		Dir:                    filepath.Join(tmpDir, "db"),
+		SchemaFile:             schemaFile,
+		IncludeMemStoreInQuery: true,
+	})
+	if !assert.NoError(t, err, "Unable to create DB") {
+		return
+	}
+	defer db.Close()
+
+	ts := time.Now().Add(-1 * time.Minute).Format(time.RFC3339)
+	input := "ts,server,load\n" +
+		ts + ",a,1\n" +
+		"bad,a,2\n" +
+		ts + ",b,3\n"
+	progress, err := Import(db, strings.NewReader(input), &Opts{
+		Mapping: Mapping{Vals: []string{"load"}},
+		Stream:  "inbound",
+		Format:  FormatCSV,
+	})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 2, progress.Inserted)
+		assert.EqualValues(t, 1, progress.Skipped)
+		assert.True(t, progress.Elapsed > 0, "Elapsed should be set even without OnProgress")
+	}
+
+	time.Sleep(1 * time.Second)
+	assert.EqualValues(t, 2, db.TableStats("import_test").InsertedPoints)
+	aq, err := db.SQLQuery("SELECT load FROM import_test ASOF '-2h' GROUP BY server")
+	if !assert.NoError(t, err) {
+		return
+	}
+	result, err := aq.Run()
+	if assert.NoError(t, err) {
+		total := float64(0)
+		for _, row := range result.Rows {
+			total += row.Values[0]
+		}
+		assert.EqualValues(t, 4, total, "Imported points should be queryable")
+	}
+
+	var reported []int64
+	_, err = Import(db, strings.NewReader(input), &Opts{
+		Mapping: Mapping{Vals: []string{"load"}},
+		Stream:  "inbound",
+		Format:  FormatCSV,
+		OnProgress: func(progress *Progress) {
+			reported = append(reported, progress.Inserted)
+		},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []int64{2}, reported, "Progress should be reported once when done")
+	}
+
+	_, err = Import(db, strings.NewReader(input), &Opts{Stream: "inbound", Format: "xml"})
+	assert.Error(t, err, "Unknown format should fail")
+
+	_, err = Import(db, strings.NewReader(input), &Opts{Stream: "unknown", Format: FormatCSV, Mapping: Mapping{Vals: []string{"load"}}})
+	assert.Error(t, err, "Inserting into unknown stream should fail")
+}
@@ -0,0 +1,341 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/zenodb"
+)
+
+const (
+	// FormatCSV is comma-separated values with a header row.
+	FormatCSV = "csv"
+
+	// FormatNDJSON is newline-delimited JSON, one object per line.
+	FormatNDJSON = "ndjson"
+
+	// TsFormatUnix parses timestamps as (possibly fractional) seconds since the
+	// epoch.
+	TsFormatUnix = "unix"
+
+	// TsFormatUnixMillis parses timestamps as milliseconds since the epoch.
+	TsFormatUnixMillis = "unixms"
+
+	// TsFormatUnixNanos parses timestamps as nanoseconds since the epoch.
+	TsFormatUnixNanos = "unixns"
+
+	// DefaultTsColumn is the column holding the timestamp if none is specified.
+	DefaultTsColumn = "ts"
+
+	// maxLineLength caps the length of a single NDJSON line
+	maxLineLength = 1024 * 1024
+)
+
+// ParseError describes a row that couldn't be parsed. Line is the row number
+// in CSV files (not counting the header) and the line number in NDJSON files.
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("Unable to parse line %d: %v", e.Line, e.Err)
+}
+
+// Mapping describes how the columns of a CSV file or the fields of NDJSON
+// objects map to points.
+type Mapping struct {
+	// TsColumn is the column that holds the timestamp, defaults to ts.
+	TsColumn string
+	// TsFormat is either a time layout as understood by time.Parse or one of
+	// TsFormatUnix, TsFormatUnixMillis or TsFormatUnixNanos. Defaults to
+	// RFC 3339.
+	TsFormat string
+	// Dims are the columns that become dimensions. If empty, all columns that
+	// aren't the timestamp or a value become dimensions.
+	Dims []string
+	// Vals are the columns that become values. Required for CSV. For NDJSON, if
+	// Vals is empty, each object is expected to look like the points accepted
+	// by the HTTP insert endpoint, i.e. {"ts": ..., "dims": {...}, "vals": {...}}.
+	Vals []string
+}
+
+func (m *Mapping) tsColumn() string {
+	if m.TsColumn == "" {
+		return DefaultTsColumn
+	}
+	return m.TsColumn
+}
+
+// ParseCSV parses CSV with a header row from the given reader, calling onPoint
+// for each point and onError for each row that couldn't be parsed. Empty
+// dimension and value cells are omitted. ParseCSV stops and returns an error if
+// the header doesn't match the mapping, if reading fails or if onPoint returns
+// an error.
+func ParseCSV(r io.Reader, m *Mapping, onPoint func(*zenodb.Point) error, onError func(*ParseError)) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read header: %v", err)
+	}
+	if len(m.Vals) == 0 {
+		return fmt.Errorf("Please specify at least one value column")
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, column := range header {
+		header[i] = strings.TrimSpace(column)
+		columns[header[i]] = i
+	}
+	indexOf := func(column string) (int, error) {
+		idx, found := columns[column]
+		if !found {
+			return 0, fmt.Errorf("Column %v not found in header", column)
+		}
+		return idx, nil
+	}
+	tsIdx, err := indexOf(m.tsColumn())
+	if err != nil {
+		return err
+	}
+	valIdxs := make([]int, 0, len(m.Vals))
+	isVal := make(map[int]bool, len(m.Vals))
+	for _, val := range m.Vals {
+		idx, err := indexOf(val)
+		if err != nil {
+			return err
+		}
+		valIdxs = append(valIdxs, idx)
+		isVal[idx] = true
+	}
+	var dimIdxs []int
+	if len(m.Dims) > 0 {
+		for _, dim := range m.Dims {
+			idx, err := indexOf(dim)
+			if err != nil {
+				return err
+			}
+			dimIdxs = append(dimIdxs, idx)
+		}
+	} else {
+		for i := range header {
+			if i != tsIdx && !isVal[i] {
+				dimIdxs = append(dimIdxs, i)
+			}
+		}
+	}
+
+	row := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		row++
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				onError(&ParseError{row, err})
+				continue
+			}
+			return err
+		}
+		if len(record) != len(header) {
+			onError(&ParseError{row, fmt.Errorf("Expected %d columns, found %d", len(header), len(record))})
+			continue
+		}
+
+		ts, err := parseTs(strings.TrimSpace(record[tsIdx]), m.TsFormat)
+		if err != nil {
+			onError(&ParseError{row, err})
+			continue
+		}
+		point := &zenodb.Point{Ts: ts, Dims: make(map[string]interface{}, len(dimIdxs)), Vals: make(map[string]float64, len(valIdxs))}
+		for _, idx := range dimIdxs {
+			if record[idx] != "" {
+				point.Dims[header[idx]] = record[idx]
+			}
+		}
+		for _, idx := range valIdxs {
+			cell := strings.TrimSpace(record[idx])
+			if cell == "" {
+				continue
+			}
+			val, parseErr := strconv.ParseFloat(cell, 64)
+			if parseErr != nil || math.IsNaN(val) {
+				err = fmt.Errorf("Invalid value for %v: %v", header[idx], cell)
+				break
+			}
+			point.Vals[header[idx]] = val
+		}
+		if err == nil && len(point.Vals) == 0 {
+			err = fmt.Errorf("No values")
+		}
+		if err != nil {
+			onError(&ParseError{row, err})
+			continue
+		}
+		err = onPoint(point)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ParseNDJSON parses newline-delimited JSON objects from the given reader,
+// calling onPoint for each point and onError for each line that couldn't be
+// parsed. Empty lines are skipped. ParseNDJSON stops and returns an error if
+// reading fails or if onPoint returns an error.
+func ParseNDJSON(r io.Reader, m *Mapping, onPoint func(*zenodb.Point) error, onError func(*ParseError)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		point, err := parseJSON(line, m)
+		if err != nil {
+			onError(&ParseError{lineNumber, err})
+			continue
+		}
+		err = onPoint(point)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func parseJSON(line []byte, m *Mapping) (*zenodb.Point, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(line, &fields)
+	if err != nil {
+		return nil, err
+	}
+	tsColumn := m.tsColumn()
+	rawTs, found := fields[tsColumn]
+	if !found {
+		return nil, fmt.Errorf("Missing %v", tsColumn)
+	}
+	var tsString string
+	if len(rawTs) > 0 && rawTs[0] == '"' {
+		err = json.Unmarshal(rawTs, &tsString)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		tsString = string(rawTs)
+	}
+	ts, err := parseTs(tsString, m.TsFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	point := &zenodb.Point{Ts: ts}
+	if len(m.Vals) == 0 {
+		for _, name := range []string{"dims", "vals"} {
+			if _, found := fields[name]; !found {
+				return nil, fmt.Errorf("Missing %v", name)
+			}
+		}
+		err = json.Unmarshal(fields["dims"], &point.Dims)
+		if err == nil {
+			err = json.Unmarshal(fields["vals"], &point.Vals)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		point.Dims = make(map[string]interface{}, len(m.Dims))
+		point.Vals = make(map[string]float64, len(m.Vals))
+		isVal := make(map[string]bool, len(m.Vals))
+		for _, name := range m.Vals {
+			isVal[name] = true
+			raw, found := fields[name]
+			if !found || string(raw) == "null" {
+				continue
+			}
+			var val float64
+			err = json.Unmarshal(raw, &val)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid value for %v: %v", name, string(raw))
+			}
+			point.Vals[name] = val
+		}
+		dims := m.Dims
+		if len(dims) == 0 {
+			for name := range fields {
+				if name != tsColumn && !isVal[name] {
+					dims = append(dims, name)
+				}
+			}
+		}
+		for _, name := range dims {
+			raw, found := fields[name]
+			if !found {
+				continue
+			}
+			var dim interface{}
+			err = json.Unmarshal(raw, &dim)
+			if err != nil {
+				return nil, err
+			}
+			if dim != nil {
+				point.Dims[name] = dim
+			}
+		}
+	}
+	if len(point.Vals) == 0 {
+		return nil, fmt.Errorf("No values")
+	}
+	return point, nil
+}
+
+// parseTs parses a timestamp using the given format (see Mapping.TsFormat).
+func parseTs(value string, format string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("Missing timestamp")
+	}
+	var ts time.Time
+	var err error
+	switch format {
+	case "":
+		ts, err = time.Parse(time.RFC3339, value)
+	case TsFormatUnix:
+		secs, intErr := strconv.ParseInt(value, 10, 64)
+		if intErr == nil {
+			return time.Unix(secs, 0), nil
+		}
+		var fsecs float64
+		fsecs, err = strconv.ParseFloat(value, 64)
+		ts = time.Unix(0, int64(fsecs*float64(time.Second)))
+	case TsFormatUnixMillis:
+		var ms int64
+		ms, err = strconv.ParseInt(value, 10, 64)
+		ts = time.Unix(0, ms*int64(time.Millisecond))
+	case TsFormatUnixNanos:
+		var ns int64
+		ns, err = strconv.ParseInt(value, 10, 64)
+		ts = time.Unix(0, ns)
+	default:
+		ts, err = time.Parse(format, value)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid timestamp %v: %v", value, err)
+	}
+	return ts, nil
+}
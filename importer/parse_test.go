@@ -0,0 +1,125 @@
+package importer
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCSV(t *testing.T) {
+	input := `ts,server,region,load,requests
+2016-10-01T12:00:00Z,a,us,0.5,10
+2016-10-01T12:01:00Z,b,,0.7,
+bad,c,eu,0.1,1
+2016-10-01T12:02:00Z,d,eu,high,1
+2016-10-01T12:03:00Z,e,eu,,
+2016-10-01T12:04:00Z,f
+`
+	points, errs, err := parseAll(ParseCSV, input, &Mapping{Vals: []string{"load", "requests"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, points, 2) {
+		assert.Equal(t, &zenodb.Point{
+			Ts:   time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC),
+			Dims: map[string]interface{}{"server": "a", "region": "us"},
+			Vals: map[string]float64{"load": 0.5, "requests": 10},
+		}, points[0])
+		assert.Equal(t, map[string]interface{}{"server": "b"}, points[1].Dims, "Empty dims should be omitted")
+		assert.Equal(t, map[string]float64{"load": 0.7}, points[1].Vals, "Empty vals should be omitted")
+	}
+	assert.Equal(t, []int{3, 4, 5, 6}, errs, "Bad timestamp, bad value, no values and short row should be skipped")
+
+	points, _, err = parseAll(ParseCSV, input, &Mapping{Dims: []string{"server"}, Vals: []string{"load"}})
+	if assert.NoError(t, err) && assert.Len(t, points, 2) {
+		assert.Equal(t, map[string]interface{}{"server": "a"}, points[0].Dims, "Only listed dims should be included")
+	}
+
+	points, _, err = parseAll(ParseCSV, "ts, server , load\n2016-10-01T12:00:00Z,a,0.5\n", &Mapping{Vals: []string{"load"}})
+	if assert.NoError(t, err) && assert.Len(t, points, 1) {
+		assert.Equal(t, map[string]interface{}{"server": "a"}, points[0].Dims, "Dim names should be trimmed")
+		assert.Equal(t, map[string]float64{"load": 0.5}, points[0].Vals, "Val names should be trimmed")
+	}
+
+	_, _, err = parseAll(ParseCSV, input, &Mapping{Vals: []string{"missing"}})
+	assert.Error(t, err, "Unknown column should fail")
+	_, _, err = parseAll(ParseCSV, input, &Mapping{})
+	assert.Error(t, err, "Missing value columns should fail")
+}
+
+func TestParseNDJSON(t *testing.T) {
+	input := `{"ts": "2016-10-01T12:00:00Z", "dims": {"server": "a"}, "vals": {"load": 0.5}}
+
+{"dims": {"server": "b"}, "vals": {"load": 0.5}}
+not json
+{"ts": "2016-10-01T12:00:00Z", "vals": {"load": 0.5}}
+`
+	points, errs, err := parseAll(ParseNDJSON, input, &Mapping{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, points, 1) {
+		assert.Equal(t, &zenodb.Point{
+			Ts:   time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC),
+			Dims: map[string]interface{}{"server": "a"},
+			Vals: map[string]float64{"load": 0.5},
+		}, points[0])
+	}
+	assert.Equal(t, []int{3, 4, 5}, errs)
+
+	flat := `{"time": 1475323200000, "server": "a", "up": true, "load": 0.5}
+{"time": 1475323200000, "server": "b", "load": "high"}
+`
+	points, errs, err = parseAll(ParseNDJSON, flat, &Mapping{TsColumn: "time", TsFormat: TsFormatUnixMillis, Vals: []string{"load"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, points, 1) {
+		assert.Equal(t, &zenodb.Point{
+			Ts:   time.Unix(1475323200, 0),
+			Dims: map[string]interface{}{"server": "a", "up": true},
+			Vals: map[string]float64{"load": 0.5},
+		}, points[0])
+	}
+	assert.Equal(t, []int{2}, errs)
+}
+
+func TestParseTs(t *testing.T) {
+	expected := time.Unix(1475323200, 500000000)
+	for _, c := range []struct{ value, format string }{
+		{"1475323200.5", TsFormatUnix},
+		{"1475323200500", TsFormatUnixMillis},
+		{"1475323200500000000", TsFormatUnixNanos},
+		{"2016-10-01 12:00:00.5", "2006-01-02 15:04:05"},
+	} {
+		ts, err := parseTs(c.value, c.format)
+		if assert.NoError(t, err, c.format) {
+			assert.True(t, expected.Equal(ts), "%v: expected %v, got %v", c.format, expected, ts)
+		}
+	}
+	ts, err := parseTs("1475323200", TsFormatUnix)
+	if assert.NoError(t, err) {
+		assert.True(t, time.Unix(1475323200, 0).Equal(ts))
+	}
+	_, err = parseTs("", "")
+	assert.Error(t, err)
+}
+
+type parseFunc func(io.Reader, *Mapping, func(*zenodb.Point) error, func(*ParseError)) error
+
+// parseAll returns the parsed points and the line numbers of parse errors.
+func parseAll(parse parseFunc, input string, m *Mapping) ([]*zenodb.Point, []int, error) {
+	var points []*zenodb.Point
+	var errs []int
+	err := parse(strings.NewReader(input), m, func(point *zenodb.Point) error {
+		points = append(points, point)
+		return nil
+	}, func(err *ParseError) {
+		errs = append(errs, err.Line)
+	})
+	return points, errs, err
+}
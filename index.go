@@ -0,0 +1,247 @@
+package zenodb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/sql"
+	"github.com/golang/snappy"
+)
+
+// rowRef identifies the position of a row within a segment by the file offset
+// of the row group containing the row and the row's number within that group.
+type rowRef struct {
+	block  int64
+	offset uint32
+}
+
+type byPosition []rowRef
+
+func (a byPosition) Len() int      { return len(a) }
+func (a byPosition) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byPosition) Less(i, j int) bool {
+	if a[i].block != a[j].block {
+		return a[i].block < a[j].block
+	}
+	return a[i].offset < a[j].offset
+}
+
+// segmentIndex is an inverted index from dimension name and value to the rows
+// whose keys contain that value. Values are indexed by their string
+// representation, so lookups may yield false positives (e.g. "1" and 1) but
+// never miss rows.
+//
+// On disk, the index is stored snappy compressed next to its segment as:
+//
+//	numdims|dim1|numvalues|value1|numrows|row1|row2|...|value2|...|dim2|...
+//
+// numdims is 16 bits
+// dims and values are each prefixed with their 16 bit length
+// numvalues and numrows are 32 bits
+// rows are encoded as 64 bit block offset followed by 32 bit row offset (see
+// rowRef)
+type segmentIndex map[string]map[string][]rowRef
+
+func (idx segmentIndex) add(key bytemap.ByteMap, ref rowRef) {
+	for dim, val := range key.AsMap() {
+		values := idx[dim]
+		if values == nil {
+			values = make(map[string][]rowRef)
+			idx[dim] = values
+		}
+		value := indexValue(val)
+		values[value] = append(values[value], ref)
+	}
+}
+
+func indexValue(val interface{}) string {
+	return fmt.Sprint(val)
+}
+
+func indexFileFor(segmentName string) string {
+	return strings.TrimSuffix(segmentName, ".dat") + ".idx"
+}
+
+// write writes the index to the given file in dir.
+func (idx segmentIndex) write(dir string, name string) error {
+	file, err := ioutil.TempFile(dir, "tmp_index")
+	if err != nil {
+		return fmt.Errorf("Unable to create temp file for index: %v", err)
+	}
+	out := snappy.NewBufferedWriter(file)
+	err = idx.writeTo(out)
+	if err == nil {
+		err = out.Close()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("Unable to write index: %v", err)
+	}
+	err = os.Rename(file.Name(), filepath.Join(dir, name))
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("Unable to move index into place: %v", err)
+	}
+	return nil
+}
+
+func (idx segmentIndex) writeTo(out io.Writer) error {
+	writeString := func(s string) error {
+		err := binary.Write(out, encoding.Binary, uint16(len(s)))
+		if err == nil {
+			_, err = io.WriteString(out, s)
+		}
+		return err
+	}
+
+	err := binary.Write(out, encoding.Binary, uint16(len(idx)))
+	if err != nil {
+		return err
+	}
+	for dim, values := range idx {
+		err = writeString(dim)
+		if err == nil {
+			err = binary.Write(out, encoding.Binary, uint32(len(values)))
+		}
+		if err != nil {
+			return err
+		}
+		for value, refs := range values {
+			err = writeString(value)
+			if err == nil {
+				err = binary.Write(out, encoding.Binary, uint32(len(refs)))
+			}
+			for _, ref := range refs {
+				if err == nil {
+					err = binary.Write(out, encoding.Binary, ref.block)
+				}
+				if err == nil {
+					err = binary.Write(out, encoding.Binary, ref.offset)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readIndex reads the index for the named segment in dir, keeping only the
+// given dims. If the segment doesn't have an index, readIndex returns nil.
+func readIndex(dir string, segmentName string, dims map[string]bool) (segmentIndex, error) {
+	filename := filepath.Join(dir, indexFileFor(segmentName))
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open index %v: %v", filename, err)
+	}
+	defer file.Close()
+	in := bufio.NewReader(snappy.NewReader(file))
+
+	readString := func() (string, error) {
+		length := uint16(0)
+		err := binary.Read(in, encoding.Binary, &length)
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, length)
+		_, err = io.ReadFull(in, b)
+		return string(b), err
+	}
+
+	idx := make(segmentIndex, len(dims))
+	numDims := uint16(0)
+	err = binary.Read(in, encoding.Binary, &numDims)
+	for i := 0; err == nil && i < int(numDims); i++ {
+		var dim string
+		numValues := uint32(0)
+		dim, err = readString()
+		if err == nil {
+			err = binary.Read(in, encoding.Binary, &numValues)
+		}
+		var values map[string][]rowRef
+		if dims[dim] {
+			values = make(map[string][]rowRef, numValues)
+			idx[dim] = values
+		}
+		for j := 0; err == nil && j < int(numValues); j++ {
+			var value string
+			numRefs := uint32(0)
+			value, err = readString()
+			if err == nil {
+				err = binary.Read(in, encoding.Binary, &numRefs)
+			}
+			var refs []rowRef
+			if values != nil {
+				refs = make([]rowRef, 0, numRefs)
+			}
+			for k := 0; err == nil && k < int(numRefs); k++ {
+				var ref rowRef
+				err = binary.Read(in, encoding.Binary, &ref.block)
+				if err == nil {
+					err = binary.Read(in, encoding.Binary, &ref.offset)
+				}
+				if values != nil {
+					refs = append(refs, ref)
+				}
+			}
+			if values != nil {
+				values[value] = refs
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read index %v: %v", filename, err)
+	}
+	return idx, nil
+}
+
+// matchingRows returns the sorted positions of the rows that satisfy all of the
+// given filters.
+func (idx segmentIndex) matchingRows(filters []*sql.DimFilter) []rowRef {
+	var result map[rowRef]bool
+	for _, filter := range filters {
+		matches := make(map[rowRef]bool)
+		values := idx[filter.Dim]
+		for _, val := range filter.Values() {
+			for _, ref := range values[indexValue(val)] {
+				if result == nil || result[ref] {
+					matches[ref] = true
+				}
+			}
+		}
+		result = matches
+	}
+
+	rows := make([]rowRef, 0, len(result))
+	for ref := range result {
+		rows = append(rows, ref)
+	}
+	sort.Sort(byPosition(rows))
+	return rows
+}
+
+// dimsOf returns the dimensions referenced by the given filters.
+func dimsOf(filters []*sql.DimFilter) map[string]bool {
+	dims := make(map[string]bool, len(filters))
+	for _, filter := range filters {
+		dims[filter.Dim] = true
+	}
+	return dims
+}
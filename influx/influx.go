@@ -0,0 +1,236 @@
+// Package influx parses data in the InfluxDB line protocol into points that can
+// be inserted into zenodb.
+//
+// Each line has the form:
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// The measurement becomes the dimension "measurement", tags become dimensions
+// and numeric and boolean fields become values (with true and false mapping to
+// 1 and 0). String fields are ignored, since zenodb only stores numeric values.
+package influx
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/zenodb"
+)
+
+const (
+	// MeasurementDim is the name of the dimension that holds the measurement.
+	MeasurementDim = "measurement"
+
+	// maxLineLength caps the length of a single line
+	maxLineLength = 1024 * 1024
+)
+
+// ParseError describes a line that couldn't be parsed.
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("Unable to parse line %d: %v", e.Line, e.Err)
+}
+
+// Parse parses all lines from the given reader, calling onPoint for each point
+// and onError for each line that couldn't be parsed. Empty lines and comments
+// are skipped. Points without a timestamp use now. Parse stops and returns an
+// error if the precision is unknown, reading fails or onPoint returns an error.
+func Parse(r io.Reader, precision string, now time.Time, onPoint func(*zenodb.Point) error, onError func(*ParseError)) error {
+	unit, err := PrecisionUnit(precision)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		point, err := parseLine(line, unit, now)
+		if err != nil {
+			onError(&ParseError{lineNumber, err})
+			continue
+		}
+		err = onPoint(point)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// ParseLine parses a single line. precision is one of n (the default), ns, u,
+// us, µ, ms, s, m or h. If the line doesn't have a timestamp, now is used.
+func ParseLine(line string, precision string, now time.Time) (*zenodb.Point, error) {
+	unit, err := PrecisionUnit(precision)
+	if err != nil {
+		return nil, err
+	}
+	return parseLine(line, unit, now)
+}
+
+func parseLine(line string, unit time.Duration, now time.Time) (*zenodb.Point, error) {
+	// Quotes only delimit string field values, so the measurement and tags end
+	// at the first unescaped space and only the remainder honors quotes.
+	line = strings.TrimLeft(line, " ")
+	seriesSection := split(line, ' ', false)[0]
+	sections := []string{seriesSection}
+	// Collapse runs of spaces
+	for _, section := range split(line[len(seriesSection):], ' ', true) {
+		if section != "" {
+			sections = append(sections, section)
+		}
+	}
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, fmt.Errorf("Expected measurement, fields and optional timestamp, got %d sections", len(sections))
+	}
+
+	point := &zenodb.Point{
+		Ts:   now,
+		Dims: make(map[string]interface{}),
+		Vals: make(map[string]float64),
+	}
+
+	series := split(sections[0], ',', false)
+	measurement := unescape(series[0])
+	if measurement == "" {
+		return nil, fmt.Errorf("Missing measurement")
+	}
+	point.Dims[MeasurementDim] = measurement
+	for _, tag := range series[1:] {
+		kv := split(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("Invalid tag %v", tag)
+		}
+		point.Dims[unescape(kv[0])] = unescape(kv[1])
+	}
+
+	for _, field := range split(sections[1], ',', true) {
+		kv := split(field, '=', true)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("Invalid field %v", field)
+		}
+		val, isNumeric, err := parseFieldValue(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for field %v: %v", kv[0], err)
+		}
+		if isNumeric {
+			point.Vals[unescape(kv[0])] = val
+		}
+	}
+	if len(point.Vals) == 0 {
+		return nil, fmt.Errorf("Need at least one numeric or boolean field")
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid timestamp %v: %v", sections[2], err)
+		}
+		if ts > math.MaxInt64/int64(unit) || ts < math.MinInt64/int64(unit) {
+			return nil, fmt.Errorf("Timestamp %v out of range", sections[2])
+		}
+		point.Ts = time.Unix(0, ts*int64(unit))
+	}
+
+	return point, nil
+}
+
+// parseFieldValue parses a field value, returning false if the value isn't
+// numeric or boolean (i.e. it's a string).
+func parseFieldValue(value string) (float64, bool, error) {
+	if value[0] == '"' {
+		if len(value) < 2 || value[len(value)-1] != '"' {
+			return 0, false, fmt.Errorf("Unterminated string %v", value)
+		}
+		return 0, false, nil
+	}
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	switch value[len(value)-1] {
+	case 'i':
+		i, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		return float64(i), true, err
+	case 'u':
+		u, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+		return float64(u), true, err
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	return f, true, err
+}
+
+// PrecisionUnit returns the unit of timestamps with the given precision (see
+// ParseLine), or an error if the precision is unknown.
+func PrecisionUnit(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("Unknown precision %v", precision)
+}
+
+// split splits s on every occurrence of sep that isn't escaped with a backslash
+// and, if quoted is true, that isn't inside of a double-quoted string.
+func split(s string, sep byte, quoted bool) []string {
+	var parts []string
+	start := 0
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			// Skip escaped character
+			i++
+		case quoted && c == '"':
+			inQuotes = !inQuotes
+		case c == sep && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescape removes the backslashes from escaped commas, spaces, equal signs,
+// quotes and backslashes.
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	result := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case ',', ' ', '=', '"', '\\':
+				i++
+			}
+		}
+		result = append(result, s[i])
+	}
+	return string(result)
+}
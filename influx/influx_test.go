@@ -0,0 +1,96 @@
+package influx
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLine(t *testing.T) {
+	now := time.Now()
+
+	point, err := ParseLine(`cpu,host=server\ 01,region=us-west usage=0.64,count=3i,up=t,note="a, \"b\" c" 1465839830100400200`, "", now)
+	if assert.NoError(t, err) {
+		assert.Equal(t, time.Unix(0, 1465839830100400200), point.Ts)
+		assert.Equal(t, map[string]interface{}{"measurement": "cpu", "host": "server 01", "region": "us-west"}, point.Dims)
+		assert.Equal(t, map[string]float64{"usage": 0.64, "count": 3, "up": 1}, point.Vals)
+	}
+
+	point, err = ParseLine(`disk\,io used=5u 1465839830`, "s", now)
+	if assert.NoError(t, err) {
+		assert.Equal(t, time.Unix(1465839830, 0), point.Ts)
+		assert.Equal(t, map[string]interface{}{"measurement": "disk,io"}, point.Dims)
+		assert.Equal(t, map[string]float64{"used": 5}, point.Vals)
+	}
+
+	point, err = ParseLine(`we"ird,host="a",quote=x" usage=1,note="c d" 1465839830`, "s", now)
+	if assert.NoError(t, err, "Quotes in measurement and tags should be literal") {
+		assert.Equal(t, map[string]interface{}{"measurement": `we"ird`, "host": `"a"`, "quote": `x"`}, point.Dims)
+		assert.Equal(t, map[string]float64{"usage": 1}, point.Vals)
+	}
+
+	point, err = ParseLine(`mem free=1e3`, "ms", now)
+	if assert.NoError(t, err) {
+		assert.Equal(t, now, point.Ts, "Point without timestamp should use now")
+		assert.Equal(t, map[string]float64{"free": 1000}, point.Vals)
+	}
+
+	for _, line := range []string{
+		`cpu`,
+		`cpu,host usage=1`,
+		`cpu usage=abc`,
+		`cpu note="only strings"`,
+		`cpu usage=1 notatime`,
+		`cpu usage=1 1 extra`,
+		`,host=a usage=1`,
+	} {
+		_, err := ParseLine(line, "", now)
+		assert.Error(t, err, line)
+	}
+
+	_, err = ParseLine(`cpu usage=1 1`, "fortnights", now)
+	assert.Error(t, err, "Unknown precision should fail")
+
+	_, err = ParseLine(`cpu usage=1 9223372036854775807`, "ns", now)
+	assert.NoError(t, err, "Largest timestamp in nanoseconds should be fine")
+	_, err = ParseLine(`cpu usage=1 9223372036854775807`, "s", now)
+	assert.Error(t, err, "Timestamp that overflows nanoseconds should fail")
+	_, err = ParseLine(`cpu usage=1 -9223372036854775807`, "h", now)
+	assert.Error(t, err, "Negative timestamp that overflows nanoseconds should fail")
+}
+
+func TestParse(t *testing.T) {
+	input := `# comment
+cpu usage=1 1
+
+cpu usage=bad 2
+cpu usage=3 3
+`
+	var points []*zenodb.Point
+	var parseErrors []*ParseError
+	err := Parse(strings.NewReader(input), "s", time.Now(), func(point *zenodb.Point) error {
+		points = append(points, point)
+		return nil
+	}, func(parseErr *ParseError) {
+		parseErrors = append(parseErrors, parseErr)
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, points, 2) {
+		assert.Equal(t, float64(1), points[0].Vals["usage"])
+		assert.Equal(t, float64(3), points[1].Vals["usage"])
+	}
+	if assert.Len(t, parseErrors, 1) {
+		assert.Equal(t, 4, parseErrors[0].Line)
+	}
+
+	points = nil
+	err = Parse(strings.NewReader(input), "fortnights", time.Now(), func(point *zenodb.Point) error {
+		points = append(points, point)
+		return nil
+	}, func(parseErr *ParseError) {})
+	assert.Error(t, err, "Unknown precision should fail up front")
+	assert.Empty(t, points)
+}
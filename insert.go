@@ -2,36 +2,220 @@ package zenodb
 
 import (
 	"fmt"
+	"math"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
 	"github.com/getlantern/wal"
 	"github.com/getlantern/zenodb/encoding"
 )
 
+// InsertPolicy determines what happens to inserts into a table that has fallen
+// behind, meaning that its queue of inserts waiting to go into the memstore is
+// full.
+type InsertPolicy string
+
+const (
+	// InsertPolicyBlock stops reading from the WAL until the table catches up.
+	// Inserts into the stream continue to be accepted and accumulate in the WAL.
+	InsertPolicyBlock InsertPolicy = "block"
+
+	// InsertPolicyReject rejects inserts into the table's stream with
+	// ErrTableBehind until the table catches up, so that clients can back off.
+	InsertPolicyReject InsertPolicy = "reject"
+
+	// InsertPolicyDrop drops points that don't fit into the queue, counting them
+	// in the table's DroppedPoints.
+	InsertPolicyDrop InsertPolicy = "drop"
+)
+
+var (
+	// ErrTableBehind is returned when inserting into a stream that's read by a
+	// table which uses InsertPolicyReject and has fallen behind.
+	ErrTableBehind = errors.New("Table is behind, please retry later")
+)
+
+// Point is a point of data for insertion into a stream.
+type Point struct {
+	Ts   time.Time              `json:"ts,omitempty"`
+	Dims map[string]interface{} `json:"dims,omitempty"`
+	Vals map[string]float64     `json:"vals,omitempty"`
+}
+
 func (db *DB) Insert(stream string, ts time.Time, dims map[string]interface{}, vals map[string]float64) error {
 	return db.InsertRaw(stream, ts, bytemap.New(dims), bytemap.NewFloat(vals))
 }
 
 func (db *DB) InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error {
+	w, err := db.walFor(stream, 1)
+	if err != nil {
+		return err
+	}
+	bufs := append([][]byte{walEntryHeader(walEntryPoint)}, encodePoint(ts, dims, vals)...)
+	_, err = w.Write(bufs...)
+	return err
+}
+
+// InsertBatch inserts the given points into the given stream. All points are
+// written to the WAL as a single entry, which is a lot more efficient than
+// inserting them one at a time.
+func (db *DB) InsertBatch(stream string, points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	w, err := db.walFor(stream, len(points))
+	if err != nil {
+		return err
+	}
+	return writeBatch(w, points)
+}
+
+// InsertBatchFrom is like InsertBatch, but also records the given source and
+// position within that source (e.g. a Kafka partition and offset) in the same
+// WAL entry as the points. Since the points and their position are written
+// atomically, SourcePositions can tell exactly which positions made it into the
+// WAL, even if the caller crashed before recording them elsewhere.
+func (db *DB) InsertBatchFrom(stream string, source string, position int64, points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	if len(source) > math.MaxUint16 {
+		return fmt.Errorf("Source name of %d bytes exceeds maximum of %d bytes", len(source), math.MaxUint16)
+	}
+	w, err := db.walFor(stream, len(points))
+	if err != nil {
+		return err
+	}
+	sourceLen := make([]byte, encoding.Width16bits)
+	encoding.WriteInt16(sourceLen, len(source))
+	pos := make([]byte, encoding.Width64bits)
+	encoding.WriteInt64(pos, int(position))
+	return writeBatch(w, points, walEntryHeader(walEntrySourced), sourceLen, []byte(source), pos)
+}
+
+// AdmitInserts checks whether the given stream currently accepts inserts,
+// returning ErrTableBehind (counting numPoints as rejected) or ErrReadOnly if it
+// doesn't. Otherwise, it returns a function that inserts batches of points like
+// InsertBatch, but without checking again. This allows requests that consist of
+// several batches to be rejected before any of their points are accepted,
+// instead of being rejected half way through.
+func (db *DB) AdmitInserts(stream string, numPoints int) (func(points []Point) error, error) {
+	w, err := db.walFor(stream, numPoints)
+	if err != nil {
+		return nil, err
+	}
+	return func(points []Point) error {
+		if len(points) == 0 {
+			return nil
+		}
+		return writeBatch(w, points)
+	}, nil
+}
+
+// writeBatch writes the given points to the WAL as a single batch entry,
+// preceded by the given prefix.
+func writeBatch(w *wal.WAL, points []Point, prefix ...[]byte) error {
+	numPoints := make([]byte, encoding.Width32bits)
+	encoding.WriteInt32(numPoints, len(points))
+	bufs := make([][]byte, 0, len(prefix)+2+len(points)*5)
+	bufs = append(bufs, prefix...)
+	bufs = append(bufs, walEntryHeader(walEntryBatch), numPoints)
+	for _, point := range points {
+		bufs = append(bufs, encodePoint(point.Ts, bytemap.New(point.Dims), bytemap.NewFloat(point.Vals))...)
+	}
+	_, err := w.Write(bufs...)
+	return err
+}
+
+// walFor returns the WAL for the given stream, or ErrTableBehind (counting the
+// given number of points as rejected) if a table reading from that stream is
+// behind, or ErrReadOnly if the database is a follower.
+func (db *DB) walFor(stream string, numPoints int) (*wal.WAL, error) {
+	if db.opts.Follower {
+		return nil, ErrReadOnly
+	}
+	w, err := db.walForStream(stream)
+	if err != nil {
+		return nil, err
+	}
 	stream = strings.TrimSpace(strings.ToLower(stream))
-	db.tablesMutex.Lock()
-	w := db.streams[stream]
-	db.tablesMutex.Unlock()
-	if w == nil {
-		return fmt.Errorf("No wal found for stream %v", stream)
+	db.tablesMutex.RLock()
+	streamBehind := db.streamsBehind[stream]
+	db.tablesMutex.RUnlock()
+	if atomic.LoadInt32(streamBehind) > 0 {
+		db.recordRejected(stream, numPoints)
+		return nil, ErrTableBehind
 	}
+	return w, nil
+}
 
+// encodePoint encodes a point for writing to the WAL.
+func encodePoint(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) [][]byte {
 	tsd := make([]byte, encoding.Width64bits)
 	encoding.EncodeTime(tsd, ts)
 	dimsLen := make([]byte, encoding.Width32bits)
 	encoding.WriteInt32(dimsLen, len(dims))
 	valsLen := make([]byte, encoding.Width32bits)
 	encoding.WriteInt32(valsLen, len(vals))
-	_, err := w.Write(tsd, dimsLen, dims, valsLen, vals)
-	return err
+	return [][]byte{tsd, dimsLen, dims, valsLen, vals}
+}
+
+// decodePoint decodes a point (minus its timestamp) that was encoded with
+// encodePoint and returns the remaining data.
+func decodePoint(data []byte) (bytemap.ByteMap, bytemap.ByteMap, []byte) {
+	dimsLen, remain := encoding.ReadInt32(data)
+	dims, remain := encoding.Read(remain, dimsLen)
+	valsLen, remain := encoding.ReadInt32(remain)
+	vals, remain := encoding.Read(remain, valsLen)
+	// Split the dims and vals so that holding on to one doesn't force holding on
+	// to the other. Also, we need copies for both because the WAL read buffer
+	// will change on next call to wal.Read().
+	dimsBM := make(bytemap.ByteMap, len(dims))
+	valsBM := make(bytemap.ByteMap, len(vals))
+	copy(dimsBM, dims)
+	copy(valsBM, vals)
+	return dimsBM, valsBM, remain
+}
+
+// recordRejected counts the given number of points as rejected by the tables
+// reading from the given stream that are behind.
+func (db *DB) recordRejected(stream string, numPoints int) {
+	db.tablesMutex.RLock()
+	defer db.tablesMutex.RUnlock()
+	for _, t := range db.orderedTables {
+		if t.From == stream && atomic.LoadInt32(&t.behind) == 1 {
+			t.statsMutex.Lock()
+			t.stats.RejectedPoints += int64(numPoints)
+			t.statsMutex.Unlock()
+		}
+	}
+}
+
+// updateBehind updates whether the table rejects inserts because it's behind,
+// which is the case while it uses InsertPolicyReject and its queue is full.
+// Stopped tables never reject inserts.
+func (t *table) updateBehind() {
+	t.behindMutex.Lock()
+	behind := int32(0)
+	select {
+	case <-t.stopCh:
+	default:
+		if t.insertPolicy() == InsertPolicyReject && t.rowStore.queueFull() {
+			behind = 1
+		}
+	}
+	previous := t.behind
+	if behind != previous {
+		atomic.StoreInt32(&t.behind, behind)
+		if t.streamBehind != nil {
+			atomic.AddInt32(t.streamBehind, behind-previous)
+		}
+	}
+	t.behindMutex.Unlock()
 }
 
 func (t *table) processInserts() {
@@ -39,26 +223,30 @@ func (t *table) processInserts() {
 	inserted := 0
 	skipped := 0
 	bytesRead := 0
+	defer close(t.stopped)
 	for {
 		data, err := t.wal.Read()
+		select {
+		case <-t.stopCh:
+			t.log.Debug("Stopped reading from WAL")
+			return
+		default:
+		}
 		if err != nil {
 			panic(fmt.Errorf("Unable to read from WAL: %v", err))
 		}
 		bytesRead += len(data)
-		tsd, data := encoding.Read(data, encoding.Width64bits)
-		ts := encoding.TimeFromBytes(tsd)
-		if ts.Before(t.truncateBefore()) {
-			// Ignore old data
-			skipped++
-		} else {
-			t.insert(ts, data)
-			inserted++
-		}
+		i, s := t.insert(data)
+		inserted += i
+		skipped += s
 		delta := time.Now().Sub(start)
 		if delta > 1*time.Minute {
 			t.log.Debugf("Read %v at %v per second", humanize.Bytes(uint64(bytesRead)), humanize.Bytes(uint64(float64(bytesRead)/delta.Seconds())))
 			t.log.Debugf("Inserted %v points at %v per second", humanize.Comma(int64(inserted)), humanize.Commaf(float64(inserted)/delta.Seconds()))
 			t.log.Debugf("Skipped %v points at %v per second", humanize.Comma(int64(skipped)), humanize.Commaf(float64(skipped)/delta.Seconds()))
+			t.statsMutex.Lock()
+			t.stats.InsertRate = float64(inserted) / delta.Seconds()
+			t.statsMutex.Unlock()
 			inserted = 0
 			skipped = 0
 			bytesRead = 0
@@ -67,23 +255,60 @@ func (t *table) processInserts() {
 	}
 }
 
-func (t *table) insert(ts time.Time, data []byte) {
+// insert inserts the point or batch of points in the given WAL entry and
+// returns the number of points that were inserted and skipped.
+func (t *table) insert(data []byte) (int, int) {
 	offset := t.wal.Offset()
-	dimsLen, remain := encoding.ReadInt32(data)
-	dims, remain := encoding.Read(remain, dimsLen)
-	valsLen, remain := encoding.ReadInt32(remain)
-	vals, _ := encoding.Read(remain, valsLen)
-	// Split the dims and vals so that holding on to one doesn't force holding on
-	// to the other. Also, we need copies for both because the WAL read buffer
-	// will change on next call to wal.Read().
-	dimsBM := make(bytemap.ByteMap, len(dims))
-	valsBM := make(bytemap.ByteMap, len(vals))
-	copy(dimsBM, dims)
-	copy(valsBM, vals)
-	t.doInsert(ts, dimsBM, valsBM, offset)
+	t.statsMutex.Lock()
+	t.readOffset = offset
+	t.statsMutex.Unlock()
+
+	// Entries replicated from a leader carry the leader's original entry, which
+	// may itself record its source
+	data, _ = stripReplicated(data)
+	data, _, _ = stripSourced(data)
+	entryType, remain, err := parseWALEntry(data)
+	if err != nil {
+		t.log.Errorf("Skipping WAL entry at %v: %v", offset, err)
+		return 0, 0
+	}
+	numPoints := 1
+	switch entryType {
+	case walEntryPoint:
+		// Single point
+	case walEntryBatch:
+		numPoints, remain = encoding.ReadInt32(remain)
+	default:
+		t.log.Errorf("Skipping WAL entry of unknown type %d at %v", entryType, offset)
+		return 0, 0
+	}
+
+	truncateBefore := t.truncateBefore()
+	inserts := make([]*insert, 0, numPoints)
+	skipped := 0
+	for i := 0; i < numPoints; i++ {
+		var tsd []byte
+		tsd, remain = encoding.Read(remain, encoding.Width64bits)
+		ts := encoding.TimeFromBytes(tsd)
+		var dims, vals bytemap.ByteMap
+		dims, vals, remain = decodePoint(remain)
+		if ts.Before(truncateBefore) {
+			// Ignore old data
+			skipped++
+			continue
+		}
+		insert := t.prepareInsert(ts, dims, vals, offset)
+		if insert != nil {
+			inserts = append(inserts, insert)
+		}
+	}
+	t.queueInserts(inserts)
+	return numPoints - skipped, skipped
 }
 
-func (t *table) doInsert(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap, offset wal.Offset) {
+// prepareInsert prepares an insert for the given point, returning nil if the
+// point is filtered out by the table's WHERE clause.
+func (t *table) prepareInsert(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap, offset wal.Offset) *insert {
 	t.whereMutex.RLock()
 	where := t.Where
 	t.whereMutex.RUnlock()
@@ -95,35 +320,87 @@ func (t *table) doInsert(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMa
 			t.statsMutex.Lock()
 			t.stats.FilteredPoints++
 			t.statsMutex.Unlock()
-			return
+			return nil
 		}
 	}
 	t.db.clock.Advance(ts)
 
-	var key bytemap.ByteMap
-	if len(t.GroupBy) == 0 {
-		key = dims
-	} else {
-		// Reslice dimensions
-		names := make([]string, 0, len(t.GroupBy))
-		values := make([]interface{}, 0, len(t.GroupBy))
-		for _, groupBy := range t.GroupBy {
-			val := groupBy.Expr.Eval(dims)
-			if val != nil {
-				names = append(names, groupBy.Name)
-				values = append(values, val)
-			}
+	key := t.keyFor(dims)
+	tsparams := encoding.NewTSParams(ts, vals)
+	return &insert{key, tsparams, dims, offset}
+}
+
+// queueInserts queues the given inserts from a single WAL entry for insertion
+// into the rowStore.
+func (t *table) queueInserts(inserts []*insert) {
+	if len(inserts) == 0 {
+		return
+	}
+	queued := t.rowStore.insert(inserts, t.insertPolicy() == InsertPolicyDrop)
+	if !queued {
+		select {
+		case <-t.stopCh:
+			// Not dropped, the inserts will be read from the WAL again on the next
+			// start
+			return
+		default:
 		}
-		key = bytemap.FromSortedKeysAndValues(names, values)
 	}
-
-	tsparams := encoding.NewTSParams(ts, vals)
-	t.rowStore.insert(&insert{key, tsparams, dims, offset})
 	t.statsMutex.Lock()
-	t.stats.InsertedPoints++
+	if queued {
+		t.stats.InsertedPoints += int64(len(inserts))
+	} else {
+		t.stats.DroppedPoints += int64(len(inserts))
+	}
 	t.statsMutex.Unlock()
 }
 
+// keyFor determines the key under which to store data for the given dims based
+// on the table's GROUP BY.
+func (t *table) keyFor(dims bytemap.ByteMap) bytemap.ByteMap {
+	if len(t.GroupBy) == 0 {
+		return dims
+	}
+	// Reslice dimensions
+	names := make([]string, 0, len(t.GroupBy))
+	values := make([]interface{}, 0, len(t.GroupBy))
+	for _, groupBy := range t.GroupBy {
+		val := groupBy.Expr.Eval(dims)
+		if val != nil {
+			names = append(names, groupBy.Name)
+			values = append(values, val)
+		}
+	}
+	return bytemap.FromSortedKeysAndValues(names, values)
+}
+
+// walLagBytes returns how many bytes the table's WAL reader is behind the head
+// of the WAL. If the reader is in an older WAL file than the head, only the
+// bytes in the head's file are counted.
+func (t *table) walLagBytes() (int64, error) {
+	t.statsMutex.RLock()
+	current := t.readOffset
+	t.statsMutex.RUnlock()
+	if t.walStream == nil || current == nil {
+		return 0, nil
+	}
+	_, head, err := t.walStream.Latest()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to determine head of WAL: %v", err)
+	}
+	if head == nil {
+		return 0, nil
+	}
+	if current.FileSequence() != head.FileSequence() {
+		return head.Position(), nil
+	}
+	lag := head.Position() - current.Position()
+	if lag < 0 {
+		lag = 0
+	}
+	return lag, nil
+}
+
 func (t *table) recordQueued() {
 	t.statsMutex.Lock()
 	t.stats.QueuedPoints++
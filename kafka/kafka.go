@@ -0,0 +1,548 @@
+// Package kafka consumes points from a Kafka topic and inserts them into a
+// zenodb stream.
+//
+// Each message holds either a single point or an array of points, encoded as
+// JSON or MsgPack:
+//
+//	{"ts": "2016-10-01T12:00:00Z", "dims": {"server": "a"}, "vals": {"load": 0.5}}
+//
+// In JSON, ts is an RFC 3339 timestamp, in MsgPack it's the number of
+// milliseconds since the epoch. Points without ts use the time at which they
+// were consumed.
+//
+// Points are written to the WAL along with the partition and offset of the
+// message that they came from (see zenodb.DB.InsertBatchFrom). Consumed offsets
+// are also tracked in a file next to the stream's WAL, along with the head of
+// the WAL at the time that they were recorded. On startup, the consumer reads
+// whatever was written to the WAL after that to pick up offsets that made it
+// into the WAL but not into the file because of a crash, so that a restarted
+// consumer picks up where it left off without counting points twice. Offsets
+// are only stored once the WAL has had time to sync the corresponding points
+// to disk (see zenodb.DBOpts.WALSyncInterval), since stored offsets that point
+// past data lost in a crash would skip that data.
+package kafka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	// OffsetOldest starts consuming partitions from the oldest available
+	// message.
+	OffsetOldest = -2
+
+	// OffsetNewest starts consuming partitions from the newest message.
+	OffsetNewest = -1
+
+	// FormatJSON indicates that messages are encoded as JSON
+	FormatJSON = "json"
+
+	// FormatMsgPack indicates that messages are encoded as MsgPack
+	FormatMsgPack = "msgpack"
+
+	minRetryDelay = 1 * time.Second
+	maxRetryDelay = 1 * time.Minute
+)
+
+var (
+	log = golog.LoggerFor("zenodb.kafka")
+)
+
+// Message is a message consumed from a Kafka partition.
+type Message struct {
+	Partition int32
+	Offset    int64
+	Value     []byte
+}
+
+// Broker provides access to the partitions of Kafka topics. NewBroker returns a
+// Broker that talks to real Kafka brokers.
+type Broker interface {
+	// Partitions returns the partitions of the given topic.
+	Partitions(topic string) ([]int32, error)
+
+	// ConsumePartition starts consuming the given partition at the given offset
+	// (or OffsetOldest or OffsetNewest).
+	ConsumePartition(topic string, partition int32, offset int64) (PartitionConsumer, error)
+
+	// Close closes the Broker.
+	Close() error
+}
+
+// PartitionConsumer consumes messages from a single partition.
+type PartitionConsumer interface {
+	// Messages returns the channel of consumed messages.
+	Messages() <-chan *Message
+
+	// Errors returns the channel of errors encountered while consuming.
+	Errors() <-chan error
+
+	// Close stops consuming.
+	Close() error
+}
+
+// Opts configures a Consumer.
+type Opts struct {
+	// Topic is the topic from which to consume.
+	Topic string
+	// Stream is the stream into which to insert points.
+	Stream string
+	// Format is the format of messages, either FormatJSON (the default) or
+	// FormatMsgPack.
+	Format string
+	// InitialOffset is where to start consuming partitions for which no offset
+	// has been stored yet, either OffsetOldest (the default) or OffsetNewest.
+	InitialOffset int64
+	// BatchSize caps how many points are written to the WAL at a time. Defaults
+	// to 1000.
+	BatchSize int
+	// FlushInterval caps how long consumed points are held before being written
+	// to the WAL. Defaults to 1 second.
+	FlushInterval time.Duration
+}
+
+// Consumer consumes points from a Kafka topic and inserts them into a stream.
+type Consumer struct {
+	db          *zenodb.DB
+	broker      Broker
+	opts        *Opts
+	offsetsFile string
+	// offsets are the offsets stored in the offsets file, consumed are the
+	// offsets of everything written to the WAL, which may not have been synced
+	// yet.
+	offsets   *storedOffsets
+	consumed  *storedOffsets
+	offsetsMx sync.Mutex
+	consumers []PartitionConsumer
+	stopCh    chan interface{}
+	wg        sync.WaitGroup
+}
+
+// Consume starts consuming all partitions of the configured topic, resuming
+// from the stored offsets.
+func Consume(db *zenodb.DB, broker Broker, opts *Opts) (*Consumer, error) {
+	if opts.Topic == "" {
+		return nil, fmt.Errorf("Please specify a Topic")
+	}
+	opts.Stream = strings.TrimSpace(strings.ToLower(opts.Stream))
+	if opts.Stream == "" {
+		return nil, fmt.Errorf("Please specify a Stream")
+	}
+	switch opts.Format {
+	case "":
+		opts.Format = FormatJSON
+	case FormatJSON, FormatMsgPack:
+		// okay
+	default:
+		return nil, fmt.Errorf("Unknown Format %v, use %v or %v", opts.Format, FormatJSON, FormatMsgPack)
+	}
+	if opts.InitialOffset == 0 {
+		opts.InitialOffset = OffsetOldest
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 1 * time.Second
+	}
+
+	c := &Consumer{
+		db:          db,
+		broker:      broker,
+		opts:        opts,
+		offsetsFile: db.WALDir(opts.Stream) + ".kafka_" + opts.Topic + ".json",
+		stopCh:      make(chan interface{}),
+	}
+	err := c.loadOffsets()
+	if err != nil {
+		return nil, err
+	}
+
+	partitions, err := broker.Partitions(opts.Topic)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list partitions of %v: %v", opts.Topic, err)
+	}
+	err = c.reconcileOffsets(partitions)
+	if err != nil {
+		return nil, err
+	}
+	c.consumed = c.offsets.copy()
+	if syncInterval := db.WALSyncInterval(); syncInterval > 0 {
+		c.wg.Add(1)
+		go c.storeSyncedOffsets(syncInterval)
+	}
+	for _, partition := range partitions {
+		offset, found := c.offsets.Offsets[partition]
+		if !found {
+			offset = opts.InitialOffset
+		}
+		log.Debugf("Consuming partition %d of %v from offset %d into %v", partition, opts.Topic, offset, opts.Stream)
+		pc, err := broker.ConsumePartition(opts.Topic, partition, offset)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("Unable to consume partition %d of %v: %v", partition, opts.Topic, err)
+		}
+		c.consumers = append(c.consumers, pc)
+		c.wg.Add(1)
+		go c.consume(partition, pc)
+	}
+	return c, nil
+}
+
+// Close stops consuming, writing any points that have already been consumed to
+// the WAL.
+func (c *Consumer) Close() error {
+	close(c.stopCh)
+	c.wg.Wait()
+	var firstErr error
+	for _, pc := range c.consumers {
+		err := pc.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (c *Consumer) consume(partition int32, pc PartitionConsumer) {
+	defer c.wg.Done()
+
+	batch := make([]zenodb.Point, 0, c.opts.BatchSize)
+	nextOffset := int64(-1)
+	flushTimer := time.NewTimer(c.opts.FlushInterval)
+	defer flushTimer.Stop()
+
+	flush := func() bool {
+		flushTimer.Reset(c.opts.FlushInterval)
+		if nextOffset < 0 {
+			// Nothing consumed
+			return true
+		}
+		if len(batch) > 0 && !c.insert(partition, nextOffset, batch) {
+			return false
+		}
+		batch = batch[:0]
+		err := c.saveOffset(partition, nextOffset)
+		if err != nil {
+			log.Errorf("Unable to save offset for partition %d of %v: %v", partition, c.opts.Topic, err)
+		}
+		nextOffset = -1
+		return true
+	}
+
+	errors := pc.Errors()
+	for {
+		select {
+		case <-c.stopCh:
+			flush()
+			return
+		case msg, ok := <-pc.Messages():
+			if !ok {
+				flush()
+				return
+			}
+			points, err := c.decode(msg.Value)
+			if err != nil {
+				log.Errorf("Skipping invalid message at offset %d of partition %d of %v: %v", msg.Offset, partition, c.opts.Topic, err)
+			}
+			batch = append(batch, points...)
+			nextOffset = msg.Offset + 1
+			if len(batch) >= c.opts.BatchSize && !flush() {
+				return
+			}
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			log.Errorf("Error consuming partition %d of %v: %v", partition, c.opts.Topic, err)
+		case <-flushTimer.C:
+			if !flush() {
+				return
+			}
+		}
+	}
+}
+
+// insert inserts the given points along with the offset of the next message to
+// consume from their partition, retrying with backoff until it succeeds or the
+// Consumer is closed. It returns false if the points weren't inserted.
+func (c *Consumer) insert(partition int32, nextOffset int64, points []zenodb.Point) bool {
+	delay := minRetryDelay
+	for {
+		err := c.db.InsertBatchFrom(c.opts.Stream, c.source(partition), nextOffset, points)
+		if err == nil {
+			return true
+		}
+		log.Errorf("Unable to insert %d points from %v, will retry in %v: %v", len(points), c.opts.Topic, delay, err)
+		select {
+		case <-c.stopCh:
+			return false
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// point is the MsgPack representation of a point.
+type point struct {
+	Ts   int64                  `msgpack:"ts"`
+	Dims map[string]interface{} `msgpack:"dims"`
+	Vals map[string]float64     `msgpack:"vals"`
+}
+
+// decode decodes the points in a message.
+func (c *Consumer) decode(value []byte) ([]zenodb.Point, error) {
+	var points []zenodb.Point
+	if c.opts.Format == FormatMsgPack {
+		var mpoints []point
+		var err error
+		if len(value) > 0 && isMsgPackArray(value[0]) {
+			err = msgpack.Unmarshal(value, &mpoints)
+		} else {
+			mpoints = make([]point, 1)
+			err = msgpack.Unmarshal(value, &mpoints[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, mpoint := range mpoints {
+			p := zenodb.Point{Dims: mpoint.Dims, Vals: mpoint.Vals}
+			if mpoint.Ts != 0 {
+				p.Ts = time.Unix(0, mpoint.Ts*int64(time.Millisecond))
+			}
+			points = append(points, p)
+		}
+	} else {
+		var err error
+		value = bytes.TrimSpace(value)
+		if len(value) > 0 && value[0] == '[' {
+			err = json.Unmarshal(value, &points)
+		} else {
+			points = make([]zenodb.Point, 1)
+			err = json.Unmarshal(value, &points[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	for i := range points {
+		if len(points[i].Dims) == 0 || len(points[i].Vals) == 0 {
+			return nil, fmt.Errorf("Points need at least one dim and one val")
+		}
+		if points[i].Ts.IsZero() {
+			points[i].Ts = now
+		}
+	}
+	return points, nil
+}
+
+// isMsgPackArray indicates whether the given leading byte starts a MsgPack
+// array.
+func isMsgPackArray(b byte) bool {
+	return b&0xf0 == 0x90 || b == 0xdc || b == 0xdd
+}
+
+// source returns the name under which points from the given partition are
+// recorded in the WAL.
+func (c *Consumer) source(partition int32) string {
+	return fmt.Sprintf("kafka:%v:%d", c.opts.Topic, partition)
+}
+
+// storedOffsets is the content of the offsets file.
+type storedOffsets struct {
+	// Offsets are the offsets of the next messages to consume, keyed by
+	// partition.
+	Offsets map[int32]int64 `json:"offsets"`
+	// WALOffsets are the heads of the WAL at the time that the Offsets were
+	// recorded, keyed by partition. Later offsets can only be found in the WAL
+	// after these.
+	WALOffsets map[int32]wal.Offset `json:"walOffsets"`
+}
+
+// copy returns a copy of these offsets that can be modified independently.
+func (so *storedOffsets) copy() *storedOffsets {
+	result := &storedOffsets{
+		Offsets:    make(map[int32]int64, len(so.Offsets)),
+		WALOffsets: make(map[int32]wal.Offset, len(so.WALOffsets)),
+	}
+	for partition, offset := range so.Offsets {
+		result.Offsets[partition] = offset
+	}
+	for partition, walOffset := range so.WALOffsets {
+		result.WALOffsets[partition] = walOffset
+	}
+	return result
+}
+
+// loadOffsets loads the stored offsets.
+func (c *Consumer) loadOffsets() error {
+	c.offsets = &storedOffsets{
+		Offsets:    make(map[int32]int64),
+		WALOffsets: make(map[int32]wal.Offset),
+	}
+	b, err := ioutil.ReadFile(c.offsetsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read offsets: %v", err)
+	}
+	err = json.Unmarshal(b, c.offsets)
+	if err != nil {
+		return fmt.Errorf("Unable to parse offsets: %v", err)
+	}
+	return nil
+}
+
+// reconcileOffsets updates the loaded offsets of the given partitions with any
+// later offsets that were written to the WAL but weren't stored, and stores the
+// result along with the current head of the WAL.
+func (c *Consumer) reconcileOffsets(partitions []int32) error {
+	// Read from the earliest WAL offset stored for any partition, with nil
+	// meaning the beginning of the WAL. Partitions without a stored WAL offset
+	// haven't been consumed yet, since the WAL offsets of all partitions get
+	// stored on every start.
+	stored := false
+	var from wal.Offset
+	for _, partition := range partitions {
+		walOffset, found := c.offsets.WALOffsets[partition]
+		if !found {
+			continue
+		}
+		if !stored || (from != nil && (walOffset == nil || from.After(walOffset))) {
+			from = walOffset
+		}
+		stored = true
+	}
+	if !stored {
+		// Nothing consumed yet, only need the head
+		head, err := c.db.WALHead(c.opts.Stream)
+		if err != nil {
+			return fmt.Errorf("Unable to determine head of WAL: %v", err)
+		}
+		return c.storeHead(partitions, head)
+	}
+
+	positions, head, err := c.db.SourcePositions(c.opts.Stream, from)
+	if err != nil {
+		return fmt.Errorf("Unable to read offsets from WAL: %v", err)
+	}
+	for _, partition := range partitions {
+		position, found := positions[c.source(partition)]
+		if found && position > c.offsets.Offsets[partition] {
+			log.Debugf("Offset %d of partition %d of %v was written to WAL but not stored, resuming from there", position, partition, c.opts.Topic)
+			c.offsets.Offsets[partition] = position
+		}
+	}
+	return c.storeHead(partitions, head)
+}
+
+// storeHead records the given WAL head for all given partitions and stores the
+// offsets.
+func (c *Consumer) storeHead(partitions []int32, head wal.Offset) error {
+	c.offsetsMx.Lock()
+	defer c.offsetsMx.Unlock()
+	for _, partition := range partitions {
+		c.offsets.WALOffsets[partition] = head
+	}
+	return c.storeOffsets()
+}
+
+// saveOffset records the offset of the next message to consume from the given
+// partition, which has already been written to the WAL. If the WAL is synced
+// after every write, the offset is stored immediately, otherwise it's left to
+// storeSyncedOffsets.
+func (c *Consumer) saveOffset(partition int32, offset int64) error {
+	head, err := c.db.WALHead(c.opts.Stream)
+	if err != nil {
+		return fmt.Errorf("Unable to determine head of WAL: %v", err)
+	}
+	c.offsetsMx.Lock()
+	defer c.offsetsMx.Unlock()
+	c.consumed.Offsets[partition] = offset
+	c.consumed.WALOffsets[partition] = head
+	if c.db.WALSyncInterval() > 0 {
+		return nil
+	}
+	c.offsets = c.consumed.copy()
+	return c.storeOffsets()
+}
+
+// storeSyncedOffsets periodically stores the offsets that were consumed at
+// least two sync intervals ago, by which time the WAL has synced them to disk.
+// Offsets consumed more recently are recovered from the WAL by
+// reconcileOffsets if the Consumer is closed before they're stored.
+func (c *Consumer) storeSyncedOffsets(syncInterval time.Duration) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	var older, newer *storedOffsets
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+			c.offsetsMx.Lock()
+			if older != nil {
+				c.offsets = older
+				err := c.storeOffsets()
+				if err != nil {
+					log.Errorf("Unable to store offsets for %v: %v", c.opts.Topic, err)
+				}
+			}
+			older, newer = newer, c.consumed.copy()
+			c.offsetsMx.Unlock()
+		}
+	}
+}
+
+// storeOffsets writes the offsets to the offsets file. Callers must hold
+// offsetsMx.
+func (c *Consumer) storeOffsets() error {
+	b, err := json.Marshal(c.offsets)
+	if err != nil {
+		return fmt.Errorf("Unable to serialize offsets: %v", err)
+	}
+	dir := filepath.Dir(c.offsetsFile)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Unable to create directory for offsets: %v", err)
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(c.offsetsFile))
+	if err != nil {
+		return fmt.Errorf("Unable to create temp file for offsets: %v", err)
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Unable to write offsets: %v", err)
+	}
+	return os.Rename(tmp.Name(), c.offsetsFile)
+}
@@ -0,0 +1,188 @@
+package kafka
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"gopkg.in/vmihailenco/msgpack.v2"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsume(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbkafkatest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpFile, err := ioutil.TempFile("", "zenodbschema")
+	if !assert.NoError(t, err, "Unable to create temp file") {
+		return
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	schema := `
+kafka_test:
+  retentionperiod: 24h
+  sql: >
+    SELECT SUM(i) AS i
+    FROM inbound
+    GROUP BY *, period(1h)
+`
+	err = ioutil.WriteFile(tmpFile.Name(), []byte(schema), 0644)
+	if !assert.NoError(t, err, "Unable to write schema") {
+		return
+	}
+
+	db, err := zenodb.NewDB(&zenodb.DBOpts{
+		Dir:        tmpDir,
+		SchemaFile: tmpFile.Name(),
+	})
+	if !assert.NoError(t, err, "Unable to create DB") {
+		return
+	}
+	defer db.Close()
+
+	ts := time.Now().Format(time.RFC3339)
+	mp, _ := msgpack.Marshal(&point{Ts: time.Now().UnixNano() / int64(time.Millisecond), Dims: map[string]interface{}{"a": "x"}, Vals: map[string]float64{"i": 1}})
+	broker := &fakeBroker{
+		partitions: map[int32][][]byte{
+			0: {
+				[]byte(fmt.Sprintf(`{"ts": "%v", "dims": {"a": "x"}, "vals": {"i": 1}}`, ts)),
+				[]byte(`not json`),
+				[]byte(`[{"dims": {"a": "y"}, "vals": {"i": 2}}, {"dims": {"a": "z"}, "vals": {"i": 3}}]`),
+			},
+			1: {
+				[]byte(`{"dims": {"a": "x"}, "vals": {"i": 4}}`),
+			},
+		},
+	}
+
+	consume := func(format string) *Consumer {
+		c, err := Consume(db, broker, &Opts{
+			Topic:         "points",
+			Stream:        "inbound",
+			Format:        format,
+			FlushInterval: 50 * time.Millisecond,
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return c
+	}
+	insertedPoints := func() int64 {
+		time.Sleep(500 * time.Millisecond)
+		return db.TableStats("kafka_test").InsertedPoints
+	}
+
+	c := consume(FormatJSON)
+	assert.EqualValues(t, 4, insertedPoints(), "Valid points from all partitions should have been inserted")
+	assert.NoError(t, c.Close())
+	assert.Equal(t, map[int32]int64{0: OffsetOldest, 1: OffsetOldest}, broker.requestedOffsets())
+
+	c = consume(FormatJSON)
+	assert.EqualValues(t, 4, insertedPoints(), "Restarting shouldn't insert points again")
+	assert.NoError(t, c.Close())
+	assert.Equal(t, map[int32]int64{0: 3, 1: 1}, broker.requestedOffsets(), "Restarting should resume from stored offsets")
+
+	// Simulate crashing after a batch was written to the WAL but before its
+	// offset was stored
+	broker.append(0, []byte(`{"dims": {"a": "x"}, "vals": {"i": 5}}`))
+	crashed := &Consumer{db: db, opts: &Opts{Topic: "points", Stream: "inbound"}, stopCh: make(chan interface{})}
+	assert.True(t, crashed.insert(0, 4, []zenodb.Point{{Ts: time.Now(), Dims: map[string]interface{}{"a": "x"}, Vals: map[string]float64{"i": 5}}}))
+	c = consume(FormatJSON)
+	assert.EqualValues(t, 5, insertedPoints(), "Point written to WAL before crash shouldn't be inserted again")
+	assert.NoError(t, c.Close())
+	assert.Equal(t, map[int32]int64{0: 4, 1: 1}, broker.requestedOffsets(), "Restarting after crash should resume from offset in WAL")
+
+	broker.append(1, mp)
+	c = consume(FormatMsgPack)
+	assert.EqualValues(t, 6, insertedPoints(), "New MsgPack point should have been inserted")
+	assert.NoError(t, c.Close())
+
+	_, err = Consume(db, broker, &Opts{Topic: "points", Stream: "inbound", Format: "xml"})
+	assert.Error(t, err, "Unknown format should fail")
+}
+
+type fakeBroker struct {
+	partitions map[int32][][]byte
+	requested  map[int32]int64
+	mx         sync.Mutex
+}
+
+func (b *fakeBroker) Partitions(topic string) ([]int32, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	result := make([]int32, 0, len(b.partitions))
+	for partition := range b.partitions {
+		result = append(result, partition)
+	}
+	return result, nil
+}
+
+func (b *fakeBroker) ConsumePartition(topic string, partition int32, offset int64) (PartitionConsumer, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.requested == nil {
+		b.requested = make(map[int32]int64)
+	}
+	b.requested[partition] = offset
+	values := b.partitions[partition]
+	start := offset
+	switch offset {
+	case OffsetOldest:
+		start = 0
+	case OffsetNewest:
+		start = int64(len(values))
+	}
+	pc := &fakePartitionConsumer{
+		messages: make(chan *Message, len(values)),
+		errors:   make(chan error),
+	}
+	for i := start; i < int64(len(values)); i++ {
+		pc.messages <- &Message{Partition: partition, Offset: i, Value: values[i]}
+	}
+	return pc, nil
+}
+
+func (b *fakeBroker) append(partition int32, value []byte) {
+	b.mx.Lock()
+	b.partitions[partition] = append(b.partitions[partition], value)
+	b.mx.Unlock()
+}
+
+func (b *fakeBroker) requestedOffsets() map[int32]int64 {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	result := b.requested
+	b.requested = nil
+	return result
+}
+
+func (b *fakeBroker) Close() error {
+	return nil
+}
+
+type fakePartitionConsumer struct {
+	messages chan *Message
+	errors   chan error
+}
+
+func (pc *fakePartitionConsumer) Messages() <-chan *Message {
+	return pc.messages
+}
+
+func (pc *fakePartitionConsumer) Errors() <-chan error {
+	return pc.errors
+}
+
+func (pc *fakePartitionConsumer) Close() error {
+	return nil
+}
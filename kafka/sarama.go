@@ -0,0 +1,101 @@
+package kafka
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+)
+
+// NewBroker returns a Broker that connects to the given Kafka brokers.
+func NewBroker(addrs []string) (Broker, error) {
+	config := sarama.NewConfig()
+	config.Consumer.Return.Errors = true
+	client, err := sarama.NewClient(addrs, config)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to Kafka at %v: %v", addrs, err)
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("Unable to create Kafka consumer: %v", err)
+	}
+	return &saramaBroker{client, consumer}, nil
+}
+
+type saramaBroker struct {
+	client   sarama.Client
+	consumer sarama.Consumer
+}
+
+func (b *saramaBroker) Partitions(topic string) ([]int32, error) {
+	return b.client.Partitions(topic)
+}
+
+func (b *saramaBroker) ConsumePartition(topic string, partition int32, offset int64) (PartitionConsumer, error) {
+	pc, err := b.consumer.ConsumePartition(topic, partition, offset)
+	if err != nil {
+		return nil, err
+	}
+	spc := &saramaPartitionConsumer{
+		pc:       pc,
+		messages: make(chan *Message),
+		errors:   make(chan error),
+		closed:   make(chan interface{}),
+	}
+	go spc.convertMessages()
+	go spc.convertErrors()
+	return spc, nil
+}
+
+func (b *saramaBroker) Close() error {
+	err := b.consumer.Close()
+	closeErr := b.client.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// saramaPartitionConsumer adapts a sarama.PartitionConsumer to a
+// PartitionConsumer.
+type saramaPartitionConsumer struct {
+	pc       sarama.PartitionConsumer
+	messages chan *Message
+	errors   chan error
+	closed   chan interface{}
+}
+
+func (spc *saramaPartitionConsumer) convertMessages() {
+	defer close(spc.messages)
+	for msg := range spc.pc.Messages() {
+		select {
+		case spc.messages <- &Message{Partition: msg.Partition, Offset: msg.Offset, Value: msg.Value}:
+		case <-spc.closed:
+			return
+		}
+	}
+}
+
+func (spc *saramaPartitionConsumer) convertErrors() {
+	defer close(spc.errors)
+	for err := range spc.pc.Errors() {
+		select {
+		case spc.errors <- err:
+		case <-spc.closed:
+			return
+		}
+	}
+}
+
+func (spc *saramaPartitionConsumer) Messages() <-chan *Message {
+	return spc.messages
+}
+
+func (spc *saramaPartitionConsumer) Errors() <-chan error {
+	return spc.errors
+}
+
+func (spc *saramaPartitionConsumer) Close() error {
+	close(spc.closed)
+	return spc.pc.Close()
+}
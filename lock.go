@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+package zenodb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockDir takes an exclusive lock on the database directory so that only one
+// process at a time (e.g. zeno and zeno import) can open it. The lock is
+// released when the returned file is closed or when the process exits, so a
+// crashed process doesn't leave the directory locked.
+func lockDir(dir string) (*os.File, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create directory %v: %v", dir, err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open lock file: %v", err)
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return nil, fmt.Errorf("Database at %v is already in use by another process", dir)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to lock database directory: %v", err)
+	}
+	return file, nil
+}
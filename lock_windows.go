@@ -0,0 +1,22 @@
+package zenodb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockDir creates the lock file but doesn't lock it, since there's no flock on
+// Windows. Users have to make sure that only one process opens the database.
+func lockDir(dir string) (*os.File, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create directory %v: %v", dir, err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open lock file: %v", err)
+	}
+	log.Debug("Not locking database directory on Windows")
+	return file, nil
+}
@@ -0,0 +1,93 @@
+package parquet
+
+import (
+	"encoding/binary"
+)
+
+// Thrift compact protocol types, as used by Parquet's metadata
+const (
+	compactI32        = 5
+	compactI64        = 6
+	compactBinary     = 8
+	compactList       = 9
+	compactStructType = 12
+)
+
+// compactStruct encodes a struct using the Thrift compact protocol. Fields
+// must be added in ascending order of their ids.
+type compactStruct struct {
+	buf       []byte
+	lastField int
+}
+
+func (s *compactStruct) fieldHeader(id int, typ byte) {
+	delta := id - s.lastField
+	if delta > 0 && delta <= 15 {
+		s.buf = append(s.buf, byte(delta)<<4|typ)
+	} else {
+		s.buf = append(s.buf, typ)
+		s.buf = appendUvarint(s.buf, zigzag(int64(id)))
+	}
+	s.lastField = id
+}
+
+func (s *compactStruct) i32(id int, v int32) {
+	s.fieldHeader(id, compactI32)
+	s.buf = appendUvarint(s.buf, zigzag(int64(v)))
+}
+
+func (s *compactStruct) i64(id int, v int64) {
+	s.fieldHeader(id, compactI64)
+	s.buf = appendUvarint(s.buf, zigzag(v))
+}
+
+func (s *compactStruct) binary(id int, v []byte) {
+	s.fieldHeader(id, compactBinary)
+	s.buf = append(s.buf, encodeBinary(v)...)
+}
+
+// strct adds a nested struct that was encoded with bytes().
+func (s *compactStruct) strct(id int, v []byte) {
+	s.fieldHeader(id, compactStructType)
+	s.buf = append(s.buf, v...)
+}
+
+// list adds a list of already encoded elements of the given type.
+func (s *compactStruct) list(id int, elemType byte, elems [][]byte) {
+	s.fieldHeader(id, compactList)
+	if len(elems) < 15 {
+		s.buf = append(s.buf, byte(len(elems))<<4|elemType)
+	} else {
+		s.buf = append(s.buf, 0xf0|elemType)
+		s.buf = appendUvarint(s.buf, uint64(len(elems)))
+	}
+	for _, elem := range elems {
+		s.buf = append(s.buf, elem...)
+	}
+}
+
+// bytes returns the encoded struct, including the stop field.
+func (s *compactStruct) bytes() []byte {
+	return append(s.buf, 0)
+}
+
+func encodeBinary(v []byte) []byte {
+	return append(appendUvarint(nil, uint64(len(v))), v...)
+}
+
+func encodeI32s(vs ...int32) [][]byte {
+	result := make([][]byte, 0, len(vs))
+	for _, v := range vs {
+		result = append(result, appendUvarint(nil, zigzag(int64(v))))
+	}
+	return result
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return append(buf, b[:binary.PutUvarint(b, v)]...)
+}
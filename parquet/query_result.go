@@ -0,0 +1,211 @@
+package parquet
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/getlantern/zenodb"
+)
+
+// WriteQueryResult writes the rows returned by nextRow (until it returns
+// io.EOF) to out as a Parquet file. The file has a time column holding the
+// start of each row's period, one column per dimension in result.GroupBy and
+// one float64 column per field. Dimension columns are typed based on their
+// values (bool, int64, float64, timestamp or string), with dimensions that mix
+// types being written as strings. For crosstab queries, the field columns hold
+// the totals and each populated crosstab column is written as
+// <field>_<crosstab dim>. Column names that would be duplicated get a numeric
+// suffix.
+//
+// Only the first row group (DefaultRowGroupSize rows) is held in memory to
+// figure out the types of dimensions, the remaining rows are streamed. If a
+// later row has a dimension value that doesn't fit the type inferred from the
+// first row group (e.g. a string in a column of ints), WriteQueryResult fails.
+func WriteQueryResult(out io.Writer, result *zenodb.QueryResult, nextRow func() (*zenodb.Row, error)) error {
+	return writeQueryResult(out, result, nextRow, DefaultRowGroupSize)
+}
+
+func writeQueryResult(out io.Writer, result *zenodb.QueryResult, nextRow func() (*zenodb.Row, error), rowGroupSize int) error {
+	// Read the first row group so that we can figure out the types of
+	// dimensions
+	var rows []*zenodb.Row
+	eof := false
+	for len(rows) < rowGroupSize {
+		row, err := nextRow()
+		if err == io.EOF {
+			eof = true
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to get next row: %v", err)
+		}
+		rows = append(rows, row)
+	}
+
+	names := make(map[string]bool)
+	column := func(name string, typ Type, optional bool) Column {
+		unique := name
+		for i := 2; names[unique]; i++ {
+			unique = fmt.Sprintf("%v_%d", name, i)
+		}
+		names[unique] = true
+		return Column{Name: unique, Type: typ, Optional: optional}
+	}
+	columns := make([]Column, 0, 1+len(result.GroupBy)+len(result.FieldNames))
+	columns = append(columns, column("time", Timestamp, false))
+	for i, dim := range result.GroupBy {
+		columns = append(columns, column(dim, dimType(rows, i), true))
+	}
+	for _, fieldName := range result.FieldNames {
+		columns = append(columns, column(fieldName, Double, false))
+	}
+	if result.IsCrosstab {
+		for i, crosstabDim := range result.CrosstabDims {
+			for j, fieldName := range result.FieldNames {
+				if result.PopulatedColumns[i*len(result.FieldNames)+j] {
+					columns = append(columns, column(fmt.Sprintf("%v_%v", fieldName, nilToDash(crosstabDim)), Double, false))
+				}
+			}
+		}
+	}
+
+	w := NewWriter(out, columns)
+	w.RowGroupSize = rowGroupSize
+	values := make([]interface{}, 0, len(columns))
+	write := func(row *zenodb.Row) error {
+		values = values[:0]
+		values = append(values, result.Until.Add(-1*result.Resolution*time.Duration(row.Period)))
+		for i, dim := range row.Dims {
+			values = append(values, dimValue(columns[1+i].Type, dim))
+		}
+		fieldValues := row.Values
+		if result.IsCrosstab {
+			fieldValues = row.Totals
+		}
+		for i := range result.FieldNames {
+			values = append(values, fieldValues[i])
+		}
+		if result.IsCrosstab {
+			for idx, populated := range result.PopulatedColumns {
+				if populated {
+					values = append(values, row.Values[idx])
+				}
+			}
+		}
+		return w.Write(values)
+	}
+
+	for _, row := range rows {
+		err := write(row)
+		if err != nil {
+			return err
+		}
+	}
+	rows = nil
+	for !eof {
+		row, err := nextRow()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to get next row: %v", err)
+		}
+		err = write(row)
+		if err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// nilToDash formats nil crosstab dimensions the same way as zeno-cli.
+func nilToDash(val interface{}) interface{} {
+	if val == nil {
+		return "-----"
+	}
+	return val
+}
+
+// dimType determines the column type for the dimension at the given index.
+func dimType(rows []*zenodb.Row, idx int) Type {
+	typ := Type(-1)
+	for _, row := range rows {
+		var valueType Type
+		switch row.Dims[idx].(type) {
+		case nil:
+			continue
+		case bool:
+			valueType = Boolean
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			valueType = Int64
+		case float32, float64:
+			valueType = Double
+		case time.Time:
+			valueType = Timestamp
+		default:
+			return String
+		}
+		switch {
+		case typ == -1 || typ == valueType:
+			typ = valueType
+		case (typ == Int64 && valueType == Double) || (typ == Double && valueType == Int64):
+			typ = Double
+		default:
+			return String
+		}
+	}
+	if typ == -1 {
+		return String
+	}
+	return typ
+}
+
+// dimValue converts a dimension value to the given column type.
+func dimValue(typ Type, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	switch typ {
+	case Int64:
+		switch v := value.(type) {
+		case int:
+			return int64(v)
+		case int8:
+			return int64(v)
+		case int16:
+			return int64(v)
+		case int32:
+			return int64(v)
+		case int64:
+			return v
+		case uint:
+			return int64(v)
+		case uint8:
+			return int64(v)
+		case uint16:
+			return int64(v)
+		case uint32:
+			return int64(v)
+		case uint64:
+			return int64(v)
+		}
+	case Double:
+		switch v := value.(type) {
+		case float32:
+			return float64(v)
+		case float64:
+			return v
+		default:
+			if i, ok := dimValue(Int64, v).(int64); ok {
+				return float64(i)
+			}
+		}
+	case String:
+		if s, ok := value.(string); ok {
+			return s
+		}
+		return fmt.Sprint(value)
+	}
+	return value
+}
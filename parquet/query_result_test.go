@@ -0,0 +1,154 @@
+package parquet
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "Set this to update the golden files in testdata")
+
+func TestWriteQueryResult(t *testing.T) {
+	until := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+	result := &zenodb.QueryResult{
+		Until:            until,
+		Resolution:       time.Hour,
+		FieldNames:       []string{"load"},
+		GroupBy:          []string{"server", "port"},
+		IsCrosstab:       true,
+		CrosstabDims:     []interface{}{"us", "eu"},
+		PopulatedColumns: []bool{true, false},
+	}
+	nextRow := rowsOf(
+		&zenodb.Row{Period: 0, Dims: []interface{}{"a", 80}, Values: []float64{0.5, 0}, Totals: []float64{0.5}},
+		&zenodb.Row{Period: 1, Dims: []interface{}{nil, 8080.5}, Values: []float64{1.5, 0}, Totals: []float64{2.5}},
+	)
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, WriteQueryResult(&buf, result, nextRow)) {
+		return
+	}
+	b := buf.Bytes()
+
+	// The golden file is verified independently with testdata/verify_golden.py
+	golden := filepath.Join("testdata", "query_result.parquet")
+	if *update {
+		if !assert.NoError(t, ioutil.WriteFile(golden, b, 0644)) {
+			return
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, b, "Output doesn't match %v, if that's intended, run with -update and check the result with testdata/verify_golden.py", golden)
+	}
+
+	meta, err := readFooter(b)
+	if !assert.NoError(t, err) {
+		return
+	}
+	columns := []Column{
+		{Name: "time", Type: Timestamp},
+		{Name: "server", Type: String, Optional: true},
+		{Name: "port", Type: Double, Optional: true},
+		{Name: "load", Type: Double},
+		{Name: "load_us", Type: Double},
+	}
+	schema := meta[2].([]interface{})
+	if !assert.Len(t, schema, 1+len(columns)) {
+		return
+	}
+	for i, column := range columns {
+		element := schema[i+1].(map[int]interface{})
+		assert.Equal(t, column.Name, string(element[4].([]byte)))
+		assert.EqualValues(t, column.physicalType(), element[1], "Type of %v", column.Name)
+	}
+	read, err := readValues(b, meta, columns)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, until.Equal(read[0][0].(time.Time)), "Time should be based on period")
+	assert.True(t, until.Add(-1*time.Hour).Equal(read[0][1].(time.Time)), "Time should be based on period")
+	assert.Equal(t, []interface{}{"a", nil}, read[1])
+	assert.Equal(t, []interface{}{float64(80), 8080.5}, read[2], "Mixed int and float dimension should be written as double")
+	assert.Equal(t, []interface{}{0.5, 2.5}, read[3], "Field should hold totals")
+	assert.Equal(t, []interface{}{0.5, 1.5}, read[4], "Only populated crosstab columns should be written")
+}
+
+func TestWriteQueryResultColumnNames(t *testing.T) {
+	result := &zenodb.QueryResult{
+		FieldNames:       []string{"load"},
+		GroupBy:          []string{"time"},
+		IsCrosstab:       true,
+		CrosstabDims:     []interface{}{nil, 1, "1"},
+		PopulatedColumns: []bool{true, true, true},
+	}
+	var buf bytes.Buffer
+	if !assert.NoError(t, WriteQueryResult(&buf, result, rowsOf())) {
+		return
+	}
+	meta, err := readFooter(buf.Bytes())
+	if !assert.NoError(t, err) {
+		return
+	}
+	var names []string
+	for _, element := range meta[2].([]interface{})[1:] {
+		names = append(names, string(element.(map[int]interface{})[4].([]byte)))
+	}
+	assert.Equal(t, []string{"time", "time_2", "load", "load_-----", "load_1", "load_1_2"}, names)
+}
+
+func TestWriteQueryResultStreaming(t *testing.T) {
+	result := &zenodb.QueryResult{
+		Until:      time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC),
+		Resolution: time.Hour,
+		FieldNames: []string{"load"},
+		GroupBy:    []string{"port"},
+	}
+	var buf bytes.Buffer
+	err := writeQueryResult(&buf, result, rowsOf(
+		&zenodb.Row{Dims: []interface{}{80}, Values: []float64{1}},
+		&zenodb.Row{Dims: []interface{}{nil}, Values: []float64{2}},
+		&zenodb.Row{Dims: []interface{}{443}, Values: []float64{3}},
+	), 2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := buf.Bytes()
+	meta, err := readFooter(b)
+	if !assert.NoError(t, err) {
+		return
+	}
+	read, err := readValues(b, meta, []Column{
+		{Name: "time", Type: Timestamp},
+		{Name: "port", Type: Int64, Optional: true},
+		{Name: "load", Type: Double},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []interface{}{int64(80), nil, int64(443)}, read[1], "Rows after the first row group should be written")
+		assert.Equal(t, []interface{}{1.0, 2.0, 3.0}, read[2])
+	}
+
+	err = writeQueryResult(&bytes.Buffer{}, result, rowsOf(
+		&zenodb.Row{Dims: []interface{}{80}, Values: []float64{1}},
+		&zenodb.Row{Dims: []interface{}{"https"}, Values: []float64{2}},
+	), 1)
+	assert.Error(t, err, "Value that doesn't fit the type inferred from the first row group should fail")
+}
+
+func rowsOf(rows ...*zenodb.Row) func() (*zenodb.Row, error) {
+	return func() (*zenodb.Row, error) {
+		if len(rows) == 0 {
+			return nil, io.EOF
+		}
+		row := rows[0]
+		rows = rows[1:]
+		return row, nil
+	}
+}
@@ -0,0 +1,33 @@
+#!/usr/bin/env python
+"""Verifies that query_result.parquet can be read by pyarrow and holds what
+TestWriteQueryResult wrote, independently of our own reader.
+
+Run this after regenerating the golden file with go test -update:
+
+    pip install pyarrow
+    python testdata/verify_golden.py
+"""
+
+import os
+
+import pyarrow as pa
+import pyarrow.parquet as pq
+
+golden = os.path.join(os.path.dirname(os.path.abspath(__file__)), "query_result.parquet")
+table = pq.read_table(golden)
+
+assert table.column_names == ["time", "server", "port", "load", "load_us"], table.column_names
+assert pa.types.is_timestamp(table.schema.field("time").type), table.schema
+assert pa.types.is_string(table.schema.field("server").type), table.schema
+for name in ["port", "load", "load_us"]:
+    assert pa.types.is_float64(table.schema.field(name).type), table.schema
+
+until = 1475323200000  # 2016-10-01T12:00:00Z in milliseconds
+rows = table.to_pydict()
+assert table.column("time").cast(pa.timestamp("ms")).cast(pa.int64()).to_pylist() == [until, until - 3600000], rows["time"]
+assert rows["server"] == ["a", None], rows["server"]
+assert rows["port"] == [80.0, 8080.5], rows["port"]
+assert rows["load"] == [0.5, 2.5], rows["load"]
+assert rows["load_us"] == [0.5, 1.5], rows["load_us"]
+
+print("%s is valid" % golden)
@@ -0,0 +1,350 @@
+// Package parquet writes query results to Apache Parquet files, which can be
+// loaded into tools like pandas and Spark.
+//
+// It implements just enough of the format to write flat files: each column is
+// written as a single snappy-compressed, PLAIN-encoded data page per row group.
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// Type is the type of a column.
+type Type int
+
+const (
+	// Boolean columns hold bools
+	Boolean Type = iota
+	// Int64 columns hold int64s
+	Int64
+	// Double columns hold float64s
+	Double
+	// String columns hold strings
+	String
+	// Timestamp columns hold time.Times, stored with millisecond precision
+	Timestamp
+)
+
+const (
+	// DefaultRowGroupSize is the default number of rows per row group
+	DefaultRowGroupSize = 64 * 1024
+
+	magic     = "PAR1"
+	createdBy = "zenodb"
+
+	// Physical types
+	typeBoolean   = 0
+	typeInt64     = 2
+	typeDouble    = 5
+	typeByteArray = 6
+
+	// Converted types
+	convertedUTF8            = 0
+	convertedTimestampMillis = 9
+
+	// Repetition types
+	repetitionRequired = 0
+	repetitionOptional = 1
+
+	// Encodings
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	codecSnappy  = 1
+	pageTypeData = 0
+)
+
+// Column describes a column.
+type Column struct {
+	Name string
+	Type Type
+	// Optional columns may hold nil values
+	Optional bool
+}
+
+func (c *Column) physicalType() int32 {
+	switch c.Type {
+	case Boolean:
+		return typeBoolean
+	case Int64, Timestamp:
+		return typeInt64
+	case Double:
+		return typeDouble
+	default:
+		return typeByteArray
+	}
+}
+
+// Writer writes rows to a Parquet file. Rows are buffered in memory until
+// RowGroupSize rows have been written, at which point they are written out as
+// a row group. Close must be called to write the final row group and the file
+// footer.
+type Writer struct {
+	// RowGroupSize is the number of rows per row group, defaults to
+	// DefaultRowGroupSize.
+	RowGroupSize int
+
+	out       io.Writer
+	offset    int64
+	columns   []Column
+	values    [][]interface{}
+	rowGroups [][]byte
+	numRows   int64
+	started   bool
+}
+
+// NewWriter creates a Writer that writes the given columns to out.
+func NewWriter(out io.Writer, columns []Column) *Writer {
+	return &Writer{
+		RowGroupSize: DefaultRowGroupSize,
+		out:          out,
+		columns:      columns,
+		values:       make([][]interface{}, len(columns)),
+	}
+}
+
+// Write writes a row, which must hold one value per column. Values must match
+// their column's Type, and may only be nil for Optional columns.
+func (w *Writer) Write(row []interface{}) error {
+	if len(row) != len(w.columns) {
+		return fmt.Errorf("Expected %d values, got %d", len(w.columns), len(row))
+	}
+	for i, value := range row {
+		column := &w.columns[i]
+		ok := false
+		switch value.(type) {
+		case nil:
+			ok = column.Optional
+		case bool:
+			ok = column.Type == Boolean
+		case int64:
+			ok = column.Type == Int64
+		case float64:
+			ok = column.Type == Double
+		case string:
+			ok = column.Type == String
+		case time.Time:
+			ok = column.Type == Timestamp
+		}
+		if !ok {
+			return fmt.Errorf("Invalid value %v for column %v", value, column.Name)
+		}
+	}
+	for i, value := range row {
+		w.values[i] = append(w.values[i], value)
+	}
+	if len(w.values[0]) >= w.RowGroupSize {
+		return w.flushRowGroup()
+	}
+	return nil
+}
+
+// Close writes any buffered rows and the file footer. It doesn't close the
+// underlying io.Writer.
+func (w *Writer) Close() error {
+	if len(w.columns) > 0 && len(w.values[0]) > 0 {
+		err := w.flushRowGroup()
+		if err != nil {
+			return err
+		}
+	}
+	err := w.start()
+	if err != nil {
+		return err
+	}
+	footer := w.fileMetaData()
+	footerLength := make([]byte, 4)
+	binary.LittleEndian.PutUint32(footerLength, uint32(len(footer)))
+	return w.write(footer, footerLength, []byte(magic))
+}
+
+func (w *Writer) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	return w.write([]byte(magic))
+}
+
+func (w *Writer) write(bufs ...[]byte) error {
+	for _, buf := range bufs {
+		n, err := w.out.Write(buf)
+		w.offset += int64(n)
+		if err != nil {
+			return fmt.Errorf("Unable to write parquet file: %v", err)
+		}
+	}
+	return nil
+}
+
+func (w *Writer) flushRowGroup() error {
+	err := w.start()
+	if err != nil {
+		return err
+	}
+	numRows := int64(len(w.values[0]))
+	chunks := make([][]byte, 0, len(w.columns))
+	totalSize := int64(0)
+	for i := range w.columns {
+		column := &w.columns[i]
+		data := encodeValues(column, w.values[i])
+		compressed := snappy.Encode(nil, data)
+
+		var dataPageHeader compactStruct
+		dataPageHeader.i32(1, int32(numRows))
+		dataPageHeader.i32(2, encodingPlain)
+		dataPageHeader.i32(3, encodingRLE)
+		dataPageHeader.i32(4, encodingRLE)
+		var pageHeader compactStruct
+		pageHeader.i32(1, pageTypeData)
+		pageHeader.i32(2, int32(len(data)))
+		pageHeader.i32(3, int32(len(compressed)))
+		pageHeader.strct(5, dataPageHeader.bytes())
+		header := pageHeader.bytes()
+
+		chunkOffset := w.offset
+		err := w.write(header, compressed)
+		if err != nil {
+			return err
+		}
+		uncompressedSize := int64(len(header) + len(data))
+		totalSize += uncompressedSize
+
+		var meta compactStruct
+		meta.i32(1, column.physicalType())
+		meta.list(2, compactI32, encodeI32s(encodingPlain, encodingRLE))
+		meta.list(3, compactBinary, [][]byte{encodeBinary([]byte(column.Name))})
+		meta.i32(4, codecSnappy)
+		meta.i64(5, numRows)
+		meta.i64(6, uncompressedSize)
+		meta.i64(7, int64(len(header)+len(compressed)))
+		meta.i64(9, chunkOffset)
+		var chunk compactStruct
+		chunk.i64(2, chunkOffset)
+		chunk.strct(3, meta.bytes())
+		chunks = append(chunks, chunk.bytes())
+		w.values[i] = w.values[i][:0]
+	}
+
+	var rowGroup compactStruct
+	rowGroup.list(1, compactStructType, chunks)
+	rowGroup.i64(2, totalSize)
+	rowGroup.i64(3, numRows)
+	w.rowGroups = append(w.rowGroups, rowGroup.bytes())
+	w.numRows += numRows
+	return nil
+}
+
+func (w *Writer) fileMetaData() []byte {
+	schema := make([][]byte, 0, 1+len(w.columns))
+	var root compactStruct
+	root.binary(4, []byte("schema"))
+	root.i32(5, int32(len(w.columns)))
+	schema = append(schema, root.bytes())
+	for i := range w.columns {
+		column := &w.columns[i]
+		var element compactStruct
+		element.i32(1, column.physicalType())
+		repetition := int32(repetitionRequired)
+		if column.Optional {
+			repetition = repetitionOptional
+		}
+		element.i32(3, repetition)
+		element.binary(4, []byte(column.Name))
+		switch column.Type {
+		case String:
+			element.i32(6, convertedUTF8)
+		case Timestamp:
+			element.i32(6, convertedTimestampMillis)
+		}
+		schema = append(schema, element.bytes())
+	}
+
+	var meta compactStruct
+	meta.i32(1, 1)
+	meta.list(2, compactStructType, schema)
+	meta.i64(3, w.numRows)
+	meta.list(4, compactStructType, w.rowGroups)
+	meta.binary(6, []byte(createdBy))
+	return meta.bytes()
+}
+
+// encodeValues encodes the definition levels (for optional columns) and the
+// PLAIN-encoded non-nil values of a column.
+func encodeValues(column *Column, values []interface{}) []byte {
+	var buf bytes.Buffer
+	if column.Optional {
+		levels := encodeDefinitionLevels(values)
+		length := make([]byte, 4)
+		binary.LittleEndian.PutUint32(length, uint32(len(levels)))
+		buf.Write(length)
+		buf.Write(levels)
+	}
+
+	if column.Type == Boolean {
+		var bits []byte
+		i := 0
+		for _, value := range values {
+			if value == nil {
+				continue
+			}
+			if i%8 == 0 {
+				bits = append(bits, 0)
+			}
+			if value.(bool) {
+				bits[i/8] |= 1 << uint(i%8)
+			}
+			i++
+		}
+		buf.Write(bits)
+		return buf.Bytes()
+	}
+
+	b := make([]byte, 8)
+	for _, value := range values {
+		switch v := value.(type) {
+		case int64:
+			binary.LittleEndian.PutUint64(b, uint64(v))
+			buf.Write(b)
+		case float64:
+			binary.LittleEndian.PutUint64(b, math.Float64bits(v))
+			buf.Write(b)
+		case time.Time:
+			binary.LittleEndian.PutUint64(b, uint64(v.UnixNano()/int64(time.Millisecond)))
+			buf.Write(b)
+		case string:
+			binary.LittleEndian.PutUint32(b, uint32(len(v)))
+			buf.Write(b[:4])
+			buf.WriteString(v)
+		}
+	}
+	return buf.Bytes()
+}
+
+// encodeDefinitionLevels encodes definition levels (1 for present values, 0
+// for nils) using runs of the RLE/bit-packing hybrid encoding with a bit width
+// of 1.
+func encodeDefinitionLevels(values []interface{}) []byte {
+	var buf []byte
+	for i := 0; i < len(values); {
+		level := byte(0)
+		if values[i] != nil {
+			level = 1
+		}
+		run := 1
+		for i+run < len(values) && (values[i+run] != nil) == (level == 1) {
+			run++
+		}
+		buf = appendUvarint(buf, uint64(run)<<1)
+		buf = append(buf, level)
+		i += run
+	}
+	return buf
+}
@@ -0,0 +1,235 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter(t *testing.T) {
+	ts := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+	columns := []Column{
+		{Name: "time", Type: Timestamp},
+		{Name: "server", Type: String, Optional: true},
+		{Name: "up", Type: Boolean, Optional: true},
+		{Name: "port", Type: Int64, Optional: true},
+		{Name: "load", Type: Double},
+	}
+	rows := [][]interface{}{
+		{ts, "a", true, int64(80), 0.5},
+		{ts.Add(time.Hour), nil, false, nil, 1.5},
+		{ts.Add(2 * time.Hour), "c", nil, int64(443), 2.5},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf, columns)
+	w.RowGroupSize = 2
+	for _, row := range rows {
+		if !assert.NoError(t, w.Write(row)) {
+			return
+		}
+	}
+	assert.Error(t, w.Write([]interface{}{ts, nil, nil, nil, nil}), "nil in required column should fail")
+	assert.Error(t, w.Write([]interface{}{ts, 5, nil, nil, 1.0}), "wrong type should fail")
+	if !assert.NoError(t, w.Close()) {
+		return
+	}
+
+	b := buf.Bytes()
+	meta, err := readFooter(b)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 3, meta[3], "num_rows")
+	schema := meta[2].([]interface{})
+	if assert.Len(t, schema, 1+len(columns)) {
+		for i, column := range columns {
+			element := schema[i+1].(map[int]interface{})
+			assert.Equal(t, column.Name, string(element[4].([]byte)))
+			assert.EqualValues(t, column.physicalType(), element[1])
+		}
+	}
+
+	// Read back all values
+	if !assert.Len(t, meta[4].([]interface{}), 2) {
+		return
+	}
+	read, err := readValues(b, meta, columns)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for i, row := range rows {
+		for j, expected := range row {
+			if e, ok := expected.(time.Time); ok {
+				assert.True(t, e.Equal(read[j][i].(time.Time)), "row %d column %d", i, j)
+			} else {
+				assert.Equal(t, expected, read[j][i], "row %d column %d", i, j)
+			}
+		}
+	}
+}
+
+// readFooter checks the magic numbers of the given file and decodes its
+// FileMetaData.
+func readFooter(b []byte) (map[int]interface{}, error) {
+	if len(b) < 12 || string(b[:4]) != magic || string(b[len(b)-4:]) != magic {
+		return nil, fmt.Errorf("Missing magic number")
+	}
+	footerLength := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	meta, _, err := readStruct(b[len(b)-8-footerLength : len(b)-8])
+	return meta, err
+}
+
+// readValues reads back the values of all columns from all row groups of the
+// given file, by column.
+func readValues(b []byte, meta map[int]interface{}, columns []Column) ([][]interface{}, error) {
+	read := make([][]interface{}, len(columns))
+	for _, rg := range meta[4].([]interface{}) {
+		chunks := rg.(map[int]interface{})[1].([]interface{})
+		numRows := int(rg.(map[int]interface{})[3].(int64))
+		for i, chunk := range chunks {
+			cmeta := chunk.(map[int]interface{})[3].(map[int]interface{})
+			offset := cmeta[9].(int64)
+			header, n, err := readStruct(b[offset:])
+			if err != nil {
+				return nil, err
+			}
+			data, err := snappy.Decode(nil, b[int(offset)+n:int(offset)+n+int(header[3].(int64))])
+			if err != nil {
+				return nil, err
+			}
+			if len(data) != int(header[2].(int64)) {
+				return nil, fmt.Errorf("Expected %d bytes of data, got %d", header[2], len(data))
+			}
+			read[i] = append(read[i], decodeValues(&columns[i], data, numRows)...)
+		}
+	}
+	return read, nil
+}
+
+// decodeValues decodes a data page written by encodeValues.
+func decodeValues(column *Column, data []byte, numRows int) []interface{} {
+	present := make([]bool, numRows)
+	if column.Optional {
+		length := binary.LittleEndian.Uint32(data)
+		levels := data[4 : 4+length]
+		data = data[4+length:]
+		i := 0
+		for len(levels) > 0 {
+			header, n := binary.Uvarint(levels)
+			run := int(header >> 1)
+			for j := 0; j < run; j++ {
+				present[i] = levels[n] == 1
+				i++
+			}
+			levels = levels[n+1:]
+		}
+	} else {
+		for i := range present {
+			present[i] = true
+		}
+	}
+
+	values := make([]interface{}, 0, numRows)
+	bit := 0
+	for _, p := range present {
+		if !p {
+			values = append(values, nil)
+			continue
+		}
+		switch column.Type {
+		case Boolean:
+			values = append(values, data[bit/8]&(1<<uint(bit%8)) != 0)
+			bit++
+		case Int64:
+			values = append(values, int64(binary.LittleEndian.Uint64(data)))
+			data = data[8:]
+		case Timestamp:
+			values = append(values, time.Unix(0, int64(binary.LittleEndian.Uint64(data))*int64(time.Millisecond)))
+			data = data[8:]
+		case Double:
+			values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(data)))
+			data = data[8:]
+		case String:
+			length := binary.LittleEndian.Uint32(data)
+			values = append(values, string(data[4:4+length]))
+			data = data[4+length:]
+		}
+	}
+	return values
+}
+
+// readStruct decodes a Thrift compact struct into a map of field ids to values
+// and returns the number of bytes read.
+func readStruct(b []byte) (map[int]interface{}, int, error) {
+	result := make(map[int]interface{})
+	pos := 0
+	lastField := 0
+	for {
+		if pos >= len(b) {
+			return nil, 0, fmt.Errorf("Truncated struct")
+		}
+		header := b[pos]
+		pos++
+		if header == 0 {
+			return result, pos, nil
+		}
+		typ := header & 0x0f
+		if delta := int(header >> 4); delta != 0 {
+			lastField += delta
+		} else {
+			id, n := binary.Uvarint(b[pos:])
+			pos += n
+			lastField = int(unzigzag(id))
+		}
+		value, n, err := readValue(b[pos:], typ)
+		if err != nil {
+			return nil, 0, err
+		}
+		pos += n
+		result[lastField] = value
+	}
+}
+
+func readValue(b []byte, typ byte) (interface{}, int, error) {
+	switch typ {
+	case compactI32, compactI64:
+		v, n := binary.Uvarint(b)
+		return unzigzag(v), n, nil
+	case compactBinary:
+		length, n := binary.Uvarint(b)
+		return b[n : n+int(length)], n + int(length), nil
+	case compactStructType:
+		return readStruct(b)
+	case compactList:
+		size := int(b[0] >> 4)
+		elemType := b[0] & 0x0f
+		pos := 1
+		if size == 15 {
+			s, n := binary.Uvarint(b[pos:])
+			size = int(s)
+			pos += n
+		}
+		list := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			value, n, err := readValue(b[pos:], elemType)
+			if err != nil {
+				return nil, 0, err
+			}
+			pos += n
+			list = append(list, value)
+		}
+		return list, pos, nil
+	}
+	return nil, 0, fmt.Errorf("Unsupported type %d", typ)
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
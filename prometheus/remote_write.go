@@ -0,0 +1,187 @@
+// Package prometheus decodes Prometheus remote_write requests into points that
+// can be inserted into zenodb.
+//
+// A remote_write request is a snappy-compressed protocol buffer containing a
+// WriteRequest. Each of its time series becomes a series of points, one per
+// sample, whose dimensions are the series' labels (except for __name__) and
+// which have a single value named after the series' __name__ label.
+package prometheus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"github.com/golang/snappy"
+)
+
+const (
+	// NameLabel is the label that holds the name of a metric.
+	NameLabel = "__name__"
+
+	// MaxBodySize is the maximum size of a request, both compressed and
+	// decompressed.
+	MaxBodySize = 32 * 1024 * 1024
+
+	wireVarint = 0
+	wire64bit  = 1
+	wireBytes  = 2
+	wire32bit  = 5
+)
+
+// DecodeWriteRequest decodes the given snappy-compressed WriteRequest into
+// points. Samples that are NaN (e.g. staleness markers) and series without a
+// __name__ label are skipped.
+func DecodeWriteRequest(compressed []byte) ([]zenodb.Point, error) {
+	length, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress request: %v", err)
+	}
+	if length > MaxBodySize {
+		return nil, fmt.Errorf("Request of %d bytes exceeds maximum of %d bytes", length, MaxBodySize)
+	}
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress request: %v", err)
+	}
+
+	var points []zenodb.Point
+	// WriteRequest: repeated TimeSeries timeseries = 1
+	err = decodeMessage(b, func(field int, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+		return decodeTimeSeries(value, func(point zenodb.Point) {
+			points = append(points, point)
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode request: %v", err)
+	}
+	return points, nil
+}
+
+// decodeTimeSeries decodes a TimeSeries (repeated Label labels = 1, repeated
+// Sample samples = 2) and calls onPoint for each of its samples.
+func decodeTimeSeries(b []byte, onPoint func(zenodb.Point)) error {
+	name := ""
+	dims := make(map[string]interface{})
+	var samples [][]byte
+	err := decodeMessage(b, func(field int, value []byte) error {
+		switch field {
+		case 1:
+			// Label: string name = 1, string value = 2
+			var labelName, labelValue string
+			err := decodeMessage(value, func(field int, value []byte) error {
+				switch field {
+				case 1:
+					labelName = string(value)
+				case 2:
+					labelValue = string(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if labelName == NameLabel {
+				name = labelValue
+			} else {
+				dims[labelName] = labelValue
+			}
+		case 2:
+			// Decode samples once we know the name
+			samples = append(samples, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return nil
+	}
+
+	for _, sample := range samples {
+		// Sample: double value = 1, int64 timestamp = 2 (milliseconds)
+		var value float64
+		var timestamp int64
+		err := decodeMessage(sample, func(field int, v []byte) error {
+			switch field {
+			case 1:
+				if len(v) != 8 {
+					return fmt.Errorf("Invalid sample value")
+				}
+				value = math.Float64frombits(binary.LittleEndian.Uint64(v))
+			case 2:
+				ts, n := binary.Uvarint(v)
+				if n <= 0 {
+					return fmt.Errorf("Invalid sample timestamp")
+				}
+				timestamp = int64(ts)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if math.IsNaN(value) {
+			continue
+		}
+		onPoint(zenodb.Point{
+			Ts:   time.Unix(0, timestamp*int64(time.Millisecond)),
+			Dims: dims,
+			Vals: map[string]float64{name: value},
+		})
+	}
+	return nil
+}
+
+// decodeMessage decodes the fields of a protocol buffer message, calling
+// onField with the raw value of each field. Varint values are passed in their
+// encoded form.
+func decodeMessage(b []byte, onField func(field int, value []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("Invalid field key")
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		var value []byte
+		switch key & 7 {
+		case wireVarint:
+			_, n = binary.Uvarint(b)
+			if n <= 0 {
+				return fmt.Errorf("Invalid varint in field %d", field)
+			}
+			value, b = b[:n], b[n:]
+		case wire64bit:
+			if len(b) < 8 {
+				return fmt.Errorf("Truncated field %d", field)
+			}
+			value, b = b[:8], b[8:]
+		case wireBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return fmt.Errorf("Truncated field %d", field)
+			}
+			b = b[n:]
+			value, b = b[:length], b[length:]
+		case wire32bit:
+			if len(b) < 4 {
+				return fmt.Errorf("Truncated field %d", field)
+			}
+			value, b = b[:4], b[4:]
+		default:
+			return fmt.Errorf("Unsupported wire type %d in field %d", key&7, field)
+		}
+		err := onField(field, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package prometheus
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeWriteRequest(t *testing.T) {
+	now := time.Now().Truncate(time.Millisecond)
+	ms := now.UnixNano() / int64(time.Millisecond)
+
+	req := bytesField(1, timeSeries(
+		[][2]string{{"__name__", "http_requests_total"}, {"job", "api"}, {"code", "200"}},
+		sample(5, ms), sample(math.NaN(), ms), sample(7, ms+1000)))
+	req = append(req, bytesField(1, timeSeries([][2]string{{"job", "unnamed"}}, sample(1, ms)))...)
+
+	points, err := DecodeWriteRequest(snappy.Encode(nil, req))
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, points, 2, "NaN sample and unnamed series should be skipped") {
+		dims := map[string]interface{}{"job": "api", "code": "200"}
+		assert.Equal(t, zenodb.Point{now, dims, map[string]float64{"http_requests_total": 5}}, points[0])
+		assert.Equal(t, zenodb.Point{now.Add(time.Second), dims, map[string]float64{"http_requests_total": 7}}, points[1])
+	}
+
+	_, err = DecodeWriteRequest(snappy.Encode(nil, req[:len(req)-3]))
+	assert.Error(t, err, "Truncated request should fail")
+
+	_, err = DecodeWriteRequest([]byte("not snappy"))
+	assert.Error(t, err, "Uncompressed request should fail")
+}
+
+func timeSeries(labels [][2]string, samples ...[]byte) []byte {
+	var b []byte
+	for _, label := range labels {
+		b = append(b, bytesField(1, append(bytesField(1, []byte(label[0])), bytesField(2, []byte(label[1]))...))...)
+	}
+	for _, s := range samples {
+		b = append(b, bytesField(2, s)...)
+	}
+	return b
+}
+
+func sample(value float64, timestamp int64) []byte {
+	b := varint(1<<3 | wire64bit)
+	v := make([]byte, 8)
+	binary.LittleEndian.PutUint64(v, math.Float64bits(value))
+	b = append(b, v...)
+	b = append(b, varint(2<<3|wireVarint)...)
+	return append(b, varint(uint64(timestamp))...)
+}
+
+func bytesField(field int, value []byte) []byte {
+	b := varint(uint64(field)<<3 | wireBytes)
+	b = append(b, varint(uint64(len(value)))...)
+	return append(b, value...)
+}
+
+func varint(v uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, v)]
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/expr"
 	"github.com/getlantern/zenodb/sql"
+	"golang.org/x/net/context"
 )
 
 type queryable interface {
@@ -16,12 +17,18 @@ type queryable interface {
 	resolution() time.Duration
 	retentionPeriod() time.Duration
 	truncateBefore() time.Time
-	iterate(fields []string, onValue func(bytemap.ByteMap, []encoding.Sequence)) error
+	// iterate iterates over all rows, including at least the data for periods
+	// after asOf and up to until (zero values being unbounded) and at least the
+	// rows that match all dimFilters. onValue receives the fields that the columns
+	// correspond to, which may differ from fields() if the table was altered in
+	// the meantime.
+	iterate(ctx context.Context, fields []string, asOf time.Time, until time.Time, dimFilters []*sql.DimFilter, onValue func(bytemap.ByteMap, []sql.Field, []encoding.Sequence)) error
 }
 
 type query struct {
 	fields      []string
 	filter      goexpr.Expr
+	dimFilters  []*sql.DimFilter
 	asOf        time.Time
 	asOfOffset  time.Duration
 	until       time.Time
@@ -37,6 +44,7 @@ type QueryStats struct {
 	ReadValue    int64
 	DataValid    int64
 	InTimeRange  int64
+	PeakMemory   int64
 	Runtime      time.Duration
 }
 
@@ -67,7 +75,7 @@ func (q *query) init(db *DB) error {
 	return nil
 }
 
-func (q *query) run(db *DB) (*QueryStats, error) {
+func (q *query) run(ctx context.Context, db *DB) (*QueryStats, error) {
 	start := time.Now()
 	stats := &QueryStats{}
 
@@ -80,8 +88,7 @@ func (q *query) run(db *DB) (*QueryStats, error) {
 	numPeriods := int(q.until.Sub(q.asOf) / q.t.resolution())
 	log.Tracef("Query will return %d periods for range %v to %v", numPeriods, q.asOf, q.until)
 
-	allFields := q.t.fields()
-	q.t.iterate(q.fields, func(key bytemap.ByteMap, columns []encoding.Sequence) {
+	err := q.t.iterate(ctx, q.fields, q.asOf, q.until, q.dimFilters, func(key bytemap.ByteMap, allFields []sql.Field, columns []encoding.Sequence) {
 		stats.Scanned++
 
 		testedInclude := false
@@ -135,6 +142,9 @@ func (q *query) run(db *DB) (*QueryStats, error) {
 			}
 		}
 	})
+	if err != nil {
+		return nil, err
+	}
 
 	stats.Runtime = time.Now().Sub(start)
 	return stats, nil
@@ -0,0 +1,88 @@
+package zenodb
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+)
+
+const (
+	// rough estimates of the memory consumed by the bookkeeping for an entry
+	// beyond the sizes of its key and sequences.
+	entryOverhead      = 256
+	sequenceSliceWidth = 24
+)
+
+// queryMemory tracks the memory allocated while executing a query against the
+// per-query (DBOpts.MaxQueryMemoryBytes) and database-wide
+// (DBOpts.MaxTotalQueryMemoryBytes) budgets. When either budget is exceeded,
+// the query's context is cancelled and the query fails with an error naming the
+// exceeded budget.
+type queryMemory struct {
+	db     *DB
+	cancel context.CancelFunc
+	used   int64
+	peak   int64
+	err    error
+	errMx  sync.Mutex
+}
+
+func newQueryMemory(db *DB, cancel context.CancelFunc) *queryMemory {
+	return &queryMemory{db: db, cancel: cancel}
+}
+
+// allocate records that the given number of bytes have been allocated. It
+// returns false if this allocation took the query over its budget.
+func (qm *queryMemory) allocate(bytes int) bool {
+	used := atomic.AddInt64(&qm.used, int64(bytes))
+	total := atomic.AddInt64(&qm.db.queryMemory, int64(bytes))
+	for {
+		peak := atomic.LoadInt64(&qm.peak)
+		if used <= peak || atomic.CompareAndSwapInt64(&qm.peak, peak, used) {
+			break
+		}
+	}
+
+	maxQuery := qm.db.opts.MaxQueryMemoryBytes
+	if maxQuery > 0 && used > int64(maxQuery) {
+		qm.fail(fmt.Errorf("Query exceeded memory budget MaxQueryMemoryBytes of %v", humanize.Bytes(uint64(maxQuery))))
+		return false
+	}
+	maxTotal := qm.db.opts.MaxTotalQueryMemoryBytes
+	if maxTotal > 0 && total > int64(maxTotal) {
+		qm.fail(fmt.Errorf("Running queries exceeded memory budget MaxTotalQueryMemoryBytes of %v", humanize.Bytes(uint64(maxTotal))))
+		return false
+	}
+	return true
+}
+
+func (qm *queryMemory) fail(err error) {
+	qm.errMx.Lock()
+	if qm.err == nil {
+		qm.err = err
+		log.Debug(err)
+	}
+	qm.errMx.Unlock()
+	qm.cancel()
+}
+
+// error returns the error that caused the query to fail, if any.
+func (qm *queryMemory) error() error {
+	qm.errMx.Lock()
+	defer qm.errMx.Unlock()
+	return qm.err
+}
+
+// peakBytes returns the highest number of bytes that were in use at any one
+// time.
+func (qm *queryMemory) peakBytes() int64 {
+	return atomic.LoadInt64(&qm.peak)
+}
+
+// release returns all memory used by this query to the database-wide budget.
+func (qm *queryMemory) release() {
+	atomic.AddInt64(&qm.db.queryMemory, -1*atomic.SwapInt64(&qm.used, 0))
+}
@@ -0,0 +1,226 @@
+package zenodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/wal"
+	"golang.org/x/net/context"
+)
+
+var (
+	// ErrReadOnly is returned when inserting into a follower.
+	ErrReadOnly = errors.New("Database is a read-only follower, please insert into its leader")
+)
+
+// Streams returns the names of the streams from which this database's tables
+// read.
+func (db *DB) Streams() []string {
+	db.tablesMutex.RLock()
+	streams := make([]string, 0, len(db.streams))
+	for stream := range db.streams {
+		streams = append(streams, stream)
+	}
+	db.tablesMutex.RUnlock()
+	sort.Strings(streams)
+	return streams
+}
+
+// StreamsChanged returns a channel that's closed the next time a stream is
+// added to the database (e.g. by a schema change). Get the channel before
+// calling Streams to make sure not to miss any changes.
+func (db *DB) StreamsChanged() <-chan interface{} {
+	db.tablesMutex.RLock()
+	defer db.tablesMutex.RUnlock()
+	return db.streamsChanged
+}
+
+// FollowWAL reads the WAL of the given stream starting after the given offset
+// (or from the beginning if offset is nil) and calls onEntry for each entry
+// along with its offset. It keeps waiting for new entries until the context is
+// done, the database is closed or onEntry returns an error. The data passed to
+// onEntry is only valid until onEntry returns.
+func (db *DB) FollowWAL(ctx context.Context, stream string, offset wal.Offset, onEntry func(data []byte, offset wal.Offset) error) error {
+	w, err := db.walForStream(stream)
+	if err != nil {
+		return err
+	}
+	reader, err := w.NewReader("follower", offset)
+	if err != nil {
+		return fmt.Errorf("Unable to obtain WAL reader: %v", err)
+	}
+	stop := make(chan interface{})
+	defer close(stop)
+	go func() {
+		// Unblock reader.Read() once we're done
+		select {
+		case <-ctx.Done():
+		case <-db.closeCh:
+		case <-stop:
+		}
+		reader.Close()
+	}()
+
+	for {
+		data, err := reader.Read()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-db.closeCh:
+				return errors.New("Database is closed")
+			default:
+				return fmt.Errorf("Unable to read from WAL: %v", err)
+			}
+		}
+		// Pass on the leader's original entry if we're a follower ourselves
+		data, _ = stripReplicated(data)
+		err = onEntry(data, reader.Offset())
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// WALHead returns the offset of the latest entry in the given stream's WAL.
+func (db *DB) WALHead(stream string) (wal.Offset, error) {
+	w, err := db.walForStream(stream)
+	if err != nil {
+		return nil, err
+	}
+	_, head, err := w.Latest()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to determine head of WAL: %v", err)
+	}
+	return head, nil
+}
+
+// ApplyReplicated writes an entry that was read from the leader's WAL at the
+// given offset into this database's WAL for the given stream. The leader's
+// offset is recorded along with the entry so that replication can resume from
+// it (see ReplicatedOffset).
+func (db *DB) ApplyReplicated(stream string, data []byte, leaderOffset wal.Offset) error {
+	if len(leaderOffset) != wal.OffsetSize {
+		return fmt.Errorf("Invalid leader offset %v", leaderOffset)
+	}
+	w, err := db.walForStream(stream)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(walEntryHeader(walEntryReplicated), leaderOffset, data)
+	return err
+}
+
+// ReplicatedOffset returns the leader's offset of the latest entry that was
+// replicated into the given stream, or nil if nothing has been replicated yet.
+// The offset is taken from the latest entry in the WAL or, if the WAL is empty
+// because it was truncated, from the offset that was stored before truncating
+// it.
+func (db *DB) ReplicatedOffset(stream string) (wal.Offset, error) {
+	leaderOffset, err := db.latestReplicatedOffset(stream)
+	if err != nil || leaderOffset != nil {
+		return leaderOffset, err
+	}
+	b, err := ioutil.ReadFile(db.replicatedOffsetFile(stream))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read stored replicated offset: %v", err)
+	}
+	if len(b) != wal.OffsetSize {
+		return nil, fmt.Errorf("Invalid stored replicated offset for %v", stream)
+	}
+	return wal.Offset(b), nil
+}
+
+// storeReplicatedOffset stores the leader's offset of the latest entry in the
+// given stream's WAL, so that ReplicatedOffset still knows it once the WAL has
+// been truncated.
+func (db *DB) storeReplicatedOffset(stream string) error {
+	leaderOffset, err := db.latestReplicatedOffset(stream)
+	if err != nil || leaderOffset == nil {
+		return err
+	}
+	filename := db.replicatedOffsetFile(stream)
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return fmt.Errorf("Unable to create temp file for replicated offset: %v", err)
+	}
+	_, err = tmp.Write(leaderOffset)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Unable to write replicated offset: %v", err)
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// replicatedOffsetFile returns the name of the file in which the replicated
+// offset for the given stream is stored.
+func (db *DB) replicatedOffsetFile(stream string) string {
+	return db.WALDir(strings.TrimSpace(strings.ToLower(stream))) + ".replicated"
+}
+
+// latestReplicatedOffset returns the leader's offset of the latest entry in the
+// given stream's WAL, or nil if the WAL is empty.
+func (db *DB) latestReplicatedOffset(stream string) (wal.Offset, error) {
+	w, err := db.walForStream(stream)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := w.Latest()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read latest WAL entry: %v", err)
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	_, leaderOffset := stripReplicated(data)
+	if leaderOffset == nil {
+		return nil, fmt.Errorf("Latest entry in WAL for %v wasn't replicated, unable to determine where to resume", stream)
+	}
+	return leaderOffset, nil
+}
+
+// walForStream returns the WAL for the given stream regardless of whether the
+// database is a follower.
+func (db *DB) walForStream(stream string) (*wal.WAL, error) {
+	stream = strings.TrimSpace(strings.ToLower(stream))
+	db.tablesMutex.RLock()
+	closed := db.closed
+	w := db.streams[stream]
+	db.tablesMutex.RUnlock()
+	if closed {
+		return nil, errors.New("Database is closed")
+	}
+	if w == nil {
+		return nil, fmt.Errorf("No wal found for stream %v", stream)
+	}
+	return w, nil
+}
+
+// stripReplicated strips the replication header from the given WAL entry,
+// returning the leader's original entry and offset. Entries that weren't
+// replicated are returned as is, with a nil offset.
+func stripReplicated(data []byte) ([]byte, wal.Offset) {
+	entryType, body, err := parseWALEntry(data)
+	if err != nil || entryType != walEntryReplicated || len(body) < wal.OffsetSize {
+		return data, nil
+	}
+	data = body
+	leaderOffset := make(wal.Offset, wal.OffsetSize)
+	copy(leaderOffset, data)
+	return data[wal.OffsetSize:], leaderOffset
+}
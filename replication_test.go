@@ -0,0 +1,137 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/wal"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestReplication(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbreplicationtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	schemaFile := filepath.Join(tmpDir, "schema.yaml")
+	err = ioutil.WriteFile(schemaFile, []byte(`
+replication_test:
+  retentionperiod: 24h
+  sql: >
+    SELECT SUM(i) AS i
+    FROM inbound
+    GROUP BY a, period(1h)
+`), 0644)
+	if !assert.NoError(t, err, "Unable to write schema") {
+		return
+	}
+
+	leader, err := NewDB(&DBOpts{Dir: filepath.Join(tmpDir, "leader"), SchemaFile: schemaFile})
+	if !assert.NoError(t, err, "Unable to create leader") {
+		return
+	}
+	defer leader.Close()
+	follower, err := NewDB(&DBOpts{Dir: filepath.Join(tmpDir, "follower"), SchemaFile: schemaFile, Follower: true, IncludeMemStoreInQuery: true})
+	if !assert.NoError(t, err, "Unable to create follower") {
+		return
+	}
+	defer follower.Close()
+
+	assert.Equal(t, []string{"inbound"}, follower.Streams())
+	assert.Equal(t, ErrReadOnly, follower.Insert("inbound", time.Now(), map[string]interface{}{"a": "x"}, map[string]float64{"i": 1}))
+	offset, err := follower.ReplicatedOffset("inbound")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Nil(t, offset, "Nothing should have been replicated yet")
+
+	now := time.Now()
+	insert := func(i float64) {
+		assert.NoError(t, leader.Insert("inbound", now, map[string]interface{}{"a": "x"}, map[string]float64{"i": i}))
+	}
+
+	// replicate applies n entries from the leader to the follower, starting after
+	// whatever the follower applied last
+	replicate := func(n int) {
+		offset, err := follower.ReplicatedOffset("inbound")
+		if !assert.NoError(t, err) {
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		applied := 0
+		leader.FollowWAL(ctx, "inbound", offset, func(data []byte, offset wal.Offset) error {
+			err := follower.ApplyReplicated("inbound", data, offset)
+			if assert.NoError(t, err) {
+				applied++
+			}
+			if err != nil || applied == n {
+				cancel()
+			}
+			return err
+		})
+		assert.Equal(t, n, applied)
+	}
+
+	insert(1)
+	insert(2)
+	replicate(2)
+	// Simulate resuming after a gap
+	insert(3)
+	replicate(1)
+
+	head, err := leader.WALHead("inbound")
+	if !assert.NoError(t, err) {
+		return
+	}
+	offset, err = follower.ReplicatedOffset("inbound")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, head, offset, "Follower should have caught up to leader")
+	}
+
+	// Once its WAL has been truncated, the follower resumes from the stored
+	// offset. Simulate this with a follower that has nothing but that offset.
+	if !assert.NoError(t, follower.storeReplicatedOffset("inbound")) {
+		return
+	}
+	b, err := ioutil.ReadFile(follower.replicatedOffsetFile("inbound"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	truncatedDir := filepath.Join(tmpDir, "truncated")
+	if !assert.NoError(t, os.MkdirAll(filepath.Join(truncatedDir, walDirName), 0755)) {
+		return
+	}
+	if !assert.NoError(t, ioutil.WriteFile(filepath.Join(truncatedDir, walDirName, "inbound.replicated"), b, 0644)) {
+		return
+	}
+	truncated, err := NewDB(&DBOpts{Dir: truncatedDir, SchemaFile: schemaFile, Follower: true})
+	if !assert.NoError(t, err, "Unable to create truncated follower") {
+		return
+	}
+	defer truncated.Close()
+	offset, err = truncated.ReplicatedOffset("inbound")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, head, offset, "Follower with empty WAL should resume from stored offset")
+	}
+
+	time.Sleep(1 * time.Second)
+	aq, err := follower.SQLQuery("SELECT i FROM replication_test ASOF '-2h' GROUP BY a")
+	if !assert.NoError(t, err) {
+		return
+	}
+	result, err := aq.Run()
+	if assert.NoError(t, err) {
+		total := float64(0)
+		for _, row := range result.Rows {
+			total += row.Values[0]
+		}
+		assert.EqualValues(t, 6, total, "Follower should contain each replicated point exactly once")
+	}
+}
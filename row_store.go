@@ -2,15 +2,17 @@ package zenodb
 
 import (
 	"bytes"
-	"encoding/binary"
+	"container/heap"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -19,8 +21,7 @@ import (
 	"github.com/getlantern/zenodb/bytetree"
 	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/sql"
-	"github.com/golang/snappy"
-	"github.com/oxtoacart/emsort"
+	"golang.org/x/net/context"
 )
 
 const (
@@ -28,7 +29,15 @@ const (
 	FileVersion_2      = 2
 	FileVersion_3      = 3
 	FileVersion_4      = 4
-	CurrentFileVersion = FileVersion_4
+	FileVersion_5      = 5
+	CurrentFileVersion = FileVersion_5
+)
+
+const (
+	// minFlushRetryDelay and maxFlushRetryDelay bound the exponential backoff
+	// between attempts to flush after a flush failed.
+	minFlushRetryDelay = 1 * time.Second
+	maxFlushRetryDelay = 1 * time.Minute
 )
 
 var (
@@ -36,6 +45,7 @@ var (
 		FileVersion_2: ",",
 		FileVersion_3: "|",
 		FileVersion_4: "|",
+		FileVersion_5: "|",
 	}
 )
 
@@ -44,11 +54,13 @@ type rowStoreOptions struct {
 	maxMemStoreBytes int
 	minFlushLatency  time.Duration
 	maxFlushLatency  time.Duration
+	insertQueueSize  int
 }
 
 type flushRequest struct {
-	idx      int
-	memstore *memstore
+	idx        int
+	memstore   *memstore
+	alteration *alteration
 }
 
 type insert struct {
@@ -59,15 +71,27 @@ type insert struct {
 }
 
 type rowStore struct {
-	t                  *table
-	opts               *rowStoreOptions
-	memStores          map[int]*memstore
-	currentMemStoreIdx int
-	fileStore          *fileStore
-	inserts            chan *insert
-	flushes            chan *flushRequest
-	flushFinished      chan time.Duration
-	mx                 sync.RWMutex
+	t                   *table
+	opts                *rowStoreOptions
+	memStores           map[int]*memstore
+	currentMemStoreIdx  int
+	fileStore           *fileStore
+	inserts             chan []*insert
+	alterations         chan *alteration
+	flushes             chan *flushRequest
+	flushFinished       chan time.Duration
+	flushesStopped      chan interface{}
+	compactionRequested chan bool
+	compactionsStopped  chan interface{}
+	stopCh              chan interface{}
+	stopped             chan interface{}
+	flushOnStop         bool
+	// queueSlots holds one token for every point waiting in inserts, bounding
+	// the queue by points rather than by WAL entries
+	queueSlots chan bool
+	// flushFailing is 1 while flushes are failing
+	flushFailing int32
+	mx           sync.RWMutex
 }
 
 type memstore struct {
@@ -75,75 +99,178 @@ type memstore struct {
 	offset wal.Offset
 }
 
-func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, wal.Offset, error) {
+// openRowStore opens the rowStore in the directory given by opts. If the
+// directory doesn't contain any data yet and seed is not nil, seed is called to
+// obtain an initial memstore that gets flushed right away, with the rowStore
+// picking up from that memstore's WAL offset.
+func (t *table) openRowStore(opts *rowStoreOptions, seed func() (*memstore, error)) (*rowStore, wal.Offset, error) {
 	err := os.MkdirAll(opts.dir, 0755)
 	if err != nil && !os.IsExist(err) {
 		return nil, nil, fmt.Errorf("Unable to create folder for row store: %v", err)
 	}
 
-	existingFileName := ""
-	files, err := ioutil.ReadDir(opts.dir)
+	rs := &rowStore{
+		opts:                opts,
+		t:                   t,
+		memStores:           make(map[int]*memstore, 2),
+		currentMemStoreIdx:  0,
+		inserts:             make(chan []*insert, opts.insertQueueSize),
+		queueSlots:          make(chan bool, opts.insertQueueSize),
+		alterations:         make(chan *alteration),
+		flushes:             make(chan *flushRequest, 1),
+		flushFinished:       make(chan time.Duration, 1),
+		flushesStopped:      make(chan interface{}),
+		compactionRequested: make(chan bool, 1),
+		compactionsStopped:  make(chan interface{}),
+		stopCh:              make(chan interface{}),
+		stopped:             make(chan interface{}),
+	}
+
+	m, err := readManifest(opts.dir)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Unable to read contents of directory: %v", err)
-	}
-	var walOffset wal.Offset
-	if len(files) > 0 {
-		// files are sorted by name, in our case timestamp, so the last file in the
-		// list is the most recent.  That's the one that we want.
-		existingFileName = filepath.Join(opts.dir, files[len(files)-1].Name())
-		fileVersion := versionFor(existingFileName)
-		if fileVersion >= FileVersion_4 {
-			log.Debug("Recent version")
-			// Get WAL offset
-			file, err := os.Open(existingFileName)
+		return nil, nil, err
+	}
+	if m != nil {
+		t.log.Debugf("Initializing row store from %d segments", len(m.Segments))
+		rs.fileStore = &fileStore{t: t, opts: opts, segments: m.Segments, offset: m.Offset}
+		damaged := rs.fileStore.verify(false)
+		if len(damaged) > 0 {
+			rs.fileStore, err = rs.recoverFrom(damaged)
 			if err != nil {
-				return nil, nil, fmt.Errorf("Unable to open existing file %v: %v", existingFileName, err)
+				return nil, nil, fmt.Errorf("Unable to recover from damaged segments: %v", err)
 			}
-			defer file.Close()
-			r := snappy.NewReader(file)
-			// Skip header length
-			walOffset = make(wal.Offset, wal.OffsetSize+4)
-			_, err = io.ReadFull(r, walOffset)
+		}
+	} else {
+		legacyFiles, err := legacyFileStores(opts.dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, legacyFile := range legacyFiles {
+			rs.fileStore, err = rs.convertLegacyFileStore(legacyFile)
+			if err == nil {
+				break
+			}
+			// Fall back to the previous file store, replaying the remaining data
+			// from the WAL
+			t.log.Errorf("Unable to convert existing file %v, quarantining: %v", legacyFile, err)
+			quarantineErr := quarantine(legacyFile)
+			if quarantineErr != nil {
+				return nil, nil, quarantineErr
+			}
+		}
+	}
+
+	var seedMemStore *memstore
+	if rs.fileStore == nil {
+		rs.fileStore = &fileStore{t: t, opts: opts}
+		if seed != nil {
+			seedMemStore, err = seed()
 			if err != nil {
-				return nil, nil, fmt.Errorf("Unable to read offset from existing file %v: %v", existingFileName, err)
+				return nil, nil, err
 			}
-			// Skip header length
-			walOffset = walOffset[4:]
 		}
-		t.log.Debugf("Initializing row store from %v", existingFileName)
 	}
+	walOffset := rs.fileStore.offset
+	if seedMemStore != nil {
+		walOffset = seedMemStore.offset
+	}
+	t.recordFileStore(rs.fileStore)
 
-	rs := &rowStore{
-		opts:               opts,
-		t:                  t,
-		memStores:          make(map[int]*memstore, 2),
-		currentMemStoreIdx: 0,
-		inserts:            make(chan *insert),
-		flushes:            make(chan *flushRequest, 1),
-		flushFinished:      make(chan time.Duration, 1),
-		fileStore: &fileStore{
-			t:        t,
-			opts:     opts,
-			filename: existingFileName,
-		},
+	rs.memStores[rs.currentMemStoreIdx] = &memstore{tree: bytetree.New(), offset: walOffset}
+	if seedMemStore != nil {
+		// Make seed visible to queries until it's been flushed
+		rs.memStores[-1] = seedMemStore
+		rs.flushes <- &flushRequest{idx: -1, memstore: seedMemStore}
 	}
 
 	go rs.processInserts()
 	go rs.processFlushes()
+	go rs.processCompactions()
 	go rs.removeOldFiles()
 
 	return rs, walOffset, nil
 }
 
-func (rs *rowStore) insert(insert *insert) {
-	rs.inserts <- insert
+// legacyFileStores returns the file stores written prior to the introduction of
+// segments, most recent first.
+func legacyFileStores(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read contents of directory: %v", err)
+	}
+	// files are sorted by name, in our case timestamp, so the last file in the
+	// list is the most recent.
+	var result []string
+	for i := len(files) - 1; i >= 0; i-- {
+		name := files[i].Name()
+		if strings.HasPrefix(name, "filestore_") {
+			result = append(result, filepath.Join(dir, name))
+		}
+	}
+	return result, nil
+}
+
+// insert queues the given inserts, which come from a single WAL entry, for
+// processing, blocking while the queue doesn't have room for them. If drop is
+// true, it doesn't block and instead returns false if the inserts couldn't be
+// queued. insert also gives up and returns false once the table is stopping.
+func (rs *rowStore) insert(inserts []*insert, drop bool) bool {
+	slots := rs.slotsFor(inserts)
+	for i := 0; i < slots; i++ {
+		select {
+		case rs.queueSlots <- true:
+			continue
+		default:
+		}
+		if drop {
+			rs.releaseSlots(i)
+			return false
+		}
+		// Queue is full, wait for room
+		rs.t.updateBehind()
+		select {
+		case rs.queueSlots <- true:
+		case <-rs.t.stopCh:
+			rs.releaseSlots(i)
+			return false
+		}
+	}
+	// Every queued entry holds at least one slot, so this never blocks
+	rs.inserts <- inserts
+	rs.t.updateBehind()
+	return true
+}
+
+// slotsFor returns the number of queue slots taken up by the given inserts. A
+// WAL entry with more points than fit into the queue takes up the whole queue.
+func (rs *rowStore) slotsFor(inserts []*insert) int {
+	slots := len(inserts)
+	if slots > cap(rs.queueSlots) {
+		slots = cap(rs.queueSlots)
+	}
+	return slots
+}
+
+func (rs *rowStore) releaseSlots(slots int) {
+	for i := 0; i < slots; i++ {
+		<-rs.queueSlots
+	}
+}
+
+// queueDepth returns the number of points waiting to be processed.
+func (rs *rowStore) queueDepth() int {
+	return len(rs.queueSlots)
+}
+
+// queueFull indicates whether the insert queue is full.
+func (rs *rowStore) queueFull() bool {
+	return len(rs.queueSlots) >= cap(rs.queueSlots)
 }
 
 func (rs *rowStore) processInserts() {
-	currentMemStore := &memstore{tree: bytetree.New()}
-	rs.mx.Lock()
-	rs.memStores[rs.currentMemStoreIdx] = currentMemStore
-	rs.mx.Unlock()
+	rs.mx.RLock()
+	currentMemStore := rs.memStores[rs.currentMemStoreIdx]
+	rs.mx.RUnlock()
 
 	flushInterval := rs.opts.maxFlushLatency
 	flushTimer := time.NewTimer(flushInterval)
@@ -157,16 +284,21 @@ func (rs *rowStore) processInserts() {
 			flushTimer.Reset(flushInterval)
 			return
 		}
+		if rs.failingToFlush() {
+			rs.t.log.Trace("Not requesting another flush while flushes are failing")
+			flushTimer.Reset(flushInterval)
+			return
+		}
 		// Temporarily disable flush timer while we're flushing
 		flushTimer.Reset(100000 * time.Hour)
 		rs.t.log.Tracef("Requesting flush at memstore size: %v", humanize.Bytes(uint64(currentMemStore.tree.Bytes())))
 		previousMemStore := currentMemStore
 		rs.mx.Lock()
-		fr := &flushRequest{rs.currentMemStoreIdx, previousMemStore}
+		fr := &flushRequest{idx: rs.currentMemStoreIdx, memstore: previousMemStore}
 		rs.mx.Unlock()
 		rs.flushes <- fr
 		rs.mx.Lock()
-		currentMemStore = &memstore{tree: bytetree.New()}
+		currentMemStore = &memstore{tree: bytetree.New(), offset: previousMemStore.offset}
 		rs.currentMemStoreIdx++
 		rs.memStores[rs.currentMemStoreIdx] = currentMemStore
 		flushIdx++
@@ -174,13 +306,26 @@ func (rs *rowStore) processInserts() {
 	}
 
 	for {
+		inserts := rs.inserts
+		if rs.failingToFlush() && currentMemStore.tree.Bytes() >= rs.opts.maxMemStoreBytes {
+			// The memstore is full and can't be flushed, hold back inserts (and
+			// thereby reading from the WAL) until flushing succeeds again
+			inserts = nil
+		}
 		select {
-		case insert := <-rs.inserts:
-			truncateBefore := rs.t.truncateBefore()
+		case batch := <-inserts:
+			// Inserts from a single WAL entry always go into the same memstore so
+			// that the memstore's offset covers all of them.
 			rs.mx.Lock()
-			currentMemStore.tree.Update(rs.t.Fields, rs.t.Resolution, truncateBefore, insert.key, insert.vals, insert.metadata)
-			currentMemStore.offset = insert.offset
+			st := rs.t.currentStructure()
+			truncateBefore := st.truncateBefore(rs.t.db.clock.Now())
+			for _, insert := range batch {
+				currentMemStore.tree.Update(st.fields, st.resolution, truncateBefore, insert.key, insert.vals, insert.metadata)
+				currentMemStore.offset = insert.offset
+			}
 			rs.mx.Unlock()
+			rs.releaseSlots(rs.slotsFor(batch))
+			rs.t.updateBehind()
 			if currentMemStore.tree.Bytes() >= rs.opts.maxMemStoreBytes {
 				rs.t.log.Debug("Requesting flush due to memstore size limit")
 				flush()
@@ -188,6 +333,37 @@ func (rs *rowStore) processInserts() {
 		case <-flushTimer.C:
 			rs.t.log.Debug("Requesting flush due to flush interval")
 			flush()
+		case alt := <-rs.alterations:
+			if rs.failingToFlush() {
+				alt.err = fmt.Errorf("Unable to alter table %v while flushes are failing", rs.t.Name)
+				close(alt.done)
+				continue
+			}
+			// Always flush prior to altering, even if the memstore is empty, so that
+			// existing data gets persisted with the structure it was written with.
+			rs.t.log.Debug("Requesting flush due to alteration")
+			rs.mx.Lock()
+			fr := &flushRequest{idx: rs.currentMemStoreIdx, memstore: currentMemStore, alteration: alt}
+			currentMemStore = &memstore{tree: bytetree.New(), offset: currentMemStore.offset}
+			rs.currentMemStoreIdx++
+			rs.memStores[rs.currentMemStoreIdx] = currentMemStore
+			rs.mx.Unlock()
+			rs.flushes <- fr
+			for altering := true; altering; {
+				select {
+				case <-alt.done:
+					altering = false
+				case <-rs.flushFinished:
+					// Keep prior flushes from blocking, flushTimer is reset below
+				}
+			}
+			if alt.err == nil {
+				rs.opts.maxMemStoreBytes = alt.opts.MaxMemStoreBytes
+				rs.opts.minFlushLatency = alt.opts.MinFlushLatency
+				rs.opts.maxFlushLatency = alt.opts.MaxFlushLatency
+				flushInterval = rs.opts.maxFlushLatency
+			}
+			flushTimer.Reset(flushInterval)
 		case flushDuration := <-rs.flushFinished:
 			flushInterval = flushDuration * 10
 			if flushInterval > rs.opts.maxFlushLatency {
@@ -196,20 +372,63 @@ func (rs *rowStore) processInserts() {
 				flushInterval = rs.opts.minFlushLatency
 			}
 			flushTimer.Reset(flushInterval)
+		case <-rs.stopCh:
+			rs.t.log.Debug("Stopping")
+			if rs.flushOnStop {
+				rs.t.log.Debug("Requesting final flush")
+				flush()
+			}
+			flushTimer.Stop()
+			close(rs.flushes)
+			// Keep processing flushFinished until pending flushes are done
+			for {
+				select {
+				case <-rs.flushFinished:
+				case <-rs.flushesStopped:
+					close(rs.stopped)
+					return
+				}
+			}
 		}
 	}
 }
 
-func (rs *rowStore) iterate(fields []string, onValue func(bytemap.ByteMap, []encoding.Sequence)) error {
+// stop stops processing inserts, waits for pending flushes to finish and stops
+// all background goroutines (abandoning any compaction that's in progress). If
+// flush is true, the current memstore is flushed before stopping. The caller
+// must make sure that nothing calls insert after calling stop.
+func (rs *rowStore) stop(flush bool) {
+	rs.flushOnStop = flush
+	close(rs.stopCh)
+	<-rs.stopped
+	<-rs.compactionsStopped
+}
+
+func (rs *rowStore) iterate(ctx context.Context, fields []string, asOf time.Time, until time.Time, dimFilters []*sql.DimFilter, onValue func(bytemap.ByteMap, []sql.Field, []encoding.Sequence)) error {
+	st, fs, memStores, _ := rs.snapshot(rs.t.db.opts.IncludeMemStoreInQuery)
+	return fs.withinRange(asOf, until).withFilters(dimFilters).iterate(ctx, st, func(key bytemap.ByteMap, columns []encoding.Sequence) {
+		onValue(key, st.fields, columns)
+	}, memStores, fields...)
+}
+
+// snapshot returns a consistent view of the table's structure, the current
+// fileStore and memstores, along with the WAL offset up to which they contain
+// data. If includeCurrentMemStore is false, the current memstore is omitted
+// (and the offset is meaningless).
+func (rs *rowStore) snapshot(includeCurrentMemStore bool) (*structure, *fileStore, []*bytetree.Tree, wal.Offset) {
 	rs.mx.RLock()
+	defer rs.mx.RUnlock()
+	st := rs.t.currentStructure()
 	fs := rs.fileStore
 	memStoresCopy := make([]*bytetree.Tree, 0, len(rs.memStores))
+	var offset wal.Offset
 	for i, _ms := range rs.memStores {
 		ms := _ms.tree
 		onCurrentMemStore := i == rs.currentMemStoreIdx
 		if onCurrentMemStore {
+			offset = _ms.offset
 			// Current memstore is still getting writes.  Either omit, or copy.
-			if !rs.t.db.opts.IncludeMemStoreInQuery {
+			if !includeCurrentMemStore {
 				// omit
 				continue
 			}
@@ -218,252 +437,570 @@ func (rs *rowStore) iterate(fields []string, onValue func(bytemap.ByteMap, []enc
 		}
 		memStoresCopy = append(memStoresCopy, ms)
 	}
-	rs.mx.RUnlock()
-	return fs.iterate(onValue, memStoresCopy, fields...)
+	return st, fs, memStoresCopy, offset
+}
+
+// currentFileStore returns the current fileStore.
+func (rs *rowStore) currentFileStore() *fileStore {
+	rs.mx.RLock()
+	defer rs.mx.RUnlock()
+	return rs.fileStore
+}
+
+// memStoreBytes returns the estimated size of all memstores.
+func (rs *rowStore) memStoreBytes() int64 {
+	rs.mx.RLock()
+	defer rs.mx.RUnlock()
+	total := int64(0)
+	for _, ms := range rs.memStores {
+		total += int64(ms.tree.Bytes())
+	}
+	return total
 }
 
 func (rs *rowStore) processFlushes() {
+	defer close(rs.flushesStopped)
+	abandoned := false
 	for req := range rs.flushes {
-		rs.processFlush(req)
+		if abandoned {
+			// Flushing later memstores would skip the abandoned data in the WAL
+			req.failAlteration(fmt.Errorf("Unable to alter table %v, flushing was abandoned", rs.t.Name))
+			continue
+		}
+		abandoned = !rs.flushWithRetry(req)
 	}
 }
 
-func (rs *rowStore) processFlush(req *flushRequest) {
-	shouldSort := rs.t.shouldSort()
-	willSort := "not sorted"
-	if shouldSort {
-		defer rs.t.stopSorting()
-		willSort = "sorted"
+// flushWithRetry processes the given flush request, retrying with exponential
+// backoff until it succeeds. The memstore is kept (and remains queryable) until
+// it has been flushed successfully. Once the rowStore is stopped, failed
+// flushes are abandoned, leaving their data to be replayed from the WAL, in
+// which case flushWithRetry returns false.
+func (rs *rowStore) flushWithRetry(req *flushRequest) bool {
+	delay := minFlushRetryDelay
+	for {
+		err := rs.processFlush(req)
+		if err == nil {
+			if atomic.CompareAndSwapInt32(&rs.flushFailing, 1, 0) {
+				rs.t.log.Debug("Flushing succeeded again")
+			}
+			return true
+		}
+		atomic.StoreInt32(&rs.flushFailing, 1)
+		rs.t.recordFlushError(err)
+		// Don't keep the alteration waiting while we retry, the flush itself is
+		// retried without it
+		req.failAlteration(fmt.Errorf("Unable to flush prior to altering table %v: %v", rs.t.Name, err))
+		select {
+		case <-rs.stopCh:
+			rs.t.log.Errorf("Flush failed, abandoning since we're stopping, data will be replayed from WAL on next start: %v", err)
+			return false
+		default:
+		}
+		rs.t.log.Errorf("Flush failed, will retry in %v: %v", delay, err)
+		select {
+		case <-time.After(delay):
+		case <-rs.stopCh:
+			// Try one last time
+		}
+		delay *= 2
+		if delay > maxFlushRetryDelay {
+			delay = maxFlushRetryDelay
+		}
 	}
+}
 
-	rs.t.log.Debugf("Starting flush, %v", willSort)
-	start := time.Now()
-	out, err := ioutil.TempFile("", "nextrowstore")
-	if err != nil {
-		panic(err)
+// failAlteration fails this flushRequest's alteration, if any, with the given
+// error. The flush itself goes ahead without altering the table.
+func (req *flushRequest) failAlteration(err error) {
+	if req.alteration == nil {
+		return
 	}
-	defer out.Close()
-	sout := snappy.NewBufferedWriter(out)
+	req.alteration.err = err
+	close(req.alteration.done)
+	req.alteration = nil
+}
+
+// failingToFlush indicates whether the most recent flush failed.
+func (rs *rowStore) failingToFlush() bool {
+	return atomic.LoadInt32(&rs.flushFailing) == 1
+}
 
-	fieldStrings := make([]string, 0, len(rs.t.Fields))
-	for _, field := range rs.t.Fields {
-		fieldStrings = append(fieldStrings, field.String())
+// processFlush flushes the memstore in the given request to a new segment. If
+// flushing fails, the memstore is left in place.
+func (rs *rowStore) processFlush(req *flushRequest) error {
+	rs.t.log.Debug("Starting flush")
+	start := time.Now()
+
+	rs.mx.RLock()
+	// Alterations are only applied after flushing, so the memstore has the
+	// current structure
+	st := rs.t.currentStructure()
+	partitionPeriod := rs.t.PartitionPeriod
+	// The memstore contains the data following what has already been flushed
+	startOffset := rs.fileStore.offset
+	rs.mx.RUnlock()
+
+	var segments []*segment
+	if req.memstore.tree.Length() > 0 {
+		pw := newPartitionedWriter(rs.opts.dir, st.fields, st.resolution, st.truncateBefore(rs.t.db.clock.Now()), req.memstore.offset, partitionPeriod, 0)
+		for _, row := range sortedMemStoreRows(req.memstore.tree, len(st.fields)) {
+			err := pw.write(row.key, row.columns)
+			if err != nil {
+				pw.abort()
+				return fmt.Errorf("Unable to write row: %v", err)
+			}
+		}
+		var err error
+		segments, err = pw.close(0)
+		if err != nil {
+			return err
+		}
+		for _, seg := range segments {
+			seg.StartOffset = startOffset
+		}
 	}
-	fieldsBytes := []byte(strings.Join(fieldStrings, fieldsDelims[CurrentFileVersion]))
-	headerLength := uint32(len(req.memstore.offset) + len(fieldsBytes))
-	err = binary.Write(sout, encoding.Binary, headerLength)
+
+	rs.mx.Lock()
+	fs := rs.fileStore.withOffset(req.memstore.offset).withSegments(segments...)
+	err := fs.writeManifest()
 	if err != nil {
-		panic(fmt.Errorf("Unable to write header length: %v", err))
+		rs.mx.Unlock()
+		for _, seg := range segments {
+			os.Remove(filepath.Join(rs.opts.dir, seg.Name))
+			os.Remove(filepath.Join(rs.opts.dir, indexFileFor(seg.Name)))
+		}
+		return err
 	}
-	_, err = sout.Write(req.memstore.offset)
-	if err != nil {
-		panic(fmt.Errorf("Unable to write header: %v", err))
+	delete(rs.memStores, req.idx)
+	rs.fileStore = fs
+	if req.alteration != nil {
+		rs.t.applyAlteration(req.alteration)
 	}
-	_, err = sout.Write(fieldsBytes)
-	if err != nil {
-		panic(fmt.Errorf("Unable to write header: %v", err))
+	rs.mx.Unlock()
+	if req.alteration != nil {
+		close(req.alteration.done)
 	}
 
-	var cout io.WriteCloser
-	if !shouldSort {
-		cout = sout
+	flushDuration := time.Now().Sub(start)
+	rs.t.recordFileStore(fs)
+	rs.t.recordFlush(flushDuration)
+	rs.flushFinished <- flushDuration
+	if len(segments) > 0 {
+		rs.t.log.Debugf("Flushed to %d segments in %v, size %v", len(segments), flushDuration, humanize.Bytes(uint64(totalBytes(segments))))
+		rs.requestCompaction()
 	} else {
-		chunk := func(r io.Reader) ([]byte, error) {
-			rowLength := uint64(0)
-			readErr := binary.Read(r, encoding.Binary, &rowLength)
-			if readErr != nil {
-				return nil, readErr
-			}
-			_row := make([]byte, rowLength)
-			row := _row
-			encoding.Binary.PutUint64(row, rowLength)
-			row = row[encoding.Width64bits:]
-			_, err = io.ReadFull(r, row)
-			return _row, err
-		}
-
-		less := func(a []byte, b []byte) bool {
-			return bytes.Compare(a, b) < 0
-		}
-
-		var sortErr error
-		cout, sortErr = emsort.New(sout, chunk, less, rs.opts.maxMemStoreBytes*5)
-		if sortErr != nil {
-			panic(sortErr)
-		}
+		rs.t.log.Debugf("Flushed empty memstore in %v", flushDuration)
 	}
+	return nil
+}
 
-	truncateBefore := rs.t.truncateBefore()
-	write := func(key bytemap.ByteMap, columns []encoding.Sequence) {
-		hasActiveSequence := false
-		for i, seq := range columns {
-			seq = seq.Truncate(rs.t.Fields[i].Expr.EncodedWidth(), rs.t.Resolution, truncateBefore)
-			columns[i] = seq
-			if seq != nil {
-				hasActiveSequence = true
-			}
-		}
+type memstoreRow struct {
+	key     bytemap.ByteMap
+	columns []encoding.Sequence
+}
 
-		if !hasActiveSequence {
-			// all encoding.Sequences expired, remove key
-			return
-		}
+// sortedMemStoreRows returns the rows in the given tree, sorted by key. The
+// columns are copies so that they can be modified without affecting the tree.
+func sortedMemStoreRows(tree *bytetree.Tree, numFields int) []*memstoreRow {
+	rows := make([]*memstoreRow, 0, tree.Length())
+	tree.Walk(0, func(key []byte, data []encoding.Sequence) bool {
+		columns := make([]encoding.Sequence, numFields)
+		copy(columns, data)
+		rows = append(rows, &memstoreRow{bytemap.ByteMap(key), columns})
+		return true
+	})
+	sort.Sort(byKey(rows))
+	return rows
+}
 
-		rowLength := encoding.Width64bits + encoding.Width16bits + len(key) + encoding.Width16bits
-		for _, seq := range columns {
-			rowLength += encoding.Width64bits + len(seq)
-		}
+type byKey []*memstoreRow
 
-		var o io.Writer = cout
-		var buf *bytes.Buffer
-		if shouldSort {
-			// When sorting, we need to write the entire row as a single byte array,
-			// so use a ByteBuffer. We don't do this otherwise because we're already
-			// using a buffered writer, so we can avoid the copying
-			b := make([]byte, 0, rowLength)
-			buf = bytes.NewBuffer(b)
-			o = buf
-		}
+func (a byKey) Len() int           { return len(a) }
+func (a byKey) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byKey) Less(i, j int) bool { return bytes.Compare(a[i].key, a[j].key) < 0 }
 
-		err = binary.Write(o, encoding.Binary, uint64(rowLength))
-		if err != nil {
-			panic(err)
-		}
+// requestCompaction asks processCompactions to check for work without waiting
+// for it to do so.
+func (rs *rowStore) requestCompaction() {
+	select {
+	case rs.compactionRequested <- true:
+	default:
+		// compaction already requested
+	}
+}
 
-		err = binary.Write(o, encoding.Binary, uint16(len(key)))
-		if err != nil {
-			panic(err)
+func (rs *rowStore) processCompactions() {
+	defer close(rs.compactionsStopped)
+	for {
+		select {
+		case <-rs.stopCh:
+			return
+		case <-rs.compactionRequested:
+		case <-time.After(1 * time.Minute):
 		}
-		_, err = o.Write(key)
-		if err != nil {
-			panic(err)
+		rs.dropExpiredPartitions()
+		for rs.compact() {
 		}
+	}
+}
 
-		err = binary.Write(o, encoding.Binary, uint16(len(columns)))
-		if err != nil {
-			panic(err)
-		}
-		for _, seq := range columns {
-			err = binary.Write(o, encoding.Binary, uint64(len(seq)))
-			if err != nil {
-				panic(err)
-			}
-		}
-		for _, seq := range columns {
-			_, err = o.Write(seq)
-			if err != nil {
-				panic(err)
-			}
-		}
+// dropExpiredPartitions removes all segments for partitions that lie entirely
+// outside of the retention period from the file store. The files themselves
+// are deleted by removeOldFiles.
+func (rs *rowStore) dropExpiredPartitions() {
+	truncateBefore := rs.t.truncateBefore()
+	rs.mx.Lock()
+	fs, expired := rs.fileStore.withoutExpired(truncateBefore)
+	if len(expired) == 0 {
+		rs.mx.Unlock()
+		return
+	}
+	err := fs.writeManifest()
+	if err == nil {
+		rs.fileStore = fs
+	}
+	rs.mx.Unlock()
+	if err != nil {
+		rs.t.log.Errorf("Unable to drop expired partitions: %v", err)
+		return
+	}
+	rs.t.recordFileStore(fs)
+	rs.t.log.Debugf("Dropped %d segments for partitions before %v", len(expired), truncateBefore)
+}
 
-		if shouldSort {
-			// flush buffer
-			_b := buf.Bytes()
-			_, writeErr := cout.Write(_b)
-			if writeErr != nil {
-				panic(writeErr)
-			}
-		}
+// compact merges the oldest compactionFanIn segments of the lowest tier that
+// has at least that many segments within a single partition into a single
+// segment on the next tier, which takes the place of the merged segments. Data
+// that's outside of the retention period and columns for fields that are no
+// longer on the table are dropped in the process. Only one table compacts at a
+// time. compact returns true if it compacted something.
+func (rs *rowStore) compact() bool {
+	select {
+	case rs.t.db.compactionSemaphore <- true:
+	case <-rs.stopCh:
+		return false
 	}
+	defer func() {
+		<-rs.t.db.compactionSemaphore
+	}()
+
 	rs.mx.RLock()
-	fs := rs.fileStore
+	inputs, tier := rs.fileStore.compactionCandidates()
+	st := rs.t.currentStructure()
 	rs.mx.RUnlock()
-	fs.iterate(write, []*bytetree.Tree{req.memstore.tree})
-	err = cout.Close()
-	if err != nil {
-		panic(err)
+	if len(inputs) == 0 {
+		return false
 	}
 
-	fi, err := out.Stat()
+	rs.t.log.Debugf("Compacting %d segments on tier %d for partition %v", len(inputs), tier, inputs[0].PartitionStart)
+	start := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-rs.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	sw, err := newSegmentWriter(rs.opts.dir, st.fields, st.resolution, st.truncateBefore(rs.t.db.clock.Now()), inputs[len(inputs)-1].Offset)
+	if err != nil {
+		rs.t.log.Errorf("Unable to compact: %v", err)
+		return false
+	}
+	var writeErr error
+	in := &fileStore{t: rs.t, opts: rs.opts, segments: inputs}
+	err = in.merge(ctx, st, func(key bytemap.ByteMap, columns []encoding.Sequence) {
+		if writeErr == nil {
+			writeErr = sw.write(key, columns)
+		}
+	}, nil, nil)
+	if err == nil {
+		err = writeErr
+	}
 	if err != nil {
-		rs.t.log.Errorf("Unable to stat output file to get size: %v", err)
+		sw.abort()
+		if err != context.Canceled {
+			rs.t.log.Errorf("Unable to compact: %v", err)
+		}
+		return false
 	}
-	// Note - we left-pad the unix nano value to the widest possible length to
-	// ensure lexicographical sort matches time-based sort (e.g. on directory
-	// listing).
-	newFileStoreName := filepath.Join(rs.opts.dir, fmt.Sprintf("filestore_%020d_%d.dat", time.Now().UnixNano(), CurrentFileVersion))
-	err = os.Rename(out.Name(), newFileStoreName)
+	seg, err := sw.close(tier + 1)
 	if err != nil {
-		panic(err)
+		rs.t.log.Errorf("Unable to compact: %v", err)
+		return false
+	}
+	seg.PartitionStart = inputs[0].PartitionStart
+	seg.PartitionEnd = inputs[0].PartitionEnd
+	seg.StartOffset = inputs[0].StartOffset
+	for _, input := range inputs[1:] {
+		seg.StartOffset = earliestOffset(seg.StartOffset, input.StartOffset)
 	}
 
 	rs.mx.Lock()
-	delete(rs.memStores, req.idx)
-	rs.fileStore = &fileStore{rs.t, rs.opts, newFileStoreName}
+	fs := rs.fileStore.replacing(inputs, []*segment{seg})
+	err = fs.writeManifest()
+	if err == nil {
+		rs.fileStore = fs
+	}
 	rs.mx.Unlock()
-
-	flushDuration := time.Now().Sub(start)
-	rs.flushFinished <- flushDuration
-	if fi != nil {
-		rs.t.log.Debugf("Flushed to %v in %v, size %v. %v.", newFileStoreName, flushDuration, humanize.Bytes(uint64(fi.Size())), willSort)
-	} else {
-		rs.t.log.Debugf("Flushed to %v in %v. %v.", newFileStoreName, flushDuration, willSort)
+	if err != nil {
+		rs.t.log.Errorf("Unable to compact: %v", err)
+		return false
 	}
+
+	rs.t.recordFileStore(fs)
+	rs.t.log.Debugf("Compacted %d segments into %v on tier %d in %v, size %v", len(inputs), seg.Name, seg.Tier, time.Now().Sub(start), humanize.Bytes(uint64(seg.Bytes)))
+	return true
 }
 
+// removeOldFiles removes files that are no longer referenced by the manifest,
+// i.e. segments that have been compacted and file stores from prior versions.
 func (rs *rowStore) removeOldFiles() {
 	for {
-		time.Sleep(1 * time.Minute)
+		select {
+		case <-rs.stopCh:
+			return
+		case <-time.After(1 * time.Minute):
+		}
 		files, err := ioutil.ReadDir(rs.opts.dir)
 		if err != nil {
 			log.Errorf("Unable to list data files in %v: %v", rs.opts.dir, err)
 		}
+		rs.mx.RLock()
+		current := make(map[string]bool, len(rs.fileStore.segments))
+		for _, seg := range rs.fileStore.segments {
+			current[seg.Name] = true
+			current[indexFileFor(seg.Name)] = true
+		}
+		rs.mx.RUnlock()
 		now := time.Now()
-		// Note - the list of files is sorted by name, which in our case is the
-		// timestamp, so that means they're sorted chronologically. We don't want
-		// to delete the last file in the list because that's the current one.
-		for i := 0; i < len(files)-1; i++ {
-			file := files[i]
+		rs.t.db.snapshotMutex.Lock()
+		for _, file := range files {
+			if file.Name() == manifestFile || current[file.Name()] || strings.HasPrefix(file.Name(), quarantinePrefix) {
+				continue
+			}
 			name := filepath.Join(rs.opts.dir, file.Name())
-			// To be safe, we wait a little before deleting files
+			// To be safe, we wait a little before deleting files (this also avoids
+			// deleting new segments before they've been added to the manifest)
 			if now.Sub(file.ModTime()) > 5*time.Minute {
 				log.Debugf("Removing old file %v", name)
 				err := os.Remove(name)
 				if err != nil {
-					rs.t.log.Errorf("Unable to delete old file store %v, still consuming disk space unnecessarily: %v", name, err)
+					rs.t.log.Errorf("Unable to delete old file %v, still consuming disk space unnecessarily: %v", name, err)
 				}
 			}
 		}
+		rs.t.db.snapshotMutex.Unlock()
+	}
+}
+
+// convertLegacyFileStore converts a file store written prior to the
+// introduction of segments into sorted, partitioned segments.
+func (rs *rowStore) convertLegacyFileStore(filename string) (*fileStore, error) {
+	rs.t.log.Debugf("Converting %v to segments", filename)
+	st := rs.t.currentStructure()
+	sr, err := openSegment(filename, st.fields, st.resolution, func(i int) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	defer sr.close()
+
+	pw := newPartitionedWriter(rs.opts.dir, st.fields, st.resolution, st.truncateBefore(rs.t.db.clock.Now()), sr.offset, rs.t.PartitionPeriod, rs.opts.maxMemStoreBytes*5)
+	for {
+		key, columns, readErr := sr.read()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			pw.abort()
+			return nil, readErr
+		}
+		err = pw.write(key, columns)
+		if err != nil {
+			pw.abort()
+			return nil, fmt.Errorf("Unable to write row: %v", err)
+		}
+	}
+	segments, err := pw.close(0)
+	if err != nil {
+		return nil, err
+	}
+	rs.assignTiers(segments)
+	fs := &fileStore{t: rs.t, opts: rs.opts, segments: segments, offset: sr.offset}
+	return fs, fs.writeManifest()
+}
+
+// assignTiers puts converted segments on the tier that they would have reached
+// through compaction so that they don't get recompacted with every few flushes.
+func (rs *rowStore) assignTiers(segments []*segment) {
+	for _, seg := range segments {
+		seg.Tier = 0
+		for size := seg.Bytes; size > int64(rs.opts.maxMemStoreBytes); size /= compactionFanIn {
+			seg.Tier++
+		}
 	}
 }
 
-// fileStore stores rows on disk, encoding them as:
-//   rowLength|keylength|key|numcolumns|col1len|col2len|...|lastcollen|col1|col2|...|lastcol
+func totalBytes(segments []*segment) int64 {
+	total := int64(0)
+	for _, seg := range segments {
+		total += seg.Bytes
+	}
+	return total
+}
+
+// fileStore stores rows on disk in a list of sorted segments, in the order in
+// which the segments were created. A fileStore is immutable, flushes and
+// compactions replace it with a new fileStore.
 //
-// rowLength is 64 bits and includes itself
-// keylength is 16 bits and does not include itself
-// key can be up to 64KB
-// numcolumns is 16 bits (i.e. 65,536 columns allowed)
-// col*len is 64 bits
+// If a fileStore has dimFilters, rows from indexed segments that don't match
+// all of the dimFilters are skipped when iterating. Likewise, if a fileStore has
+// an asOf or until, row groups that don't contain data within that range are
+// skipped.
 type fileStore struct {
-	t        *table
-	opts     *rowStoreOptions
-	filename string
+	t          *table
+	opts       *rowStoreOptions
+	segments   []*segment
+	offset     wal.Offset
+	dimFilters []*sql.DimFilter
+	asOf       time.Time
+	until      time.Time
 }
 
-func (fs *fileStore) iterate(onRow func(bytemap.ByteMap, []encoding.Sequence), memStores []*bytetree.Tree, fields ...string) error {
-	ctx := time.Now().UnixNano()
+func (fs *fileStore) withOffset(offset wal.Offset) *fileStore {
+	return &fileStore{t: fs.t, opts: fs.opts, segments: fs.segments, offset: offset}
+}
 
-	if fs.t.log.IsTraceEnabled() {
-		fs.t.log.Tracef("Iterating with %d memstores from file %v", len(memStores), fs.filename)
+func (fs *fileStore) withFilters(dimFilters []*sql.DimFilter) *fileStore {
+	return &fileStore{t: fs.t, opts: fs.opts, segments: fs.segments, offset: fs.offset, dimFilters: dimFilters, asOf: fs.asOf, until: fs.until}
+}
+
+func (fs *fileStore) withSegments(segs ...*segment) *fileStore {
+	if len(segs) == 0 {
+		return fs
 	}
+	segments := make([]*segment, 0, len(fs.segments)+len(segs))
+	segments = append(segments, fs.segments...)
+	segments = append(segments, segs...)
+	return &fileStore{t: fs.t, opts: fs.opts, segments: segments, offset: fs.offset}
+}
 
-	truncateBefore := fs.t.truncateBefore()
-	var includeField func(int) bool
-	if len(fields) == 0 {
-		includeField = func(i int) bool {
-			return true
+// replacing returns a fileStore in which the given inputs have been replaced by
+// segs, which take the position of the first input.
+func (fs *fileStore) replacing(inputs []*segment, segs []*segment) *fileStore {
+	replaced := make(map[*segment]bool, len(inputs))
+	for _, input := range inputs {
+		replaced[input] = true
+	}
+	segments := make([]*segment, 0, len(fs.segments)-len(inputs)+len(segs))
+	for _, candidate := range fs.segments {
+		if !replaced[candidate] {
+			segments = append(segments, candidate)
+		} else if candidate == inputs[0] {
+			segments = append(segments, segs...)
 		}
-	} else {
-		includedFields := make([]bool, 0, len(fs.t.Fields))
-		for _, field := range fs.t.Fields {
-			includeThisField := len(fields) == 0
-			if !includeThisField {
-				for _, fieldName := range fields {
-					if fieldName == field.Name {
-						includeThisField = true
-						break
-					}
+	}
+	return &fileStore{t: fs.t, opts: fs.opts, segments: segments, offset: fs.offset}
+}
+
+// withoutExpired returns a fileStore without the segments for partitions that
+// end at or before truncateBefore, along with the segments that were removed.
+func (fs *fileStore) withoutExpired(truncateBefore time.Time) (*fileStore, []*segment) {
+	var segments, expired []*segment
+	for _, seg := range fs.segments {
+		if seg.partitioned() && !seg.PartitionEnd.After(truncateBefore) {
+			expired = append(expired, seg)
+		} else {
+			segments = append(segments, seg)
+		}
+	}
+	return &fileStore{t: fs.t, opts: fs.opts, segments: segments, offset: fs.offset}, expired
+}
+
+// tierKey identifies a tier within a partition. Partitions are identified by
+// both their start and end, since segments written before and after a change
+// to the table's PartitionPeriod may start at the same time but end at
+// different times.
+type tierKey struct {
+	partition    int64
+	partitionEnd int64
+	tier         int
+}
+
+// compactionCandidates returns the oldest compactionFanIn segments of the
+// lowest tier that has at least that many segments within a single partition,
+// along with that tier. All of the returned segments have the same partition
+// bounds.
+func (fs *fileStore) compactionCandidates() ([]*segment, int) {
+	byTier := make(map[tierKey][]*segment)
+	tiers := make([]tierKey, 0)
+	for _, seg := range fs.segments {
+		if !seg.partitioned() {
+			continue
+		}
+		key := tierKey{seg.PartitionStart.UnixNano(), seg.PartitionEnd.UnixNano(), seg.Tier}
+		if byTier[key] == nil {
+			tiers = append(tiers, key)
+		}
+		byTier[key] = append(byTier[key], seg)
+	}
+	sort.Sort(byTierAndPartition(tiers))
+	for _, key := range tiers {
+		if len(byTier[key]) >= compactionFanIn {
+			return byTier[key][:compactionFanIn], key.tier
+		}
+	}
+	return nil, 0
+}
+
+type byTierAndPartition []tierKey
+
+func (a byTierAndPartition) Len() int      { return len(a) }
+func (a byTierAndPartition) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byTierAndPartition) Less(i, j int) bool {
+	if a[i].tier != a[j].tier {
+		return a[i].tier < a[j].tier
+	}
+	if a[i].partition != a[j].partition {
+		return a[i].partition < a[j].partition
+	}
+	return a[i].partitionEnd < a[j].partitionEnd
+}
+
+// withinRange returns a fileStore containing only the segments that may hold
+// data for periods after asOf and up to until, which also skips row groups
+// outside of that range when iterating. Zero values for asOf and until are
+// unbounded.
+func (fs *fileStore) withinRange(asOf time.Time, until time.Time) *fileStore {
+	segments := make([]*segment, 0, len(fs.segments))
+	for _, seg := range fs.segments {
+		if seg.overlaps(asOf, until) {
+			segments = append(segments, seg)
+		}
+	}
+	return &fileStore{t: fs.t, opts: fs.opts, segments: segments, offset: fs.offset, asOf: asOf, until: until}
+}
+
+func (fs *fileStore) writeManifest() error {
+	return writeManifest(fs.opts.dir, &manifest{Segments: fs.segments, Offset: fs.offset})
+}
+
+// iterate iterates over the rows in this fileStore and the given memstores,
+// which must all have been written with the given structure.
+func (fs *fileStore) iterate(ctx context.Context, st *structure, onRow func(bytemap.ByteMap, []encoding.Sequence), memStores []*bytetree.Tree, fields ...string) error {
+	tableFields := st.fields
+	var includeField func(int) bool
+	if len(fields) > 0 {
+		includedFields := make([]bool, 0, len(tableFields))
+		for _, field := range tableFields {
+			includeThisField := false
+			for _, fieldName := range fields {
+				if fieldName == field.Name {
+					includeThisField = true
+					break
 				}
 			}
 			includedFields = append(includedFields, includeThisField)
@@ -472,173 +1009,135 @@ func (fs *fileStore) iterate(onRow func(bytemap.ByteMap, []encoding.Sequence), m
 			return includedFields[i]
 		}
 	}
+	return fs.merge(ctx, st, onRow, memStores, includeField)
+}
 
-	file, err := os.OpenFile(fs.filename, os.O_RDONLY, 0)
-	if !os.IsNotExist(err) {
-		if err != nil {
-			return fmt.Errorf("Unable to open file %v: %v", fs.filename, err)
-		}
-		r := snappy.NewReader(file)
-
-		fileVersion := versionFor(fs.filename)
-		fileFields := fs.t.Fields
-		if fileVersion >= FileVersion_2 {
-			// File contains header with field info, use it
-			headerLength := uint32(0)
-			lengthErr := binary.Read(r, encoding.Binary, &headerLength)
-			if lengthErr != nil {
-				return fmt.Errorf("Unexpected error reading header length: %v", lengthErr)
-			}
-			fieldsBytes := make([]byte, headerLength)
-			_, err = io.ReadFull(r, fieldsBytes)
-			if err != nil {
-				return err
+// merge merges the rows from all segments and the given memstores, calling
+// onRow for each distinct key in key order (followed by keys that are only in
+// the memstores, in no particular order). Columns are laid out according to the
+// given structure. If includeField is nil, all fields are included.
+func (fs *fileStore) merge(ctx context.Context, st *structure, onRow func(bytemap.ByteMap, []encoding.Sequence), memStores []*bytetree.Tree, includeField func(int) bool) error {
+	tableFields := st.fields
+	resolution := st.resolution
+	walkCtx := time.Now().UnixNano()
+
+	if fs.t.log.IsTraceEnabled() {
+		fs.t.log.Tracef("Iterating with %d memstores from %d segments", len(memStores), len(fs.segments))
+	}
+
+	truncateBefore := st.truncateBefore(fs.t.db.clock.Now())
+	if includeField == nil {
+		includeField = func(i int) bool {
+			return true
+		}
+	}
+
+	// mergeColumns merges columns2 into columns and returns true if columns2
+	// contained any data
+	mergeColumns := func(columns []encoding.Sequence, columns2 []encoding.Sequence) bool {
+		merged := false
+		for i, field := range tableFields {
+			if !includeField(i) {
+				continue
 			}
-			if fileVersion >= FileVersion_4 {
-				// Strip offset
-				fieldsBytes = fieldsBytes[wal.OffsetSize:]
+			if i >= len(columns2) {
+				continue
 			}
-			delim := fieldsDelims[fileVersion]
-			fieldStrings := strings.Split(string(fieldsBytes), delim)
-			fileFields = make([]sql.Field, 0, len(fieldStrings))
-			for _, fieldString := range fieldStrings {
-				foundField := false
-				for _, field := range fs.t.Fields {
-					if fieldString == field.String() {
-						fileFields = append(fileFields, field)
-						foundField = true
-						break
-					}
-				}
-				if !foundField {
-					panic(fmt.Errorf("Unable to find field %v on table %v", fieldString, fs.t.Name))
-				}
+			column2 := columns2[i]
+			if column2 == nil {
+				continue
 			}
-		}
-
-		reverseFileFieldIndexes := make([]int, 0, len(fields))
-		for _, candidate := range fileFields {
-			idx := -1
-			for i, field := range fs.t.Fields {
-				if includeField(i) && field.String() == candidate.String() {
-					idx = i
-				}
+			merged = true
+			column := columns[i]
+			if column == nil {
+				// Nothing to merge, just use column2
+				columns[i] = column2
+				continue
 			}
-			reverseFileFieldIndexes = append(reverseFileFieldIndexes, idx)
+			// merge
+			columns[i] = column.Merge(column2, field.Expr, resolution, truncateBefore)
 		}
+		return merged
+	}
 
-		// Read from file
-		for {
-			rowLength := uint64(0)
-			err := binary.Read(r, encoding.Binary, &rowLength)
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return fmt.Errorf("Unexpected error reading row length: %v", err)
-			}
+	var filterDims map[string]bool
+	if len(fs.dimFilters) > 0 {
+		filterDims = dimsOf(fs.dimFilters)
+	}
 
-			row := make([]byte, rowLength)
-			encoding.Binary.PutUint64(row, rowLength)
-			row = row[encoding.Width64bits:]
-			_, err = io.ReadFull(r, row)
-			if err != nil {
-				return fmt.Errorf("Unexpected error while reading row: %v", err)
+	rows := make(rowHeap, 0, len(fs.segments))
+	for _, seg := range fs.segments {
+		sr, err := openSegment(filepath.Join(fs.opts.dir, seg.Name), tableFields, resolution, includeField)
+		if err != nil {
+			return err
+		}
+		defer sr.close()
+		sr.onlyWithin(fs.asOf, fs.until)
+		if filterDims != nil && sr.indexed() {
+			idx, indexErr := readIndex(fs.opts.dir, seg.Name, filterDims)
+			if indexErr != nil {
+				// Fall back to reading the whole segment
+				fs.t.log.Error(indexErr)
+			} else if idx != nil {
+				sr.onlyRows(idx.matchingRows(fs.dimFilters))
 			}
+		}
+		key, columns, err := sr.read()
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		rows = append(rows, &segmentRow{sr, key, columns})
+	}
+	heap.Init(&rows)
 
-			keyLength, row := encoding.ReadInt16(row)
-			key, row := encoding.ReadByteMap(row, keyLength)
+	// Read from segments
+	for len(rows) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 
-			numColumns, row := encoding.ReadInt16(row)
-			colLengths := make([]int, 0, numColumns)
-			for i := 0; i < numColumns; i++ {
-				var colLength int
-				colLength, row = encoding.ReadInt64(row)
-				colLengths = append(colLengths, int(colLength))
+		key := rows[0].key
+		columns := make([]encoding.Sequence, len(tableFields))
+		includesAtLeastOneColumn := false
+		for len(rows) > 0 && bytes.Equal(rows[0].key, key) {
+			if mergeColumns(columns, rows[0].columns) {
+				includesAtLeastOneColumn = true
 			}
-
-			includesAtLeastOneColumn := false
-			columns := make([]encoding.Sequence, len(fs.t.Fields))
-			for i, colLength := range colLengths {
-				var seq encoding.Sequence
-				seq, row = encoding.ReadSequence(row, colLength)
-				idx := reverseFileFieldIndexes[i]
-				if idx > -1 {
-					columns[idx] = seq
-					if seq != nil {
-						includesAtLeastOneColumn = true
-					}
-				}
-				if fs.t.log.IsTraceEnabled() {
-					fs.t.log.Tracef("File Read: %v", seq.String(fileFields[i].Expr))
-				}
+			err := rows.advance()
+			if err != nil {
+				return err
 			}
+		}
 
-			for _, ms := range memStores {
-				columns2 := ms.Remove(ctx, key)
-
-				// Merge memStore columns into fileStore columns
-				for i, field := range fs.t.Fields {
-					if !includeField(i) {
-						continue
-					}
-					if i >= len(columns2) {
-						continue
-					}
-					column2 := columns2[i]
-					if column2 == nil {
-						continue
-					}
-					includesAtLeastOneColumn = true
-					column := columns[i]
-					if column == nil {
-						// Nothing to merge, just use column2
-						columns[i] = column2
-						continue
-					}
-					// merge
-					columns[i] = column.Merge(column2, field.Expr, fs.t.Resolution, truncateBefore)
-				}
+		for _, ms := range memStores {
+			if mergeColumns(columns, ms.Remove(walkCtx, key)) {
+				includesAtLeastOneColumn = true
 			}
+		}
 
-			if includesAtLeastOneColumn {
-				onRow(key, columns)
-			}
+		if includesAtLeastOneColumn {
+			onRow(key, columns)
 		}
 	}
 
 	// Read remaining stuff from mem stores
 	for s, ms := range memStores {
-		ms.Walk(ctx, func(key []byte, columns1 []encoding.Sequence) bool {
-			columns := make([]encoding.Sequence, len(fs.t.Fields))
-			for i, column := range columns1 {
-				if includeField(i) {
-					columns[i] = column
-				}
+		ms.Walk(walkCtx, func(key []byte, columns1 []encoding.Sequence) bool {
+			select {
+			case <-ctx.Done():
+				// Query cancelled, skip remaining rows
+				return false
+			default:
 			}
+			columns := make([]encoding.Sequence, len(tableFields))
+			mergeColumns(columns, columns1)
 			for j := s + 1; j < len(memStores); j++ {
-				ms2 := memStores[j]
-				columns2 := ms2.Remove(ctx, key)
-				for i, field := range fs.t.Fields {
-					if !includeField(i) {
-						continue
-					}
-					if i >= len(columns2) {
-						continue
-					}
-					column2 := columns2[i]
-					if column2 == nil {
-						continue
-					}
-					column := columns[i]
-					if column == nil {
-						// Nothing to merge, just use column2
-						columns[i] = column2
-						continue
-					}
-					// merge
-					columns[i] = column.Merge(column2, field.Expr, fs.t.Resolution, truncateBefore)
-				}
+				mergeColumns(columns, memStores[j].Remove(walkCtx, key))
 			}
 			onRow(bytemap.ByteMap(key), columns)
 
@@ -646,7 +1145,7 @@ func (fs *fileStore) iterate(onRow func(bytemap.ByteMap, []encoding.Sequence), m
 		})
 	}
 
-	return nil
+	return ctx.Err()
 }
 
 func versionFor(filename string) int {
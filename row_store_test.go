@@ -1,12 +1,24 @@
 package zenodb
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/getlantern/bytemap"
 	"github.com/getlantern/golog"
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/sql"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 )
 
 func TestStorage(t *testing.T) {
@@ -22,12 +34,512 @@ func TestStorage(t *testing.T) {
 	cs, _, err := tb.openRowStore(&rowStoreOptions{
 		dir:              tmpDir,
 		maxMemStoreBytes: 1,
-	})
+	}, nil)
 	if !assert.NoError(t, err) {
 		return
 	}
 
 	if false {
-		cs.insert(&insert{})
+		cs.insert([]*insert{&insert{}}, false)
 	}
 }
+
+func TestSegmentMerge(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	resolution := time.Minute
+	now := time.Now().Truncate(resolution)
+	fields := []sql.Field{sql.NewField("a", expr.SUM("a"))}
+	tb := &table{
+		TableOpts: &TableOpts{RetentionPeriod: time.Hour},
+		Query:     sql.Query{Fields: fields, Resolution: resolution},
+		db:        &DB{clock: vtime.RealClock},
+		log:       golog.LoggerFor("segmenttest"),
+	}
+	tb.initStructure()
+	opts := &rowStoreOptions{dir: tmpDir}
+
+	writeSegment := func(vals map[string]float64) *segment {
+		sw, err := newSegmentWriter(tmpDir, fields, resolution, tb.truncateBefore(), nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		for _, key := range []string{"k1", "k2", "k3"} {
+			val, found := vals[key]
+			if !found {
+				continue
+			}
+			var seq encoding.Sequence
+			seq = seq.Update(encoding.NewTSParams(now, bytemap.NewFloat(map[string]float64{"a": val})), nil, fields[0].Expr, resolution, tb.truncateBefore())
+			assert.NoError(t, sw.write(bytemap.New(map[string]interface{}{"k": key}), []encoding.Sequence{seq}))
+		}
+		seg, err := sw.close(0)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		seg.PartitionStart = now.Truncate(24 * time.Hour)
+		seg.PartitionEnd = seg.PartitionStart.Add(24 * time.Hour)
+		return seg
+	}
+
+	fs := &fileStore{t: tb, opts: opts}
+	fs = fs.withSegments(
+		writeSegment(map[string]float64{"k1": 1, "k3": 3}),
+		writeSegment(map[string]float64{"k1": 10, "k2": 20}),
+		writeSegment(map[string]float64{"k3": 30}))
+
+	results := make(map[string]float64)
+	var keys []string
+	err = fs.iterate(context.Background(), tb.currentStructure(), func(key bytemap.ByteMap, columns []encoding.Sequence) {
+		k := key.Get("k").(string)
+		keys = append(keys, k)
+		val, _ := columns[0].ValueAtTime(now, fields[0].Expr, resolution)
+		results[k] = val
+	}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"k1", "k2", "k3"}, keys, "Rows should be merged in key order")
+	assert.Equal(t, map[string]float64{"k1": 11, "k2": 20, "k3": 33}, results)
+
+	candidates, _ := fs.compactionCandidates()
+	assert.Empty(t, candidates, "Should not compact fewer than compactionFanIn segments")
+	fs = fs.withSegments(writeSegment(map[string]float64{"k2": 2}))
+	candidates, tier := fs.compactionCandidates()
+	assert.Len(t, candidates, compactionFanIn)
+	assert.Equal(t, 0, tier)
+
+	partition := fs.segments[0].PartitionStart
+	assert.Len(t, fs.withinRange(partition.Add(-24*time.Hour), partition).segments, len(fs.segments))
+	assert.Empty(t, fs.withinRange(partition.Add(24*time.Hour), time.Time{}).segments, "Should skip partitions before asOf")
+	assert.Empty(t, fs.withinRange(time.Time{}, partition.Add(-1*time.Hour)).segments, "Should skip partitions after until")
+	_, expired := fs.withoutExpired(partition.Add(24 * time.Hour))
+	assert.Len(t, expired, len(fs.segments))
+	_, expired = fs.withoutExpired(partition)
+	assert.Empty(t, expired)
+}
+
+func TestCompactionCandidatesAfterPartitionPeriodChange(t *testing.T) {
+	start := time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)
+	partitionSegment := func(partitionPeriod time.Duration) *segment {
+		return &segment{PartitionStart: start, PartitionEnd: start.Add(partitionPeriod)}
+	}
+	fs := &fileStore{}
+	for i := 0; i < compactionFanIn-1; i++ {
+		fs = fs.withSegments(partitionSegment(24*time.Hour), partitionSegment(time.Hour))
+	}
+	candidates, _ := fs.compactionCandidates()
+	assert.Empty(t, candidates, "Segments with different partition ends shouldn't be compacted together")
+
+	fs = fs.withSegments(partitionSegment(time.Hour))
+	candidates, _ = fs.compactionCandidates()
+	if assert.Len(t, candidates, compactionFanIn) {
+		for _, seg := range candidates {
+			assert.Equal(t, start.Add(time.Hour), seg.PartitionEnd)
+		}
+	}
+}
+
+func TestSegmentIndex(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	resolution := time.Minute
+	now := time.Now().Truncate(resolution)
+	fields := []sql.Field{sql.NewField("a", expr.SUM("a"))}
+	tb := &table{
+		TableOpts: &TableOpts{RetentionPeriod: time.Hour},
+		Query:     sql.Query{Fields: fields, Resolution: resolution},
+		db:        &DB{clock: vtime.RealClock},
+		log:       golog.LoggerFor("indextest"),
+	}
+	tb.initStructure()
+
+	// Write enough rows to span multiple row groups
+	numRows := 10000
+	keys := make([]bytemap.ByteMap, 0, numRows)
+	for i := 0; i < numRows; i++ {
+		keys = append(keys, bytemap.New(map[string]interface{}{"i": i, "mod": i % 10}))
+	}
+	sort.Sort(byteMaps(keys))
+	sw, err := newSegmentWriter(tmpDir, fields, resolution, tb.truncateBefore(), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, key := range keys {
+		var seq encoding.Sequence
+		seq = seq.Update(encoding.NewTSParams(now, bytemap.NewFloat(map[string]float64{"a": 1})), nil, fields[0].Expr, resolution, tb.truncateBefore())
+		assert.NoError(t, sw.write(key, []encoding.Sequence{seq}))
+	}
+	seg, err := sw.close(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	q, err := sql.Parse("SELECT a FROM t WHERE mod = 3 AND i IN (3, 13, 14, 9993)", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fs := (&fileStore{t: tb, opts: &rowStoreOptions{dir: tmpDir}}).withSegments(seg).withFilters(q.DimFilters)
+	var matched []int
+	err = fs.iterate(context.Background(), tb.currentStructure(), func(key bytemap.ByteMap, columns []encoding.Sequence) {
+		matched = append(matched, key.Get("i").(int))
+		val, _ := columns[0].ValueAtTime(now, fields[0].Expr, resolution)
+		assert.EqualValues(t, 1, val)
+	}, nil)
+	if assert.NoError(t, err) {
+		sort.Ints(matched)
+		assert.Equal(t, []int{3, 13, 9993}, matched, "Should only read rows matching the index")
+	}
+
+	rows := 0
+	err = fs.withFilters(nil).iterate(context.Background(), tb.currentStructure(), func(key bytemap.ByteMap, columns []encoding.Sequence) {
+		rows++
+	}, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, numRows, rows, "Unfiltered iteration should read all rows")
+	}
+}
+
+func TestColumnProjection(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	resolution := time.Minute
+	now := time.Now().Truncate(resolution)
+	fields := []sql.Field{sql.NewField("a", expr.SUM("a")), sql.NewField("b", expr.SUM("b"))}
+	tb := &table{
+		TableOpts: &TableOpts{RetentionPeriod: time.Hour},
+		Query:     sql.Query{Fields: fields, Resolution: resolution},
+		db:        &DB{clock: vtime.RealClock},
+		log:       golog.LoggerFor("projectiontest"),
+	}
+	tb.initStructure()
+
+	// Write rows out of order so that they get sorted, spanning multiple row
+	// groups
+	numRows := 10000
+	sw, err := newSegmentWriter(tmpDir, fields, resolution, tb.truncateBefore(), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, sw.sortRows(1024*1024)) {
+		return
+	}
+	for i := numRows - 1; i >= 0; i-- {
+		params := encoding.NewTSParams(now, bytemap.NewFloat(map[string]float64{"a": 1, "b": 2}))
+		columns := make([]encoding.Sequence, 0, len(fields))
+		for _, field := range fields {
+			var seq encoding.Sequence
+			columns = append(columns, seq.Update(params, nil, field.Expr, resolution, tb.truncateBefore()))
+		}
+		assert.NoError(t, sw.write(bytemap.New(map[string]interface{}{"i": i}), columns))
+	}
+	seg, err := sw.close(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	fs := (&fileStore{t: tb, opts: &rowStoreOptions{dir: tmpDir}}).withSegments(seg)
+	rows := 0
+	var lastKey bytemap.ByteMap
+	err = fs.iterate(context.Background(), tb.currentStructure(), func(key bytemap.ByteMap, columns []encoding.Sequence) {
+		rows++
+		assert.True(t, bytes.Compare(lastKey, key) < 0, "Rows should be sorted")
+		lastKey = key
+		assert.Nil(t, columns[0], "Unused column should not be read")
+		val, _ := columns[1].ValueAtTime(now, fields[1].Expr, resolution)
+		assert.EqualValues(t, 2, val)
+	}, nil, "b")
+	if assert.NoError(t, err) {
+		assert.Equal(t, numRows, rows)
+	}
+
+	q, err := sql.Parse("SELECT a FROM t WHERE i IN (5, 9999)", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var matched []int
+	err = fs.withFilters(q.DimFilters).iterate(context.Background(), tb.currentStructure(), func(key bytemap.ByteMap, columns []encoding.Sequence) {
+		matched = append(matched, key.Get("i").(int))
+		val, _ := columns[0].ValueAtTime(now, fields[0].Expr, resolution)
+		assert.EqualValues(t, 1, val)
+		assert.Nil(t, columns[1], "Unused column should not be read")
+	}, nil, "a")
+	if assert.NoError(t, err) {
+		sort.Ints(matched)
+		assert.Equal(t, []int{5, 9999}, matched, "Sorted segments should be indexed")
+	}
+}
+
+func TestRowGroupTimeRange(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	resolution := time.Minute
+	now := time.Now().Truncate(resolution)
+	old := now.Add(-10 * time.Hour)
+	fields := []sql.Field{sql.NewField("a", expr.SUM("a"))}
+	tb := &table{
+		TableOpts: &TableOpts{RetentionPeriod: 24 * time.Hour},
+		Query:     sql.Query{Fields: fields, Resolution: resolution},
+		db:        &DB{clock: vtime.RealClock},
+		log:       golog.LoggerFor("timerangetest"),
+	}
+	tb.initStructure()
+
+	// The first half of the rows only has old data, the second half only has
+	// recent data
+	numRows := 10000
+	keys := make([]bytemap.ByteMap, 0, numRows)
+	for i := 0; i < numRows; i++ {
+		keys = append(keys, bytemap.New(map[string]interface{}{"i": i}))
+	}
+	sort.Sort(byteMaps(keys))
+	sw, err := newSegmentWriter(tmpDir, fields, resolution, tb.truncateBefore(), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for i, key := range keys {
+		ts := now
+		if i < numRows/2 {
+			ts = old
+		}
+		var seq encoding.Sequence
+		seq = seq.Update(encoding.NewTSParams(ts, bytemap.NewFloat(map[string]float64{"a": 1})), nil, fields[0].Expr, resolution, tb.truncateBefore())
+		assert.NoError(t, sw.write(key, []encoding.Sequence{seq}))
+	}
+	seg, err := sw.close(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	fs := (&fileStore{t: tb, opts: &rowStoreOptions{dir: tmpDir}}).withSegments(seg)
+	countRows := func(fs *fileStore) (int, int) {
+		oldRows, newRows := 0, 0
+		err := fs.iterate(context.Background(), tb.currentStructure(), func(key bytemap.ByteMap, columns []encoding.Sequence) {
+			if columns[0].Start().Equal(old) {
+				oldRows++
+			} else {
+				newRows++
+			}
+		}, nil)
+		assert.NoError(t, err)
+		return oldRows, newRows
+	}
+
+	oldRows, newRows := countRows(fs)
+	assert.Equal(t, numRows/2, oldRows)
+	assert.Equal(t, numRows/2, newRows)
+
+	oldRows, newRows = countRows(fs.withinRange(now.Add(-1*time.Hour), time.Time{}))
+	assert.True(t, oldRows < numRows/2, "Row groups with only old data should have been skipped")
+	assert.Equal(t, numRows/2, newRows, "Row groups with recent data should have been read")
+
+	oldRows, newRows = countRows(fs.withinRange(time.Time{}, now.Add(-1*time.Hour)))
+	assert.Equal(t, numRows/2, oldRows, "Row groups with old data should have been read")
+	assert.True(t, newRows < numRows/2, "Row groups with only recent data should have been skipped")
+}
+
+func TestFlushRetry(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	resolution := time.Minute
+	now := time.Now().Truncate(resolution)
+	fields := []sql.Field{sql.NewField("a", expr.SUM("a"))}
+	tb := &table{
+		TableOpts: &TableOpts{Name: "flushtest", RetentionPeriod: time.Hour, PartitionPeriod: 24 * time.Hour},
+		Query:     sql.Query{Fields: fields, Resolution: resolution},
+		db:        &DB{opts: &DBOpts{Dir: tmpDir}, clock: vtime.RealClock, compactionSemaphore: make(chan bool, 1)},
+		log:       golog.LoggerFor("flushtest"),
+	}
+	tb.initStructure()
+	dir := filepath.Join(tmpDir, "flushtest")
+	rs, _, err := tb.openRowStore(&rowStoreOptions{
+		dir:              dir,
+		maxMemStoreBytes: 1,
+		minFlushLatency:  10 * time.Millisecond,
+		maxFlushLatency:  50 * time.Millisecond,
+	}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tb.rowStore = rs
+	defer rs.stop(false)
+
+	waitFor := func(cond func() bool) bool {
+		for i := 0; i < 100; i++ {
+			if cond() {
+				return true
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return false
+	}
+	countRows := func() int {
+		rows := 0
+		err := rs.iterate(context.Background(), nil, time.Time{}, time.Time{}, nil, func(key bytemap.ByteMap, fields []sql.Field, columns []encoding.Sequence) {
+			rows++
+		})
+		assert.NoError(t, err)
+		return rows
+	}
+
+	// Make flushes fail by removing the table's directory
+	if !assert.NoError(t, os.RemoveAll(dir)) {
+		return
+	}
+	rs.insert([]*insert{&insert{
+		key:    bytemap.New(map[string]interface{}{"dim": "x"}),
+		vals:   encoding.NewTSParams(now, bytemap.NewFloat(map[string]float64{"a": 1})),
+		offset: wal.NewOffset(0, 1),
+	}}, false)
+	if !assert.True(t, waitFor(rs.failingToFlush), "Flush should have failed") {
+		return
+	}
+	stats := tb.currentStats()
+	assert.True(t, stats.FlushErrors > 0)
+	assert.False(t, stats.FlushFailingSince.IsZero())
+	assert.NotEmpty(t, stats.LastFlushError)
+	assert.Equal(t, 1, countRows(), "Data should be kept in memstore while flushes fail")
+
+	// Alterations fail instead of waiting for flushes to succeed
+	alt := &alteration{opts: tb.TableOpts, fields: fields, resolution: 2 * resolution, done: make(chan bool)}
+	rs.alterations <- alt
+	select {
+	case <-alt.done:
+		assert.Error(t, alt.err, "Alteration should have failed")
+	case <-time.After(1 * time.Second):
+		t.Fatal("Alteration should have failed while flushes are failing")
+	}
+	assert.Equal(t, resolution, tb.resolution(), "Failed alteration shouldn't have been applied")
+
+	// Let flushes succeed again
+	if !assert.NoError(t, os.MkdirAll(dir, 0755)) {
+		return
+	}
+	if !assert.True(t, waitFor(func() bool { return !rs.failingToFlush() }), "Flush should have been retried") {
+		return
+	}
+	stats = tb.currentStats()
+	assert.True(t, stats.FlushFailingSince.IsZero())
+	assert.Empty(t, stats.LastFlushError)
+	m, err := readManifest(dir)
+	if assert.NoError(t, err) && assert.NotNil(t, m) {
+		assert.Len(t, m.Segments, 1)
+	}
+	assert.Equal(t, 1, countRows())
+}
+
+func TestInsertPolicy(t *testing.T) {
+	rs := &rowStore{inserts: make(chan []*insert, 1), queueSlots: make(chan bool, 1)}
+	tb := &table{
+		TableOpts:    &TableOpts{Name: "policytest"},
+		Query:        sql.Query{From: "stream"},
+		rowStore:     rs,
+		log:          golog.LoggerFor("policytest"),
+		stopCh:       make(chan interface{}),
+		streamBehind: new(int32),
+	}
+	rs.t = tb
+	db := &DB{tables: map[string]*table{tb.Name: tb}, orderedTables: []*table{tb}, streamsBehind: map[string]*int32{"stream": tb.streamBehind}}
+	behind := func() bool {
+		return atomic.LoadInt32(db.streamsBehind["stream"]) > 0
+	}
+
+	tb.applyInsertPolicy(InsertPolicyReject)
+	assert.False(t, behind(), "Table with empty queue shouldn't be behind")
+	assert.True(t, rs.insert([]*insert{&insert{}}, true))
+	assert.Equal(t, int64(1), tb.currentStats().QueueDepth)
+	assert.True(t, behind(), "Table with full queue should be behind")
+	db.recordRejected("stream", 5)
+	db.recordRejected("otherstream", 7)
+	assert.Equal(t, int64(5), tb.currentStats().RejectedPoints)
+
+	tb.applyInsertPolicy(InsertPolicyBlock)
+	assert.False(t, behind(), "Only tables that reject should hold back inserts")
+
+	tb.applyInsertPolicy(InsertPolicyReject)
+	assert.True(t, behind())
+	<-rs.inserts
+	rs.releaseSlots(1)
+	tb.updateBehind()
+	assert.False(t, behind(), "Table should catch up once its queue has room")
+
+	tb.applyInsertPolicy(InsertPolicyDrop)
+	assert.True(t, rs.insert([]*insert{&insert{}}, true))
+	assert.False(t, rs.insert([]*insert{&insert{}}, true), "Insert into full queue should have been dropped")
+}
+
+func TestInsertQueueBoundByPoints(t *testing.T) {
+	rs := &rowStore{inserts: make(chan []*insert, 3), queueSlots: make(chan bool, 3)}
+	tb := &table{rowStore: rs, stopCh: make(chan interface{})}
+	rs.t = tb
+
+	assert.True(t, rs.insert([]*insert{&insert{}, &insert{}}, true))
+	assert.Equal(t, 2, rs.queueDepth())
+	assert.False(t, rs.queueFull())
+	assert.False(t, rs.insert([]*insert{&insert{}, &insert{}}, true), "Batch that doesn't fit should have been dropped")
+	assert.Equal(t, 2, rs.queueDepth(), "Dropped batch shouldn't take up room in queue")
+	assert.True(t, rs.insert([]*insert{&insert{}}, true))
+	assert.True(t, rs.queueFull())
+
+	// Processing an entry frees up room for its points
+	batch := <-rs.inserts
+	rs.releaseSlots(rs.slotsFor(batch))
+	assert.Equal(t, 1, rs.queueDepth())
+	<-rs.inserts
+	rs.releaseSlots(1)
+
+	// A batch larger than the queue fills it by itself
+	assert.True(t, rs.insert([]*insert{&insert{}, &insert{}, &insert{}, &insert{}}, false))
+	assert.True(t, rs.queueFull())
+	assert.Equal(t, 3, rs.slotsFor(<-rs.inserts))
+}
+
+func TestInsertGivesUpOnStop(t *testing.T) {
+	rs := &rowStore{inserts: make(chan []*insert, 1), queueSlots: make(chan bool, 1)}
+	tb := &table{rowStore: rs, stopCh: make(chan interface{})}
+	rs.t = tb
+	assert.True(t, rs.insert([]*insert{&insert{}}, false))
+
+	result := make(chan bool)
+	go func() {
+		result <- rs.insert([]*insert{&insert{}}, false)
+	}()
+	select {
+	case <-result:
+		t.Fatal("Insert into full queue should have blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(tb.stopCh)
+	select {
+	case queued := <-result:
+		assert.False(t, queued, "Insert shouldn't have been queued once stopping")
+	case <-time.After(1 * time.Second):
+		t.Fatal("Insert should have given up once stopping")
+	}
+}
+
+type byteMaps []bytemap.ByteMap
+
+func (a byteMaps) Len() int           { return len(a) }
+func (a byteMaps) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byteMaps) Less(i, j int) bool { return bytes.Compare(a[i], a[j]) < 0 }
@@ -0,0 +1,419 @@
+package zenodb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/sql"
+	"github.com/golang/snappy"
+)
+
+// rowGroupWriter writes rows in row groups of roughly blockSize uncompressed
+// bytes. Within a row group, the keys and each of the columns are stored in
+// separate, independently snappy compressed blocks, so that readers can skip
+// the columns that they don't need. A row group is encoded as:
+//
+//	numrows|minstart|maxstart|maxperiods|keyslen|col1len|...|lastcollen|keyscrc|col1crc|...|lastcolcrc|headercrc|keys|col1|...|lastcol
+//
+// numrows is 32 bits
+// minstart and maxstart are the earliest and latest start times (64 bit unix
+// nanos) of the sequences in the row group
+// maxperiods is the largest number of periods in any sequence (32 bits)
+// keyslen and col*len are 32 bits and give the compressed length of each block
+// keyscrc and col*crc are the 32 bit CRC-32C checksums of each compressed block
+// headercrc is the 32 bit CRC-32C checksum of everything that precedes it
+// keys is the compressed block of keys, each prefixed with its 16 bit length
+// col* is the compressed block of one column's sequences, each prefixed with
+// its 32 bit length (0 if the row has no data for that column)
+type rowGroupWriter struct {
+	out    io.Writer
+	fields []sql.Field
+	// offset is the file offset at which the current row group will be written
+	offset     int64
+	numRows    int
+	size       int
+	minStart   int64
+	maxStart   int64
+	maxPeriods int
+	keys       *bytes.Buffer
+	columns    []*bytes.Buffer
+}
+
+func newRowGroupWriter(out io.Writer, fields []sql.Field, offset int64) *rowGroupWriter {
+	gw := &rowGroupWriter{
+		out:     out,
+		fields:  fields,
+		offset:  offset,
+		keys:    &bytes.Buffer{},
+		columns: make([]*bytes.Buffer, 0, len(fields)),
+	}
+	for range fields {
+		gw.columns = append(gw.columns, &bytes.Buffer{})
+	}
+	return gw
+}
+
+// position returns the position at which the next row will be written.
+func (gw *rowGroupWriter) position() rowRef {
+	return rowRef{block: gw.offset, offset: uint32(gw.numRows)}
+}
+
+func (gw *rowGroupWriter) add(key bytemap.ByteMap, columns []encoding.Sequence) error {
+	binary.Write(gw.keys, encoding.Binary, uint16(len(key)))
+	gw.keys.Write(key)
+	gw.size += encoding.Width16bits + len(key)
+	for i, buf := range gw.columns {
+		var seq encoding.Sequence
+		if i < len(columns) {
+			seq = columns[i]
+		}
+		binary.Write(buf, encoding.Binary, uint32(len(seq)))
+		buf.Write(seq)
+		gw.size += encoding.Width32bits + len(seq)
+		gw.track(seq, gw.fields[i].Expr.EncodedWidth())
+	}
+	gw.numRows++
+	if gw.size >= blockSize {
+		return gw.flush()
+	}
+	return nil
+}
+
+// track updates the time range of the current row group to include the given
+// sequence.
+func (gw *rowGroupWriter) track(seq encoding.Sequence, periodWidth int) {
+	if len(seq) == 0 {
+		return
+	}
+	numPeriods := seq.NumPeriods(periodWidth)
+	if numPeriods == 0 {
+		return
+	}
+	start := seq.Start().UnixNano()
+	if gw.maxPeriods == 0 || start < gw.minStart {
+		gw.minStart = start
+	}
+	if gw.maxPeriods == 0 || start > gw.maxStart {
+		gw.maxStart = start
+	}
+	if numPeriods > gw.maxPeriods {
+		gw.maxPeriods = numPeriods
+	}
+}
+
+func (gw *rowGroupWriter) flush() error {
+	if gw.numRows == 0 {
+		return nil
+	}
+	blocks := make([][]byte, 0, 1+len(gw.columns))
+	blocks = append(blocks, snappy.Encode(nil, gw.keys.Bytes()))
+	for _, buf := range gw.columns {
+		blocks = append(blocks, snappy.Encode(nil, buf.Bytes()))
+	}
+
+	header := &bytes.Buffer{}
+	binary.Write(header, encoding.Binary, uint32(gw.numRows))
+	binary.Write(header, encoding.Binary, gw.minStart)
+	binary.Write(header, encoding.Binary, gw.maxStart)
+	binary.Write(header, encoding.Binary, uint32(gw.maxPeriods))
+	for _, block := range blocks {
+		binary.Write(header, encoding.Binary, uint32(len(block)))
+	}
+	for _, block := range blocks {
+		binary.Write(header, encoding.Binary, checksum(block))
+	}
+	binary.Write(header, encoding.Binary, checksum(header.Bytes()))
+
+	groupLength := header.Len()
+	_, err := gw.out.Write(header.Bytes())
+	for _, block := range blocks {
+		if err == nil {
+			_, err = gw.out.Write(block)
+		}
+		groupLength += len(block)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write row group: %v", err)
+	}
+
+	gw.offset += int64(groupLength)
+	gw.numRows = 0
+	gw.size = 0
+	gw.minStart = 0
+	gw.maxStart = 0
+	gw.maxPeriods = 0
+	gw.keys.Reset()
+	for _, buf := range gw.columns {
+		buf.Reset()
+	}
+	return nil
+}
+
+// rowGroupReader reads the row groups written by a rowGroupWriter, only
+// decompressing the columns that are included. If overlaps is set, row groups
+// whose time range it rejects are skipped without being decompressed. Row group
+// headers are always verified against their checksums, blocks are verified
+// when read (skipped blocks aren't verified). If checksumsOnly is set, all
+// blocks are verified without being decompressed and no rows are returned.
+type rowGroupReader struct {
+	file          *os.File
+	in            *bufio.Reader
+	includeColumn []bool
+	overlaps      func(minStart time.Time, maxStart time.Time, maxPeriods int) bool
+	checksumsOnly bool
+	// size is the size of the file, which bounds the lengths of blocks
+	size int64
+	// position is the file offset from which in is reading
+	position int64
+	// currentOffset is the file offset of the currently loaded row group
+	currentOffset int64
+	loaded        bool
+	skipped       bool
+	keys          []bytemap.ByteMap
+	// columns holds the sequences of the current row group by column and row.
+	// Columns that aren't included are nil.
+	columns [][]encoding.Sequence
+	row     int
+}
+
+func newRowGroupReader(file *os.File, in *bufio.Reader, offset int64, size int64, includeColumn []bool) *rowGroupReader {
+	return &rowGroupReader{
+		file:          file,
+		in:            in,
+		includeColumn: includeColumn,
+		size:          size,
+		position:      offset,
+	}
+}
+
+// next returns the next row, returning io.EOF once all row groups have been
+// read. Columns that aren't included are returned as nil.
+func (gr *rowGroupReader) next() (bytemap.ByteMap, []encoding.Sequence, error) {
+	for !gr.loaded || gr.row >= len(gr.keys) {
+		err := gr.load(gr.position)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	columns := make([]encoding.Sequence, len(gr.columns))
+	for i, column := range gr.columns {
+		if column != nil {
+			columns[i] = column[gr.row]
+		}
+	}
+	key := gr.keys[gr.row]
+	gr.row++
+	return key, columns, nil
+}
+
+// seek positions the rowGroupReader at the given row. If the row is in a row
+// group that was skipped, seek returns false.
+func (gr *rowGroupReader) seek(ref rowRef) (bool, error) {
+	if !gr.loaded || ref.block != gr.currentOffset {
+		err := gr.load(ref.block)
+		if err != nil {
+			return false, err
+		}
+	}
+	if gr.skipped {
+		return false, nil
+	}
+	if int(ref.offset) >= len(gr.keys) {
+		return false, fmt.Errorf("Row %d beyond end of row group at %d", ref.offset, ref.block)
+	}
+	gr.row = int(ref.offset)
+	return true, nil
+}
+
+// load loads the row group at the given file offset.
+func (gr *rowGroupReader) load(offset int64) error {
+	if offset != gr.position {
+		_, err := gr.file.Seek(offset, 0)
+		if err != nil {
+			return err
+		}
+		gr.in.Reset(gr.file)
+		gr.position = offset
+	}
+
+	numBlocks := 1 + len(gr.includeColumn)
+	header := make([]byte, encoding.Width32bits*(3+2*numBlocks)+encoding.Width64bits*2)
+	n, err := io.ReadFull(gr.in, header)
+	if err != nil {
+		if n == 0 {
+			// Note - this returns io.EOF at the end of the file
+			return err
+		}
+		return unexpectedEOF(err)
+	}
+	gr.position += int64(len(header))
+	headerLength := len(header) - encoding.Width32bits
+	if checksum(header[:headerLength]) != encoding.Binary.Uint32(header[headerLength:]) {
+		return fmt.Errorf("Checksum mismatch in header of row group at %d", offset)
+	}
+	numRows := int(encoding.Binary.Uint32(header))
+	header = header[encoding.Width32bits:]
+	minStart := int64(encoding.Binary.Uint64(header))
+	header = header[encoding.Width64bits:]
+	maxStart := int64(encoding.Binary.Uint64(header))
+	header = header[encoding.Width64bits:]
+	maxPeriods := int(encoding.Binary.Uint32(header))
+	header = header[encoding.Width32bits:]
+	blockLengths := make([]uint32, numBlocks)
+	remaining := gr.size - gr.position
+	for i := range blockLengths {
+		blockLengths[i] = encoding.Binary.Uint32(header)
+		header = header[encoding.Width32bits:]
+		remaining -= int64(blockLengths[i])
+	}
+	if remaining < 0 {
+		return fmt.Errorf("Blocks of row group at %d extend beyond end of file", offset)
+	}
+	checksums := make([]uint32, numBlocks)
+	for i := range checksums {
+		checksums[i] = encoding.Binary.Uint32(header)
+		header = header[encoding.Width32bits:]
+	}
+
+	gr.currentOffset = offset
+	gr.loaded = true
+	gr.row = 0
+	if gr.checksumsOnly {
+		gr.keys = nil
+		gr.columns = nil
+		for i, length := range blockLengths {
+			_, err = gr.readCompressedBlock(length, checksums, i)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	gr.skipped = gr.overlaps != nil && !gr.overlaps(time.Unix(0, minStart), time.Unix(0, maxStart), maxPeriods)
+	if gr.skipped {
+		// Skip entire row group without decompressing it
+		gr.keys = nil
+		gr.columns = nil
+		for _, length := range blockLengths {
+			_, err = gr.in.Discard(int(length))
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			gr.position += int64(length)
+		}
+		return nil
+	}
+
+	keysBlock, err := gr.readBlock(blockLengths[0], checksums, 0)
+	if err != nil {
+		return err
+	}
+	if numRows > len(keysBlock)/encoding.Width16bits {
+		return fmt.Errorf("Keys block at %d is truncated", offset)
+	}
+	gr.keys = make([]bytemap.ByteMap, 0, numRows)
+	for i := 0; i < numRows; i++ {
+		if len(keysBlock) < encoding.Width16bits {
+			return fmt.Errorf("Keys block at %d is truncated", offset)
+		}
+		var keyLength int
+		var key bytemap.ByteMap
+		keyLength, keysBlock = encoding.ReadInt16(keysBlock)
+		if len(keysBlock) < keyLength {
+			return fmt.Errorf("Keys block at %d is truncated", offset)
+		}
+		key, keysBlock = encoding.ReadByteMap(keysBlock, keyLength)
+		gr.keys = append(gr.keys, key)
+	}
+
+	gr.columns = make([][]encoding.Sequence, len(gr.includeColumn))
+	for i, include := range gr.includeColumn {
+		length := blockLengths[1+i]
+		if !include {
+			// Skip column without decompressing it
+			_, err = gr.in.Discard(int(length))
+			if err != nil {
+				return unexpectedEOF(err)
+			}
+			gr.position += int64(length)
+			continue
+		}
+		block, err := gr.readBlock(length, checksums, 1+i)
+		if err != nil {
+			return err
+		}
+		if numRows > len(block)/encoding.Width32bits {
+			return fmt.Errorf("Column %d of row group at %d is truncated", i, offset)
+		}
+		column := make([]encoding.Sequence, 0, numRows)
+		for j := 0; j < numRows; j++ {
+			if len(block) < encoding.Width32bits {
+				return fmt.Errorf("Column %d of row group at %d is truncated", i, offset)
+			}
+			var seqLength int
+			var seq encoding.Sequence
+			seqLength, block = encoding.ReadInt32(block)
+			if len(block) < seqLength {
+				return fmt.Errorf("Column %d of row group at %d is truncated", i, offset)
+			}
+			if seqLength > 0 {
+				seq, block = encoding.ReadSequence(block, seqLength)
+			}
+			column = append(column, seq)
+		}
+		gr.columns[i] = column
+	}
+	return nil
+}
+
+// readBlock reads and decompresses the next block, verifying it against
+// checksums[idx].
+func (gr *rowGroupReader) readBlock(length uint32, checksums []uint32, idx int) ([]byte, error) {
+	compressed, err := gr.readCompressedBlock(length, checksums, idx)
+	if err != nil {
+		return nil, err
+	}
+	block, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode block: %v", err)
+	}
+	return block, nil
+}
+
+// readCompressedBlock reads the next block without decompressing it, verifying
+// it against checksums[idx].
+func (gr *rowGroupReader) readCompressedBlock(length uint32, checksums []uint32, idx int) ([]byte, error) {
+	compressed := make([]byte, length)
+	_, err := io.ReadFull(gr.in, compressed)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	gr.position += int64(length)
+	if checksum(compressed) != checksums[idx] {
+		return nil, fmt.Errorf("Checksum mismatch in block %d of row group at %d", idx, gr.currentOffset)
+	}
+	return compressed, nil
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(b []byte) uint32 {
+	return crc32.Checksum(b, crcTable)
+}
+
+// unexpectedEOF converts io.EOF into io.ErrUnexpectedEOF for reads that happen
+// in the middle of a row group.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,202 @@
+package rpc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb"
+	"golang.org/x/net/context"
+)
+
+const (
+	minRetryDelay = 1 * time.Second
+	maxRetryDelay = 1 * time.Minute
+)
+
+// FollowerLag describes how far a follower is behind its leader on a stream.
+type FollowerLag struct {
+	// Connected indicates whether the follower is currently receiving the
+	// stream from the leader.
+	Connected bool
+	// Offset is the leader's offset of the latest entry that the follower
+	// applied.
+	Offset wal.Offset
+	// Head is the latest known offset of the head of the leader's WAL.
+	Head wal.Offset
+	// Bytes is how many bytes of the leader's WAL the follower has yet to apply.
+	// If the follower is still working through an older WAL file than the
+	// leader's head, only the bytes in the head's file are counted, so this is a
+	// lower bound.
+	Bytes int64
+	// LastContact is when the follower last heard from the leader.
+	LastContact time.Time
+	// Error describes the most recent error, if any.
+	Error string
+}
+
+// Follower replicates a leader's WALs into a read-only follower database.
+type Follower struct {
+	db     *zenodb.DB
+	client Client
+	lags   map[string]*FollowerLag
+	mx     sync.RWMutex
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Follow starts replicating all of db's streams from the leader to which client
+// is connected, including streams that are added later by schema changes. db
+// should be opened with DBOpts.Follower and the same schema as the leader. Each
+// stream resumes after the latest entry that db applied, so following picks up
+// where it left off after restarts of either database or network
+// interruptions, which are retried with exponential backoff.
+func Follow(db *zenodb.DB, client Client) *Follower {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Follower{
+		db:     db,
+		client: client,
+		lags:   make(map[string]*FollowerLag),
+		cancel: cancel,
+	}
+	changed := db.StreamsChanged()
+	f.followNewStreams(ctx)
+	f.wg.Add(1)
+	go f.watchStreams(ctx, changed)
+	return f
+}
+
+// watchStreams starts following streams as they're added to the database.
+func (f *Follower) watchStreams(ctx context.Context, changed <-chan interface{}) {
+	defer f.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+			changed = f.db.StreamsChanged()
+			f.followNewStreams(ctx)
+		}
+	}
+}
+
+// followNewStreams starts following all of the database's streams that aren't
+// being followed yet.
+func (f *Follower) followNewStreams(ctx context.Context) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	for _, stream := range f.db.Streams() {
+		if f.lags[stream] != nil {
+			continue
+		}
+		log.Debugf("Starting to follow %v", stream)
+		f.lags[stream] = &FollowerLag{}
+		f.wg.Add(1)
+		go f.follow(ctx, stream)
+	}
+}
+
+// Lag reports how far behind the leader this follower is, by stream.
+func (f *Follower) Lag() map[string]FollowerLag {
+	f.mx.RLock()
+	defer f.mx.RUnlock()
+	result := make(map[string]FollowerLag, len(f.lags))
+	for stream, lag := range f.lags {
+		result[stream] = *lag
+	}
+	return result
+}
+
+// Close stops following the leader.
+func (f *Follower) Close() {
+	f.cancel()
+	f.wg.Wait()
+}
+
+func (f *Follower) follow(ctx context.Context, stream string) {
+	defer f.wg.Done()
+	delay := minRetryDelay
+	for {
+		received, err := f.followOnce(ctx, stream)
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			delay = minRetryDelay
+		}
+		log.Errorf("Error following %v, will retry in %v: %v", stream, delay, err)
+		f.mx.Lock()
+		f.lags[stream].Connected = false
+		f.lags[stream].Error = err.Error()
+		f.mx.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// followOnce follows the stream until an error occurs, returning whether it
+// heard from the leader at all.
+func (f *Follower) followOnce(ctx context.Context, stream string) (bool, error) {
+	offset, err := f.db.ReplicatedOffset(stream)
+	if err != nil {
+		return false, err
+	}
+	log.Debugf("Following %v from %v", stream, offset)
+	next, err := f.client.Follow(ctx, &Follow{Stream: stream, Offset: offset})
+	if err != nil {
+		return false, err
+	}
+
+	received := false
+	for {
+		entry, err := next()
+		if err != nil {
+			return received, err
+		}
+		received = true
+		if len(entry.Data) > 0 {
+			err = f.db.ApplyReplicated(stream, entry.Data, entry.Offset)
+			if err != nil {
+				return received, err
+			}
+			offset = entry.Offset
+		}
+
+		f.mx.Lock()
+		lag := f.lags[stream]
+		lag.Connected = true
+		lag.Offset = offset
+		if entry.Head != nil {
+			lag.Head = entry.Head
+		}
+		lag.Bytes = lagBytes(offset, lag.Head)
+		lag.LastContact = time.Now()
+		lag.Error = ""
+		f.mx.Unlock()
+	}
+}
+
+// lagBytes calculates how many bytes the given offset is behind head.
+func lagBytes(offset wal.Offset, head wal.Offset) int64 {
+	if head == nil {
+		return 0
+	}
+	if offset == nil || offset.FileSequence() != head.FileSequence() {
+		if offset != nil && offset.After(head) {
+			return 0
+		}
+		return head.Position()
+	}
+	lag := head.Position() - offset.Position()
+	if lag < 0 {
+		lag = 0
+	}
+	return lag
+}
@@ -1,7 +1,10 @@
 package rpc
 
 import (
+	"time"
+
 	"github.com/getlantern/golog"
+	"github.com/getlantern/wal"
 	"google.golang.org/grpc"
 )
 
@@ -19,19 +22,72 @@ type Query struct {
 	SQL string
 }
 
-var serviceDesc = grpc.ServiceDesc{
-	ServiceName: "zenodb",
-	HandlerType: (*Server)(nil),
-	Methods:     []grpc.MethodDesc{},
-	Streams: []grpc.StreamDesc{
-		{
-			StreamName:    "query",
-			Handler:       queryHandler,
-			ServerStreams: true,
-		},
-	},
+// Insert is a single point to insert into a stream as part of a streaming
+// insert. An Insert with EndOfBatch set doesn't carry a point, instead it asks
+// the server to insert the points received so far and acknowledge them with an
+// InsertReport.
+type Insert struct {
+	Stream     string
+	TS         time.Time
+	Dims       map[string]interface{}
+	Vals       map[string]float64
+	EndOfBatch bool
+}
+
+// InsertReport reports the outcome of inserting a batch.
+type InsertReport struct {
+	// Points is the number of points that were inserted
+	Points int
+	// Errors is the number of points that couldn't be inserted
+	Errors int
+	// Error describes the most recent error, if any
+	Error string
+}
+
+// Follow asks the leader to stream the entries of a stream's WAL after the
+// given offset (or from the beginning if Offset is nil).
+type Follow struct {
+	Stream string
+	Offset wal.Offset
+}
+
+// WALEntry is an entry from the leader's WAL along with its offset. Entries
+// without Data are heartbeats that only report the offset of the head of the
+// leader's WAL.
+type WALEntry struct {
+	Data   []byte
+	Offset wal.Offset
+	Head   wal.Offset
 }
 
+var (
+	queryStreamDesc = grpc.StreamDesc{
+		StreamName:    "query",
+		Handler:       queryHandler,
+		ServerStreams: true,
+	}
+
+	insertStreamDesc = grpc.StreamDesc{
+		StreamName:    "insert",
+		Handler:       insertHandler,
+		ClientStreams: true,
+		ServerStreams: true,
+	}
+
+	followStreamDesc = grpc.StreamDesc{
+		StreamName:    "follow",
+		Handler:       followHandler,
+		ServerStreams: true,
+	}
+
+	serviceDesc = grpc.ServiceDesc{
+		ServiceName: "zenodb",
+		HandlerType: (*Server)(nil),
+		Methods:     []grpc.MethodDesc{},
+		Streams:     []grpc.StreamDesc{queryStreamDesc, insertStreamDesc, followStreamDesc},
+	}
+)
+
 func queryHandler(srv interface{}, stream grpc.ServerStream) error {
 	m := new(Query)
 	if err := stream.RecvMsg(m); err != nil {
@@ -39,3 +95,15 @@ func queryHandler(srv interface{}, stream grpc.ServerStream) error {
 	}
 	return srv.(Server).Query(m, stream)
 }
+
+func insertHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(Server).Insert(stream)
+}
+
+func followHandler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(Follow)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(Server).Follow(m, stream)
+}
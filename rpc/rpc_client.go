@@ -15,9 +15,33 @@ type ClientOpts struct {
 	Password string
 }
 
+// Inserter inserts points as part of a streaming insert.
+type Inserter interface {
+	// Insert sends a point for insertion into the given stream.
+	Insert(stream string, ts time.Time, dims map[string]interface{}, vals map[string]float64) error
+
+	// Flush ends the current batch and waits for the server to acknowledge it,
+	// returning the server's report of how many of the batch's points were
+	// inserted.
+	Flush() (*InsertReport, error)
+
+	// Close finishes the streaming insert and returns the server's report for
+	// the points sent since the last Flush.
+	Close() (*InsertReport, error)
+}
+
 type Client interface {
 	Query(ctx context.Context, in *Query, opts ...grpc.CallOption) (*zenodb.QueryResult, func() (*zenodb.Row, error), error)
 
+	// Insert starts a streaming insert. Points are sent to the server as they're
+	// inserted into the returned Inserter, and the server acknowledges them batch
+	// by batch whenever the Inserter is flushed or closed.
+	Insert(ctx context.Context, opts ...grpc.CallOption) (Inserter, error)
+
+	// Follow starts following a stream's WAL on the server. The returned
+	// function blocks until the next WALEntry is available.
+	Follow(ctx context.Context, in *Follow, opts ...grpc.CallOption) (func() (*WALEntry, error), error)
+
 	Close() error
 }
 
@@ -40,7 +64,7 @@ type client struct {
 }
 
 func (c *client) Query(ctx context.Context, in *Query, opts ...grpc.CallOption) (*zenodb.QueryResult, func() (*zenodb.Row, error), error) {
-	stream, err := grpc.NewClientStream(c.authenticated(ctx), &serviceDesc.Streams[0], c.cc, "/zenodb/query", opts...)
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &queryStreamDesc, c.cc, "/zenodb/query", opts...)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -65,6 +89,70 @@ func (c *client) Query(ctx context.Context, in *Query, opts ...grpc.CallOption)
 	return result, nextRow, nil
 }
 
+func (c *client) Insert(ctx context.Context, opts ...grpc.CallOption) (Inserter, error) {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &insertStreamDesc, c.cc, "/zenodb/insert", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &inserter{stream}, nil
+}
+
+type inserter struct {
+	stream grpc.ClientStream
+}
+
+func (i *inserter) Insert(stream string, ts time.Time, dims map[string]interface{}, vals map[string]float64) error {
+	return i.stream.SendMsg(&Insert{
+		Stream: stream,
+		TS:     ts,
+		Dims:   dims,
+		Vals:   vals,
+	})
+}
+
+func (i *inserter) Flush() (*InsertReport, error) {
+	if err := i.stream.SendMsg(&Insert{EndOfBatch: true}); err != nil {
+		return nil, err
+	}
+	return i.report()
+}
+
+func (i *inserter) Close() (*InsertReport, error) {
+	if err := i.stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return i.report()
+}
+
+func (i *inserter) report() (*InsertReport, error) {
+	report := &InsertReport{}
+	err := i.stream.RecvMsg(report)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (c *client) Follow(ctx context.Context, in *Follow, opts ...grpc.CallOption) (func() (*WALEntry, error), error) {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &followStreamDesc, c.cc, "/zenodb/follow", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	next := func() (*WALEntry, error) {
+		entry := &WALEntry{}
+		err := stream.RecvMsg(entry)
+		return entry, err
+	}
+	return next, nil
+}
+
 func (c *client) Close() error {
 	return c.cc.Close()
 }
@@ -1,15 +1,33 @@
 package rpc
 
 import (
+	"fmt"
+	"io"
 	"net"
+	"time"
 
+	"github.com/getlantern/wal"
 	"github.com/getlantern/zenodb"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
 )
 
+const (
+	// maxBatchSize caps how many points from a streaming insert are inserted
+	// into the database at a time
+	maxBatchSize = 1000
+
+	// heartbeatInterval is how frequently followers are told about the head of
+	// the leader's WAL
+	heartbeatInterval = 1 * time.Second
+)
+
 type Server interface {
 	Query(*Query, grpc.ServerStream) error
+
+	Insert(grpc.ServerStream) error
+
+	Follow(*Follow, grpc.ServerStream) error
 }
 
 type ServerOpts struct {
@@ -42,7 +60,7 @@ func (s *server) Query(query *Query, stream grpc.ServerStream) error {
 	if err != nil {
 		return err
 	}
-	result, err := q.Run()
+	result, err := q.RunContext(stream.Context())
 	if err != nil {
 		return err
 	}
@@ -68,6 +86,127 @@ func (s *server) Query(query *Query, stream grpc.ServerStream) error {
 	return nil
 }
 
+// Insert receives a stream of points from the client and inserts them in
+// batches. Whenever the client ends a batch (see Insert.EndOfBatch) or finishes
+// sending, it acknowledges the points received since the last acknowledgement
+// with an InsertReport. Points that can't be inserted are counted as errors
+// without failing the whole stream.
+func (s *server) Insert(stream grpc.ServerStream) error {
+	authorizeErr := s.authorize(stream)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	report := &InsertReport{}
+	recordError := func(numPoints int, err error) {
+		report.Errors += numPoints
+		report.Error = err.Error()
+	}
+
+	currentStream := ""
+	batch := make([]zenodb.Point, 0, maxBatchSize)
+	insertBatch := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := s.db.InsertBatch(currentStream, batch)
+		if err != nil {
+			recordError(len(batch), err)
+		} else {
+			report.Points += len(batch)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		insert := &Insert{}
+		err := stream.RecvMsg(insert)
+		if err == io.EOF {
+			insertBatch()
+			return stream.SendMsg(report)
+		}
+		if err != nil {
+			return err
+		}
+		if insert.EndOfBatch {
+			insertBatch()
+			err = stream.SendMsg(report)
+			if err != nil {
+				return err
+			}
+			report = &InsertReport{}
+			continue
+		}
+		if len(insert.Dims) == 0 {
+			recordError(1, fmt.Errorf("Need at least one dim"))
+			continue
+		}
+		if len(insert.Vals) == 0 {
+			recordError(1, fmt.Errorf("Need at least one val"))
+			continue
+		}
+		if insert.TS.IsZero() {
+			insert.TS = time.Now()
+		}
+		if insert.Stream != currentStream || len(batch) == maxBatchSize {
+			insertBatch()
+			currentStream = insert.Stream
+		}
+		batch = append(batch, zenodb.Point{Ts: insert.TS, Dims: insert.Dims, Vals: insert.Vals})
+	}
+}
+
+// Follow streams the entries of a stream's WAL to a follower, interspersed with
+// heartbeats that report the head of the WAL so that the follower can tell how
+// far behind it is.
+func (s *server) Follow(f *Follow, stream grpc.ServerStream) error {
+	authorizeErr := s.authorize(stream)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	log.Debugf("Follower is following %v from %v", f.Stream, f.Offset)
+	ctx := stream.Context()
+	entries := make(chan *WALEntry, maxBatchSize)
+	followErr := make(chan error, 1)
+	go func() {
+		followErr <- s.db.FollowWAL(ctx, f.Stream, f.Offset, func(data []byte, offset wal.Offset) error {
+			entry := &WALEntry{Data: make([]byte, len(data)), Offset: make(wal.Offset, len(offset))}
+			copy(entry.Data, data)
+			copy(entry.Offset, offset)
+			select {
+			case entries <- entry:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case entry := <-entries:
+			err := stream.SendMsg(entry)
+			if err != nil {
+				return err
+			}
+		case <-heartbeat.C:
+			head, err := s.db.WALHead(f.Stream)
+			if err != nil {
+				return err
+			}
+			err = stream.SendMsg(&WALEntry{Head: head})
+			if err != nil {
+				return err
+			}
+		case err := <-followErr:
+			return err
+		}
+	}
+}
+
 func (s *server) authorize(stream grpc.ServerStream) error {
 	if s.password == "" {
 		log.Debug("No password specified, allowing access to world")
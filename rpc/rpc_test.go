@@ -0,0 +1,306 @@
+package rpc
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+const (
+	testPassword = "testpassword"
+
+	testSchema = `
+rpc_test:
+  retentionperiod: 24h
+  sql: >
+    SELECT SUM(i) AS i
+    FROM inbound
+    GROUP BY a, period(1h)
+`
+)
+
+func TestInsert(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbrpctest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := newTestDB(tmpDir, "db", false)
+	if !assert.NoError(t, err, "Unable to create database") {
+		return
+	}
+	defer db.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err, "Unable to listen") {
+		return
+	}
+	defer l.Close()
+	go Serve(db, l, &ServerOpts{Password: testPassword})
+
+	now := time.Now()
+	dims := map[string]interface{}{"a": "x"}
+
+	badClient, err := Dial(l.Addr().String(), &ClientOpts{Password: "wrong"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer badClient.Close()
+	inserter, err := badClient.Insert(context.Background())
+	if assert.NoError(t, err) {
+		inserter.Insert("inbound", now, dims, map[string]float64{"i": 1000})
+		_, err = inserter.Flush()
+		assert.Error(t, err, "Insert with wrong password should have failed")
+	}
+
+	client, err := Dial(l.Addr().String(), &ClientOpts{Password: testPassword})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+	inserter, err = client.Insert(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Each batch is acknowledged separately
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, inserter.Insert("inbound", now, dims, map[string]float64{"i": 1}))
+	}
+	report, err := inserter.Flush()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, report.Points)
+		assert.Equal(t, 0, report.Errors)
+	}
+
+	assert.NoError(t, inserter.Insert("inbound", now, dims, map[string]float64{"i": 2}))
+	assert.NoError(t, inserter.Insert("inbound", now, nil, map[string]float64{"i": 2000}))
+	assert.NoError(t, inserter.Insert("unknown", now, dims, map[string]float64{"i": 3000}))
+	report, err = inserter.Flush()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, report.Points)
+		assert.Equal(t, 2, report.Errors, "Point without dims and point for unknown stream should have failed")
+		assert.NotEmpty(t, report.Error)
+	}
+
+	assert.NoError(t, inserter.Insert("inbound", now, dims, map[string]float64{"i": 3}))
+	report, err = inserter.Close()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, report.Points, "Close should only report points since last flush")
+		assert.Equal(t, 0, report.Errors)
+	}
+
+	time.Sleep(1 * time.Second)
+	assert.EqualValues(t, 8, queryTotal(t, client), "All acknowledged points should have been inserted exactly once")
+}
+
+func newTestDB(tmpDir string, name string, follower bool) (*zenodb.DB, error) {
+	schemaFile := filepath.Join(tmpDir, "schema.yaml")
+	err := ioutil.WriteFile(schemaFile, []byte(testSchema), 0644)
+	if err != nil {
+		return nil, err
+	}
+	return zenodb.NewDB(&zenodb.DBOpts{
+		Dir:                    filepath.Join(tmpDir, name),
+		SchemaFile:             schemaFile,
+		IncludeMemStoreInQuery: true,
+		Follower:               follower,
+	})
+}
+
+// queryTotal returns the sum of i across all rows of rpc_test.
+func queryTotal(t *testing.T, client Client) float64 {
+	_, nextRow, err := client.Query(context.Background(), &Query{SQL: "SELECT i FROM rpc_test ASOF '-2h' GROUP BY a"})
+	if !assert.NoError(t, err, "Unable to query") {
+		return 0
+	}
+	total := float64(0)
+	for {
+		row, err := nextRow()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err, "Unable to read row") {
+			break
+		}
+		total += row.Values[0]
+	}
+	return total
+}
+
+func TestFollow(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbfollowtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	leader, err := newTestDB(tmpDir, "leader", false)
+	if !assert.NoError(t, err, "Unable to create leader") {
+		return
+	}
+	defer leader.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err, "Unable to listen") {
+		return
+	}
+	defer l.Close()
+	go Serve(leader, l, &ServerOpts{Password: testPassword})
+
+	// Connect through a proxy so that we can interrupt the connection
+	p, err := newProxy(l.Addr().String())
+	if !assert.NoError(t, err, "Unable to start proxy") {
+		return
+	}
+	defer p.stop()
+
+	followerDB, err := newTestDB(tmpDir, "follower", true)
+	if !assert.NoError(t, err, "Unable to create follower") {
+		return
+	}
+	defer followerDB.Close()
+	client, err := Dial(p.addr, &ClientOpts{Password: testPassword})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+	follower := Follow(followerDB, client)
+	defer follower.Close()
+
+	now := time.Now()
+	insert := func(i float64) {
+		assert.NoError(t, leader.Insert("inbound", now, map[string]interface{}{"a": "x"}, map[string]float64{"i": i}))
+	}
+	waitFor := func(cond func(lag FollowerLag) bool) bool {
+		for i := 0; i < 300; i++ {
+			if cond(follower.Lag()["inbound"]) {
+				return true
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		return false
+	}
+	caughtUp := func(lag FollowerLag) bool {
+		head, err := leader.WALHead("inbound")
+		return err == nil && lag.Connected && bytes.Equal(head, lag.Offset) && bytes.Equal(head, lag.Head) && lag.Bytes == 0
+	}
+
+	insert(1)
+	insert(2)
+	if !assert.True(t, waitFor(caughtUp), "Follower should have caught up with leader") {
+		return
+	}
+
+	// Heartbeats keep coming without new entries
+	lastContact := follower.Lag()["inbound"].LastContact
+	assert.True(t, waitFor(func(lag FollowerLag) bool {
+		return lag.LastContact.After(lastContact)
+	}), "Follower should have received heartbeat")
+
+	// Interrupt the connection, the follower falls behind while disconnected
+	p.stop()
+	assert.True(t, waitFor(func(lag FollowerLag) bool {
+		return !lag.Connected && lag.Error != ""
+	}), "Follower should have noticed disconnect")
+	insert(3)
+	insert(4)
+	assert.False(t, caughtUp(follower.Lag()["inbound"]))
+
+	// Once the leader is reachable again, the follower reconnects and resumes
+	// where it left off
+	if !assert.NoError(t, p.start(), "Unable to restart proxy") {
+		return
+	}
+	if !assert.True(t, waitFor(caughtUp), "Follower should have reconnected and caught up with leader") {
+		return
+	}
+	assert.Empty(t, follower.Lag()["inbound"].Error)
+
+	time.Sleep(1 * time.Second)
+	assert.EqualValues(t, 10, localTotal(t, followerDB), "Follower should contain each point exactly once")
+}
+
+// localTotal returns the sum of i across all rows of rpc_test in the given
+// database.
+func localTotal(t *testing.T, db *zenodb.DB) float64 {
+	aq, err := db.SQLQuery("SELECT i FROM rpc_test ASOF '-2h' GROUP BY a")
+	if !assert.NoError(t, err) {
+		return 0
+	}
+	result, err := aq.Run()
+	if !assert.NoError(t, err) {
+		return 0
+	}
+	total := float64(0)
+	for _, row := range result.Rows {
+		total += row.Values[0]
+	}
+	return total
+}
+
+// proxy forwards TCP connections to a target address and can be stopped and
+// restarted at the same address in order to simulate network interruptions.
+type proxy struct {
+	addr   string
+	target string
+	l      net.Listener
+	conns  []net.Conn
+	mx     sync.Mutex
+}
+
+func newProxy(target string) (*proxy, error) {
+	p := &proxy{addr: "127.0.0.1:0", target: target}
+	err := p.start()
+	return p, err
+}
+
+func (p *proxy) start() error {
+	l, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	p.mx.Lock()
+	p.l = l
+	p.addr = l.Addr().String()
+	p.mx.Unlock()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", p.target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			p.mx.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.mx.Unlock()
+			go io.Copy(conn, upstream)
+			go io.Copy(upstream, conn)
+		}
+	}()
+	return nil
+}
+
+// stop stops accepting connections and closes all existing connections.
+func (p *proxy) stop() {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.l.Close()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
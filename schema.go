@@ -28,7 +28,11 @@ func (db *DB) pollForSchema(filename string) error {
 
 	go func() {
 		for {
-			time.Sleep(100 * time.Millisecond)
+			select {
+			case <-db.closeCh:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
 			newStat, err := os.Stat(filename)
 			if err != nil {
 				log.Errorf("Unable to stat schema: %v", err)
@@ -63,7 +67,13 @@ func (db *DB) ApplySchemaFromFile(filename string) error {
 	return db.ApplySchema(schema)
 }
 
+// ApplySchema creates tables and views that are new in the given schema, alters
+// existing ones and drops tables and views that were present in the previously
+// applied schema but have been removed from this one.
 func (db *DB) ApplySchema(_schema Schema) error {
+	db.schemaMutex.Lock()
+	defer db.schemaMutex.Unlock()
+
 	schema := make(Schema, len(_schema))
 	// Convert all names in schema to lowercase
 	for name, opts := range _schema {
@@ -112,16 +122,44 @@ func (db *DB) ApplySchema(_schema Schema) error {
 			}
 			log.Debugf("Created %v %v", tableType, name)
 		} else {
-			// TODO: support more comprehensive altering of tables (maybe)
-			q, err := sql.Parse(opts.SQL, nil)
+			log.Debugf("Altering table '%v' to\n%v", name, opts.SQL)
+			err := t.alter(opts)
 			if err != nil {
-				return err
+				return fmt.Errorf("Error altering table %v: %v", name, err)
 			}
-			log.Debugf("Cowardly altering where and nothing else on table '%v': %v", name, q.Where)
-			t.applyWhere(q.Where)
 		}
 	}
 
+	err := db.dropRemovedTables(schema)
+	db.schema = schema
+	return err
+}
+
+// dropRemovedTables drops tables and views that were in the previously applied
+// schema but aren't in the given schema, dropping views first so that their
+// tables can be dropped too.
+func (db *DB) dropRemovedTables(schema Schema) error {
+	var views, tables []string
+	for name, opts := range db.schema {
+		if schema[name] != nil {
+			continue
+		}
+		if opts.View {
+			views = append(views, name)
+		} else {
+			tables = append(tables, name)
+		}
+	}
+	for _, name := range append(views, tables...) {
+		if db.getTable(name) == nil {
+			continue
+		}
+		log.Debugf("Dropping '%v', which was removed from schema", name)
+		err := db.DropTable(name)
+		if err != nil {
+			return fmt.Errorf("Error dropping table %v: %v", name, err)
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,893 @@
+package zenodb
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/sql"
+	"github.com/golang/snappy"
+	"github.com/oxtoacart/emsort"
+)
+
+const (
+	manifestFile = "manifest.json"
+
+	// compactionFanIn is the number of segments in a tier that get compacted
+	// into a single segment on the next tier.
+	compactionFanIn = 4
+
+	// blockSize is the approximate uncompressed size at which row groups are
+	// compressed and written to disk.
+	blockSize = 64 * 1024
+
+	// maxRowLength is the length beyond which encoded rows are assumed to be
+	// corrupt.
+	maxRowLength = 1 << 32
+
+	// maxHeaderLength is the length beyond which segment headers are assumed to
+	// be corrupt.
+	maxHeaderLength = 1 << 20
+)
+
+var (
+	lastSegmentTimestamp int64
+)
+
+// segment is an immutable file containing rows sorted by key. Segments are
+// created by flushing memstores (tier 0) and by compacting compactionFanIn
+// segments of one tier into a single segment of the next tier.
+//
+// Each segment holds data for a single time partition, i.e. it only contains
+// periods whose times fall within [PartitionStart, PartitionEnd).
+type segment struct {
+	Name           string
+	Tier           int
+	Bytes          int64
+	PartitionStart time.Time
+	PartitionEnd   time.Time
+	// Offset is the WAL offset up to which this segment contains data.
+	Offset wal.Offset
+	// StartOffset is the WAL offset after which this segment's data starts, or
+	// nil if the segment may contain data from the beginning of the WAL (e.g.
+	// converted segments).
+	StartOffset wal.Offset
+	// Keys is the number of keys in this segment.
+	Keys int64
+	// DistinctValues is the number of distinct values per dimension in this
+	// segment, up to maxDistinctValues.
+	DistinctValues map[string]int64
+}
+
+// manifest records the segments that make up a table's file store, in the
+// order in which they were created, along with the WAL offset up to which the
+// file store contains data.
+type manifest struct {
+	Segments []*segment
+	Offset   wal.Offset
+}
+
+func readManifest(dir string) (*manifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read manifest: %v", err)
+	}
+	m := &manifest{}
+	err = json.Unmarshal(b, m)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse manifest: %v", err)
+	}
+	return m, nil
+}
+
+// writeManifest atomically replaces the manifest in the given dir.
+func writeManifest(dir string, m *manifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("Unable to serialize manifest: %v", err)
+	}
+	tmp, err := ioutil.TempFile(dir, "tmp_manifest")
+	if err != nil {
+		return fmt.Errorf("Unable to create temp file for manifest: %v", err)
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Unable to write manifest: %v", err)
+	}
+	err = os.Rename(tmp.Name(), filepath.Join(dir, manifestFile))
+	if err != nil {
+		return fmt.Errorf("Unable to replace manifest: %v", err)
+	}
+	return nil
+}
+
+// segmentWriter writes a new segment. The segment starts with an uncompressed
+// header, followed by the rows, which are stored column by column in row groups
+// (see rowGroupWriter) so that readers only need to decompress the columns that
+// they use.
+//
+// Rows must be written in key order unless sortRows has been called. The
+// segmentWriter also writes an index of the rows in which each dimension value
+// occurs (see segmentIndex).
+type segmentWriter struct {
+	dir            string
+	fields         []sql.Field
+	resolution     time.Duration
+	truncateBefore time.Time
+	offset         wal.Offset
+	file           *os.File
+	out            *bufio.Writer
+	groups         *rowGroupWriter
+	sorter         io.WriteCloser
+	index          segmentIndex
+	keys           int64
+	distinctValues distinctValueCounter
+}
+
+func newSegmentWriter(dir string, fields []sql.Field, resolution time.Duration, truncateBefore time.Time, offset wal.Offset) (*segmentWriter, error) {
+	if len(offset) == 0 {
+		// Nothing has been read from the WAL yet
+		offset = make(wal.Offset, wal.OffsetSize)
+	}
+	file, err := ioutil.TempFile(dir, "tmp_segment")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create temp file for segment: %v", err)
+	}
+	sw := &segmentWriter{
+		dir:            dir,
+		fields:         fields,
+		resolution:     resolution,
+		truncateBefore: truncateBefore,
+		offset:         offset,
+		file:           file,
+		out:            bufio.NewWriter(file),
+		index:          make(segmentIndex),
+		distinctValues: make(distinctValueCounter),
+	}
+
+	fieldStrings := make([]string, 0, len(fields))
+	for _, field := range fields {
+		fieldStrings = append(fieldStrings, field.String())
+	}
+	fieldsBytes := []byte(strings.Join(fieldStrings, fieldsDelims[CurrentFileVersion]))
+	headerLength := uint32(len(offset) + encoding.Width64bits + len(fieldsBytes))
+	err = binary.Write(sw.out, encoding.Binary, headerLength)
+	if err == nil {
+		_, err = sw.out.Write(offset)
+	}
+	if err == nil {
+		err = binary.Write(sw.out, encoding.Binary, int64(resolution))
+	}
+	if err == nil {
+		_, err = sw.out.Write(fieldsBytes)
+	}
+	if err != nil {
+		sw.abort()
+		return nil, fmt.Errorf("Unable to write header: %v", err)
+	}
+	sw.groups = newRowGroupWriter(sw.out, fields, int64(encoding.Width32bits)+int64(headerLength))
+	return sw, nil
+}
+
+// sortRows makes the segmentWriter sort rows by key (using an external sort
+// that uses up to memLimit bytes of memory), allowing rows to be written in any
+// order. While sorting, rows are encoded as:
+//
+//	rowLength|keylength|key|numcolumns|col1len|col2len|...|lastcollen|col1|col2|...|lastcol
+//
+// rowLength is 64 bits and includes itself
+// keylength is 16 bits and does not include itself
+// key can be up to 64KB
+// numcolumns is 16 bits (i.e. 65,536 columns allowed)
+// col*len is 64 bits
+func (sw *segmentWriter) sortRows(memLimit int) error {
+	chunk := func(r io.Reader) ([]byte, error) {
+		rowLength := uint64(0)
+		readErr := binary.Read(r, encoding.Binary, &rowLength)
+		if readErr != nil {
+			return nil, readErr
+		}
+		row := make([]byte, rowLength)
+		encoding.Binary.PutUint64(row, rowLength)
+		_, readErr = io.ReadFull(r, row[encoding.Width64bits:])
+		return row, readErr
+	}
+
+	less := func(a []byte, b []byte) bool {
+		return bytes.Compare(keyOfRow(a), keyOfRow(b)) < 0
+	}
+
+	sorter, err := emsort.New(&sortedRowWriter{sw: sw}, chunk, less, memLimit)
+	if err != nil {
+		return fmt.Errorf("Unable to initialize sorting: %v", err)
+	}
+	sw.sorter = sorter
+	return nil
+}
+
+// keyOfRow extracts the key from an encoded row.
+func keyOfRow(row []byte) []byte {
+	row = row[encoding.Width64bits:]
+	keyLength, row := encoding.ReadInt16(row)
+	return row[:keyLength]
+}
+
+// encodeRow encodes a row in the format used for sorting (see sortRows).
+func encodeRow(key bytemap.ByteMap, columns []encoding.Sequence) []byte {
+	rowLength := encoding.Width64bits + encoding.Width16bits + len(key) + encoding.Width16bits
+	for _, seq := range columns {
+		rowLength += encoding.Width64bits + len(seq)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, rowLength))
+	binary.Write(buf, encoding.Binary, uint64(rowLength))
+	binary.Write(buf, encoding.Binary, uint16(len(key)))
+	buf.Write(key)
+	binary.Write(buf, encoding.Binary, uint16(len(columns)))
+	for _, seq := range columns {
+		binary.Write(buf, encoding.Binary, uint64(len(seq)))
+	}
+	for _, seq := range columns {
+		buf.Write(seq)
+	}
+	return buf.Bytes()
+}
+
+// decodeRow decodes a row encoded with encodeRow (minus the leading rowLength).
+func decodeRow(row []byte) (bytemap.ByteMap, []encoding.Sequence, error) {
+	errTruncated := fmt.Errorf("Row is truncated")
+	if len(row) < encoding.Width16bits {
+		return nil, nil, errTruncated
+	}
+	keyLength, row := encoding.ReadInt16(row)
+	if len(row) < keyLength+encoding.Width16bits {
+		return nil, nil, errTruncated
+	}
+	key, row := encoding.ReadByteMap(row, keyLength)
+
+	numColumns, row := encoding.ReadInt16(row)
+	if len(row) < numColumns*encoding.Width64bits {
+		return nil, nil, errTruncated
+	}
+	colLengths := make([]int, 0, numColumns)
+	for i := 0; i < numColumns; i++ {
+		var colLength int
+		colLength, row = encoding.ReadInt64(row)
+		colLengths = append(colLengths, int(colLength))
+	}
+
+	columns := make([]encoding.Sequence, 0, numColumns)
+	for _, colLength := range colLengths {
+		if colLength < 0 || len(row) < colLength {
+			return nil, nil, errTruncated
+		}
+		var seq encoding.Sequence
+		seq, row = encoding.ReadSequence(row, colLength)
+		columns = append(columns, seq)
+	}
+	return key, columns, nil
+}
+
+// sortedRowWriter receives the encoded rows coming out of the sorter and
+// appends them to its segmentWriter.
+type sortedRowWriter struct {
+	sw  *segmentWriter
+	buf []byte
+}
+
+func (w *sortedRowWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	for len(w.buf) >= encoding.Width64bits {
+		rowLength := encoding.Binary.Uint64(w.buf)
+		if uint64(len(w.buf)) < rowLength {
+			break
+		}
+		key, columns, err := decodeRow(w.buf[encoding.Width64bits:rowLength])
+		if err == nil {
+			err = w.sw.append(key, columns)
+		}
+		if err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[rowLength:]
+	}
+	return len(b), nil
+}
+
+// write writes the given row, truncating any data that falls outside of the
+// retention period. Rows whose data has all expired are omitted.
+func (sw *segmentWriter) write(key bytemap.ByteMap, columns []encoding.Sequence) error {
+	if len(columns) > len(sw.fields) {
+		columns = columns[:len(sw.fields)]
+	}
+	hasActiveSequence := false
+	for i, seq := range columns {
+		seq = seq.Truncate(sw.fields[i].Expr.EncodedWidth(), sw.resolution, sw.truncateBefore)
+		columns[i] = seq
+		if seq != nil {
+			hasActiveSequence = true
+		}
+	}
+
+	if !hasActiveSequence {
+		// all encoding.Sequences expired, remove key
+		return nil
+	}
+	sw.keys++
+	sw.distinctValues.add(key)
+
+	if sw.sorter != nil {
+		// We always write the entire row as a single byte array because that's
+		// what the sorter needs.
+		_, err := sw.sorter.Write(encodeRow(key, columns))
+		return err
+	}
+	return sw.append(key, columns)
+}
+
+// append appends a row that's already in key order.
+func (sw *segmentWriter) append(key bytemap.ByteMap, columns []encoding.Sequence) error {
+	sw.index.add(key, sw.groups.position())
+	return sw.groups.add(key, columns)
+}
+
+// close finishes writing the segment and moves it into place.
+func (sw *segmentWriter) close(tier int) (*segment, error) {
+	var err error
+	if sw.sorter != nil {
+		err = sw.sorter.Close()
+	}
+	if err == nil {
+		err = sw.groups.flush()
+	}
+	if err == nil {
+		err = sw.out.Flush()
+	}
+	if err == nil {
+		err = sw.file.Sync()
+	}
+	if err != nil {
+		sw.abort()
+		return nil, fmt.Errorf("Unable to finish writing segment: %v", err)
+	}
+	fi, err := sw.file.Stat()
+	if err != nil {
+		sw.abort()
+		return nil, fmt.Errorf("Unable to stat segment: %v", err)
+	}
+	sw.file.Close()
+
+	// Note - we left-pad the unix nano value to the widest possible length to
+	// ensure lexicographical sort matches time-based sort (e.g. on directory
+	// listing).
+	name := fmt.Sprintf("segment_%020d_%d.dat", segmentTimestamp(), CurrentFileVersion)
+	err = os.Rename(sw.file.Name(), filepath.Join(sw.dir, name))
+	if err != nil {
+		os.Remove(sw.file.Name())
+		return nil, fmt.Errorf("Unable to move segment into place: %v", err)
+	}
+	// Segments work without their index, so failing to write it isn't fatal
+	indexErr := sw.index.write(sw.dir, indexFileFor(name))
+	if indexErr != nil {
+		log.Errorf("Unable to write index for %v: %v", name, indexErr)
+	}
+	return &segment{
+		Name:           name,
+		Tier:           tier,
+		Bytes:          fi.Size(),
+		Offset:         sw.offset,
+		Keys:           sw.keys,
+		DistinctValues: sw.distinctValues.counts(),
+	}, nil
+}
+
+// segmentTimestamp returns the current unix nano time, making sure that it
+// never returns the same value twice so that segment names are unique.
+func segmentTimestamp() int64 {
+	for {
+		last := atomic.LoadInt64(&lastSegmentTimestamp)
+		ts := time.Now().UnixNano()
+		if ts <= last {
+			ts = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastSegmentTimestamp, last, ts) {
+			return ts
+		}
+	}
+}
+
+// abort stops writing and removes the partially written segment.
+func (sw *segmentWriter) abort() {
+	sw.file.Close()
+	os.Remove(sw.file.Name())
+}
+
+func (seg *segment) partitioned() bool {
+	return !seg.PartitionEnd.IsZero()
+}
+
+// overlaps indicates whether this segment may contain data for periods after
+// asOf and up to until. Zero values for asOf and until are unbounded.
+func (seg *segment) overlaps(asOf time.Time, until time.Time) bool {
+	if !seg.partitioned() {
+		return true
+	}
+	if !asOf.IsZero() && !seg.PartitionEnd.After(asOf) {
+		return false
+	}
+	if !until.IsZero() && seg.PartitionStart.After(until) {
+		return false
+	}
+	return true
+}
+
+// partitionedWriter writes rows to one segmentWriter per time partition,
+// splitting each row's sequences along partition boundaries.
+type partitionedWriter struct {
+	dir             string
+	fields          []sql.Field
+	resolution      time.Duration
+	truncateBefore  time.Time
+	offset          wal.Offset
+	partitionPeriod time.Duration
+	sortMemLimit    int
+	writers         map[int64]*segmentWriter
+}
+
+// newPartitionedWriter creates a partitionedWriter. If sortMemLimit is greater
+// than 0, each partition's rows are sorted using up to that much memory,
+// otherwise rows must be written in key order.
+func newPartitionedWriter(dir string, fields []sql.Field, resolution time.Duration, truncateBefore time.Time, offset wal.Offset, partitionPeriod time.Duration, sortMemLimit int) *partitionedWriter {
+	return &partitionedWriter{
+		dir:             dir,
+		fields:          fields,
+		resolution:      resolution,
+		truncateBefore:  truncateBefore,
+		offset:          offset,
+		partitionPeriod: partitionPeriod,
+		sortMemLimit:    sortMemLimit,
+		writers:         make(map[int64]*segmentWriter),
+	}
+}
+
+func (pw *partitionedWriter) write(key bytemap.ByteMap, columns []encoding.Sequence) error {
+	var partitions map[int64][]encoding.Sequence
+	for i, seq := range columns {
+		if i >= len(pw.fields) {
+			break
+		}
+		if len(seq) == 0 {
+			continue
+		}
+		periodWidth := pw.fields[i].Expr.EncodedWidth()
+		numPeriods := seq.NumPeriods(periodWidth)
+		if numPeriods == 0 {
+			continue
+		}
+		start := seq.Start()
+		end := start.Add(-1 * time.Duration(numPeriods-1) * pw.resolution)
+		for partitionStart := end.Truncate(pw.partitionPeriod); !partitionStart.After(start); partitionStart = partitionStart.Add(pw.partitionPeriod) {
+			partitionEnd := partitionStart.Add(pw.partitionPeriod)
+			if !partitionEnd.After(pw.truncateBefore) {
+				// Partition already expired
+				continue
+			}
+			sliced := seq.Slice(periodWidth, pw.resolution, partitionStart, partitionEnd)
+			if sliced == nil {
+				continue
+			}
+			if partitions == nil {
+				partitions = make(map[int64][]encoding.Sequence)
+			}
+			partition := partitions[partitionStart.UnixNano()]
+			if partition == nil {
+				partition = make([]encoding.Sequence, len(columns))
+				partitions[partitionStart.UnixNano()] = partition
+			}
+			partition[i] = sliced
+		}
+	}
+
+	for partitionStart, partition := range partitions {
+		sw := pw.writers[partitionStart]
+		if sw == nil {
+			var err error
+			sw, err = newSegmentWriter(pw.dir, pw.fields, pw.resolution, pw.truncateBefore, pw.offset)
+			if err != nil {
+				return err
+			}
+			if pw.sortMemLimit > 0 {
+				err = sw.sortRows(pw.sortMemLimit)
+				if err != nil {
+					sw.abort()
+					return err
+				}
+			}
+			pw.writers[partitionStart] = sw
+		}
+		err := sw.write(key, partition)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close finishes writing all partitions and returns the resulting segments in
+// order of partition.
+func (pw *partitionedWriter) close(tier int) ([]*segment, error) {
+	partitionStarts := make([]int64, 0, len(pw.writers))
+	for partitionStart := range pw.writers {
+		partitionStarts = append(partitionStarts, partitionStart)
+	}
+	sort.Sort(int64s(partitionStarts))
+	segments := make([]*segment, 0, len(partitionStarts))
+	for i, partitionStart := range partitionStarts {
+		seg, err := pw.writers[partitionStart].close(tier)
+		if err != nil {
+			for _, remaining := range partitionStarts[i+1:] {
+				pw.writers[remaining].abort()
+			}
+			return nil, err
+		}
+		seg.PartitionStart = time.Unix(0, partitionStart)
+		seg.PartitionEnd = seg.PartitionStart.Add(pw.partitionPeriod)
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+// abort stops writing all partitions and removes their partially written
+// segments.
+func (pw *partitionedWriter) abort() {
+	for _, sw := range pw.writers {
+		sw.abort()
+	}
+}
+
+type int64s []int64
+
+func (a int64s) Len() int           { return len(a) }
+func (a int64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a int64s) Less(i, j int) bool { return a[i] < a[j] }
+
+// segmentReader reads the rows from a segment (or from a file store written
+// prior to the introduction of segments), translating its columns into the
+// given fields and resolution.
+//
+// Segments (FileVersion_5) are read row group by row group. Older file stores
+// are read from a single snappy stream of encoded rows.
+type segmentReader struct {
+	filename       string
+	file           *os.File
+	r              io.Reader
+	groups         *rowGroupReader
+	fields         []sql.Field
+	resolution     time.Duration
+	fileFields     []sql.Field
+	fileResolution time.Duration
+	fieldIdxs      []int
+	offset         wal.Offset
+	// dataOffset is the file offset at which the rows start
+	dataOffset int64
+	// if rows is not nil, only these rows are read
+	rows []rowRef
+}
+
+// openSegment opens the given segment for reading the given fields at the given
+// resolution. If fields is nil, all columns are read as stored in the file.
+func openSegment(filename string, fields []sql.Field, resolution time.Duration, includeField func(int) bool) (*segmentReader, error) {
+	fileVersion := versionFor(filename)
+	if fileVersion > CurrentFileVersion {
+		return nil, fmt.Errorf("Unsupported file version %d of %v", fileVersion, filename)
+	}
+	file, err := os.OpenFile(filename, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open file %v: %v", filename, err)
+	}
+	sr := &segmentReader{
+		filename:       filename,
+		file:           file,
+		fields:         fields,
+		resolution:     resolution,
+		fileFields:     fields,
+		fileResolution: resolution,
+	}
+	var in *bufio.Reader
+	if fileVersion >= FileVersion_5 {
+		// Header is uncompressed
+		in = bufio.NewReader(file)
+		sr.r = in
+	} else {
+		sr.r = snappy.NewReader(file)
+	}
+	err = sr.readHeader(includeField)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if fileVersion >= FileVersion_5 {
+		fi, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Unable to stat file %v: %v", filename, err)
+		}
+		includeColumn := make([]bool, 0, len(sr.fieldIdxs))
+		for _, idx := range sr.fieldIdxs {
+			includeColumn = append(includeColumn, idx >= 0)
+		}
+		sr.groups = newRowGroupReader(file, in, sr.dataOffset, fi.Size(), includeColumn)
+		sr.r = nil
+	}
+	return sr, nil
+}
+
+// indexed indicates whether the segment's rows can be located with a
+// segmentIndex.
+func (sr *segmentReader) indexed() bool {
+	return sr.groups != nil
+}
+
+// onlyWithin makes the segmentReader skip row groups that don't contain data
+// for periods after asOf and up to until. Zero values for asOf and until are
+// unbounded. Rows from row groups that aren't skipped may still contain data
+// outside of that range.
+func (sr *segmentReader) onlyWithin(asOf time.Time, until time.Time) {
+	if sr.groups == nil || (asOf.IsZero() && until.IsZero()) {
+		return
+	}
+	sr.groups.overlaps = func(minStart time.Time, maxStart time.Time, maxPeriods int) bool {
+		// Rescaling may round times up to the table's resolution
+		latest := encoding.RoundTime(maxStart, sr.resolution)
+		earliest := encoding.RoundTime(minStart.Add(-1*time.Duration(maxPeriods-1)*sr.fileResolution), sr.resolution)
+		if !asOf.IsZero() && !latest.After(asOf) {
+			return false
+		}
+		if !until.IsZero() && earliest.After(until) {
+			return false
+		}
+		return true
+	}
+}
+
+// onlyRows restricts the segmentReader to reading the given rows, which must be
+// sorted.
+func (sr *segmentReader) onlyRows(rows []rowRef) {
+	if rows == nil {
+		rows = make([]rowRef, 0)
+	}
+	sr.rows = rows
+}
+
+func (sr *segmentReader) readHeader(includeField func(int) bool) error {
+	fileVersion := versionFor(sr.filename)
+	if fileVersion >= FileVersion_2 {
+		// File contains header with field info, use it
+		headerLength := uint32(0)
+		lengthErr := binary.Read(sr.r, encoding.Binary, &headerLength)
+		if lengthErr != nil {
+			return fmt.Errorf("Unexpected error reading header length from %v: %v", sr.filename, lengthErr)
+		}
+		if headerLength > maxHeaderLength {
+			return fmt.Errorf("Invalid header length %d in %v", headerLength, sr.filename)
+		}
+		sr.dataOffset = int64(encoding.Width32bits) + int64(headerLength)
+		fieldsBytes := make([]byte, headerLength)
+		_, err := io.ReadFull(sr.r, fieldsBytes)
+		if err != nil {
+			return fmt.Errorf("Unexpected error reading header from %v: %v", sr.filename, err)
+		}
+		minHeaderLength := 0
+		if fileVersion >= FileVersion_4 {
+			minHeaderLength += wal.OffsetSize
+		}
+		if fileVersion >= FileVersion_5 {
+			minHeaderLength += encoding.Width64bits
+		}
+		if len(fieldsBytes) < minHeaderLength {
+			return fmt.Errorf("Header in %v is truncated", sr.filename)
+		}
+		if fileVersion >= FileVersion_4 {
+			// Strip offset
+			sr.offset = wal.Offset(fieldsBytes[:wal.OffsetSize])
+			fieldsBytes = fieldsBytes[wal.OffsetSize:]
+		}
+		if fileVersion >= FileVersion_5 {
+			sr.fileResolution = time.Duration(encoding.Binary.Uint64(fieldsBytes))
+			fieldsBytes = fieldsBytes[encoding.Width64bits:]
+		}
+		delim := fieldsDelims[fileVersion]
+		fieldStrings := strings.Split(string(fieldsBytes), delim)
+		sr.fileFields = make([]sql.Field, 0, len(fieldStrings))
+		for _, fieldString := range fieldStrings {
+			foundField := false
+			for _, field := range sr.fields {
+				if fieldString == field.String() {
+					sr.fileFields = append(sr.fileFields, field)
+					foundField = true
+					break
+				}
+			}
+			if !foundField {
+				// Field was removed from table, its column will be skipped (and
+				// dropped on the next compaction)
+				log.Tracef("Skipping field %v that's no longer on table", fieldString)
+				sr.fileFields = append(sr.fileFields, sql.Field{Name: fieldString})
+			}
+		}
+	}
+
+	if sr.fields == nil {
+		// Read all columns as stored
+		sr.fields = sr.fileFields
+		sr.resolution = sr.fileResolution
+		sr.fieldIdxs = make([]int, 0, len(sr.fileFields))
+		for i := range sr.fileFields {
+			sr.fieldIdxs = append(sr.fieldIdxs, i)
+		}
+		return nil
+	}
+
+	if sr.fileResolution != sr.resolution && (sr.fileResolution > sr.resolution || sr.resolution%sr.fileResolution != 0) {
+		return fmt.Errorf("Unable to convert data in %v from resolution %v to %v", sr.filename, sr.fileResolution, sr.resolution)
+	}
+
+	sr.fieldIdxs = make([]int, 0, len(sr.fileFields))
+	for _, candidate := range sr.fileFields {
+		idx := -1
+		for i, field := range sr.fields {
+			if includeField(i) && candidate.Expr != nil && field.String() == candidate.String() {
+				idx = i
+			}
+		}
+		sr.fieldIdxs = append(sr.fieldIdxs, idx)
+	}
+	return nil
+}
+
+// read reads the next row, returning io.EOF once all rows have been read.
+func (sr *segmentReader) read() (bytemap.ByteMap, []encoding.Sequence, error) {
+	for sr.rows != nil {
+		if len(sr.rows) == 0 {
+			return nil, nil, io.EOF
+		}
+		found, err := sr.groups.seek(sr.rows[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to seek to row in %v: %v", sr.filename, err)
+		}
+		sr.rows = sr.rows[1:]
+		if found {
+			break
+		}
+	}
+
+	if sr.groups != nil {
+		key, fileColumns, err := sr.groups.next()
+		if err == io.EOF {
+			return nil, nil, err
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unexpected error reading row group from %v: %v", sr.filename, err)
+		}
+		return key, sr.tableColumns(fileColumns), nil
+	}
+
+	rowLength := uint64(0)
+	err := binary.Read(sr.r, encoding.Binary, &rowLength)
+	if err == io.EOF {
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unexpected error reading row length from %v: %v", sr.filename, err)
+	}
+	if rowLength < encoding.Width64bits || rowLength > maxRowLength {
+		return nil, nil, fmt.Errorf("Invalid row length %d in %v", rowLength, sr.filename)
+	}
+
+	row := make([]byte, rowLength)
+	encoding.Binary.PutUint64(row, rowLength)
+	row = row[encoding.Width64bits:]
+	_, err = io.ReadFull(sr.r, row)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unexpected error while reading row from %v: %v", sr.filename, err)
+	}
+
+	key, fileColumns, err := decodeRow(row)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to decode row from %v: %v", sr.filename, err)
+	}
+	return key, sr.tableColumns(fileColumns), nil
+}
+
+// tableColumns maps the columns as stored in the file to the table's fields.
+func (sr *segmentReader) tableColumns(fileColumns []encoding.Sequence) []encoding.Sequence {
+	columns := make([]encoding.Sequence, len(sr.fields))
+	for i, seq := range fileColumns {
+		if i >= len(sr.fieldIdxs) {
+			continue
+		}
+		idx := sr.fieldIdxs[i]
+		if idx < 0 || seq == nil {
+			continue
+		}
+		if sr.fileResolution != sr.resolution {
+			seq = seq.Rescale(sr.fileFields[i].Expr, sr.fileResolution, sr.resolution)
+		}
+		columns[idx] = seq
+	}
+	return columns
+}
+
+func (sr *segmentReader) close() {
+	sr.file.Close()
+}
+
+// segmentRow is the current row of a segmentReader.
+type segmentRow struct {
+	reader  *segmentReader
+	key     bytemap.ByteMap
+	columns []encoding.Sequence
+}
+
+// rowHeap is a min-heap of the current rows of multiple segmentReaders, ordered
+// by key, used to merge sorted segments.
+type rowHeap []*segmentRow
+
+func (h rowHeap) Len() int           { return len(h) }
+func (h rowHeap) Less(i, j int) bool { return bytes.Compare(h[i].key, h[j].key) < 0 }
+func (h rowHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *rowHeap) Push(x interface{}) {
+	*h = append(*h, x.(*segmentRow))
+}
+
+func (h *rowHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// advance reads the next row for the reader at the top of the heap, removing
+// the reader from the heap once it has no more rows.
+func (h *rowHeap) advance() error {
+	top := (*h)[0]
+	key, columns, err := top.reader.read()
+	if err == io.EOF {
+		heap.Pop(h)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	top.key = key
+	top.columns = columns
+	heap.Fix(h, 0)
+	return nil
+}
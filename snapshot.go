@@ -0,0 +1,436 @@
+package zenodb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/wal"
+	"github.com/getlantern/yaml"
+)
+
+const (
+	// SnapshotSchemaFile is the name of the file in a snapshot that holds the
+	// schema that was in effect when the snapshot was taken.
+	SnapshotSchemaFile = "schema.yaml"
+
+	snapshotInfoFile       = "snapshot.json"
+	snapshotStagingDirName = "_snapshot"
+	walDirName             = "_wal"
+)
+
+// SnapshotInfo describes a snapshot.
+type SnapshotInfo struct {
+	// Time is when the snapshot was taken.
+	Time time.Time
+	// Offsets are the WAL offsets up to which each table's file store in the
+	// snapshot contains data. On restore, tables replay the WAL from there.
+	Offsets map[string]wal.Offset
+	// BytesCopied is the number of bytes that had to be copied, i.e. excluding
+	// files that were unchanged since the previous snapshot in the same dir or
+	// that could be hard linked.
+	BytesCopied int64
+}
+
+// Snapshot writes a consistent copy of the database to dir, from which a data
+// directory can be rebuilt with RestoreSnapshot. The snapshot contains the
+// current file store of every table along with the WAL offset up to which it
+// contains data, the WAL files from which to replay the data that hasn't been
+// flushed yet, the tables' stats and the schema.
+//
+// The database is only held still while the file stores are captured and the
+// files to include are hard linked into a staging directory inside of the data
+// directory, after which they're copied into the snapshot without holding up
+// the database. Segment files never change once written, so they are hard
+// linked into the snapshot where possible. If dir already holds a snapshot,
+// files that haven't changed since are reused, so that only new segments and
+// WAL data get copied. The new snapshot is built next to dir and only replaces
+// it once complete.
+//
+// The newest WAL file is still being written to while it's copied, so points
+// inserted during the snapshot may or may not be included. State stored next
+// to the WALs (like Kafka offsets) is captured before the WALs, so that it never
+// refers to points that are missing from the snapshot.
+func (db *DB) Snapshot(dir string) (*SnapshotInfo, error) {
+	db.snapshotsMutex.Lock()
+	defer db.snapshotsMutex.Unlock()
+
+	dir = filepath.Clean(dir)
+	err := recoverPreviousSnapshot(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to recover previous snapshot in %v: %v", dir, err)
+	}
+	tmpDir := dir + ".tmp"
+	err = os.RemoveAll(tmpDir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to remove leftover temp dir %v: %v", tmpDir, err)
+	}
+	stagingDir := filepath.Join(db.opts.Dir, snapshotStagingDirName)
+	err = os.RemoveAll(stagingDir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to remove leftover staging dir %v: %v", stagingDir, err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	st, err := db.stageSnapshot(stagingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &snapshotCopier{previousDir: dir, dir: tmpDir}
+	info := &SnapshotInfo{Time: st.time, Offsets: make(map[string]wal.Offset, len(st.fileStores))}
+	for _, staged := range st.files {
+		err = sc.copy(stagingDir, staged.rel, staged.immutable, false)
+		if err != nil {
+			os.RemoveAll(tmpDir)
+			return nil, fmt.Errorf("Unable to snapshot %v: %v", staged.rel, err)
+		}
+	}
+	for name, fs := range st.fileStores {
+		tableDir := filepath.Join(tmpDir, name)
+		err = os.MkdirAll(tableDir, 0755)
+		if err == nil {
+			err = writeManifest(tableDir, &manifest{Segments: fs.segments, Offset: fs.offset})
+		}
+		if err != nil {
+			os.RemoveAll(tmpDir)
+			return nil, fmt.Errorf("Unable to snapshot table %v: %v", name, err)
+		}
+		info.Offsets[name] = fs.offset
+	}
+
+	err = ioutil.WriteFile(filepath.Join(tmpDir, SnapshotSchemaFile), st.schema, 0644)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, fmt.Errorf("Unable to snapshot schema: %v", err)
+	}
+	info.BytesCopied = sc.bytesCopied
+	infoBytes, err := json.Marshal(info)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(tmpDir, snapshotInfoFile), infoBytes, 0644)
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, fmt.Errorf("Unable to write snapshot info: %v", err)
+	}
+
+	// Swap in the new snapshot. If this gets interrupted, the previous snapshot
+	// is left in oldDir, from where recoverPreviousSnapshot restores it.
+	oldDir := dir + ".old"
+	err = os.Rename(dir, oldDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Unable to move previous snapshot out of the way: %v", err)
+	}
+	err = os.Rename(tmpDir, dir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to move snapshot into place: %v", err)
+	}
+	err = os.RemoveAll(oldDir)
+	if err != nil {
+		log.Errorf("Unable to remove previous snapshot %v: %v", oldDir, err)
+	}
+	log.Debugf("Snapshotted %d tables to %v, copied %d bytes", len(st.fileStores), dir, info.BytesCopied)
+	return info, nil
+}
+
+// stagedSnapshot is what stageSnapshot captured.
+type stagedSnapshot struct {
+	time       time.Time
+	fileStores map[string]*fileStore
+	schema     []byte
+	// files are the staged files in the order in which they were staged
+	files []*stagedFile
+}
+
+type stagedFile struct {
+	rel       string
+	immutable bool
+}
+
+// stageSnapshot captures the current file stores and schema and hard links all
+// files that belong in the snapshot into stagingDir, so that they can be copied
+// after the database has moved on (e.g. removed compacted segments, truncated
+// its WALs or dropped tables). It blocks schema changes, removal of segments and
+// WAL truncation while it runs, which is quick since linking doesn't copy any
+// data.
+func (db *DB) stageSnapshot(stagingDir string) (*stagedSnapshot, error) {
+	// Hold the schema mutex to keep tables from being created or dropped while
+	// we capture them
+	db.schemaMutex.Lock()
+	defer db.schemaMutex.Unlock()
+	// Hold the snapshot mutex to keep segments from being deleted after
+	// compaction and WALs from being truncated or compressed while we link them
+	db.snapshotMutex.Lock()
+	defer db.snapshotMutex.Unlock()
+
+	db.tablesMutex.RLock()
+	closed := db.closed
+	tables := db.orderedTables
+	db.tablesMutex.RUnlock()
+	if closed {
+		return nil, fmt.Errorf("Database is closed")
+	}
+
+	st := &stagedSnapshot{time: time.Now(), fileStores: make(map[string]*fileStore, len(tables))}
+	stage := func(rel string, immutable bool, optional bool) error {
+		dst := filepath.Join(stagingDir, rel)
+		err := os.MkdirAll(filepath.Dir(dst), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.Link(filepath.Join(db.opts.Dir, rel), dst)
+		if err != nil {
+			if optional && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		st.files = append(st.files, &stagedFile{rel: rel, immutable: immutable})
+		return nil
+	}
+
+	// The WAL of each stream is needed from the earliest offset up to which a
+	// table reading from it has flushed its data
+	replayFrom := make(map[string]wal.Offset)
+	for _, t := range tables {
+		fs := t.rowStore.currentFileStore()
+		st.fileStores[t.Name] = fs
+		for _, seg := range fs.segments {
+			err := stage(filepath.Join(t.Name, seg.Name), true, false)
+			if err == nil {
+				err = stage(filepath.Join(t.Name, indexFileFor(seg.Name)), true, true)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Unable to snapshot table %v: %v", t.Name, err)
+			}
+		}
+		err := stage(filepath.Join(filepath.Base(db.statsDir()), t.Name+".json"), false, true)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to snapshot stats of table %v: %v", t.Name, err)
+		}
+		from, found := replayFrom[t.From]
+		if found {
+			from = earliestOffset(from, fs.offset)
+		} else {
+			from = fs.offset
+		}
+		replayFrom[t.From] = from
+	}
+
+	err := db.stageWALs(replayFrom, stage)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to snapshot WAL: %v", err)
+	}
+
+	st.schema, err = yaml.Marshal(db.schema)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to snapshot schema: %v", err)
+	}
+	return st, nil
+}
+
+// recoverPreviousSnapshot cleans up after a snapshot into dir that was
+// interrupted while swapping in the new snapshot. If the previous snapshot was
+// already moved out of the way, it's moved back, since it's the only complete
+// snapshot left.
+func recoverPreviousSnapshot(dir string) error {
+	oldDir := dir + ".old"
+	_, err := os.Stat(oldDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(dir)
+	if os.IsNotExist(err) {
+		log.Debugf("Restoring previous snapshot %v", oldDir)
+		return os.Rename(oldDir, dir)
+	}
+	if err != nil {
+		return err
+	}
+	// The new snapshot was swapped in, only removing the old one failed
+	return os.RemoveAll(oldDir)
+}
+
+// RestoreSnapshot rebuilds a data directory at dir from the snapshot in
+// snapshotDir. dir must not exist or be empty. The snapshot's schema is not
+// restored, it can be found in SnapshotSchemaFile inside of snapshotDir.
+func RestoreSnapshot(snapshotDir string, dir string) (*SnapshotInfo, error) {
+	infoBytes, err := ioutil.ReadFile(filepath.Join(snapshotDir, snapshotInfoFile))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read snapshot info, %v doesn't seem to be a complete snapshot: %v", snapshotDir, err)
+	}
+	info := &SnapshotInfo{}
+	err = json.Unmarshal(infoBytes, info)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse snapshot info: %v", err)
+	}
+
+	existing, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Unable to check contents of %v: %v", dir, err)
+	}
+	if len(existing) > 0 {
+		return nil, fmt.Errorf("%v is not empty, please restore into a new directory", dir)
+	}
+
+	// Copy rather than link so that the snapshot stays intact no matter what
+	// happens to the restored database
+	sc := &snapshotCopier{dir: dir}
+	err = filepath.Walk(snapshotDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(snapshotDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == snapshotInfoFile || rel == SnapshotSchemaFile {
+			return nil
+		}
+		return sc.copy(snapshotDir, rel, false, false)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to restore snapshot: %v", err)
+	}
+	return info, nil
+}
+
+// stageWALs stages the WAL files of all streams, along with the state stored
+// next to them (see DB.WALDir), using the given stage function. For streams in
+// replayFrom, only the files containing entries from the given offset onward are
+// staged (all of them if the offset is nil). This has to happen after capturing
+// the file stores so that the WALs contain everything after the captured
+// offsets.
+func (db *DB) stageWALs(replayFrom map[string]wal.Offset, stage func(rel string, immutable bool, optional bool) error) error {
+	walDir := filepath.Join(db.opts.Dir, walDirName)
+	entries, err := ioutil.ReadDir(walDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Stage the state next to the WALs (like the offsets of ingestion sources)
+	// first. It only ever refers to data that's already in the WALs, so the WALs
+	// that we stage afterwards contain everything it refers to. This state may
+	// be replaced while we're staging it, so it's okay for files to be missing.
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			err = stage(filepath.Join(walDirName, entry.Name()), false, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// WAL files aren't truncated or compressed while we hold the snapshotMutex
+	// (see capWALAge), so they all have to be there
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		from, found := replayFrom[entry.Name()]
+		files, err := ioutil.ReadDir(filepath.Join(walDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+			if found && from != nil {
+				sequence, ok := walFileSequence(file.Name())
+				if ok && sequence < from.FileSequence() {
+					// Only contains entries that have already been flushed
+					continue
+				}
+			}
+			err = stage(filepath.Join(walDirName, entry.Name(), file.Name()), false, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// walFileSequence returns the file sequence of the WAL file with the given
+// name, which is the number before the extension (if any).
+func walFileSequence(name string) (int64, bool) {
+	if idx := strings.Index(name, "."); idx >= 0 {
+		name = name[:idx]
+	}
+	sequence, err := strconv.ParseInt(name, 10, 64)
+	return sequence, err == nil
+}
+
+// snapshotCopier copies files into a snapshot, reusing unchanged files from
+// the previous snapshot if available.
+type snapshotCopier struct {
+	previousDir string
+	dir         string
+	bytesCopied int64
+}
+
+// copy copies the file at rel inside of srcDir to the same relative path in
+// the snapshot. If immutable is true, the file is hard linked if possible. If
+// optional is true, it's okay for the file not to exist.
+func (sc *snapshotCopier) copy(srcDir string, rel string, immutable bool, optional bool) error {
+	src := filepath.Join(srcDir, rel)
+	dst := filepath.Join(sc.dir, rel)
+	fi, err := os.Stat(src)
+	if err != nil {
+		if optional && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+
+	if sc.previousDir != "" {
+		previous := filepath.Join(sc.previousDir, rel)
+		pfi, statErr := os.Stat(previous)
+		if statErr == nil && pfi.Size() == fi.Size() && (immutable || !pfi.ModTime().Before(fi.ModTime())) && os.Link(previous, dst) == nil {
+			return nil
+		}
+	}
+	if immutable && os.Link(src, dst) == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		if optional && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, in)
+	sc.bytesCopied += n
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbsnapshottest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbDir := filepath.Join(tmpDir, "db")
+	snapshotDir := filepath.Join(tmpDir, "snapshot")
+	restoredDir := filepath.Join(tmpDir, "restored")
+	schemaFile := filepath.Join(tmpDir, "schema.yaml")
+	err = ioutil.WriteFile(schemaFile, []byte(`
+snapshot_test:
+  maxmemstorebytes: 1
+  retentionperiod: 24h
+  sql: >
+    SELECT SUM(i) AS i
+    FROM inbound
+    GROUP BY a, period(1h)
+`), 0644)
+	if !assert.NoError(t, err, "Unable to write schema") {
+		return
+	}
+
+	db, err := NewDB(&DBOpts{Dir: dbDir, SchemaFile: schemaFile})
+	if !assert.NoError(t, err, "Unable to create DB") {
+		return
+	}
+
+	now := time.Now()
+	insert := func(i float64) {
+		assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"a": "x"}, map[string]float64{"i": i}))
+	}
+	insert(1)
+	insert(2)
+	time.Sleep(1 * time.Second)
+	offsetsFile := db.WALDir("inbound") + ".kafka_points.json"
+	err = ioutil.WriteFile(offsetsFile, []byte(`{"offsets":{"0":2}}`), 0644)
+	if !assert.NoError(t, err, "Unable to write offsets file") {
+		db.Close()
+		return
+	}
+
+	info, err := db.Snapshot(snapshotDir)
+	if !assert.NoError(t, err) {
+		db.Close()
+		return
+	}
+	assert.Contains(t, info.Offsets, "snapshot_test")
+	m, err := readManifest(filepath.Join(snapshotDir, "snapshot_test"))
+	if assert.NoError(t, err) && assert.NotNil(t, m) {
+		assert.NotEmpty(t, m.Segments, "Flushed data should be in snapshot")
+		for _, seg := range m.Segments {
+			_, err := os.Stat(filepath.Join(snapshotDir, "snapshot_test", seg.Name))
+			assert.NoError(t, err, "Segment should be in snapshot")
+		}
+	}
+	_, err = os.Stat(filepath.Join(snapshotDir, "_stats", "snapshot_test.json"))
+	assert.NoError(t, err, "Stats should be in snapshot")
+
+	// Simulate a snapshot that was interrupted after moving the previous
+	// snapshot out of the way
+	if !assert.NoError(t, os.Rename(snapshotDir, snapshotDir+".old")) {
+		db.Close()
+		return
+	}
+
+	// Take an incremental snapshot on top of the first one
+	insert(3)
+	_, err = db.Snapshot(snapshotDir)
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dbDir, snapshotStagingDirName))
+	assert.True(t, os.IsNotExist(err), "Staging dir should have been removed")
+	for _, leftover := range []string{snapshotDir + ".tmp", snapshotDir + ".old"} {
+		_, err = os.Stat(leftover)
+		assert.True(t, os.IsNotExist(err), "%v should have been removed", leftover)
+	}
+	insert(4)
+	assert.NoError(t, db.Close())
+
+	_, err = RestoreSnapshot(snapshotDir, dbDir)
+	assert.Error(t, err, "Restoring into non-empty dir should fail")
+	_, err = RestoreSnapshot(snapshotDir, restoredDir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	offsets, err := ioutil.ReadFile(filepath.Join(restoredDir, walDirName, "inbound.kafka_points.json"))
+	if assert.NoError(t, err, "State next to WAL should have been restored") {
+		assert.Equal(t, `{"offsets":{"0":2}}`, string(offsets))
+	}
+
+	restored, err := NewDB(&DBOpts{Dir: restoredDir, SchemaFile: filepath.Join(snapshotDir, SnapshotSchemaFile), IncludeMemStoreInQuery: true})
+	if !assert.NoError(t, err, "Unable to open restored DB") {
+		return
+	}
+	defer restored.Close()
+	time.Sleep(1 * time.Second)
+
+	aq, err := restored.SQLQuery("SELECT i FROM snapshot_test ASOF '-2h' GROUP BY a")
+	if !assert.NoError(t, err) {
+		return
+	}
+	result, err := aq.Run()
+	if assert.NoError(t, err) {
+		total := float64(0)
+		for _, row := range result.Rows {
+			total += row.Values[0]
+		}
+		assert.EqualValues(t, 6, total, "Restored DB should contain data up to the second snapshot, without double counting")
+	}
+}
@@ -0,0 +1,71 @@
+package zenodb
+
+import (
+	"time"
+
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/encoding"
+	"golang.org/x/net/context"
+)
+
+// SourcePositions reads the WAL of the given stream from after the given offset
+// (or from the beginning if offset is nil) up to its current head and returns
+// the latest position recorded for each source by InsertBatchFrom, along with
+// the head. Callers that record their positions elsewhere (e.g. in a file) can
+// use this to catch up on positions that were written to the WAL but not
+// recorded because of a crash, as long as they remember the head of the WAL at
+// the time they recorded their positions.
+func (db *DB) SourcePositions(stream string, offset wal.Offset) (map[string]int64, wal.Offset, error) {
+	head, err := db.WALHead(stream)
+	if err != nil {
+		return nil, nil, err
+	}
+	positions := make(map[string]int64)
+	if head == nil || (offset != nil && !head.After(offset)) {
+		// Nothing to read
+		return positions, head, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = db.FollowWAL(ctx, stream, offset, func(data []byte, offset wal.Offset) error {
+		_, source, position := stripSourced(data)
+		if source != "" {
+			positions[source] = position
+		}
+		if !head.After(offset) {
+			// Reached head
+			cancel()
+		}
+		return nil
+	})
+	if ctx.Err() == nil {
+		return nil, nil, err
+	}
+	return positions, head, nil
+}
+
+// WALSyncInterval returns how frequently the WAL is synced to disk, 0 meaning
+// after every write. Until then, entries written with InsertBatchFrom can be
+// lost in a crash, so callers that record their positions elsewhere shouldn't
+// record positions that were written more recently than that.
+func (db *DB) WALSyncInterval() time.Duration {
+	return db.opts.WALSyncInterval
+}
+
+// stripSourced strips the source header from the given WAL entry, returning the
+// original entry along with the source and position. Entries that don't record
+// a source are returned as is, with an empty source.
+func stripSourced(data []byte) ([]byte, string, int64) {
+	entryType, body, err := parseWALEntry(data)
+	if err != nil || entryType != walEntrySourced || len(body) < encoding.Width16bits {
+		return data, "", 0
+	}
+	sourceLen, remain := encoding.ReadInt16(body)
+	if len(remain) < sourceLen+encoding.Width64bits {
+		return data, "", 0
+	}
+	source, remain := encoding.Read(remain, sourceLen)
+	position, remain := encoding.ReadInt64(remain)
+	return remain, string(source), int64(position)
+}
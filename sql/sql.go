@@ -178,9 +178,36 @@ type Query struct {
 	Offset      int
 	Limit       int
 	SubQueries  []*SubQuery
+	DimFilters  []*DimFilter
 	fieldSource FieldSource
 	knownFields []Field
 	fieldsMap   map[string]Field
+	// inSubQueries tracks the SubQuery for each IN subquery condition
+	inSubQueries map[*sqlparser.ComparisonExpr]*SubQuery
+}
+
+// DimFilter requires the dimension Dim to have one of a set of values. A
+// Query's DimFilters are the =, IN and IN subquery conditions from the WHERE
+// clause that must hold for the WHERE clause to be true, which allows executors
+// to use indexes.
+type DimFilter struct {
+	Dim      string
+	values   []goexpr.Expr
+	subQuery *SubQuery
+}
+
+// Values returns the values allowed by this DimFilter. For IN subqueries, the
+// values are only available once the SubQuery's result has been set.
+func (f *DimFilter) Values() []interface{} {
+	exprs := f.values
+	if f.subQuery != nil {
+		exprs = f.subQuery.Values()
+	}
+	values := make([]interface{}, 0, len(exprs))
+	for _, e := range exprs {
+		values = append(values, e.Eval(nil))
+	}
+	return values
 }
 
 // FieldSource is a function that returns the known fields for a given table.
@@ -355,9 +382,89 @@ func (q *Query) applyWhere(stmt *sqlparser.Select) error {
 	}
 	log.Tracef("Applying where: %v", where)
 	q.Where = where
+	q.DimFilters = q.dimFiltersFor(stmt.Where.Expr)
 	return err
 }
 
+// dimFiltersFor extracts DimFilters from the top-level conjunction of the given
+// expression. Conditions nested in OR or NOT are ignored.
+func (q *Query) dimFiltersFor(_e sqlparser.BoolExpr) []*DimFilter {
+	switch e := _e.(type) {
+	case *sqlparser.AndExpr:
+		return append(q.dimFiltersFor(e.Left), q.dimFiltersFor(e.Right)...)
+	case *sqlparser.ParenBoolExpr:
+		return q.dimFiltersFor(e.Expr)
+	case *sqlparser.ComparisonExpr:
+		switch strings.ToUpper(e.Operator) {
+		case "=":
+			if dim := dimFor(e.Left); dim != "" {
+				if val := constantFor(e.Right); val != nil {
+					return []*DimFilter{{Dim: dim, values: []goexpr.Expr{val}}}
+				}
+			}
+			if dim := dimFor(e.Right); dim != "" {
+				if val := constantFor(e.Left); val != nil {
+					return []*DimFilter{{Dim: dim, values: []goexpr.Expr{val}}}
+				}
+			}
+		case "IN":
+			dim := dimFor(e.Left)
+			if dim == "" {
+				return nil
+			}
+			switch right := e.Right.(type) {
+			case sqlparser.ValTuple:
+				values := make([]goexpr.Expr, 0, len(right))
+				for _, ve := range right {
+					val := constantFor(ve)
+					if val == nil {
+						return nil
+					}
+					values = append(values, val)
+				}
+				return []*DimFilter{{Dim: dim, values: values}}
+			case *sqlparser.Subquery:
+				sq := q.inSubQueries[e]
+				if sq != nil {
+					return []*DimFilter{{Dim: dim, subQuery: sq}}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// dimFor returns the name of the dimension referenced by the given expression,
+// or "" if it doesn't reference a dimension.
+func dimFor(_e sqlparser.ValExpr) string {
+	e, ok := _e.(*sqlparser.ColName)
+	if !ok {
+		return ""
+	}
+	colName := strings.TrimSpace(strings.ToLower(string(e.Name)))
+	if _, err := strconv.ParseBool(colName); err == nil {
+		// Boolean constant
+		return ""
+	}
+	return colName
+}
+
+// constantFor returns a goexpr.Constant for the given literal, or nil if it's
+// not a literal.
+func constantFor(_e sqlparser.ValExpr) goexpr.Expr {
+	switch e := _e.(type) {
+	case sqlparser.StrVal:
+		return goexpr.Constant(string(e))
+	case sqlparser.NumVal:
+		val, err := strconv.ParseFloat(string(e), 64)
+		if err != nil {
+			return nil
+		}
+		return goexpr.Constant(val)
+	}
+	return nil
+}
+
 func (q *Query) applyTimeRange(stmt *sqlparser.Select) error {
 	if stmt.TimeRange.From != "" {
 		t, d, err := stringToTimeOrDuration(stmt.TimeRange.From)
@@ -746,6 +853,10 @@ func (q *Query) goExprFor(_e sqlparser.Expr) (goexpr.Expr, error) {
 				}
 				sq := newSubQuery(_sq)
 				q.SubQueries = append(q.SubQueries, sq)
+				if q.inSubQueries == nil {
+					q.inSubQueries = make(map[*sqlparser.ComparisonExpr]*SubQuery)
+				}
+				q.inSubQueries[e] = sq
 				right = sq
 			default:
 				return nil, fmt.Errorf("IN requires a list of values on the right hand side, not %v %v", reflect.TypeOf(e.Right), nodeToString(e.Right))
@@ -224,3 +224,39 @@ func (e *testexpr) Eval(params goexpr.Params) interface{} {
 func (e *testexpr) String() string {
 	return fmt.Sprintf("TEST(%v)", e.val.String())
 }
+
+func TestDimFilters(t *testing.T) {
+	q, err := Parse(`
+SELECT a
+FROM table_a
+WHERE
+	dim_a = 'a' AND
+	(5 = dim_b AND dim_c IN ('x', 'y')) AND
+	dim_d IN (SELECT subdim FROM subtable) AND
+	dim_e > 10 AND
+	(dim_f = 'f' OR dim_g = 'g') AND
+	NOT dim_h = 'h' AND
+	dim_i IN (other, 'i')
+`, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	if assert.Len(t, q.DimFilters, 4) {
+		assert.Equal(t, "dim_a", q.DimFilters[0].Dim)
+		assert.Equal(t, []interface{}{"a"}, q.DimFilters[0].Values())
+		assert.Equal(t, "dim_b", q.DimFilters[1].Dim)
+		assert.Equal(t, []interface{}{float64(5)}, q.DimFilters[1].Values())
+		assert.Equal(t, "dim_c", q.DimFilters[2].Dim)
+		assert.Equal(t, []interface{}{"x", "y"}, q.DimFilters[2].Values())
+		assert.Equal(t, "dim_d", q.DimFilters[3].Dim)
+		assert.Empty(t, q.DimFilters[3].Values(), "Subquery values should be empty until result is set")
+		q.SubQueries[0].SetResult([]goexpr.Params{goexpr.MapParams{"subdim": "d"}})
+		assert.Equal(t, []interface{}{"d"}, q.DimFilters[3].Values())
+	}
+
+	q, err = Parse(`SELECT a FROM table_a WHERE dim_a = 'a' OR dim_b = 'b'`, nil)
+	if assert.NoError(t, err) {
+		assert.Empty(t, q.DimFilters)
+	}
+}
@@ -0,0 +1,301 @@
+package zenodb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/bytetree"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/sql"
+	"golang.org/x/net/context"
+)
+
+const (
+	// StatsTable is the name of the virtual table that exposes TableStats for
+	// all tables.
+	StatsTable = "_stats"
+
+	statsResolution = 1 * time.Minute
+
+	// maxDistinctValues caps the number of distinct values that are counted per
+	// dimension.
+	maxDistinctValues = 10000
+)
+
+var (
+	statsFields = []sql.Field{
+		statsField("filtered_points"),
+		statsField("queued_points"),
+		statsField("inserted_points"),
+		statsField("dropped_points"),
+		statsField("rejected_points"),
+		statsField("queue_depth"),
+		statsField("wal_lag_bytes"),
+		statsField("expired_values"),
+		statsField("file_store_bytes"),
+		statsField("mem_store_bytes"),
+		statsField("keys"),
+		statsField("flushes"),
+		statsField("flush_errors"),
+		statsField("flush_failing"),
+		statsField("last_flush_ms"),
+		statsField("avg_flush_ms"),
+		statsField("insert_rate"),
+		statsField("distinct_values"),
+	}
+)
+
+func statsField(name string) sql.Field {
+	return sql.NewField(name, expr.SUM(name))
+}
+
+func (db *DB) statsDir() string {
+	return filepath.Join(db.opts.Dir, "_stats")
+}
+
+func (t *table) statsFile() string {
+	return filepath.Join(t.db.statsDir(), t.Name+".json")
+}
+
+// loadStats loads previously saved stats for this table, if any.
+func (t *table) loadStats() error {
+	b, err := ioutil.ReadFile(t.statsFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read stats: %v", err)
+	}
+	var stats TableStats
+	err = json.Unmarshal(b, &stats)
+	if err != nil {
+		return fmt.Errorf("Unable to parse stats: %v", err)
+	}
+	// Flushes haven't failed yet since starting
+	stats.FlushFailingSince = time.Time{}
+	stats.LastFlushError = ""
+	t.statsMutex.Lock()
+	t.stats = stats
+	t.statsMutex.Unlock()
+	return nil
+}
+
+// saveStats saves this table's stats to disk so that they survive restarts.
+func (t *table) saveStats() error {
+	t.statsMutex.RLock()
+	b, err := json.Marshal(t.stats)
+	t.statsMutex.RUnlock()
+	if err != nil {
+		return fmt.Errorf("Unable to serialize stats: %v", err)
+	}
+	dir := t.db.statsDir()
+	err = os.MkdirAll(dir, 0755)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Unable to create stats directory: %v", err)
+	}
+	tmp, err := ioutil.TempFile(dir, t.Name)
+	if err != nil {
+		return fmt.Errorf("Unable to create temp file for stats: %v", err)
+	}
+	_, err = tmp.Write(b)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Unable to write stats: %v", err)
+	}
+	return os.Rename(tmp.Name(), t.statsFile())
+}
+
+// recordFlush records statistics about a completed flush and saves the stats.
+func (t *table) recordFlush(flushDuration time.Duration) {
+	t.statsMutex.Lock()
+	t.stats.Flushes++
+	t.stats.LastFlushDuration = flushDuration
+	t.stats.TotalFlushDuration += flushDuration
+	t.stats.FlushFailingSince = time.Time{}
+	t.stats.LastFlushError = ""
+	t.statsMutex.Unlock()
+
+	err := t.saveStats()
+	if err != nil {
+		t.log.Errorf("Unable to save stats: %v", err)
+	}
+}
+
+// recordFlushError records a failed flush.
+func (t *table) recordFlushError(err error) {
+	t.statsMutex.Lock()
+	t.stats.FlushErrors++
+	if t.stats.FlushFailingSince.IsZero() {
+		t.stats.FlushFailingSince = time.Now()
+	}
+	t.stats.LastFlushError = err.Error()
+	t.statsMutex.Unlock()
+}
+
+// recordFileStore records statistics about the segments in the given fileStore.
+func (t *table) recordFileStore(fs *fileStore) {
+	fileStoreBytes := int64(0)
+	keys := int64(0)
+	distinctValues := make(map[string]int64)
+	for _, seg := range fs.segments {
+		fileStoreBytes += seg.Bytes
+		keys += seg.Keys
+		for dim, count := range seg.DistinctValues {
+			if count > distinctValues[dim] {
+				distinctValues[dim] = count
+			}
+		}
+	}
+	t.statsMutex.Lock()
+	t.stats.FileStoreBytes = fileStoreBytes
+	t.stats.Keys = keys
+	t.stats.DistinctValues = distinctValues
+	t.statsMutex.Unlock()
+}
+
+// currentStats returns a copy of the table's stats, including the current size
+// of the memstores, the depth of the insert queue and the WAL lag.
+func (t *table) currentStats() TableStats {
+	t.statsMutex.RLock()
+	stats := t.stats
+	if stats.DistinctValues != nil {
+		distinctValues := make(map[string]int64, len(stats.DistinctValues))
+		for dim, count := range stats.DistinctValues {
+			distinctValues[dim] = count
+		}
+		stats.DistinctValues = distinctValues
+	}
+	t.statsMutex.RUnlock()
+	if t.rowStore != nil {
+		stats.MemStoreBytes = t.rowStore.memStoreBytes()
+		stats.QueueDepth = int64(t.rowStore.queueDepth())
+	}
+	walLagBytes, err := t.walLagBytes()
+	if err != nil {
+		t.log.Errorf("Unable to determine WAL lag: %v", err)
+	}
+	stats.WALLagBytes = walLagBytes
+	return stats
+}
+
+// distinctValueCounter counts the distinct values of each dimension in a set of
+// keys, up to maxDistinctValues per dimension.
+type distinctValueCounter map[string]map[interface{}]bool
+
+func (dvc distinctValueCounter) add(key bytemap.ByteMap) {
+	for dim, val := range key.AsMap() {
+		values := dvc[dim]
+		if values == nil {
+			values = make(map[interface{}]bool)
+			dvc[dim] = values
+		}
+		if len(values) < maxDistinctValues {
+			values[val] = true
+		}
+	}
+}
+
+func (dvc distinctValueCounter) counts() map[string]int64 {
+	result := make(map[string]int64, len(dvc))
+	for dim, values := range dvc {
+		result[dim] = int64(len(values))
+	}
+	return result
+}
+
+// statsTable is a virtual table that exposes the TableStats of all tables as
+// of the current time. Table-level stats are keyed by "table", distinct value
+// counts are keyed by "table" and "dimension".
+type statsTable struct {
+	db *DB
+}
+
+func (st *statsTable) fields() []sql.Field {
+	return statsFields
+}
+
+func (st *statsTable) resolution() time.Duration {
+	return statsResolution
+}
+
+func (st *statsTable) retentionPeriod() time.Duration {
+	return statsResolution
+}
+
+func (st *statsTable) truncateBefore() time.Time {
+	return st.db.clock.Now().Add(-1 * st.retentionPeriod())
+}
+
+func (st *statsTable) iterate(ctx context.Context, fields []string, asOf time.Time, until time.Time, dimFilters []*sql.DimFilter, onValue func(bytemap.ByteMap, []sql.Field, []encoding.Sequence)) error {
+	now := st.db.clock.Now()
+	truncateBefore := st.truncateBefore()
+	bt := bytetree.New()
+	update := func(dims map[string]interface{}, vals map[string]float64) {
+		key := bytemap.New(dims)
+		bt.Update(statsFields, statsResolution, truncateBefore, key, encoding.NewTSParams(now, bytemap.NewFloat(vals)), key)
+	}
+
+	allStats := st.db.AllTableStats()
+	names := make([]string, 0, len(allStats))
+	for name := range allStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stats := allStats[name]
+		avgFlush := time.Duration(0)
+		if stats.Flushes > 0 {
+			avgFlush = stats.TotalFlushDuration / time.Duration(stats.Flushes)
+		}
+		flushFailing := float64(0)
+		if !stats.FlushFailingSince.IsZero() {
+			flushFailing = 1
+		}
+		update(map[string]interface{}{"table": name}, map[string]float64{
+			"filtered_points":  float64(stats.FilteredPoints),
+			"queued_points":    float64(stats.QueuedPoints),
+			"inserted_points":  float64(stats.InsertedPoints),
+			"dropped_points":   float64(stats.DroppedPoints),
+			"rejected_points":  float64(stats.RejectedPoints),
+			"queue_depth":      float64(stats.QueueDepth),
+			"wal_lag_bytes":    float64(stats.WALLagBytes),
+			"expired_values":   float64(stats.ExpiredValues),
+			"file_store_bytes": float64(stats.FileStoreBytes),
+			"mem_store_bytes":  float64(stats.MemStoreBytes),
+			"keys":             float64(stats.Keys),
+			"flushes":          float64(stats.Flushes),
+			"flush_errors":     float64(stats.FlushErrors),
+			"flush_failing":    flushFailing,
+			"last_flush_ms":    stats.LastFlushDuration.Seconds() * 1000,
+			"avg_flush_ms":     avgFlush.Seconds() * 1000,
+			"insert_rate":      stats.InsertRate,
+		})
+		for dim, count := range stats.DistinctValues {
+			update(map[string]interface{}{"table": name, "dimension": dim}, map[string]float64{
+				"distinct_values": float64(count),
+			})
+		}
+	}
+
+	bt.Walk(0, func(key []byte, columns []encoding.Sequence) bool {
+		select {
+		case <-ctx.Done():
+			// Query cancelled, skip remaining rows
+		default:
+			onValue(bytemap.ByteMap(key), statsFields, columns)
+		}
+		return false
+	})
+	return ctx.Err()
+}
@@ -0,0 +1,242 @@
+// Package statsd implements a listener for StatsD and DogStatsD packets that
+// inserts the received metrics into a zenodb stream.
+//
+// Each metric becomes a value named after the metric, with DogStatsD tags
+// becoming dimensions (tags without a value become boolean dimensions set to
+// true). Metrics from the same packet with the same tags are combined into a
+// single point. Sample rates are honoured as follows:
+//
+//	counters (c)                           - value / rate
+//	gauges (g)                             - value
+//	timers and histograms (ms, h, d)       - value / rate, plus <name>_count with 1 / rate
+//
+// Timer and histogram values are scaled just like their counts so that a
+// sampled value stands in for all of the samples that it represents. That way,
+// SUM(<name>) / SUM(<name>_count) yields the mean regardless of sample rates.
+//
+// Sets, relative gauges, events and service checks are not supported and are
+// ignored.
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/zenodb"
+)
+
+const (
+	// maxPacketSize is the largest packet that we'll read
+	maxPacketSize = 65536
+
+	// CountSuffix is appended to the names of timers and histograms to name the
+	// values that hold their sample counts.
+	CountSuffix = "_count"
+)
+
+var (
+	log = golog.LoggerFor("zenodb.statsd")
+
+	// errUnsupported indicates that a line is valid but not supported
+	errUnsupported = fmt.Errorf("Unsupported metric")
+)
+
+// Metric is a single metric parsed from a StatsD line.
+type Metric struct {
+	Name       string
+	Type       string
+	Value      float64
+	SampleRate float64
+	Tags       map[string]interface{}
+}
+
+// vals returns the values that represent this metric.
+func (m *Metric) vals() map[string]float64 {
+	switch m.Type {
+	case "c":
+		return map[string]float64{m.Name: m.Value / m.SampleRate}
+	case "ms", "h", "d":
+		// Scale the value along with the count so that value / count is the mean
+		return map[string]float64{m.Name: m.Value / m.SampleRate, m.Name + CountSuffix: 1 / m.SampleRate}
+	default:
+		return map[string]float64{m.Name: m.Value}
+	}
+}
+
+// ParseLine parses a single line of the form
+// name:value|type[|@rate][|#tag:value,...].
+func ParseLine(line string) (*Metric, error) {
+	if strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+		// Event or service check
+		return nil, errUnsupported
+	}
+	parts := strings.Split(line, "|")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("Missing type in %v", line)
+	}
+	colon := strings.LastIndex(parts[0], ":")
+	if colon <= 0 {
+		return nil, fmt.Errorf("Missing value in %v", line)
+	}
+	m := &Metric{
+		Name:       parts[0][:colon],
+		Type:       parts[1],
+		SampleRate: 1,
+	}
+	valueString := parts[0][colon+1:]
+
+	switch m.Type {
+	case "c", "ms", "h", "d":
+	case "g":
+		if strings.HasPrefix(valueString, "+") || strings.HasPrefix(valueString, "-") {
+			// Relative gauge
+			return nil, errUnsupported
+		}
+	case "s":
+		return nil, errUnsupported
+	default:
+		return nil, fmt.Errorf("Unknown type %v in %v", m.Type, line)
+	}
+
+	var err error
+	m.Value, err = strconv.ParseFloat(valueString, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value in %v: %v", line, err)
+	}
+
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			m.SampleRate, err = strconv.ParseFloat(part[1:], 64)
+			if err != nil || m.SampleRate <= 0 || m.SampleRate > 1 {
+				return nil, fmt.Errorf("Invalid sample rate in %v", line)
+			}
+		case strings.HasPrefix(part, "#"):
+			m.Tags = make(map[string]interface{})
+			for _, tag := range strings.Split(part[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) == 2 {
+					m.Tags[kv[0]] = kv[1]
+				} else {
+					m.Tags[kv[0]] = true
+				}
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// Point is a point built from the metrics in a packet.
+type Point struct {
+	Dims bytemap.ByteMap
+	Vals map[string]float64
+}
+
+// ParsePacket parses the metrics in the given packet into points, combining
+// metrics with the same tags into a single point where possible. It returns the
+// points along with the number of lines that couldn't be parsed.
+func ParsePacket(packet []byte) ([]*Point, int) {
+	var points []*Point
+	// Index points by their dims, the most recent point for given dims wins
+	byDims := make(map[string]*Point)
+	invalid := 0
+	for _, line := range bytes.Split(packet, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		m, err := ParseLine(string(line))
+		if err == errUnsupported {
+			continue
+		}
+		if err != nil {
+			log.Tracef("Invalid line: %v", err)
+			invalid++
+			continue
+		}
+		dims := bytemap.New(m.Tags)
+		vals := m.vals()
+		point := byDims[string(dims)]
+		if point != nil && !point.canAdd(m.Type, vals) {
+			point = nil
+		}
+		if point == nil {
+			point = &Point{Dims: dims, Vals: make(map[string]float64, len(vals))}
+			points = append(points, point)
+			byDims[string(dims)] = point
+		}
+		point.add(m.Type, vals)
+	}
+	return points, invalid
+}
+
+// canAdd indicates whether the given vals can be added to this point. Counters
+// can always be added, other metrics only if the point doesn't have them yet.
+func (p *Point) canAdd(metricType string, vals map[string]float64) bool {
+	if metricType == "c" {
+		return true
+	}
+	for name := range vals {
+		if _, found := p.Vals[name]; found {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Point) add(metricType string, vals map[string]float64) {
+	for name, val := range vals {
+		if metricType == "c" {
+			p.Vals[name] += val
+		} else {
+			p.Vals[name] = val
+		}
+	}
+}
+
+// Opts configures a statsd listener.
+type Opts struct {
+	// Stream is the stream into which to insert metrics.
+	Stream string
+}
+
+// Serve reads StatsD packets from the given connection and inserts their
+// metrics into the configured stream of the given database, timestamped with
+// the time at which they were received. The points from each packet are
+// inserted as a single batch, so if the insert fails (e.g. because a table is
+// behind), the whole packet is dropped and logged along with the total number
+// of points dropped so far.
+func Serve(db *zenodb.DB, conn net.PacketConn, opts *Opts) error {
+	buf := make([]byte, maxPacketSize)
+	dropped := 0
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return fmt.Errorf("Unable to read StatsD packet: %v", err)
+		}
+		now := time.Now()
+		points, invalid := ParsePacket(buf[:n])
+		if invalid > 0 {
+			log.Debugf("Skipped %d invalid lines from %v", invalid, addr)
+		}
+		batch := make([]zenodb.Point, 0, len(points))
+		for _, point := range points {
+			batch = append(batch, zenodb.Point{Ts: now, Dims: point.Dims.AsMap(), Vals: point.Vals})
+		}
+		err = db.InsertBatch(opts.Stream, batch)
+		if err != nil {
+			dropped += len(batch)
+			log.Errorf("Unable to insert %d points from %v, %d dropped in total: %v", len(batch), addr, dropped, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/getlantern/bytemap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLine(t *testing.T) {
+	m, err := ParseLine("requests:3|c|@0.5|#server:a,canary")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "requests", m.Name)
+		assert.Equal(t, "c", m.Type)
+		assert.Equal(t, 0.5, m.SampleRate)
+		assert.Equal(t, map[string]interface{}{"server": "a", "canary": true}, m.Tags)
+		assert.Equal(t, map[string]float64{"requests": 6}, m.vals())
+	}
+
+	m, err = ParseLine("latency:250|ms|@0.25")
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]float64{"latency": 1000, "latency_count": 4}, m.vals(), "Value should be scaled along with count")
+	}
+
+	m, err = ParseLine("load:0.5|g")
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]float64{"load": 0.5}, m.vals())
+	}
+
+	for _, line := range []string{"users:bob|s", "load:+1|g", "_e{5,4}:title|text", "_sc|check|0"} {
+		_, err := ParseLine(line)
+		assert.Equal(t, errUnsupported, err, line)
+	}
+
+	for _, line := range []string{"requests", "requests:1", "requests:x|c", "requests:1|q", "requests:1|c|@2"} {
+		_, err := ParseLine(line)
+		if assert.Error(t, err, line) {
+			assert.NotEqual(t, errUnsupported, err, line)
+		}
+	}
+}
+
+func TestParsePacket(t *testing.T) {
+	points, invalid := ParsePacket([]byte("requests:1|c|#server:a\nrequests:2|c|#server:a\nlatency:10|ms|#server:a\nlatency:20|ms|#server:a\nrequests:1|c\nbad\nusers:bob|s\n"))
+	assert.Equal(t, 1, invalid)
+	if assert.Len(t, points, 3) {
+		serverA := bytemap.New(map[string]interface{}{"server": "a"})
+		assert.Equal(t, serverA, points[0].Dims)
+		assert.Equal(t, map[string]float64{"requests": 3, "latency": 10, "latency_count": 1}, points[0].Vals)
+		assert.Equal(t, serverA, points[1].Dims)
+		assert.Equal(t, map[string]float64{"latency": 20, "latency_count": 1}, points[1].Vals, "Second timing should go into new point")
+		assert.Equal(t, bytemap.New(nil), points[2].Dims)
+		assert.Equal(t, map[string]float64{"requests": 1}, points[2].Vals)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/getlantern/zenodb/bytetree"
 	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/sql"
+	"golang.org/x/net/context"
 )
 
 type subqueryResult struct {
@@ -15,10 +16,10 @@ type subqueryResult struct {
 	knownFields []sql.Field
 }
 
-func (aq *Query) runSubQuery() (queryable, error) {
+func (aq *Query) runSubQuery(ctx context.Context) (queryable, error) {
 	subQuery := &Query{db: aq.db, Query: *aq.FromSubQuery}
 	// TODO: there's probably a more efficient way to get a queryable
-	result, err := subQuery.Run()
+	result, err := subQuery.RunContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -61,10 +62,15 @@ func (sr *subqueryResult) truncateBefore() time.Time {
 	return sr.qr.exec.q.asOf
 }
 
-func (sr *subqueryResult) iterate(fields []string, onValue func(bytemap.ByteMap, []encoding.Sequence)) error {
+func (sr *subqueryResult) iterate(ctx context.Context, fields []string, asOf time.Time, until time.Time, dimFilters []*sql.DimFilter, onValue func(bytemap.ByteMap, []sql.Field, []encoding.Sequence)) error {
 	sr.bt.Walk(0, func(key []byte, columns []encoding.Sequence) bool {
-		onValue(bytemap.ByteMap(key), columns)
+		select {
+		case <-ctx.Done():
+			// Query cancelled, skip remaining rows
+		default:
+			onValue(bytemap.ByteMap(key), sr.knownFields, columns)
+		}
 		return false
 	})
-	return nil
+	return ctx.Err()
 }
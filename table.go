@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/bytemap"
@@ -17,16 +18,52 @@ import (
 	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/expr"
 	"github.com/getlantern/zenodb/sql"
+	"golang.org/x/net/context"
 )
 
-// TableStats presents statistics for a given table (currently only since the
-// last time the database process was started).
+// TableStats presents statistics for a given table. Stats are saved to disk on
+// every flush, so they survive restarts.
 type TableStats struct {
 	FilteredPoints int64
 	QueuedPoints   int64
 	InsertedPoints int64
 	DroppedPoints  int64
 	ExpiredValues  int64
+	// FileStoreBytes is the size of the table's segments on disk.
+	FileStoreBytes int64
+	// MemStoreBytes is the estimated size of the table's memstores.
+	MemStoreBytes int64
+	// Keys is the number of keys on disk. Keys that appear in multiple segments
+	// are counted once per segment until those segments are compacted.
+	Keys int64
+	// DistinctValues counts the distinct values per dimension on disk (the
+	// highest count in any one segment), up to 10,000 values per dimension.
+	DistinctValues map[string]int64
+	// Flushes is the number of times that the table has been flushed.
+	Flushes int64
+	// LastFlushDuration is how long the last flush took.
+	LastFlushDuration time.Duration
+	// TotalFlushDuration is the total time spent flushing.
+	TotalFlushDuration time.Duration
+	// FlushErrors is the number of times that flushing the table failed.
+	FlushErrors int64
+	// FlushFailingSince is when flushes started failing, or zero if the last
+	// flush succeeded.
+	FlushFailingSince time.Time
+	// LastFlushError is the error from the most recent flush if it failed.
+	LastFlushError string
+	// InsertRate is the recent number of points inserted per second.
+	InsertRate float64
+	// RejectedPoints is the number of points that were rejected because the
+	// table was behind (see InsertPolicyReject).
+	RejectedPoints int64
+	// QueueDepth is the number of points that have been read from the WAL and
+	// are waiting to be inserted into the memstore.
+	QueueDepth int64
+	// WALLagBytes is how far (in bytes) the table's reader is behind the head
+	// of the WAL. If the reader is still working through older WAL files, only
+	// the bytes in the newest file are counted, so this is a lower bound.
+	WALLagBytes int64
 }
 
 // TableOpts configures a table.
@@ -35,6 +72,9 @@ type TableOpts struct {
 	Name string
 	// View indicates if this table is a view on top of an existing table.
 	View bool
+	// Backfill indicates that a newly created view should be populated with the
+	// data that's already in the underlying table.
+	Backfill bool
 	// MaxMemStoreBytes sets a cap on how large the memstore is allowed to become
 	// before being flushed to disk.
 	MaxMemStoreBytes int
@@ -47,22 +87,60 @@ type TableOpts struct {
 	// RetentionPeriod limits how long data is kept in the table (based on the
 	// timestamp of the data itself).
 	RetentionPeriod time.Duration
+	// PartitionPeriod sets the time range covered by each partition of the
+	// table's data on disk. Partitions that fall entirely outside of the
+	// RetentionPeriod are deleted, and queries skip partitions outside of their
+	// time range. Defaults to 24 hours.
+	PartitionPeriod time.Duration
+	// InsertQueueSize sets how many points may be queued for insertion into the
+	// memstore before the table is considered to be behind. A batch with more
+	// points than that fills the queue by itself. Defaults to 10,000.
+	InsertQueueSize int
+	// InsertPolicy determines what happens to inserts while the table is
+	// behind. Defaults to InsertPolicyBlock.
+	InsertPolicy InsertPolicy
 	// SQL is the SELECT query that determines the fields, filtering and input
 	// source for this table.
 	SQL          string
 	dependencyOf []*TableOpts
 }
 
+// structure describes how a table's data is laid out. A structure is never
+// modified, alterations replace it with a new one.
+type structure struct {
+	fields          []sql.Field
+	resolution      time.Duration
+	retentionPeriod time.Duration
+}
+
+func (s *structure) truncateBefore(now time.Time) time.Time {
+	return now.Add(-1 * s.retentionPeriod)
+}
+
 type table struct {
 	*TableOpts
 	sql.Query
-	db         *DB
-	rowStore   *rowStore
-	log        golog.Logger
-	whereMutex sync.RWMutex
-	stats      TableStats
-	statsMutex sync.RWMutex
-	wal        *wal.Reader
+	// structure holds the current *structure. The Fields, Resolution and
+	// RetentionPeriod embedded above only reflect the table as it was created.
+	structure   atomic.Value
+	db          *DB
+	rowStore    *rowStore
+	log         golog.Logger
+	whereMutex  sync.RWMutex
+	policy      InsertPolicy
+	policyMutex sync.RWMutex
+	stats       TableStats
+	statsMutex  sync.RWMutex
+	walStream   *wal.WAL
+	wal         *wal.Reader
+	stopCh      chan interface{}
+	stopped     chan interface{}
+	// behind is 1 while the table rejects inserts because it's behind, in which
+	// case it's counted in streamBehind, which is shared by all tables reading
+	// from the same stream
+	behind       int32
+	streamBehind *int32
+	behindMutex  sync.Mutex
 }
 
 // CreateTable creates a table based on the given opts.
@@ -76,23 +154,38 @@ func (db *DB) CreateTable(opts *TableOpts) error {
 
 // CreateView creates a view based on the given opts.
 func (db *DB) CreateView(opts *TableOpts) error {
-	table, err := sql.TableFor(opts.SQL)
+	q, err := db.viewQuery(opts)
 	if err != nil {
 		return err
 	}
+	return db.doCreateTable(opts, q)
+}
+
+// queryFor parses the query for the table or view described by opts.
+func (db *DB) queryFor(opts *TableOpts) (*sql.Query, error) {
+	if opts.View {
+		return db.viewQuery(opts)
+	}
+	return sql.Parse(opts.SQL, nil)
+}
+
+func (db *DB) viewQuery(opts *TableOpts) (*sql.Query, error) {
+	table, err := sql.TableFor(opts.SQL)
+	if err != nil {
+		return nil, err
+	}
 
 	// Get existing fields from existing table
 	t := db.getTable(table)
 	if t == nil {
-		return fmt.Errorf("Table '%v' not found", table)
+		return nil, fmt.Errorf("Table '%v' not found", table)
 	}
 	q, err := sql.Parse(opts.SQL, db.getFieldsOptional)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Point view at same stream as table
-	// TODO: populate view with existing data from table
 	q.From = t.From
 
 	if q.GroupBy == nil {
@@ -101,7 +194,7 @@ func (db *DB) CreateView(opts *TableOpts) error {
 	}
 
 	if q.Resolution == 0 {
-		q.Resolution = t.Resolution
+		q.Resolution = t.resolution()
 	}
 
 	// Combine where clauses
@@ -111,51 +204,47 @@ func (db *DB) CreateView(opts *TableOpts) error {
 		} else {
 			combined, err := goexpr.Binary("AND", q.Where, t.Where)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			q.Where = combined
 		}
 	}
 
-	return db.doCreateTable(opts, q)
+	return q, nil
 }
 
 func (db *DB) doCreateTable(opts *TableOpts, q *sql.Query) error {
-	if opts.RetentionPeriod <= 0 {
-		return errors.New("Please specify a positive RetentionPeriod")
-	}
-	if opts.MaxMemStoreBytes <= 0 {
-		opts.MaxMemStoreBytes = 100000000
-		log.Debugf("Defaulted MaxMemStoreBytes to %v", opts.MaxMemStoreBytes)
-	}
-	if opts.MinFlushLatency <= 0 {
-		log.Debug("MinFlushLatency disabled")
-	}
-	if opts.MaxFlushLatency <= 0 {
-		opts.MaxFlushLatency = time.Duration(math.MaxInt64)
-		log.Debug("MaxFlushLatency disabled")
+	err := opts.applyDefaults()
+	if err != nil {
+		return err
 	}
-	opts.Name = strings.ToLower(opts.Name)
-
-	// prepend a magic _points field
-	newFields := make([]sql.Field, 0, len(q.Fields)+1)
-	newFields = append(newFields, sql.NewField("_points", expr.SUM("_point")))
-	for _, field := range q.Fields {
-		// Don't add _points twice
-		if field.Name != "_points" {
-			newFields = append(newFields, field)
-		}
+	if opts.Name == StatsTable {
+		return fmt.Errorf("%v is reserved for the built-in stats table", StatsTable)
 	}
-	q.Fields = newFields
+	q.Fields = withPointsField(q.Fields)
 
 	t := &table{
 		TableOpts: opts,
 		Query:     *q,
 		db:        db,
 		log:       golog.LoggerFor("zenodb." + opts.Name),
+		stopCh:    make(chan interface{}),
+		stopped:   make(chan interface{}),
 	}
 
+	t.initStructure()
 	t.applyWhere(q.Where)
+	t.applyInsertPolicy(opts.InsertPolicy)
+
+	err = t.loadStats()
+	if err != nil {
+		log.Errorf("Unable to load stats for %v, starting fresh: %v", t.Name, err)
+	}
+
+	var seed func() (*memstore, error)
+	if opts.View && opts.Backfill {
+		seed = t.backfill
+	}
 
 	var rsErr error
 	var walOffset wal.Offset
@@ -164,7 +253,8 @@ func (db *DB) doCreateTable(opts *TableOpts, q *sql.Query) error {
 		maxMemStoreBytes: t.MaxMemStoreBytes,
 		minFlushLatency:  t.MinFlushLatency,
 		maxFlushLatency:  t.MaxFlushLatency,
-	})
+		insertQueueSize:  t.InsertQueueSize,
+	}, seed)
 	if rsErr != nil {
 		return rsErr
 	}
@@ -177,10 +267,14 @@ func (db *DB) doCreateTable(opts *TableOpts, q *sql.Query) error {
 	}
 	db.tables[t.Name] = t
 	db.orderedTables = append(db.orderedTables, t)
+	if db.streamsBehind[q.From] == nil {
+		db.streamsBehind[q.From] = new(int32)
+	}
+	t.streamBehind = db.streamsBehind[q.From]
 	var walErr error
 	w := db.streams[q.From]
 	if w == nil {
-		walDir := filepath.Join(db.opts.Dir, "_wal", q.From)
+		walDir := db.WALDir(q.From)
 		dirErr := os.MkdirAll(walDir, 0755)
 		if dirErr != nil && !os.IsExist(dirErr) {
 			return dirErr
@@ -189,10 +283,13 @@ func (db *DB) doCreateTable(opts *TableOpts, q *sql.Query) error {
 		if walErr != nil {
 			return walErr
 		}
-		go db.capWALAge(w)
+		go db.capWALAge(q.From, w)
 		db.streams[q.From] = w
+		close(db.streamsChanged)
+		db.streamsChanged = make(chan interface{})
 	}
 	log.Debugf("%v will read inserts from %v at offset %v", t.Name, q.From, walOffset)
+	t.walStream = w
 	t.wal, walErr = w.NewReader(t.Name, walOffset)
 	if walErr != nil {
 		return fmt.Errorf("Unable to obtain WAL reader: %v", walErr)
@@ -202,51 +299,108 @@ func (db *DB) doCreateTable(opts *TableOpts, q *sql.Query) error {
 	return nil
 }
 
+// applyDefaults validates the opts and fills in defaults for unspecified
+// values.
+func (opts *TableOpts) applyDefaults() error {
+	if opts.RetentionPeriod <= 0 {
+		return errors.New("Please specify a positive RetentionPeriod")
+	}
+	if opts.PartitionPeriod <= 0 {
+		opts.PartitionPeriod = 24 * time.Hour
+		log.Debugf("Defaulted PartitionPeriod to %v", opts.PartitionPeriod)
+	}
+	if opts.MaxMemStoreBytes <= 0 {
+		opts.MaxMemStoreBytes = 100000000
+		log.Debugf("Defaulted MaxMemStoreBytes to %v", opts.MaxMemStoreBytes)
+	}
+	if opts.MinFlushLatency <= 0 {
+		log.Debug("MinFlushLatency disabled")
+	}
+	if opts.InsertQueueSize <= 0 {
+		opts.InsertQueueSize = 10000
+		log.Debugf("Defaulted InsertQueueSize to %v", opts.InsertQueueSize)
+	}
+	switch opts.InsertPolicy {
+	case "":
+		opts.InsertPolicy = InsertPolicyBlock
+	case InsertPolicyBlock, InsertPolicyReject, InsertPolicyDrop:
+		// okay
+	default:
+		return fmt.Errorf("Unknown InsertPolicy %v, use one of %v, %v or %v", opts.InsertPolicy, InsertPolicyBlock, InsertPolicyReject, InsertPolicyDrop)
+	}
+	if opts.MaxFlushLatency <= 0 {
+		opts.MaxFlushLatency = time.Duration(math.MaxInt64)
+		log.Debug("MaxFlushLatency disabled")
+	}
+	opts.Name = strings.ToLower(opts.Name)
+	return nil
+}
+
+// withPointsField prepends the magic _points field to the given fields.
+func withPointsField(fields []sql.Field) []sql.Field {
+	newFields := make([]sql.Field, 0, len(fields)+1)
+	newFields = append(newFields, sql.NewField("_points", expr.SUM("_point")))
+	for _, field := range fields {
+		// Don't add _points twice
+		if field.Name != "_points" {
+			newFields = append(newFields, field)
+		}
+	}
+	return newFields
+}
+
 func (t *table) applyWhere(where goexpr.Expr) {
 	t.whereMutex.Lock()
 	t.Where = where
 	t.whereMutex.Unlock()
 }
 
-func (t *table) fields() []sql.Field {
-	return t.Fields
+func (t *table) applyInsertPolicy(policy InsertPolicy) {
+	t.policyMutex.Lock()
+	t.policy = policy
+	t.policyMutex.Unlock()
+	if t.rowStore != nil {
+		t.updateBehind()
+	}
 }
 
-func (t *table) resolution() time.Duration {
-	return t.Resolution
+func (t *table) insertPolicy() InsertPolicy {
+	t.policyMutex.RLock()
+	policy := t.policy
+	t.policyMutex.RUnlock()
+	return policy
 }
 
-func (t *table) retentionPeriod() time.Duration {
-	return t.RetentionPeriod
+// initStructure sets the table's structure based on the fields, resolution and
+// retention period that it was created with.
+func (t *table) initStructure() {
+	t.structure.Store(&structure{
+		fields:          t.Fields,
+		resolution:      t.Resolution,
+		retentionPeriod: t.RetentionPeriod,
+	})
 }
 
-func (t *table) truncateBefore() time.Time {
-	return t.db.clock.Now().Add(-1 * t.RetentionPeriod)
+func (t *table) currentStructure() *structure {
+	return t.structure.Load().(*structure)
 }
 
-func (t *table) iterate(fields []string, onValue func(bytemap.ByteMap, []encoding.Sequence)) error {
-	return t.rowStore.iterate(fields, onValue)
+func (t *table) fields() []sql.Field {
+	return t.currentStructure().fields
 }
 
-// shouldSort determines whether or not a flush should be sorted. The flush will
-// sort if the table is the next table in line to be sorted, and no other sort
-// is currently happening. If shouldSort returns true, the flushing process
-// must call stopSorting when finished so that other tables have a chance to
-// sort.
-func (t *table) shouldSort() bool {
-	t.db.tablesMutex.RLock()
-	if t.db.nextTableToSort >= len(t.db.orderedTables) {
-		t.db.nextTableToSort = 0
-	}
-	nextTableToSort := t.db.orderedTables[t.db.nextTableToSort]
-	result := t.Name == nextTableToSort.Name && !t.db.isSorting
-	t.db.tablesMutex.RUnlock()
-	return result
+func (t *table) resolution() time.Duration {
+	return t.currentStructure().resolution
+}
+
+func (t *table) retentionPeriod() time.Duration {
+	return t.currentStructure().retentionPeriod
+}
+
+func (t *table) truncateBefore() time.Time {
+	return t.currentStructure().truncateBefore(t.db.clock.Now())
 }
 
-func (t *table) stopSorting() {
-	t.db.tablesMutex.RLock()
-	t.db.isSorting = false
-	t.db.nextTableToSort++
-	t.db.tablesMutex.RUnlock()
+func (t *table) iterate(ctx context.Context, fields []string, asOf time.Time, until time.Time, dimFilters []*sql.DimFilter, onValue func(bytemap.ByteMap, []sql.Field, []encoding.Sequence)) error {
+	return t.rowStore.iterate(ctx, fields, asOf, until, dimFilters, onValue)
 }
@@ -0,0 +1,71 @@
+package zenodb
+
+import (
+	"fmt"
+)
+
+// WAL entries start with a header that identifies the version of the entry
+// format and the type of the entry:
+//
+//	format|type|body
+//
+// format is 8 bits, its most significant bit is always set and the remaining
+// bits hold the version (currently 1)
+// type is 8 bits (see walEntryType)
+//
+// Entries written by earlier versions of ZenoDB don't have a header and consist
+// of a single point, starting with its 64 bit timestamp. Since timestamps of
+// real data are after the epoch, the most significant bit of these entries is
+// never set, which distinguishes them from entries with a header.
+const (
+	walEntryFormatFlag = 0x80
+	walEntryVersion    = 1
+	walEntryFormat     = walEntryFormatFlag | walEntryVersion
+	walEntryHeaderSize = 2
+)
+
+// walEntryType identifies the type of a WAL entry.
+type walEntryType byte
+
+const (
+	// walEntryPoint is a single point (see encodePoint).
+	walEntryPoint walEntryType = 1
+
+	// walEntryBatch is a batch of points, consisting of the number of points
+	// (32 bits) followed by the points.
+	walEntryBatch walEntryType = 2
+
+	// walEntryReplicated is an entry that was replicated from a leader,
+	// consisting of the leader's offset (wal.OffsetSize bytes) followed by the
+	// leader's original entry.
+	walEntryReplicated walEntryType = 3
+
+	// walEntrySourced is an entry that records where its points came from,
+	// consisting of the length of the source's name (16 bits), the source's name,
+	// the position within the source (64 bits) and the original entry (see
+	// InsertBatchFrom).
+	walEntrySourced walEntryType = 4
+)
+
+// walEntryHeader returns the header for a WAL entry of the given type.
+func walEntryHeader(entryType walEntryType) []byte {
+	return []byte{walEntryFormat, byte(entryType)}
+}
+
+// parseWALEntry returns the type and body of the given WAL entry.
+func parseWALEntry(data []byte) (walEntryType, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, fmt.Errorf("Empty WAL entry")
+	}
+	if data[0]&walEntryFormatFlag == 0 {
+		// Legacy entry without header
+		return walEntryPoint, data, nil
+	}
+	if data[0] != walEntryFormat {
+		return 0, nil, fmt.Errorf("Unsupported WAL entry version %d", data[0]&^walEntryFormatFlag)
+	}
+	if len(data) < walEntryHeaderSize {
+		return 0, nil, fmt.Errorf("WAL entry is truncated")
+	}
+	return walEntryType(data[1]), data[walEntryHeaderSize:], nil
+}
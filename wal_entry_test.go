@@ -0,0 +1,32 @@
+package zenodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWALEntry(t *testing.T) {
+	legacy := make([]byte, encoding.Width64bits)
+	encoding.EncodeTime(legacy, time.Now())
+	entryType, body, err := parseWALEntry(legacy)
+	if assert.NoError(t, err) {
+		assert.Equal(t, walEntryPoint, entryType, "Legacy entries should be single points")
+		assert.Equal(t, legacy, body, "Legacy entries should be returned as is")
+	}
+
+	entryType, body, err = parseWALEntry(append(walEntryHeader(walEntryBatch), 1, 2, 3))
+	if assert.NoError(t, err) {
+		assert.Equal(t, walEntryBatch, entryType)
+		assert.Equal(t, []byte{1, 2, 3}, body)
+	}
+
+	_, _, err = parseWALEntry([]byte{walEntryFormatFlag | (walEntryVersion + 1), byte(walEntryPoint)})
+	assert.Error(t, err, "Entries from future versions should be rejected")
+	_, _, err = parseWALEntry([]byte{walEntryFormat})
+	assert.Error(t, err, "Truncated header should be rejected")
+	_, _, err = parseWALEntry(nil)
+	assert.Error(t, err, "Empty entry should be rejected")
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"time"
@@ -16,6 +17,7 @@ import (
 	"github.com/getlantern/appdir"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/parquet"
 	"github.com/getlantern/zenodb/rpc"
 	"golang.org/x/net/context"
 )
@@ -24,6 +26,10 @@ const (
 	basePrompt  = "zeno-cli >"
 	emptyPrompt = "            "
 	totalLabel  = "*total*"
+
+	formatText    = "text"
+	formatCSV     = "csv"
+	formatParquet = "parquet"
 )
 
 var (
@@ -32,10 +38,21 @@ var (
 	addr       = flag.String("addr", ":17712", "The address to which to connect, defaults to localhost:17712")
 	queryStats = flag.Bool("querystats", false, "Set this to show query stats on each query")
 	password   = flag.String("password", "", "if specified, will authenticate against server using this password")
+	format     = flag.String("format", "", "text, csv or parquet. Defaults to csv when running a single query and text otherwise")
+	out        = flag.String("out", "", "If specified, results are written to this file instead of stdout (overwriting it on every query)")
 )
 
 func main() {
 	flag.Parse()
+	switch *format {
+	case "", formatText, formatCSV, formatParquet:
+		// okay
+	default:
+		log.Fatalf("Unknown format %v", *format)
+	}
+	if *format == formatParquet && *out == "" {
+		log.Fatalf("Parquet is a binary format, please specify a file with -out")
+	}
 
 	clidir := appdir.General("zeno-cli")
 	err := os.MkdirAll(clidir, 0700)
@@ -56,7 +73,11 @@ func main() {
 	if flag.NArg() == 1 {
 		// Process single command from command-line and then exit
 		sql := strings.Trim(flag.Arg(0), ";")
-		queryErr := query(os.Stdout, os.Stderr, client, sql, true)
+		queryFormat := *format
+		if queryFormat == "" {
+			queryFormat = formatCSV
+		}
+		queryErr := query(os.Stdout, os.Stderr, client, sql, queryFormat)
 		if queryErr != nil {
 			log.Fatal(queryErr)
 		}
@@ -100,7 +121,11 @@ func processLine(rl *readline.Instance, client rpc.Client, cmds []string, line s
 	cmds = cmds[:0]
 	rl.SetPrompt(basePrompt + " ")
 
-	err := query(rl.Stdout(), rl.Stderr(), client, cmd, false)
+	queryFormat := *format
+	if queryFormat == "" {
+		queryFormat = formatText
+	}
+	err := query(rl.Stdout(), rl.Stderr(), client, cmd, queryFormat)
 	if err != nil {
 		fmt.Fprintln(rl.Stderr(), err)
 	}
@@ -108,8 +133,24 @@ func processLine(rl *readline.Instance, client rpc.Client, cmds []string, line s
 	return cmds
 }
 
-func query(stdout io.Writer, stderr io.Writer, client rpc.Client, sql string, csv bool) error {
-	result, nextRow, err := client.Query(context.Background(), &rpc.Query{
+func query(stdout io.Writer, stderr io.Writer, client rpc.Client, sql string, format string) (err error) {
+	// Cancel the query on Ctrl-C
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		select {
+		case <-interrupts:
+			fmt.Fprintln(stderr, "Cancelling query")
+			cancel()
+		case <-ctx.Done():
+			// query finished
+		}
+	}()
+
+	result, nextRow, err := client.Query(ctx, &rpc.Query{
 		SQL: sql,
 	})
 	if err != nil {
@@ -130,8 +171,26 @@ func query(stdout io.Writer, stderr io.Writer, client rpc.Client, sql string, cs
 		}
 	}
 
-	if csv {
+	if *out != "" {
+		file, createErr := os.Create(*out)
+		if createErr != nil {
+			return fmt.Errorf("Unable to create %v: %v", *out, createErr)
+		}
+		defer func() {
+			// Errors writing to the file may only surface on close
+			closeErr := file.Close()
+			if err == nil && closeErr != nil {
+				err = fmt.Errorf("Unable to close %v: %v", *out, closeErr)
+			}
+		}()
+		stdout = file
+	}
+
+	switch format {
+	case formatCSV:
 		return dumpCSV(stdout, result, nextRow)
+	case formatParquet:
+		return dumpParquet(stdout, result, nextRow)
 	}
 	return dumpPlainText(stdout, sql, result, nextRow)
 }
@@ -415,6 +474,11 @@ func dumpCSV(stdout io.Writer, result *zenodb.QueryResult, nextRow func() (*zeno
 	return nil
 }
 
+func dumpParquet(stdout io.Writer, result *zenodb.QueryResult, nextRow func() (*zenodb.Row, error)) error {
+	printQueryStats(os.Stderr, result)
+	return parquet.WriteQueryResult(stdout, result, nextRow)
+}
+
 func nilToBlank(val interface{}) interface{} {
 	if val == nil {
 		return ""
@@ -451,7 +515,8 @@ func printQueryStats(stderr io.Writer, result *zenodb.QueryResult) {
 	fmt.Fprintf(stderr, "# Resolution: %v\n", result.Resolution)
 	fmt.Fprintf(stderr, "# Group By:   %v\n\n", strings.Join(result.GroupBy, " "))
 
-	fmt.Fprintf(stderr, "# Query Runtime:  %v\n\n", result.Stats.Runtime)
+	fmt.Fprintf(stderr, "# Query Runtime:  %v\n", result.Stats.Runtime)
+	fmt.Fprintf(stderr, "# Peak Memory:    %v\n\n", humanize.Bytes(uint64(result.Stats.PeakMemory)))
 
 	fmt.Fprintln(stderr, "# Key Statistics")
 	fmt.Fprintf(stderr, "#   Scanned:       %v\n", humanize.Comma(result.Stats.Scanned))
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/zenodb"
+)
+
+// fsck implements the fsck subcommand, which checks the data of tables in a
+// database directory for damage and optionally repairs it. The database must
+// not be running while fsck is run. It returns the exit code.
+func fsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fsckDBDir := flags.String("dbdir", "zenodb", "The directory containing the database files, defaults to ./zenodb")
+	repair := flags.Bool("repair", false, "Set this flag to quarantine damaged files so that the affected data is replayed from the WAL on next startup")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: zeno fsck [-dbdir dir] [-repair] [table ...]")
+		fmt.Fprintln(os.Stderr, "Checks the given tables, or all tables if none are given")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	tables := flags.Args()
+	if len(tables) == 0 {
+		files, err := ioutil.ReadDir(*fsckDBDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to list tables in %v: %v\n", *fsckDBDir, err)
+			return 2
+		}
+		for _, file := range files {
+			if file.IsDir() && !strings.HasPrefix(file.Name(), "_") {
+				tables = append(tables, file.Name())
+			}
+		}
+	}
+
+	exitCode := 0
+	for _, table := range tables {
+		result, err := zenodb.Fsck(filepath.Join(*fsckDBDir, table), *repair)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: unable to check: %v\n", table, err)
+			exitCode = 2
+			continue
+		}
+		if result.OK() {
+			fmt.Printf("%v: ok (%d segments)\n", table, result.Segments)
+			continue
+		}
+		if exitCode == 0 {
+			exitCode = 1
+		}
+		fmt.Printf("%v: %d of %d segments damaged\n", table, len(result.Damaged), result.Segments)
+		damaged := make([]string, 0, len(result.Damaged))
+		for name := range result.Damaged {
+			damaged = append(damaged, name)
+		}
+		sort.Strings(damaged)
+		for _, name := range damaged {
+			fmt.Printf("  damaged: %v: %v\n", name, result.Damaged[name])
+		}
+		for _, name := range result.Dropped {
+			fmt.Printf("  dropped: %v\n", name)
+		}
+		if result.Repaired {
+			fmt.Println("  repaired, affected data will be replayed from the WAL on next startup")
+		}
+	}
+	return exitCode
+}
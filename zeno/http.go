@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/rpc"
 	"github.com/gorilla/mux"
 )
 
@@ -18,17 +19,22 @@ const (
 
 	// ContentTypeJSON is the allowed content type
 	ContentTypeJSON = "application/json"
-)
 
-type Point struct {
-	Ts   time.Time              `json:"ts,omitempty"`
-	Dims map[string]interface{} `json:"dims,omitempty"`
-	Vals map[string]float64     `json:"vals,omitempty"`
-}
+	// maxBatchSize caps how many points are inserted into the database at a
+	// time
+	maxBatchSize = 1000
+)
 
-func serveHTTP(db *zenodb.DB, hl net.Listener) {
+func serveHTTP(db *zenodb.DB, hl net.Listener, follower *rpc.Follower) {
 	r := mux.NewRouter()
 	r.HandleFunc("/insert/{stream}", httpHandler(db))
+	r.HandleFunc("/health", healthHandler(db))
+	if follower != nil {
+		r.HandleFunc("/replication", replicationHandler(follower))
+	}
+	r.HandleFunc("/write", influxWriteHandler(db))
+	r.HandleFunc("/ping", influxPingHandler)
+	r.HandleFunc("/prometheus/write", prometheusWriteHandler(db, *prometheusStream))
 
 	s := &http.Server{
 		Handler: r,
@@ -57,12 +63,41 @@ func httpHandler(db *zenodb.DB) func(resp http.ResponseWriter, req *http.Request
 
 		stream := mux.Vars(req)["stream"]
 		dec := json.NewDecoder(req.Body)
+		batch := make([]zenodb.Point, 0, maxBatchSize)
+		// insert is obtained once the first batch has been read, so that requests
+		// are rejected before any of their points are accepted
+		var insert func(points []zenodb.Point) error
+		insertBatch := func() bool {
+			var insertErr error
+			if insert == nil {
+				insert, insertErr = db.AdmitInserts(stream, len(batch))
+			}
+			if insertErr == nil {
+				insertErr = insert(batch)
+			}
+			batch = batch[:0]
+			if insertErr == zenodb.ErrTableBehind {
+				tooManyRequests(resp)
+				return false
+			}
+			if insertErr == zenodb.ErrReadOnly {
+				readOnly(resp)
+				return false
+			}
+			if insertErr != nil {
+				internalServerError(resp, "Error submitting points: %v", insertErr)
+				return false
+			}
+			return true
+		}
 		for {
-			point := &Point{}
-			err := dec.Decode(point)
+			point := zenodb.Point{}
+			err := dec.Decode(&point)
 			if err == io.EOF {
 				// Done reading points
-				resp.WriteHeader(http.StatusCreated)
+				if insertBatch() {
+					resp.WriteHeader(http.StatusCreated)
+				}
 				return
 			}
 			if err != nil {
@@ -81,20 +116,68 @@ func httpHandler(db *zenodb.DB) func(resp http.ResponseWriter, req *http.Request
 				return
 			}
 
-			insertErr := db.Insert(stream, point.Ts, point.Dims, point.Vals)
-			if insertErr != nil {
-				internalServerError(resp, "Error submitting point: %v", insertErr)
+			batch = append(batch, point)
+			if len(batch) == maxBatchSize && !insertBatch() {
+				return
 			}
 		}
 	}
 }
 
+// healthHandler reports the health of all tables as JSON, responding with 503
+// if any table is degraded.
+func healthHandler(db *zenodb.DB) func(resp http.ResponseWriter, req *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		healthy, tables := db.Health()
+		resp.Header().Set(ContentType, ContentTypeJSON)
+		if healthy {
+			resp.WriteHeader(http.StatusOK)
+		} else {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+		}
+		err := json.NewEncoder(resp).Encode(map[string]interface{}{
+			"healthy": healthy,
+			"tables":  tables,
+		})
+		if err != nil {
+			log.Errorf("Unable to write health: %v", err)
+		}
+	}
+}
+
+// replicationHandler reports how far behind the leader this follower is, by
+// stream.
+func replicationHandler(follower *rpc.Follower) func(resp http.ResponseWriter, req *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set(ContentType, ContentTypeJSON)
+		err := json.NewEncoder(resp).Encode(follower.Lag())
+		if err != nil {
+			log.Errorf("Unable to write replication lag: %v", err)
+		}
+	}
+}
+
 func badRequest(resp http.ResponseWriter, msg string, args ...interface{}) {
 	resp.WriteHeader(http.StatusBadRequest)
 	log.Errorf(msg, args...)
 	fmt.Fprintf(resp, msg+"\n", args...)
 }
 
+// tooManyRequests tells the client to back off because a table is behind.
+// None of the request's points have been accepted.
+func tooManyRequests(resp http.ResponseWriter) {
+	resp.Header().Set("Retry-After", "1")
+	resp.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintln(resp, zenodb.ErrTableBehind)
+}
+
+// readOnly tells the client that it has to insert into the leader because this
+// database is a follower.
+func readOnly(resp http.ResponseWriter) {
+	resp.WriteHeader(http.StatusForbidden)
+	fmt.Fprintln(resp, zenodb.ErrReadOnly)
+}
+
 func internalServerError(resp http.ResponseWriter, msg string, args ...interface{}) {
 	resp.WriteHeader(http.StatusInternalServerError)
 	log.Errorf(msg, args...)
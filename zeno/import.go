@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/importer"
+)
+
+// importFiles implements the import subcommand, which bulk loads CSV and
+// NDJSON files into a stream. It opens the database itself, which fails if zeno
+// is running against the same directory. It returns the exit code.
+func importFiles(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	importDBDir := flags.String("dbdir", "zenodb", "The directory in which to store the database files, defaults to ./zenodb")
+	importSchema := flags.String("schema", "schema.yaml", "Location of schema file, defaults to ./schema.yaml")
+	stream := flags.String("stream", "inbound", "The stream into which to insert points, defaults to inbound")
+	format := flags.String("format", "", "csv or ndjson, defaults to guessing based on the file extension")
+	tsColumn := flags.String("ts", importer.DefaultTsColumn, "The column holding the timestamp, defaults to ts")
+	tsFormat := flags.String("tsformat", "", "unix, unixms, unixns or a Go time layout, defaults to RFC 3339")
+	dims := flags.String("dims", "", "Comma-separated list of columns to use as dimensions, defaults to all columns that aren't the timestamp or a value")
+	vals := flags.String("vals", "", "Comma-separated list of columns to use as values, required for CSV")
+	importVTime := flags.Bool("vtime", false, "Set this flag to use virtual time, so that historical data isn't dropped because it's older than the retention period")
+	progressInterval := flags.Duration("progress", 5*time.Second, "How frequently to report progress, defaults to 5 seconds")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: zeno import [flags] file ...")
+		fmt.Fprintln(os.Stderr, "Imports the given CSV or NDJSON files, use - to read from stdin")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	db, err := zenodb.NewDB(&zenodb.DBOpts{
+		Dir:         *importDBDir,
+		SchemaFile:  *importSchema,
+		VirtualTime: *importVTime,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open database at %v: %v\n", *importDBDir, err)
+		return 2
+	}
+
+	exitCode := 0
+	for _, file := range flags.Args() {
+		fileFormat := *format
+		if fileFormat == "" {
+			fileFormat = guessFormat(file)
+		}
+		progress, err := importFile(db, file, &importer.Opts{
+			Mapping: importer.Mapping{
+				TsColumn: *tsColumn,
+				TsFormat: *tsFormat,
+				Dims:     splitColumns(*dims),
+				Vals:     splitColumns(*vals),
+			},
+			Stream: *stream,
+			Format: fileFormat,
+			OnProgress: func(progress *importer.Progress) {
+				fmt.Printf("%v: imported %d rows, skipped %d in %v\n", file, progress.Inserted, progress.Skipped, progress.Elapsed)
+			},
+			ProgressInterval: *progressInterval,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", file, err)
+			exitCode = 2
+			continue
+		}
+		if progress.Skipped > 0 && exitCode == 0 {
+			exitCode = 1
+		}
+	}
+
+	fmt.Println("Flushing database")
+	err = db.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error closing database: %v\n", err)
+		return 2
+	}
+	return exitCode
+}
+
+func importFile(db *zenodb.DB, file string, opts *importer.Opts) (*importer.Progress, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	return importer.Import(db, r, opts)
+}
+
+func guessFormat(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".ndjson", ".jsonl", ".json":
+		return importer.FormatNDJSON
+	default:
+		return importer.FormatCSV
+	}
+}
+
+func splitColumns(columns string) []string {
+	var result []string
+	for _, column := range strings.Split(columns, ",") {
+		column = strings.TrimSpace(column)
+		if column != "" {
+			result = append(result, column)
+		}
+	}
+	return result
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/influx"
+)
+
+const (
+	// maxUDPPacketSize is the largest UDP packet that we'll read
+	maxUDPPacketSize = 65536
+)
+
+// influxWriteHandler accepts points in InfluxDB line protocol, mimicking
+// InfluxDB's /write endpoint. The db parameter names the stream into which to
+// insert. Like InfluxDB, it inserts all valid points and responds with 400 if
+// any lines couldn't be parsed.
+func influxWriteHandler(db *zenodb.DB) func(resp http.ResponseWriter, req *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(resp, "Method %v not allowed\n", req.Method)
+			return
+		}
+
+		stream := req.URL.Query().Get("db")
+		if stream == "" {
+			badRequest(resp, "Please specify a stream with the db parameter")
+			return
+		}
+		precision := req.URL.Query().Get("precision")
+		_, err := influx.PrecisionUnit(precision)
+		if err != nil {
+			badRequest(resp, "%v", err)
+			return
+		}
+
+		body := io.Reader(req.Body)
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			gzr, err := gzip.NewReader(req.Body)
+			if err != nil {
+				badRequest(resp, "Unable to decompress body: %v", err)
+				return
+			}
+			defer gzr.Close()
+			body = gzr
+		}
+
+		var firstParseErr *influx.ParseError
+		parseErrors := 0
+		batch := make([]zenodb.Point, 0, maxBatchSize)
+		// insert is obtained once the first batch has been read, so that requests
+		// are rejected before any of their points are accepted
+		var insert func(points []zenodb.Point) error
+		insertBatch := func() error {
+			if insert == nil {
+				var err error
+				insert, err = db.AdmitInserts(stream, len(batch))
+				if err != nil {
+					return err
+				}
+			}
+			err := insert(batch)
+			batch = batch[:0]
+			return err
+		}
+		err = influx.Parse(body, precision, time.Now(), func(point *zenodb.Point) error {
+			batch = append(batch, *point)
+			if len(batch) < maxBatchSize {
+				return nil
+			}
+			return insertBatch()
+		}, func(parseErr *influx.ParseError) {
+			if firstParseErr == nil {
+				firstParseErr = parseErr
+			}
+			parseErrors++
+		})
+		if err == nil && len(batch) > 0 {
+			err = insertBatch()
+		}
+		if err == zenodb.ErrTableBehind {
+			tooManyRequests(resp)
+			return
+		}
+		if err == zenodb.ErrReadOnly {
+			readOnly(resp)
+			return
+		}
+		if err != nil {
+			internalServerError(resp, "Error submitting points: %v", err)
+			return
+		}
+		if firstParseErr != nil {
+			badRequest(resp, "Unable to parse %d lines, first error: %v", parseErrors, firstParseErr)
+			return
+		}
+		resp.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// influxPingHandler responds to pings from InfluxDB clients.
+func influxPingHandler(resp http.ResponseWriter, req *http.Request) {
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// serveInfluxUDP accepts points in InfluxDB line protocol (with nanosecond
+// precision) over UDP and inserts them into the given stream.
+func serveInfluxUDP(db *zenodb.DB, conn net.PacketConn, stream string) {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Fatalf("Error reading InfluxDB line protocol over UDP: %v", err)
+		}
+		err = influx.Parse(bytes.NewReader(buf[:n]), "", time.Now(), func(point *zenodb.Point) error {
+			return db.Insert(stream, point.Ts, point.Dims, point.Vals)
+		}, func(parseErr *influx.ParseError) {
+			log.Debugf("Invalid InfluxDB line protocol from %v: %v", addr, parseErr)
+		})
+		if err != nil {
+			log.Errorf("Unable to insert points from %v: %v", addr, err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/prometheus"
+)
+
+// prometheusWriteHandler accepts Prometheus remote_write requests and inserts
+// the samples into the configured stream.
+func prometheusWriteHandler(db *zenodb.DB, stream string) func(resp http.ResponseWriter, req *http.Request) {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(resp, "Method %v not allowed\n", req.Method)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(resp, req.Body, prometheus.MaxBodySize))
+		if err != nil {
+			badRequest(resp, "Unable to read request: %v", err)
+			return
+		}
+		points, err := prometheus.DecodeWriteRequest(body)
+		if err != nil {
+			badRequest(resp, "%v", err)
+			return
+		}
+
+		insert, err := db.AdmitInserts(stream, len(points))
+		if err == zenodb.ErrTableBehind {
+			tooManyRequests(resp)
+			return
+		}
+		if err == zenodb.ErrReadOnly {
+			readOnly(resp)
+			return
+		}
+		if err != nil {
+			internalServerError(resp, "Error submitting points: %v", err)
+			return
+		}
+		for len(points) > 0 {
+			n := len(points)
+			if n > maxBatchSize {
+				n = maxBatchSize
+			}
+			err = insert(points[:n])
+			if err != nil {
+				internalServerError(resp, "Error submitting points: %v", err)
+				return
+			}
+			points = points[n:]
+		}
+		resp.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/getlantern/zenodb"
+)
+
+// snapshotPeriodically takes a snapshot of the database every interval,
+// updating the snapshot in dir incrementally.
+func snapshotPeriodically(db *zenodb.DB, dir string, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		start := time.Now()
+		info, err := db.Snapshot(dir)
+		if err != nil {
+			log.Errorf("Unable to snapshot database to %v: %v", dir, err)
+			continue
+		}
+		log.Debugf("Snapshotted database to %v in %v, copied %v", dir, time.Now().Sub(start), humanize.Bytes(uint64(info.BytesCopied)))
+	}
+}
+
+// restore implements the restore subcommand, which rebuilds a database
+// directory from a snapshot. It returns the exit code.
+func restore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	restoreDBDir := flags.String("dbdir", "zenodb", "The directory into which to restore the database files, must not exist yet, defaults to ./zenodb")
+	restoreSchema := flags.String("schema", "schema.yaml", "Where to write the schema from the snapshot unless the file already exists, defaults to ./schema.yaml")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: zeno restore [-dbdir dir] [-schema file] snapshotdir")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	snapshotDir := flags.Arg(0)
+
+	info, err := zenodb.RestoreSnapshot(snapshotDir, *restoreDBDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Printf("Restored %d tables from snapshot taken at %v into %v\n", len(info.Offsets), info.Time.In(time.UTC).Format(time.RFC1123), *restoreDBDir)
+
+	_, err = os.Stat(*restoreSchema)
+	if err == nil {
+		fmt.Printf("Not overwriting existing schema at %v, the snapshot's schema is at %v\n", *restoreSchema, filepath.Join(snapshotDir, zenodb.SnapshotSchemaFile))
+		return 0
+	}
+	schema, err := ioutil.ReadFile(filepath.Join(snapshotDir, zenodb.SnapshotSchemaFile))
+	if err == nil {
+		err = ioutil.WriteFile(*restoreSchema, schema, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to restore schema: %v\n", err)
+		return 2
+	}
+	fmt.Printf("Restored schema to %v\n", *restoreSchema)
+	return 0
+}
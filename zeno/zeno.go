@@ -4,7 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/getlantern/goexpr/isp"
@@ -12,7 +15,9 @@ import (
 	"github.com/getlantern/goexpr/isp/maxmind"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/kafka"
 	"github.com/getlantern/zenodb/rpc"
+	"github.com/getlantern/zenodb/statsd"
 )
 
 var (
@@ -27,13 +32,39 @@ var (
 	walSync           = flag.Duration("walsync", 5*time.Second, "How frequently to sync the WAL to disk. Set to 0 to sync after every write. Defaults to 5 seconds.")
 	maxWALAge         = flag.Duration("maxwalage", 336*time.Hour, "Maximum age for WAL files. Files older than this will be deleted. Defaults to 336 hours (2 weeks).")
 	walCompressionAge = flag.Duration("walcompressage", 1*time.Hour, "Age at which to start compressing WAL files with gzip. Defaults to 1 hour.")
+	maxQueryMemory    = flag.Int("maxquerymemory", 0, "Maximum number of bytes a single query may use while aggregating results. 0 means unlimited.")
+	maxTotalMemory    = flag.Int("maxtotalquerymemory", 0, "Maximum number of bytes all running queries may use together. 0 means unlimited.")
 	addr              = flag.String("addr", "localhost:17712", "The address at which to listen for gRPC connections, defaults to localhost:17712")
 	httpAddr          = flag.String("http-addr", "localhost:17713", "The address at which to listen for JSON over HTTP connections, defaults to localhost:17713")
+	influxUDPAddr     = flag.String("influx-udp-addr", "", "If specified, will listen for InfluxDB line protocol over UDP at this address")
+	influxUDPStream   = flag.String("influx-udp-stream", "inbound", "The stream into which to insert points received via InfluxDB line protocol over UDP, defaults to inbound")
+	prometheusStream  = flag.String("prometheus-stream", "prometheus", "The stream into which to insert samples received via Prometheus remote_write, defaults to prometheus")
+	statsdAddr        = flag.String("statsd-addr", "", "If specified, will listen for StatsD and DogStatsD packets over UDP at this address")
+	statsdStream      = flag.String("statsd-stream", "statsd", "The stream into which to insert StatsD metrics, defaults to statsd")
+	kafkaBrokers      = flag.String("kafka-brokers", "", "If specified, will consume points from Kafka using this comma-separated list of broker addresses")
+	kafkaTopic        = flag.String("kafka-topic", "zenodb", "The Kafka topic from which to consume points, defaults to zenodb")
+	kafkaStream       = flag.String("kafka-stream", "inbound", "The stream into which to insert points consumed from Kafka, defaults to inbound")
+	kafkaFormat       = flag.String("kafka-format", kafka.FormatJSON, "The format of Kafka messages, json or msgpack, defaults to json")
+	snapshotDir       = flag.String("snapshot-dir", "", "If specified, will periodically snapshot the database into this directory")
+	snapshotInterval  = flag.Duration("snapshot-interval", 1*time.Hour, "How frequently to snapshot the database if -snapshot-dir is specified, defaults to 1 hour")
+	leaderAddr        = flag.String("leader", "", "If specified, will run as a read-only follower that replicates the WALs of the leader at this gRPC address")
+	leaderPassword    = flag.String("leader-password", "", "The password with which to authenticate against the leader")
 	pprofAddr         = flag.String("pprofaddr", "localhost:4000", "if specified, will listen for pprof connections at the specified tcp address")
 	password          = flag.String("password", "", "if specified, will authenticate clients using this password")
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fsck":
+			os.Exit(fsck(os.Args[2:]))
+		case "import":
+			os.Exit(importFiles(os.Args[2:]))
+		case "restore":
+			os.Exit(restore(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 
 	l, err := net.Listen("tcp", *addr)
@@ -66,14 +97,17 @@ func main() {
 	}
 
 	db, err := zenodb.NewDB(&zenodb.DBOpts{
-		Dir:                    *dbdir,
-		SchemaFile:             *schema,
-		ISPProvider:            ispProvider,
-		IncludeMemStoreInQuery: *fresh,
-		VirtualTime:            *vtime,
-		WALSyncInterval:        *walSync,
-		MaxWALAge:              *maxWALAge,
-		WALCompressionAge:      *walCompressionAge,
+		Dir:                      *dbdir,
+		SchemaFile:               *schema,
+		ISPProvider:              ispProvider,
+		IncludeMemStoreInQuery:   *fresh,
+		VirtualTime:              *vtime,
+		WALSyncInterval:          *walSync,
+		MaxWALAge:                *maxWALAge,
+		WALCompressionAge:        *walCompressionAge,
+		MaxQueryMemoryBytes:      *maxQueryMemory,
+		MaxTotalQueryMemoryBytes: *maxTotalMemory,
+		Follower:                 *leaderAddr != "",
 	})
 
 	if err != nil {
@@ -81,13 +115,109 @@ func main() {
 	}
 	fmt.Printf("Opened database at %v\n", *dbdir)
 
+	var consumer *kafka.Consumer
+	if *kafkaBrokers != "" {
+		consumer = consumeKafka(db)
+		fmt.Printf("Consuming Kafka topic %v into %v\n", *kafkaTopic, *kafkaStream)
+	}
+	var follower *rpc.Follower
+	if *leaderAddr != "" {
+		follower = followLeader(db)
+		fmt.Printf("Following leader at %v\n", *leaderAddr)
+	}
+	go closeOnSignal(db, consumer, follower)
+
 	fmt.Printf("Listening for gRPC connections at %v\n", l.Addr())
 	fmt.Printf("Listening for HTTP connections at %v\n", hl.Addr())
 
-	go serveHTTP(db, hl)
+	if *influxUDPAddr != "" {
+		ul, err := net.ListenPacket("udp", *influxUDPAddr)
+		if err != nil {
+			log.Fatalf("Unable to listen for InfluxDB line protocol at %v: %v", *influxUDPAddr, err)
+		}
+		fmt.Printf("Listening for InfluxDB line protocol over UDP at %v\n", ul.LocalAddr())
+		go serveInfluxUDP(db, ul, *influxUDPStream)
+	}
+
+	if *statsdAddr != "" {
+		sl, err := net.ListenPacket("udp", *statsdAddr)
+		if err != nil {
+			log.Fatalf("Unable to listen for StatsD at %v: %v", *statsdAddr, err)
+		}
+		fmt.Printf("Listening for StatsD over UDP at %v\n", sl.LocalAddr())
+		go serveStatsD(db, sl)
+	}
+
+	if *snapshotDir != "" {
+		fmt.Printf("Snapshotting database to %v every %v\n", *snapshotDir, *snapshotInterval)
+		go snapshotPeriodically(db, *snapshotDir, *snapshotInterval)
+	}
+
+	go serveHTTP(db, hl, follower)
 	serveRPC(db, l)
 }
 
+func closeOnSignal(db *zenodb.DB, consumer *kafka.Consumer, follower *rpc.Follower) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-c
+	fmt.Printf("Received %v, closing database\n", sig)
+	if consumer != nil {
+		// Stop consuming first so that consumed points make it into the WAL
+		fmt.Println("Stopping Kafka consumer")
+		err := consumer.Close()
+		if err != nil {
+			log.Errorf("Error stopping Kafka consumer: %v", err)
+		}
+	}
+	if follower != nil {
+		fmt.Println("Stopping replication")
+		follower.Close()
+	}
+	err := db.Close()
+	if err != nil {
+		log.Errorf("Error closing database: %v", err)
+		os.Exit(1)
+	}
+	fmt.Println("Closed database")
+	os.Exit(0)
+}
+
+func consumeKafka(db *zenodb.DB) *kafka.Consumer {
+	broker, err := kafka.NewBroker(strings.Split(*kafkaBrokers, ","))
+	if err != nil {
+		log.Fatal(err)
+	}
+	consumer, err := kafka.Consume(db, broker, &kafka.Opts{
+		Topic:  *kafkaTopic,
+		Stream: *kafkaStream,
+		Format: *kafkaFormat,
+	})
+	if err != nil {
+		log.Fatalf("Unable to consume Kafka topic %v: %v", *kafkaTopic, err)
+	}
+	return consumer
+}
+
+func followLeader(db *zenodb.DB) *rpc.Follower {
+	client, err := rpc.Dial(*leaderAddr, &rpc.ClientOpts{
+		Password: *leaderPassword,
+	})
+	if err != nil {
+		log.Fatalf("Unable to dial leader at %v: %v", *leaderAddr, err)
+	}
+	return rpc.Follow(db, client)
+}
+
+func serveStatsD(db *zenodb.DB, l net.PacketConn) {
+	err := statsd.Serve(db, l, &statsd.Opts{
+		Stream: *statsdStream,
+	})
+	if err != nil {
+		log.Fatalf("Error serving StatsD: %v", err)
+	}
+}
+
 func serveRPC(db *zenodb.DB, l net.Listener) {
 	err := rpc.Serve(db, l, &rpc.ServerOpts{
 		Password: *password,
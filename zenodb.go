@@ -2,6 +2,7 @@ package zenodb
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -16,6 +17,12 @@ import (
 	"github.com/getlantern/zenodb/sql"
 )
 
+const (
+	// lockFileName is the file in DBOpts.Dir that's locked while the database
+	// is open
+	lockFileName = "zenodb.lock"
+)
+
 var (
 	log = golog.LoggerFor("zenodb")
 )
@@ -45,24 +52,53 @@ type DBOpts struct {
 	// WALCompressionAge sets a cutoff for the age of WAL files that will be
 	// gzipped
 	WALCompressionAge time.Duration
+	// MaxQueryMemoryBytes caps how much memory a single query may use for
+	// aggregating its results. Queries that exceed this fail with an error. 0
+	// means unlimited.
+	MaxQueryMemoryBytes int
+	// MaxTotalQueryMemoryBytes caps how much memory all concurrently running
+	// queries may use together. 0 means unlimited.
+	MaxTotalQueryMemoryBytes int
+	// Follower makes the database a read-only replica of a leader. Inserts are
+	// rejected with ErrReadOnly, instead the WALs of its streams are fed with
+	// entries from the leader's WALs using ApplyReplicated (see rpc.Follow).
+	Follower bool
 }
 
 // DB is a zenodb database.
 type DB struct {
-	opts            *DBOpts
-	clock           vtime.Clock
-	streams         map[string]*wal.WAL
-	tables          map[string]*table
-	orderedTables   []*table
-	tablesMutex     sync.RWMutex
-	isSorting       bool
-	nextTableToSort int
+	// queryMemory needs to be 64-bit aligned for atomic access
+	queryMemory   int64
+	opts          *DBOpts
+	clock         vtime.Clock
+	streams       map[string]*wal.WAL
+	tables        map[string]*table
+	orderedTables []*table
+	tablesMutex   sync.RWMutex
+	schema        Schema
+	schemaMutex   sync.Mutex
+	// snapshotMutex keeps old segments from being deleted and WALs from being
+	// truncated or compressed while a snapshot is being taken
+	snapshotMutex sync.Mutex
+	// snapshotsMutex keeps snapshots from being taken concurrently
+	snapshotsMutex sync.Mutex
+	closed         bool
+	closeCh        chan interface{}
+	// compactionSemaphore limits compaction to one table at a time
+	compactionSemaphore chan bool
+	// streamsBehind counts, by stream, the tables that reject inserts into that
+	// stream because they're behind
+	streamsBehind map[string]*int32
+	// streamsChanged is closed (and replaced) whenever a stream is added
+	streamsChanged chan interface{}
+	// lockFile holds the lock on opts.Dir until the database is closed
+	lockFile *os.File
 }
 
 // NewDB creates a database using the given options.
 func NewDB(opts *DBOpts) (*DB, error) {
 	var err error
-	db := &DB{opts: opts, clock: vtime.RealClock, tables: make(map[string]*table), streams: make(map[string]*wal.WAL)}
+	db := &DB{opts: opts, clock: vtime.RealClock, tables: make(map[string]*table), streams: make(map[string]*wal.WAL), streamsBehind: make(map[string]*int32), streamsChanged: make(chan interface{}), closeCh: make(chan interface{}), compactionSemaphore: make(chan bool, 1)}
 	if opts.VirtualTime {
 		db.clock = vtime.NewVirtualClock(time.Time{})
 	}
@@ -72,9 +108,14 @@ func NewDB(opts *DBOpts) (*DB, error) {
 	if opts.WALCompressionAge == 0 {
 		opts.WALCompressionAge = opts.MaxWALAge / 10
 	}
+	db.lockFile, err = lockDir(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
 	log.Debug("Enabling geolocation functions")
 	err = geo.Init(filepath.Join(opts.Dir, "geoip.dat.gz"))
 	if err != nil {
+		db.lockFile.Close()
 		return nil, fmt.Errorf("Unable to initialize geo: %v", err)
 	}
 	if opts.ISPProvider != nil {
@@ -83,6 +124,7 @@ func NewDB(opts *DBOpts) (*DB, error) {
 	if opts.SchemaFile != "" {
 		err = db.pollForSchema(opts.SchemaFile)
 		if err != nil {
+			db.Close()
 			return nil, fmt.Errorf("Unable to apply schema: %v", err)
 		}
 	}
@@ -90,15 +132,53 @@ func NewDB(opts *DBOpts) (*DB, error) {
 	return db, err
 }
 
+// Close closes the database. It stops accepting inserts, flushes the memstores
+// of all tables to disk, closes all WALs and stops all background processing.
+func (db *DB) Close() error {
+	// Wait for any schema changes in progress
+	db.schemaMutex.Lock()
+	defer db.schemaMutex.Unlock()
+
+	db.tablesMutex.Lock()
+	if db.closed {
+		db.tablesMutex.Unlock()
+		return nil
+	}
+	db.closed = true
+	close(db.closeCh)
+	tables := db.orderedTables
+	streams := db.streams
+	db.tablesMutex.Unlock()
+
+	log.Debug("Closing database")
+	var firstErr error
+	for _, t := range tables {
+		err := t.stop(true)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for name, w := range streams {
+		err := w.Close()
+		if err != nil {
+			log.Errorf("Unable to close WAL for stream %v: %v", name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	db.lockFile.Close()
+	log.Debug("Closed database")
+	return firstErr
+}
+
 // TableStats returns the TableStats for the named table.
 func (db *DB) TableStats(table string) TableStats {
 	t := db.getTable(table)
 	if t == nil {
 		return TableStats{}
 	}
-	t.statsMutex.RLock()
-	defer t.statsMutex.RUnlock()
-	return t.stats
+	return t.currentStats()
 }
 
 // AllTableStats returns all TableStats for all tables, keyed to the table
@@ -112,25 +192,57 @@ func (db *DB) AllTableStats() map[string]TableStats {
 	}
 	db.tablesMutex.RUnlock()
 	for name, t := range tables {
-		t.statsMutex.RLock()
-		m[name] = t.stats
-		t.statsMutex.RUnlock()
+		m[name] = t.currentStats()
 	}
 	return m
 }
 
+// TableHealth describes the health of a table.
+type TableHealth struct {
+	// Degraded indicates that the table is currently unable to flush its
+	// memstore to disk. While degraded, data accumulates in memory and inserts
+	// into the table are held back once its memstore is full.
+	Degraded bool
+	// FlushFailingSince is when flushes started failing.
+	FlushFailingSince time.Time
+	// LastFlushError is the error from the most recent failed flush.
+	LastFlushError string
+}
+
+// Health returns the TableHealth for all tables, keyed to the table names,
+// along with a flag indicating whether all tables are healthy.
+func (db *DB) Health() (bool, map[string]TableHealth) {
+	healthy := true
+	m := make(map[string]TableHealth)
+	for name, stats := range db.AllTableStats() {
+		degraded := !stats.FlushFailingSince.IsZero()
+		if degraded {
+			healthy = false
+		}
+		m[name] = TableHealth{
+			Degraded:          degraded,
+			FlushFailingSince: stats.FlushFailingSince,
+			LastFlushError:    stats.LastFlushError,
+		}
+	}
+	return healthy, m
+}
+
 // PrintTableStats prints the stats for the named table to a string.
 func (db *DB) PrintTableStats(table string) string {
 	stats := db.TableStats(table)
 	now := db.clock.Now()
-	return fmt.Sprintf("%v (%v)\tFiltered: %v    Queued: %v    Inserted: %v    Dropped: %v    Expired: %v",
+	return fmt.Sprintf("%v (%v)\tFiltered: %v    Queued: %v    Inserted: %v    Dropped: %v    Expired: %v    On Disk: %v    Memstore: %v    Keys: %v",
 		table,
 		now.In(time.UTC),
 		humanize.Comma(stats.FilteredPoints),
 		humanize.Comma(stats.QueuedPoints),
 		humanize.Comma(stats.InsertedPoints),
 		humanize.Comma(stats.DroppedPoints),
-		humanize.Comma(stats.ExpiredValues))
+		humanize.Comma(stats.ExpiredValues),
+		humanize.Bytes(uint64(stats.FileStoreBytes)),
+		humanize.Bytes(uint64(stats.MemStoreBytes)),
+		humanize.Comma(stats.Keys))
 }
 
 func (db *DB) getTable(table string) *table {
@@ -140,12 +252,25 @@ func (db *DB) getTable(table string) *table {
 	return t
 }
 
-func (db *DB) getFields(table string) ([]sql.Field, error) {
+// getQueryable returns the table or virtual table with the given name, or nil
+// if there's no such table.
+func (db *DB) getQueryable(table string) queryable {
+	if strings.ToLower(table) == StatsTable {
+		return &statsTable{db}
+	}
 	t := db.getTable(table)
+	if t == nil {
+		return nil
+	}
+	return t
+}
+
+func (db *DB) getFields(table string) ([]sql.Field, error) {
+	t := db.getQueryable(table)
 	if t == nil {
 		return nil, fmt.Errorf("Table '%v' not found", table)
 	}
-	return t.Fields, nil
+	return t.fields(), nil
 }
 
 func (db *DB) getFieldsOptional(table string) ([]sql.Field, error) {
@@ -153,12 +278,35 @@ func (db *DB) getFieldsOptional(table string) ([]sql.Field, error) {
 	if t == nil {
 		return nil, nil
 	}
-	return t.Fields, nil
+	return t.fields(), nil
 }
 
-func (db *DB) capWALAge(wal *wal.WAL) {
+// WALDir returns the directory containing the WAL for the given stream. State
+// that has to be kept in sync with a stream's WAL (like the offsets of
+// ingestion sources) can be stored next to this directory.
+func (db *DB) WALDir(stream string) string {
+	return filepath.Join(db.opts.Dir, walDirName, stream)
+}
+
+func (db *DB) capWALAge(stream string, wal *wal.WAL) {
 	for {
-		time.Sleep(1 * time.Minute)
+		select {
+		case <-db.closeCh:
+			return
+		case <-time.After(1 * time.Minute):
+		}
+		// Don't remove or compress WAL files while they're being snapshotted
+		db.snapshotMutex.Lock()
+		if db.opts.Follower {
+			// Truncation may remove the entry that records where to resume
+			// replication, so store that first
+			err := db.storeReplicatedOffset(stream)
+			if err != nil {
+				log.Errorf("Unable to store replicated offset, not truncating WAL: %v", err)
+				db.snapshotMutex.Unlock()
+				continue
+			}
+		}
 		err := wal.TruncateBeforeTime(time.Now().Add(-1 * db.opts.MaxWALAge))
 		if err != nil {
 			log.Errorf("Error truncating WAL: %v", err)
@@ -167,5 +315,6 @@ func (db *DB) capWALAge(wal *wal.WAL) {
 		if err != nil {
 			log.Errorf("Error compressing WAL: %v", err)
 		}
+		db.snapshotMutex.Unlock()
 	}
 }
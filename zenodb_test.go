@@ -1,10 +1,12 @@
 package zenodb
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
@@ -13,6 +15,7 @@ import (
 	"github.com/getlantern/zenodb/encoding"
 	. "github.com/getlantern/zenodb/expr"
 	"github.com/getlantern/zenodb/sql"
+	"golang.org/x/net/context"
 
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -113,7 +116,9 @@ view_a:
 	// from the file stores.
 	shuffleFields := func() {
 		time.Sleep(100 * time.Millisecond)
-		tab.Fields[0], tab.Fields[1], tab.Fields[2] = tab.Fields[1], tab.Fields[2], tab.Fields[0]
+		fields := append([]sql.Field(nil), tab.fields()...)
+		fields[0], fields[1], fields[2] = fields[1], fields[2], fields[0]
+		tab.setFields(fields)
 		time.Sleep(100 * time.Millisecond)
 	}
 
@@ -165,12 +170,12 @@ view_a:
 	shuffleFields()
 
 	// Change the schema a bit
-	newFields := make([]sql.Field, 0, len(tab.Fields)+1)
+	newFields := make([]sql.Field, 0, len(tab.fields())+1)
 	newFields = append(newFields, sql.NewField("newfield", AVG("h")))
-	for _, field := range tab.Fields {
+	for _, field := range tab.fields() {
 		newFields = append(newFields, field)
 	}
-	tab.Fields = newFields
+	tab.setFields(newFields)
 
 	advance(resolution)
 
@@ -253,7 +258,7 @@ view_a:
 		if err != nil {
 			return nil, err
 		}
-		stats, err := q.run(db)
+		stats, err := q.run(context.Background(), db)
 		log.Debugf("Query stats - scanned: %d    filterpass: %d    datavalid: %d    intimerange: %d", stats.Scanned, stats.FilterPass, stats.DataValid, stats.InTimeRange)
 		log.Debugf("Result: %v", result)
 		return result, err
@@ -408,18 +413,246 @@ HAVING unknown = 5
 		assert.NotNil(t, result.Until)
 	}
 
+	// Test cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = aq.RunContext(ctx)
+	assert.Equal(t, context.Canceled, err, "Cancelled query should have returned context error")
+
+	// Test memory budget
+	db.opts.MaxQueryMemoryBytes = 1
+	_, err = aq.Run()
+	db.opts.MaxQueryMemoryBytes = 0
+	if assert.Error(t, err, "Query exceeding memory budget should have failed") {
+		assert.Contains(t, err.Error(), "MaxQueryMemoryBytes")
+	}
+	assert.EqualValues(t, 0, db.queryMemory, "All query memory should have been released")
+
 	testMissingField(t, db, epoch, resolution, now)
+
+	assert.NoError(t, db.Close(), "Unable to close database")
+	assert.Error(t, db.Insert("inbound", now, map[string]interface{}{"r": "A"}, map[string]float64{"i": 1}), "Insert after close should have failed")
+	assert.NoError(t, db.Close(), "Closing database twice should be harmless")
 }
 
-func testMissingField(t *testing.T, db *DB, epoch time.Time, resolution time.Duration, now time.Time) {
-	defer func() {
-		assert.NotNil(t, recover(), "Query after removing fields should have panicked")
-	}()
+const testSchema = `
+test_a:
+  maxmemstorebytes: 1
+  retentionperiod: 1h
+  sql: >
+    SELECT ii FROM inbound GROUP BY *, period(1s)
+view_a:
+  view: true
+  maxmemstorebytes: 1
+  retentionperiod: 1h
+  sql: >
+    SELECT * FROM test_a GROUP BY u
+`
 
+// newTestDB creates a database with the given schema in a new temp directory
+// and inserts a few points into stream inbound. The returned function closes
+// the database and removes the directory.
+func newTestDB(schema string) (*DB, func(), error) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if err != nil {
+		return nil, nil, err
+	}
+	schemaFile := filepath.Join(tmpDir, "schema.yaml")
+	err = ioutil.WriteFile(schemaFile, []byte(schema), 0644)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, nil, err
+	}
+	db, err := NewDB(&DBOpts{Dir: filepath.Join(tmpDir, "db"), SchemaFile: schemaFile, IncludeMemStoreInQuery: true})
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, nil, err
+	}
+	cleanup := func() {
+		db.Close()
+		os.RemoveAll(tmpDir)
+	}
+
+	now := time.Now()
+	for i, u := range []int{1, 2, 1} {
+		err = db.Insert("inbound", now.Add(-1*time.Duration(i)*time.Second), map[string]interface{}{"u": u, "b": i%2 == 0}, map[string]float64{"ii": float64(i + 1)})
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	}
+	// Give the points time to be inserted and flushed
+	time.Sleep(1 * time.Second)
+	return db, cleanup, nil
+}
+
+func TestBackfill(t *testing.T) {
+	db, cleanup, err := newTestDB(testSchema)
+	if !assert.NoError(t, err, "Unable to create DB") {
+		return
+	}
+	defer cleanup()
+
+	err = db.CreateView(&TableOpts{
+		Name:             "backfilled",
+		View:             true,
+		Backfill:         true,
+		MaxMemStoreBytes: 1,
+		RetentionPeriod:  1 * time.Hour,
+		SQL:              `SELECT ii FROM test_a GROUP BY u`,
+	})
+	if !assert.NoError(t, err, "Unable to create backfilled view") {
+		return
+	}
+	// Give backfill time to flush
+	time.Sleep(250 * time.Millisecond)
+
+	run := func(table string) map[string][]float64 {
+		aq := db.Query(&sql.Query{
+			From:       table,
+			Fields:     []sql.Field{sql.NewField("ii", SUM("ii"))},
+			GroupBy:    []sql.GroupBy{sql.NewGroupBy("u", goexpr.Param("u"))},
+			AsOfOffset: -1 * time.Hour,
+		})
+		result, err := aq.Run()
+		if !assert.NoError(t, err, "Unable to query %v", table) {
+			return nil
+		}
+		rows := make(map[string][]float64, len(result.Rows))
+		for _, row := range result.Rows {
+			key := fmt.Sprintf("%v %d", row.Dims, row.Period)
+			rows[key] = append(rows[key], row.Values...)
+		}
+		return rows
+	}
+
+	expected := run("test_a")
+	if assert.NotEmpty(t, expected, "Table should have data") {
+		assert.Equal(t, expected, run("backfilled"), "Backfilled view should match table")
+	}
+}
+
+func TestStats(t *testing.T) {
+	db, cleanup, err := newTestDB(testSchema)
+	if !assert.NoError(t, err, "Unable to create DB") {
+		return
+	}
+	defer cleanup()
+
+	aq := db.Query(&sql.Query{
+		From:    StatsTable,
+		Fields:  []sql.Field{sql.NewField("inserted_points", SUM("inserted_points")), sql.NewField("file_store_bytes", SUM("file_store_bytes"))},
+		GroupBy: []sql.GroupBy{sql.NewGroupBy("table", goexpr.Param("table"))},
+	})
+	result, err := aq.Run()
+	if !assert.NoError(t, err, "Unable to query stats") {
+		return
+	}
+	found := false
+	for _, row := range result.Rows {
+		if row.Dims[0] == "test_a" {
+			found = true
+			assert.True(t, row.Values[0] > 0, "Stats should include inserted points")
+			assert.True(t, row.Values[1] > 0, "Stats should include file store bytes")
+		}
+	}
+	assert.True(t, found, "Stats should include test_a")
+
+	b, err := ioutil.ReadFile(db.getTable("test_a").statsFile())
+	if assert.NoError(t, err, "Stats should have been saved") {
+		var saved TableStats
+		if assert.NoError(t, json.Unmarshal(b, &saved)) {
+			assert.True(t, saved.InsertedPoints > 0, "Saved stats should include inserted points")
+			assert.True(t, saved.Flushes > 0, "Saved stats should include flushes")
+		}
+	}
+}
+
+func TestDropTable(t *testing.T) {
+	db, cleanup, err := newTestDB(testSchema)
+	if !assert.NoError(t, err, "Unable to create DB") {
+		return
+	}
+	defer cleanup()
+
+	err = db.DropTable("test_a")
+	if assert.Error(t, err, "Dropping table with dependent views should have failed") {
+		assert.Contains(t, err.Error(), "view_a")
+	}
+	assert.NotNil(t, db.getTable("test_a"))
+
+	dir := db.getTable("view_a").rowStore.opts.dir
+	err = db.DropTable("View_A")
+	if assert.NoError(t, err, "Unable to drop view") {
+		assert.Nil(t, db.getTable("view_a"))
+		_, statErr := os.Stat(dir)
+		assert.True(t, os.IsNotExist(statErr), "View's data should have been deleted")
+	}
+	assert.Error(t, db.DropTable("view_a"), "Dropping non-existent table should have failed")
+	assert.NoError(t, db.DropTable("test_a"), "Dropping table without views should have succeeded")
+}
+
+func TestAlterTable(t *testing.T) {
+	db, cleanup, err := newTestDB(testSchema)
+	if !assert.NoError(t, err, "Unable to create DB") {
+		return
+	}
+	defer cleanup()
+
+	alter := func(sqlString string) error {
+		return db.ApplySchema(Schema{
+			"test_a": &TableOpts{
+				MaxMemStoreBytes: 1,
+				RetentionPeriod:  2 * time.Hour,
+				SQL:              sqlString,
+			},
+		})
+	}
+
+	err = alter(`SELECT ii FROM otherstream GROUP BY *, period(1s)`)
+	if assert.Error(t, err, "Changing FROM should have failed") {
+		assert.Contains(t, err.Error(), "FROM")
+	}
+	err = alter(`SELECT ii FROM inbound GROUP BY u, period(1s)`)
+	if assert.Error(t, err, "Changing GROUP BY should have failed") {
+		assert.Contains(t, err.Error(), "GROUP BY")
+	}
+	err = alter(`SELECT ii FROM inbound GROUP BY *, period(1500ms)`)
+	assert.Error(t, err, "Changing to a resolution that isn't a multiple of the existing resolution should have failed")
+
+	tab := db.getTable("test_a")
+	if !assert.Equal(t, time.Second, tab.resolution(), "Failed alterations should not have changed table") {
+		return
+	}
+
+	err = alter(`SELECT ii, h FROM inbound GROUP BY *, period(2s)`)
+	if !assert.NoError(t, err, "Unable to alter table") {
+		return
+	}
+	assert.Equal(t, 2*time.Second, tab.resolution())
+	assert.Equal(t, 2*time.Hour, tab.retentionPeriod())
+	assert.Equal(t, "h", tab.fields()[len(tab.fields())-1].Name, "New field should have been added")
+	assert.Nil(t, db.getTable("view_a"), "View removed from schema should have been dropped")
+
+	aq := db.Query(&sql.Query{
+		From:       "test_a",
+		Fields:     []sql.Field{sql.NewField("ii", SUM("ii")), sql.NewField("h", SUM("h"))},
+		GroupByAll: true,
+		AsOfOffset: -1 * time.Hour,
+	})
+	result, err := aq.Run()
+	if assert.NoError(t, err, "Unable to query altered table") {
+		assert.NotEmpty(t, result.Rows, "Altered table should still have data")
+	}
+}
+
+func testMissingField(t *testing.T, db *DB, epoch time.Time, resolution time.Duration, now time.Time) {
 	tab := db.getTable("test_a")
-	for i, field := range tab.Fields {
-		tab.Fields[i] = sql.NewField("_"+field.Name, field.Expr)
+	fields := make([]sql.Field, 0, len(tab.fields()))
+	for _, field := range tab.fields() {
+		fields = append(fields, sql.NewField("_"+field.Name, field.Expr))
 	}
+	tab.setFields(fields)
 
 	aq := db.Query(&sql.Query{
 		From:       "test_a",
@@ -428,5 +661,83 @@ func testMissingField(t *testing.T, db *DB, epoch time.Time, resolution time.Dur
 		AsOfOffset: epoch.Add(-1 * resolution).Sub(now),
 	})
 
-	aq.Run()
+	_, err := aq.Run()
+	assert.NoError(t, err, "Query after removing fields should have succeeded")
+}
+
+func TestInsertBatch(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbbatchtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	schemaFile := filepath.Join(tmpDir, "schema.yaml")
+	err = ioutil.WriteFile(schemaFile, []byte(`
+batch_test:
+  retentionperiod: 1h
+  sql: >
+    SELECT SUM(i) AS i
+    FROM inbound
+    WHERE r = 'A'
+    GROUP BY r, period(1h)
+`), 0644)
+	if !assert.NoError(t, err, "Unable to write schema") {
+		return
+	}
+
+	db, err := NewDB(&DBOpts{Dir: filepath.Join(tmpDir, "db"), SchemaFile: schemaFile, IncludeMemStoreInQuery: true})
+	if !assert.NoError(t, err, "Unable to create DB") {
+		return
+	}
+	defer db.Close()
+
+	now := time.Now()
+	point := func(ts time.Time, r string, i float64) Point {
+		return Point{Ts: ts, Dims: map[string]interface{}{"r": r}, Vals: map[string]float64{"i": i}}
+	}
+	insert := func(p Point) {
+		assert.NoError(t, db.Insert("inbound", p.Ts, p.Dims, p.Vals))
+	}
+
+	// Mix single points and batches in the WAL
+	insert(point(now, "A", 1))
+	insert(point(now, "B", 10))
+	assert.NoError(t, db.InsertBatch("inbound", []Point{
+		point(now, "A", 2),
+		point(now.Add(-2*time.Hour), "A", 100),
+		point(now, "B", 20),
+		point(now, "A", 3),
+	}))
+	insert(point(now, "A", 4))
+	assert.NoError(t, db.InsertBatch("inbound", nil), "Empty batch should be ignored")
+	assert.NoError(t, db.InsertBatch("inbound", []Point{point(now.Add(-2*time.Hour), "A", 200)}))
+
+	time.Sleep(1 * time.Second)
+	stats := db.getTable("batch_test").currentStats()
+	assert.EqualValues(t, 4, stats.InsertedPoints, "Points beyond retention period and filtered points shouldn't be inserted")
+	assert.EqualValues(t, 2, stats.FilteredPoints, "Points not matching WHERE should have been filtered")
+
+	aq, err := db.SQLQuery("SELECT i FROM batch_test ASOF '-3h' GROUP BY r")
+	if !assert.NoError(t, err) {
+		return
+	}
+	result, err := aq.Run()
+	if !assert.NoError(t, err) {
+		return
+	}
+	totals := make(map[interface{}]float64)
+	for _, row := range result.Rows {
+		totals[row.Dims[0]] += row.Values[0]
+	}
+	assert.Equal(t, map[interface{}]float64{"A": 10}, totals, "Only points within the retention period that match WHERE should have been inserted")
+}
+
+// setFields replaces the table's fields without going through an alteration,
+// so that tests can simulate data that was written with different fields.
+func (t *table) setFields(fields []sql.Field) {
+	t.rowStore.mx.Lock()
+	current := t.currentStructure()
+	t.structure.Store(&structure{fields: fields, resolution: current.resolution, retentionPeriod: current.retentionPeriod})
+	t.rowStore.mx.Unlock()
 }